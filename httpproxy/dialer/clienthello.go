@@ -0,0 +1,15 @@
+package dialer
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// ClientHelloProfiles maps a Transport.TLSClientConfig.Fingerprint to a
+// handshake presenting that ClientHello over conn. crypto/tls cannot reorder
+// extensions, builds with -tags utls register "chrome", "firefox", "safari",
+// "edge" and "ios" from uTLS, the others have none.
+//
+// A profile returns conn after a completed handshake, implementing
+// ConnectionState() tls.ConnectionState if it can.
+var ClientHelloProfiles = map[string]func(conn net.Conn, config *tls.Config) (net.Conn, error){}
@@ -0,0 +1,54 @@
+// +build utls
+
+package dialer
+
+import (
+	"crypto/tls"
+	"net"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+func init() {
+	for name, id := range map[string]utls.ClientHelloID{
+		"chrome":  utls.HelloChrome_Auto,
+		"firefox": utls.HelloFirefox_Auto,
+		"safari":  utls.HelloSafari_Auto,
+		"edge":    utls.HelloEdge_Auto,
+		"ios":     utls.HelloIOS_Auto,
+	} {
+		ClientHelloProfiles[name] = utlsHandshake(id)
+	}
+}
+
+// utlsHandshake returns the profile of the uTLS ClientHello id. Its ALPN is
+// cut down to http/1.1, http.Transport only speaks h2 over a *tls.Conn, and it
+// resumes no sessions.
+func utlsHandshake(id utls.ClientHelloID) func(conn net.Conn, config *tls.Config) (net.Conn, error) {
+	return func(conn net.Conn, config *tls.Config) (net.Conn, error) {
+		spec, err := utls.UTLSIdToSpec(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, ext := range spec.Extensions {
+			if alpn, ok := ext.(*utls.ALPNExtension); ok {
+				alpn.AlpnProtocols = []string{"http/1.1"}
+			}
+		}
+
+		uconn := utls.UClient(conn, &utls.Config{
+			ServerName:         config.ServerName,
+			RootCAs:            config.RootCAs,
+			InsecureSkipVerify: config.InsecureSkipVerify,
+			MinVersion:         config.MinVersion,
+			MaxVersion:         config.MaxVersion,
+		}, utls.HelloCustom)
+		if err := uconn.ApplyPreset(&spec); err != nil {
+			return nil, err
+		}
+		if err := uconn.Handshake(); err != nil {
+			return nil, err
+		}
+		return uconn, nil
+	}
+}
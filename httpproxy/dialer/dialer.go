@@ -1,8 +1,12 @@
 package dialer
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"net/http/httptrace"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/cloudflare/golibs/lrucache"
@@ -14,8 +18,28 @@ const (
 	DefaultRetryDelay     time.Duration = 100 * time.Millisecond
 	DefaultDNSCacheExpiry time.Duration = time.Hour
 	DefaultDNSCacheSize   uint          = 8 * 1024
+	MaxDNSCacheSize       uint          = 1024 * 1024
 )
 
+var (
+	dialersMu sync.Mutex
+	dialers   []*Dialer
+)
+
+// Register lists d among the dialers the admin DNS endpoints act on.
+func Register(d *Dialer) {
+	dialersMu.Lock()
+	dialers = append(dialers, d)
+	dialersMu.Unlock()
+}
+
+// Dialers returns the dialers listed by Register.
+func Dialers() []*Dialer {
+	dialersMu.Lock()
+	defer dialersMu.Unlock()
+	return append([]*Dialer(nil), dialers...)
+}
+
 type Dialer struct {
 	Dialer interface {
 		Dial(network, addr string) (net.Conn, error)
@@ -27,34 +51,292 @@ type Dialer struct {
 	DNSCacheExpiry time.Duration
 	LoopbackAddrs  map[string]struct{}
 	Level          int
+	SocketOptions  *SocketOptions
+	// DialOverrides maps "host" or "host:port" to the "ip:port" dialed instead,
+	// the caller still uses host for Host and SNI
+	DialOverrides map[string]string
+	// RTTCache makes DNSCache keep all resolved ips, and the dialer prefer the
+	// ones with lower connect times
+	RTTCache *RTTCache
+	// FailCache remembers "ip:port" endpoints which failed to connect, dials to
+	// them fail fast for FailCacheTTL or until one succeeds
+	FailCache    lrucache.Cache
+	FailCacheTTL time.Duration
+	// AddressFamily is "ipv4" or "ipv6" to dial only addresses of it, "" for any
+	AddressFamily string
+	// QueryHTTPSRecords makes dials to port 443 look up the HTTPS record of the
+	// host from HTTPSServer into HTTPSCache, and use its ip hints instead of
+	// an A/AAAA lookup
+	QueryHTTPSRecords bool
+	HTTPSServer       string
+	HTTPSCache        lrucache.Cache
+	// SlowResolveThreshold warns of resolutions taking longer, rate limited
+	SlowResolveThreshold time.Duration
+	// DNSExportFile is the file ImportDNSFile loads DNSCache from, and
+	// ExportDNSFiles writes it to on shutdown
+	DNSExportFile string
+
+	slowMu         sync.Mutex
+	slowLogged     time.Time
+	slowSuppressed int
+
+	dnsMu sync.Mutex
+	// dnsPorts holds the expiry of each cached host and port
+	dnsPorts map[string]map[string]time.Time
+}
+
+type dialFailure struct {
+	err error
+	at  time.Time
+}
+
+// NewDNSCache returns a DNSCache of size entries, nil for size 0, with which
+// every dial resolves afresh. Sizes over MaxDNSCacheSize are an error.
+func NewDNSCache(size uint) (lrucache.Cache, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	if size > MaxDNSCacheSize {
+		return nil, fmt.Errorf("dialer: DNSCacheSize %d over %d", size, MaxDNSCacheSize)
+	}
+	return lrucache.NewLRUCache(size), nil
+}
+
+// DNSStats returns the connect times learned per host and ip.
+func (d *Dialer) DNSStats() []RTTStat {
+	if d.RTTCache == nil {
+		return nil
+	}
+	return d.RTTCache.Stats()
+}
+
+// cacheDNS caches ips as the addresses of host:port in DNSCache, all of them
+// with RTTCache, and returns what it cached.
+func (d *Dialer) cacheDNS(host, port string, ips []net.IP) (interface{}, error) {
+	ip := ips[0].String()
+	if d.LoopbackAddrs != nil {
+		if _, ok := d.LoopbackAddrs[ip]; ok {
+			return nil, net.InvalidAddrError(fmt.Sprintf("Invaid DNS Record: %s(%s)", host, ip))
+		}
+	}
+
+	expiry := d.DNSCacheExpiry
+	if expiry == 0 {
+		expiry = DefaultDNSCacheExpiry
+	}
+
+	address := net.JoinHostPort(host, port)
+
+	var v interface{}
+	if d.RTTCache != nil && len(ips) > 1 {
+		addrs := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			if _, ok := d.LoopbackAddrs[ip.String()]; !ok {
+				addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+			}
+		}
+		v = addrs
+	} else {
+		v = net.JoinHostPort(ip, port)
+	}
+	expires := time.Now().Add(expiry)
+	d.DNSCache.Set(address, v, expires)
+	glog.V(3).Infof("direct Dial cache dns %#v=%#v", address, v)
+
+	// DNSCache cannot list its keys, PurgeDNS, Resolve and ExportDNS need the
+	// ports
+	d.dnsMu.Lock()
+	if d.dnsPorts == nil {
+		d.dnsPorts = make(map[string]map[string]time.Time)
+	}
+	if d.dnsPorts[host] == nil {
+		d.dnsPorts[host] = make(map[string]time.Time)
+	}
+	d.dnsPorts[host][port] = expires
+	if len(d.dnsPorts) > 2*d.DNSCache.Capacity() {
+		for h, ports := range d.dnsPorts {
+			for p := range ports {
+				if _, ok := d.DNSCache.GetQuiet(net.JoinHostPort(h, p)); !ok {
+					delete(ports, p)
+				}
+			}
+			if len(ports) == 0 {
+				delete(d.dnsPorts, h)
+			}
+		}
+	}
+	d.dnsMu.Unlock()
+
+	return v, nil
+}
+
+// DNSHosts returns the hosts resolved into DNSCache.
+func (d *Dialer) DNSHosts() []string {
+	d.dnsMu.Lock()
+	defer d.dnsMu.Unlock()
+
+	hosts := make([]string, 0, len(d.dnsPorts))
+	for host := range d.dnsPorts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// PurgeDNS drops the cached addresses of host, of all hosts if it is empty,
+// so that the next dial resolves it again.
+func (d *Dialer) PurgeDNS(host string) {
+	if d.DNSCache == nil {
+		return
+	}
+
+	if host == "" {
+		d.DNSCache.Clear()
+		return
+	}
+
+	d.dnsMu.Lock()
+	defer d.dnsMu.Unlock()
+
+	for port := range d.dnsPorts[host] {
+		d.DNSCache.Del(net.JoinHostPort(host, port))
+	}
+}
+
+// Resolve looks host up now, replacing its cached addresses, and returns
+// its ips.
+func (d *Dialer) Resolve(host string) ([]net.IP, error) {
+	if d.SlowResolveThreshold > 0 {
+		defer d.timeResolve(host, "the system resolver", time.Now())
+	}
+	ips, err := lookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	ips = filterAddressFamily(ips, d.AddressFamily)
+	if len(ips) == 0 || d.DNSCache == nil {
+		return ips, nil
+	}
+
+	d.dnsMu.Lock()
+	ports := make([]string, 0, len(d.dnsPorts[host]))
+	for port := range d.dnsPorts[host] {
+		ports = append(ports, port)
+	}
+	d.dnsMu.Unlock()
+
+	for _, port := range ports {
+		if _, err := d.cacheDNS(host, port, ips); err != nil {
+			return nil, err
+		}
+	}
+
+	return ips, nil
 }
 
 func (d *Dialer) Dial(network, address string) (conn net.Conn, err error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext is Dial, reporting DNS lookups to the httptrace.ClientTrace of ctx.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
 	glog.V(3).Infof("Dail(%#v, %#v)", network, address)
 
+	nd := d.Dialer
+	if d.SocketOptions != nil {
+		if d1, ok := d.Dialer.(*net.Dialer); ok {
+			if host, _, err := net.SplitHostPort(address); err == nil {
+				d2 := *d1
+				d2.Control = d.SocketOptions.ControlHost(host)
+				nd = &d2
+			}
+		}
+	}
+
+	dial := nd.Dial
+	if cd, ok := nd.(interface {
+		DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	}); ok {
+		dial = func(network, address string) (net.Conn, error) {
+			return cd.DialContext(ctx, network, address)
+		}
+	}
+
+	trace := httptrace.ContextClientTrace(ctx)
+
+	if d.DialOverrides != nil {
+		addr, ok := d.DialOverrides[address]
+		if !ok {
+			if host, _, err := net.SplitHostPort(address); err == nil {
+				addr, ok = d.DialOverrides[host]
+			}
+		}
+		if ok {
+			glog.V(2).Infof("Dial(%#v, %#v) overridden to %#v", network, address, addr)
+			return d.dial(ctx, dial, network, addr)
+		}
+	}
+
+	rttHost := ""
+
+	// DNSCache holds the addresses of AddressFamily only
+	family := d.AddressFamily
+	bypass := false
+	if f := addressFamily(ctx); f != "" && f != family {
+		family, bypass = f, true
+	}
+	network = familyNetwork(network, family)
+
 	switch network {
 	case "tcp", "tcp4", "tcp6":
-		if d.DNSCache != nil {
-			if addr, ok := d.DNSCache.Get(address); ok {
-				address = addr.(string)
-			} else {
-				if host, port, err := net.SplitHostPort(address); err == nil {
-					if ips, err := net.LookupIP(host); err == nil && len(ips) > 0 {
-						ip := ips[0].String()
-						if d.LoopbackAddrs != nil {
-							if _, ok := d.LoopbackAddrs[ip]; ok {
-								return nil, net.InvalidAddrError(fmt.Sprintf("Invaid DNS Record: %s(%s)", host, ip))
-							}
-						}
-						addr := net.JoinHostPort(ip, port)
-						expiry := d.DNSCacheExpiry
-						if expiry == 0 {
-							expiry = DefaultDNSCacheExpiry
-						}
-						d.DNSCache.Set(address, addr, time.Now().Add(expiry))
-						glog.V(3).Infof("direct Dial cache dns %#v=%#v", address, addr)
-						address = addr
-					}
+		var cached interface{}
+		if d.DNSCache != nil && !bypass {
+			cached, _ = d.DNSCache.Get(address)
+		}
+		if cached != nil {
+			switch v := cached.(type) {
+			case string:
+				address = v
+			case []string:
+				rttHost, _, _ = net.SplitHostPort(address)
+				address = d.RTTCache.Pick(rttHost, v)
+			}
+		} else if host, port, err := net.SplitHostPort(address); err == nil {
+			// resolved here even without a cache, the LoopbackAddrs,
+			// AddressFamily and HTTPS record checks need the ips
+			if trace != nil && trace.DNSStart != nil {
+				trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+			}
+			ips, err := d.resolveIP(host, port)
+			if trace != nil && trace.DNSDone != nil {
+				addrs := make([]net.IPAddr, len(ips))
+				for i, ip := range ips {
+					addrs[i] = net.IPAddr{IP: ip}
+				}
+				trace.DNSDone(httptrace.DNSDoneInfo{Addrs: addrs, Err: err})
+			}
+			if err == nil && family != "" {
+				if ips = filterAddressFamily(ips, family); len(ips) == 0 {
+					return nil, &net.DNSError{Err: "no " + family + " address", Name: host}
+				}
+			}
+			if err == nil && len(ips) > 0 && (bypass || d.DNSCache == nil) {
+				ip := ips[0].String()
+				if _, ok := d.LoopbackAddrs[ip]; ok {
+					return nil, net.InvalidAddrError(fmt.Sprintf("Invaid DNS Record: %s(%s)", host, ip))
+				}
+				address = net.JoinHostPort(ip, port)
+			} else if err == nil && len(ips) > 0 {
+				addr, err := d.cacheDNS(host, port, ips)
+				if err != nil {
+					return nil, err
+				}
+				switch v := addr.(type) {
+				case string:
+					address = v
+				case []string:
+					rttHost = host
+					address = d.RTTCache.Pick(host, v)
 				}
 			}
 		}
@@ -62,6 +344,46 @@ func (d *Dialer) Dial(network, address string) (conn net.Conn, err error) {
 		break
 	}
 
+	if rttHost != "" {
+		dial0 := dial
+		dial = func(network, address string) (net.Conn, error) {
+			start := time.Now()
+			conn, err := dial0(network, address)
+			rtt := time.Since(start)
+			if err != nil && rtt < rttErrorPenalty {
+				rtt = rttErrorPenalty
+			}
+			if ip, _, err := net.SplitHostPort(address); err == nil {
+				d.RTTCache.Observe(rttHost, ip, rtt)
+			}
+			return conn, err
+		}
+	}
+
+	return d.dial(ctx, dial, network, address)
+}
+
+// dial dials address with the FailCache. Dials ctx aborted fail for the
+// client, not the endpoint, and are not remembered.
+func (d *Dialer) dial(ctx context.Context, dial func(network, address string) (net.Conn, error), network, address string) (conn net.Conn, err error) {
+	if d.FailCache != nil && d.FailCacheTTL > 0 {
+		// a stale failure has expired, the dial clearing it must go through
+		if v, ok := d.FailCache.GetNotStale(address); ok {
+			f := v.(dialFailure)
+			return nil, fmt.Errorf("dial %s %s: failed %s ago: %v", network, address, time.Since(f.at), f.err)
+		}
+		defer func() {
+			if err != nil && ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				d.FailCache.Set(address, dialFailure{err, time.Now()}, time.Now().Add(d.FailCacheTTL))
+			} else {
+				d.FailCache.Del(address)
+			}
+		}()
+	}
+
 	if d.Level <= 1 {
 		retry := d.RetryTimes
 		if retry == 0 {
@@ -69,7 +391,7 @@ func (d *Dialer) Dial(network, address string) (conn net.Conn, err error) {
 		}
 
 		for i := 0; i < retry; i++ {
-			conn, err = d.Dialer.Dial(network, address)
+			conn, err = dial(network, address)
 			if err == nil || i == retry-1 {
 				break
 			}
@@ -91,7 +413,7 @@ func (d *Dialer) Dial(network, address string) (conn net.Conn, err error) {
 		for i := 0; i < retry; i++ {
 			for j := 0; j < d.Level; j++ {
 				go func(addr string, c chan<- racer) {
-					conn, err := d.Dialer.Dial(network, addr)
+					conn, err := dial(network, addr)
 					lane <- racer{conn, err}
 				}(address, lane)
 			}
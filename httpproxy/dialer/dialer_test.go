@@ -0,0 +1,185 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+type flakyDialer struct {
+	delay time.Duration
+	down  bool
+	dials int
+}
+
+func (d *flakyDialer) Dial(network, address string) (net.Conn, error) {
+	d.dials++
+	time.Sleep(d.delay)
+	if d.down {
+		return nil, errors.New("i/o timeout")
+	}
+	c1, c2 := net.Pipe()
+	c2.Close()
+	return c1, nil
+}
+
+func TestDialerFailCache(t *testing.T) {
+	nd := &flakyDialer{delay: 100 * time.Millisecond, down: true}
+	d := &Dialer{
+		Dialer:       nd,
+		RetryTimes:   1,
+		FailCache:    lrucache.NewLRUCache(16),
+		FailCacheTTL: 300 * time.Millisecond,
+	}
+
+	if _, err := d.Dial("tcp", "192.0.2.1:443"); err == nil {
+		t.Fatalf("Dialer.Dial() to a down endpoint return no error")
+	}
+
+	start := time.Now()
+	if _, err := d.Dial("tcp", "192.0.2.1:443"); err == nil {
+		t.Fatalf("Dialer.Dial() to a failed endpoint return no error")
+	}
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Errorf("Dialer.Dial() to a failed endpoint took %s, want it to fail fast", elapsed)
+	}
+	if nd.dials != 1 {
+		t.Errorf("Dialer.Dial() dialed a failed endpoint %d times, want 1", nd.dials)
+	}
+
+	// other ports of the same ip are dialed as usual
+	nd.down = false
+	if c, err := d.Dial("tcp", "192.0.2.1:80"); err != nil {
+		t.Errorf("Dialer.Dial() to another endpoint error: %v", err)
+	} else {
+		c.Close()
+	}
+
+	// dialed again once the failure expires, and a success clears it
+	time.Sleep(d.FailCacheTTL)
+	if c, err := d.Dial("tcp", "192.0.2.1:443"); err != nil {
+		t.Fatalf("Dialer.Dial() error: %v", err)
+	} else {
+		c.Close()
+	}
+	if _, ok, _ := d.FailCache.GetStale("192.0.2.1:443"); ok {
+		t.Errorf("Dialer.Dial() success keeps the failure cached")
+	}
+
+	// a client hanging up fails its dial only
+	nd.down = true
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := d.DialContext(ctx, "tcp", "192.0.2.1:443"); err == nil {
+		t.Fatalf("Dialer.DialContext() to a down endpoint return no error")
+	}
+	if _, ok, _ := d.FailCache.GetStale("192.0.2.1:443"); ok {
+		t.Errorf("Dialer.DialContext() with a cancelled ctx caches the failure")
+	}
+}
+
+func TestDialerPurgeDNS(t *testing.T) {
+	d := &Dialer{
+		Dialer:     &flakyDialer{},
+		RetryTimes: 1,
+		DNSCache:   lrucache.NewLRUCache(16),
+	}
+
+	c, err := d.Dial("tcp", "localhost:80")
+	if err != nil {
+		t.Fatalf("Dialer.Dial() error: %v", err)
+	}
+	c.Close()
+
+	// the record changed since it was cached
+	d.DNSCache.Set("localhost:80", "192.0.2.1:80", time.Now().Add(time.Hour))
+
+	d.PurgeDNS("localhost")
+	if _, ok := d.DNSCache.Get("localhost:80"); ok {
+		t.Fatalf("Dialer.PurgeDNS() keeps localhost:80 cached")
+	}
+
+	ips, err := d.Resolve("localhost")
+	if err != nil || len(ips) == 0 {
+		t.Fatalf("Dialer.Resolve() = %v, %v, want the addresses of localhost", ips, err)
+	}
+	if v, ok := d.DNSCache.Get("localhost:80"); !ok || v != net.JoinHostPort(ips[0].String(), "80") {
+		t.Errorf("Dialer.Resolve() caches localhost:80 = %#v, want %s", v, ips[0])
+	}
+	if hosts := d.DNSHosts(); len(hosts) != 1 || hosts[0] != "localhost" {
+		t.Errorf("Dialer.DNSHosts() = %v, want [localhost]", hosts)
+	}
+
+	d.PurgeDNS("")
+	if _, ok := d.DNSCache.Get("localhost:80"); ok {
+		t.Errorf("Dialer.PurgeDNS(\"\") keeps localhost:80 cached")
+	}
+}
+
+type addrDialer struct {
+	addrs []string
+}
+
+func (d *addrDialer) Dial(network, address string) (net.Conn, error) {
+	d.addrs = append(d.addrs, address)
+	c1, c2 := net.Pipe()
+	c2.Close()
+	return c1, nil
+}
+
+func TestNewDNSCache(t *testing.T) {
+	if _, err := NewDNSCache(MaxDNSCacheSize + 1); err == nil {
+		t.Errorf("NewDNSCache(%d) returns no error", MaxDNSCacheSize+1)
+	}
+
+	for _, size := range []uint{0, 16} {
+		cache, err := NewDNSCache(size)
+		if err != nil {
+			t.Fatalf("NewDNSCache(%d) error: %v", size, err)
+		}
+		if (cache == nil) != (size == 0) {
+			t.Fatalf("NewDNSCache(%d) = %#v", size, cache)
+		}
+
+		nd := &addrDialer{}
+		d := &Dialer{Dialer: nd, RetryTimes: 1, DNSCache: cache}
+		for i := 0; i < 2; i++ {
+			c, err := d.Dial("tcp", "localhost:80")
+			if err != nil {
+				t.Fatalf("Dialer.Dial() with DNSCacheSize %d error: %v", size, err)
+			}
+			c.Close()
+		}
+
+		// with or without a cache the address is resolved before the dial
+		for _, addr := range nd.addrs {
+			if addr == "localhost:80" {
+				t.Errorf("Dialer.Dial() with DNSCacheSize %d dials %#v unresolved", size, addr)
+			}
+		}
+
+		// and the loopback guard holds for both
+		guarded, _ := NewDNSCache(size)
+		nd1 := &addrDialer{}
+		d1 := &Dialer{Dialer: nd1, RetryTimes: 1, DNSCache: guarded, LoopbackAddrs: map[string]struct{}{"127.0.0.1": {}, "::1": {}}}
+		if c, err := d1.Dial("tcp", "localhost:80"); err == nil {
+			c.Close()
+			t.Errorf("Dialer.Dial(localhost) with DNSCacheSize %d and LoopbackAddrs returns no error", size)
+		}
+		if len(nd1.addrs) != 0 {
+			t.Errorf("Dialer.Dial(localhost) with DNSCacheSize %d and LoopbackAddrs dials %v", size, nd1.addrs)
+		}
+
+		want := 0
+		if size > 0 {
+			want = 1
+		}
+		if hosts := d.DNSHosts(); len(hosts) != want {
+			t.Errorf("Dialer.DNSHosts() with DNSCacheSize %d = %v", size, hosts)
+		}
+	}
+}
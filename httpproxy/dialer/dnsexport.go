@@ -0,0 +1,173 @@
+package dialer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"time"
+)
+
+// dnsExportVersion is the version of the ExportDNS format.
+const dnsExportVersion = 1
+
+type dnsExport struct {
+	Version int
+	Entries []dnsExportEntry
+}
+
+type dnsExportEntry struct {
+	// Address is the host:port dialed, Addrs the ip:ports cached for it
+	Address string
+	Addrs   []string
+	// Expires is the unix time the entry expires at
+	Expires int64
+}
+
+// ExportDNS serializes the unexpired entries of DNSCache, so that a restarted
+// instance can load them with ImportDNS instead of resolving every host anew.
+func (d *Dialer) ExportDNS() []byte {
+	export := dnsExport{Version: dnsExportVersion}
+
+	if d.DNSCache != nil {
+		now := time.Now()
+
+		d.dnsMu.Lock()
+		for host, ports := range d.dnsPorts {
+			for port, expires := range ports {
+				if !expires.After(now) {
+					continue
+				}
+				address := net.JoinHostPort(host, port)
+				v, ok := d.DNSCache.GetQuiet(address)
+				if !ok {
+					continue
+				}
+				e := dnsExportEntry{Address: address, Expires: expires.Unix()}
+				switch v := v.(type) {
+				case string:
+					e.Addrs = []string{v}
+				case []string:
+					e.Addrs = v
+				default:
+					continue
+				}
+				export.Entries = append(export.Entries, e)
+			}
+		}
+		d.dnsMu.Unlock()
+	}
+
+	sort.Slice(export.Entries, func(i, j int) bool { return export.Entries[i].Address < export.Entries[j].Address })
+
+	data, _ := json.Marshal(export)
+	return data
+}
+
+// ImportDNS loads the entries ExportDNS serialized into DNSCache, dropping the
+// expired ones and the addresses in LoopbackAddrs as a lookup does, and
+// returns how many it loaded.
+func (d *Dialer) ImportDNS(data []byte) (int, error) {
+	var export dnsExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return 0, err
+	}
+	if export.Version != dnsExportVersion {
+		return 0, fmt.Errorf("dialer: unsupported DNS export version %d", export.Version)
+	}
+	if d.DNSCache == nil {
+		return 0, nil
+	}
+
+	now := time.Now()
+	n := 0
+
+	d.dnsMu.Lock()
+	defer d.dnsMu.Unlock()
+
+	for _, e := range export.Entries {
+		expires := time.Unix(e.Expires, 0)
+		if !expires.After(now) || len(e.Addrs) == 0 {
+			continue
+		}
+		host, port, err := net.SplitHostPort(e.Address)
+		if err != nil {
+			continue
+		}
+		addrs := d.dropLoopbackAddrs(e.Addrs)
+		if len(addrs) == 0 {
+			continue
+		}
+
+		// only RTTCache picks among several addresses
+		var v interface{} = addrs[0]
+		if d.RTTCache != nil && len(addrs) > 1 {
+			v = addrs
+		}
+		d.DNSCache.Set(e.Address, v, expires)
+
+		if d.dnsPorts == nil {
+			d.dnsPorts = make(map[string]map[string]time.Time)
+		}
+		if d.dnsPorts[host] == nil {
+			d.dnsPorts[host] = make(map[string]time.Time)
+		}
+		d.dnsPorts[host][port] = expires
+		n++
+	}
+
+	return n, nil
+}
+
+// dropLoopbackAddrs returns the ip:ports of addrs not in LoopbackAddrs.
+func (d *Dialer) dropLoopbackAddrs(addrs []string) []string {
+	kept := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		ip, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		if _, ok := d.LoopbackAddrs[ip]; !ok {
+			kept = append(kept, addr)
+		}
+	}
+	return kept
+}
+
+// ImportDNSFile loads DNSExportFile with ImportDNS, a missing file loads
+// nothing.
+func (d *Dialer) ImportDNSFile() (int, error) {
+	if d.DNSExportFile == "" {
+		return 0, nil
+	}
+	data, err := ioutil.ReadFile(d.DNSExportFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return d.ImportDNS(data)
+}
+
+// ExportDNSFiles writes the ExportDNS of every registered dialer with a
+// DNSExportFile to it, through a temporary file so a crash leaves the old one.
+func ExportDNSFiles() error {
+	var err error
+	for _, d := range Dialers() {
+		if d.DNSExportFile == "" {
+			continue
+		}
+		tmp := d.DNSExportFile + ".tmp"
+		err1 := ioutil.WriteFile(tmp, d.ExportDNS(), 0644)
+		if err1 == nil {
+			err1 = os.Rename(tmp, d.DNSExportFile)
+		}
+		if err1 != nil {
+			err = fmt.Errorf("dialer: export DNS to %#v: %v", d.DNSExportFile, err1)
+		}
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+package dialer
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+func TestDialerExportImportDNS(t *testing.T) {
+	d := &Dialer{
+		Dialer:     &flakyDialer{},
+		RetryTimes: 1,
+		DNSCache:   lrucache.NewLRUCache(16),
+	}
+
+	c, err := d.Dial("tcp", "localhost:80")
+	if err != nil {
+		t.Fatalf("Dialer.Dial() error: %v", err)
+	}
+	c.Close()
+	addr, _ := d.DNSCache.Get("localhost:80")
+
+	// expired entries are left out
+	d.dnsMu.Lock()
+	d.dnsPorts["expired.example"] = map[string]time.Time{"443": time.Now().Add(-time.Minute)}
+	d.dnsMu.Unlock()
+	d.DNSCache.Set("expired.example:443", "192.0.2.1:443", time.Now().Add(time.Hour))
+
+	data := d.ExportDNS()
+
+	d1 := &Dialer{DNSCache: lrucache.NewLRUCache(16)}
+	n, err := d1.ImportDNS(data)
+	if err != nil || n != 1 {
+		t.Fatalf("Dialer.ImportDNS(%s) = %d, %v, want 1 entry", data, n, err)
+	}
+	if v, ok := d1.DNSCache.Get("localhost:80"); !ok || v != addr {
+		t.Errorf("Dialer.ImportDNS() caches localhost:80 = %#v, want %#v", v, addr)
+	}
+	if _, ok := d1.DNSCache.Get("expired.example:443"); ok {
+		t.Errorf("Dialer.ImportDNS() caches the expired expired.example:443")
+	}
+	if hosts := d1.DNSHosts(); len(hosts) != 1 || hosts[0] != "localhost" {
+		t.Errorf("Dialer.DNSHosts() after ImportDNS = %v, want [localhost]", hosts)
+	}
+	// the expiry carries over, so a second export is the same
+	if data1 := d1.ExportDNS(); !bytes.Equal(data1, data) {
+		t.Errorf("Dialer.ExportDNS() after ImportDNS = %s, want %s", data1, data)
+	}
+
+	// entries which expired since the export are dropped
+	expired := []byte(`{"Version":1,"Entries":[{"Address":"a.example:443","Addrs":["192.0.2.1:443"],"Expires":1}]}`)
+	if n, err := d1.ImportDNS(expired); err != nil || n != 0 {
+		t.Errorf("Dialer.ImportDNS(%s) = %d, %v, want 0 entries", expired, n, err)
+	}
+
+	if _, err := d1.ImportDNS([]byte(`{"Version":2,"Entries":[]}`)); err == nil {
+		t.Errorf("Dialer.ImportDNS() of an unknown version returns no error")
+	}
+}
+
+func TestDialerImportDNSLoopback(t *testing.T) {
+	d := &Dialer{
+		DNSCache:      lrucache.NewLRUCache(16),
+		RTTCache:      NewRTTCache(16),
+		LoopbackAddrs: map[string]struct{}{"192.0.2.9": {}},
+	}
+	expires := time.Now().Add(time.Hour).Unix()
+	data := []byte(fmt.Sprintf(`{"Version":1,"Entries":[`+
+		`{"Address":"a.example:443","Addrs":["192.0.2.9:443"],"Expires":%d},`+
+		`{"Address":"b.example:443","Addrs":["192.0.2.9:443","192.0.2.2:443"],"Expires":%d}]}`, expires, expires))
+
+	if n, err := d.ImportDNS(data); err != nil || n != 1 {
+		t.Fatalf("Dialer.ImportDNS(%s) = %d, %v, want 1 entry", data, n, err)
+	}
+	if _, ok := d.DNSCache.Get("a.example:443"); ok {
+		t.Errorf("Dialer.ImportDNS() caches a.example:443 at a LoopbackAddrs ip")
+	}
+	if v, ok := d.DNSCache.Get("b.example:443"); !ok || v != "192.0.2.2:443" {
+		t.Errorf("Dialer.ImportDNS() caches b.example:443 = %#v, want \"192.0.2.2:443\"", v)
+	}
+}
+
+func TestExportDNSFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsexport")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "dns.json")
+	d := &Dialer{DNSCache: lrucache.NewLRUCache(16), DNSExportFile: file}
+	if n, err := d.ImportDNSFile(); err != nil || n != 0 {
+		t.Fatalf("Dialer.ImportDNSFile() of a missing file = %d, %v, want 0, nil", n, err)
+	}
+	d.cacheDNS("a.example", "443", []net.IP{net.ParseIP("192.0.2.1")})
+	Register(d)
+
+	if err := ExportDNSFiles(); err != nil {
+		t.Fatalf("ExportDNSFiles() error: %v", err)
+	}
+
+	d1 := &Dialer{DNSCache: lrucache.NewLRUCache(16), DNSExportFile: file}
+	if n, err := d1.ImportDNSFile(); err != nil || n != 1 {
+		t.Fatalf("Dialer.ImportDNSFile() = %d, %v, want 1 entry", n, err)
+	}
+	if v, ok := d1.DNSCache.Get("a.example:443"); !ok || v != "192.0.2.1:443" {
+		t.Errorf("Dialer.ImportDNSFile() caches a.example:443 = %#v, want \"192.0.2.1:443\"", v)
+	}
+}
@@ -0,0 +1,21 @@
+// +build go1.23
+
+package dialer
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+func init() {
+	ApplyECH = func(config *tls.Config, echConfigList []byte) {
+		config.EncryptedClientHelloConfigList = echConfigList
+	}
+	ECHRetryConfigs = func(err error) ([]byte, bool) {
+		var e *tls.ECHRejectionError
+		if errors.As(err, &e) {
+			return e.RetryConfigList, true
+		}
+		return nil, false
+	}
+}
@@ -0,0 +1,60 @@
+package dialer
+
+import (
+	"context"
+	"net"
+)
+
+const (
+	AddressFamilyIPv4 = "ipv4"
+	AddressFamilyIPv6 = "ipv6"
+)
+
+type addressFamilyKey struct{}
+
+// lookupIP resolves the hosts dialed, tests fake dual stack hosts with it.
+var lookupIP = net.LookupIP
+
+// WithAddressFamily makes dials with ctx use only ipv4 or ipv6 addresses,
+// overriding Dialer.AddressFamily. Such dials bypass DNSCache unless they ask
+// for the family it caches anyway.
+func WithAddressFamily(ctx context.Context, family string) context.Context {
+	return context.WithValue(ctx, addressFamilyKey{}, family)
+}
+
+func addressFamily(ctx context.Context) string {
+	family, _ := ctx.Value(addressFamilyKey{}).(string)
+	return family
+}
+
+// ValidAddressFamily reports whether family is "", "ipv4" or "ipv6".
+func ValidAddressFamily(family string) bool {
+	return family == "" || family == AddressFamilyIPv4 || family == AddressFamilyIPv6
+}
+
+func filterAddressFamily(ips []net.IP, family string) []net.IP {
+	if family == "" {
+		return ips
+	}
+
+	ips1 := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (family == AddressFamilyIPv4) {
+			ips1 = append(ips1, ip)
+		}
+	}
+	return ips1
+}
+
+func familyNetwork(network, family string) string {
+	if network != "tcp" {
+		return network
+	}
+	switch family {
+	case AddressFamilyIPv4:
+		return "tcp4"
+	case AddressFamilyIPv6:
+		return "tcp6"
+	}
+	return network
+}
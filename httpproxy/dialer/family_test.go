@@ -0,0 +1,89 @@
+package dialer
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+// recordDialer records the network and address of each dial.
+type recordDialer struct {
+	mu    sync.Mutex
+	dials []string
+}
+
+func (d *recordDialer) Dial(network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dials = append(d.dials, network+" "+address)
+	d.mu.Unlock()
+	c1, c2 := net.Pipe()
+	c2.Close()
+	return c1, nil
+}
+
+func (d *recordDialer) last() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dials[len(d.dials)-1]
+}
+
+func TestDialerAddressFamily(t *testing.T) {
+	lookupIP = func(host string) ([]net.IP, error) {
+		if ip := net.ParseIP(host); ip != nil {
+			return []net.IP{ip}, nil
+		}
+		return []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}, nil
+	}
+	defer func() { lookupIP = net.LookupIP }()
+
+	nd := &recordDialer{}
+	d := &Dialer{
+		Dialer:         nd,
+		RetryTimes:     1,
+		DNSCache:       lrucache.NewLRUCache(16),
+		DNSCacheExpiry: time.Hour,
+	}
+
+	for _, c := range []struct {
+		family string
+		dial   string
+	}{
+		{"", "tcp 192.0.2.1:80"},
+		{AddressFamilyIPv6, "tcp6 [2001:db8::1]:80"},
+		{AddressFamilyIPv4, "tcp4 192.0.2.1:80"},
+		// the override is not cached
+		{"", "tcp 192.0.2.1:80"},
+	} {
+		ctx := context.Background()
+		if c.family != "" {
+			ctx = WithAddressFamily(ctx, c.family)
+		}
+		conn, err := d.DialContext(ctx, "tcp", "example.org:80")
+		if err != nil {
+			t.Fatalf("Dialer.DialContext(%#v) error: %v", c.family, err)
+		}
+		conn.Close()
+		if got := nd.last(); got != c.dial {
+			t.Errorf("Dialer.DialContext(%#v) dials %#v, want %#v", c.family, got, c.dial)
+		}
+	}
+
+	d.AddressFamily = AddressFamilyIPv6
+	d.PurgeDNS("")
+	conn, err := d.Dial("tcp", "example.org:80")
+	if err != nil {
+		t.Fatalf("Dialer.Dial() error: %v", err)
+	}
+	conn.Close()
+	if got := nd.last(); got != "tcp6 [2001:db8::1]:80" {
+		t.Errorf("Dialer.Dial() with AddressFamily ipv6 dials %#v", got)
+	}
+
+	if _, err := d.DialContext(WithAddressFamily(context.Background(), AddressFamilyIPv4), "tcp", "[2001:db8::2]:80"); err == nil {
+		t.Errorf("Dialer.DialContext(ipv4) of an ipv6 address succeeds")
+	}
+}
@@ -0,0 +1,124 @@
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FlakyPolicy is when and how a FlakyDialer fails.
+type FlakyPolicy struct {
+	// FailFirst fails the first FailFirst dials to each host
+	FailFirst int
+	// FailRate fails this fraction of the dials after those, at random
+	FailRate float64
+	// Error is the class of the failures, "refused" by default, "reset",
+	// "unreachable", "timeout" or "dns"
+	Error string
+	// Seed makes the random failures repeatable, 0 seeds from the clock
+	Seed int64
+}
+
+// FlakyDialer fails dials by a FlakyPolicy and passes the others to an inner
+// dialer, for tests and staging of the retry paths.
+type FlakyDialer struct {
+	inner interface {
+		Dial(network, addr string) (net.Conn, error)
+	}
+	policy FlakyPolicy
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	dials map[string]int
+}
+
+func NewFlakyDialer(inner interface {
+	Dial(network, addr string) (net.Conn, error)
+}, policy FlakyPolicy) (*FlakyDialer, error) {
+	switch policy.Error {
+	case "", "refused", "reset", "unreachable", "timeout", "dns":
+	default:
+		return nil, fmt.Errorf("unknown FlakyPolicy.Error %#v", policy.Error)
+	}
+
+	seed := policy.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	return &FlakyDialer{
+		inner:  inner,
+		policy: policy,
+		rand:   rand.New(rand.NewSource(seed)),
+		dials:  make(map[string]int),
+	}, nil
+}
+
+// Dials returns how many dials to host were attempted, failed ones included.
+func (d *FlakyDialer) Dials(host string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dials[host]
+}
+
+func (d *FlakyDialer) Dial(network, addr string) (net.Conn, error) {
+	if err := d.fail(network, addr); err != nil {
+		return nil, err
+	}
+	return d.inner.Dial(network, addr)
+}
+
+func (d *FlakyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if err := d.fail(network, addr); err != nil {
+		return nil, err
+	}
+	if cd, ok := d.inner.(interface {
+		DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	}); ok {
+		return cd.DialContext(ctx, network, addr)
+	}
+	return d.inner.Dial(network, addr)
+}
+
+// fail counts the dial and returns the error it fails with, if any.
+func (d *FlakyDialer) fail(network, addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	d.mu.Lock()
+	d.dials[host]++
+	fail := d.dials[host] <= d.policy.FailFirst || (d.policy.FailRate > 0 && d.rand.Float64() < d.policy.FailRate)
+	d.mu.Unlock()
+
+	if !fail {
+		return nil
+	}
+
+	var errno error
+	switch d.policy.Error {
+	case "dns":
+		return &net.DNSError{Err: "no such host", Name: host}
+	case "timeout":
+		return &net.OpError{Op: "dial", Net: network, Err: flakyTimeoutError{}}
+	case "reset":
+		errno = syscall.ECONNRESET
+	case "unreachable":
+		errno = syscall.ENETUNREACH
+	default:
+		errno = syscall.ECONNREFUSED
+	}
+	return &net.OpError{Op: "dial", Net: network, Err: os.NewSyscallError("connect", errno)}
+}
+
+type flakyTimeoutError struct{}
+
+func (flakyTimeoutError) Error() string   { return "i/o timeout" }
+func (flakyTimeoutError) Timeout() bool   { return true }
+func (flakyTimeoutError) Temporary() bool { return true }
@@ -0,0 +1,103 @@
+package dialer
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type pipeDialer struct{}
+
+func (pipeDialer) Dial(network, address string) (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	c2.Close()
+	return c1, nil
+}
+
+func TestFlakyDialerRetry(t *testing.T) {
+	cases := []struct {
+		failFirst  int
+		retryTimes int
+		level      int
+		ok         bool
+		dials      int
+	}{
+		{1, 2, 1, true, 2},
+		{2, 2, 1, false, 2},
+		{2, 3, 1, true, 3},
+		// a racing dialer gets through if one of the Level racers does
+		{1, 2, 2, true, 2},
+		{2, 2, 2, false, 2},
+	}
+
+	for _, c := range cases {
+		fd, err := NewFlakyDialer(pipeDialer{}, FlakyPolicy{FailFirst: c.failFirst})
+		if err != nil {
+			t.Fatalf("NewFlakyDialer error: %v", err)
+		}
+		d := &Dialer{
+			Dialer:     fd,
+			RetryTimes: c.retryTimes,
+			RetryDelay: time.Millisecond,
+			Level:      c.level,
+		}
+
+		conn, err := d.Dial("tcp", "192.0.2.1:443")
+		if conn != nil {
+			conn.Close()
+		}
+		if (err == nil) != c.ok {
+			t.Errorf("Dialer{RetryTimes: %d, Level: %d}.Dial() failing %d times error = %v, want ok=%v", c.retryTimes, c.level, c.failFirst, err, c.ok)
+		}
+		if err != nil {
+			if oe, ok := err.(*net.OpError); !ok || oe.Err.(*os.SyscallError).Err != syscall.ECONNREFUSED {
+				t.Errorf("Dialer.Dial() error = %#v, want connection refused", err)
+			}
+		}
+		if n := fd.Dials("192.0.2.1"); n != c.dials {
+			t.Errorf("Dialer{RetryTimes: %d, Level: %d}.Dial() dialed %d times, want %d", c.retryTimes, c.level, n, c.dials)
+		}
+	}
+}
+
+func TestFlakyDialerPolicy(t *testing.T) {
+	fd, err := NewFlakyDialer(pipeDialer{}, FlakyPolicy{FailFirst: 1, Error: "timeout"})
+	if err != nil {
+		t.Fatalf("NewFlakyDialer error: %v", err)
+	}
+	if _, err := fd.Dial("tcp", "192.0.2.1:443"); err == nil || !err.(net.Error).Timeout() {
+		t.Errorf("FlakyDialer.Dial() error = %v, want a timeout", err)
+	}
+	// the failures are counted per host
+	if _, err := fd.Dial("tcp", "192.0.2.2:443"); err == nil {
+		t.Errorf("FlakyDialer.Dial() to another host return no error")
+	}
+	if c, err := fd.Dial("tcp", "192.0.2.1:80"); err != nil {
+		t.Errorf("FlakyDialer.Dial() after FailFirst error: %v", err)
+	} else {
+		c.Close()
+	}
+
+	fd, _ = NewFlakyDialer(pipeDialer{}, FlakyPolicy{FailRate: 0.5, Error: "dns", Seed: 1})
+	failed := 0
+	for i := 0; i < 1000; i++ {
+		c, err := fd.Dial("tcp", "example.org:443")
+		if err != nil {
+			if _, ok := err.(*net.DNSError); !ok {
+				t.Fatalf("FlakyDialer.Dial() error = %#v, want a *net.DNSError", err)
+			}
+			failed++
+		} else {
+			c.Close()
+		}
+	}
+	if failed < 400 || failed > 600 {
+		t.Errorf("FlakyDialer with FailRate 0.5 failed %d of 1000 dials", failed)
+	}
+
+	if _, err := NewFlakyDialer(pipeDialer{}, FlakyPolicy{Error: "bogus"}); err == nil {
+		t.Errorf("NewFlakyDialer(Error: bogus) return no error")
+	}
+}
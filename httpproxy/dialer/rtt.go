@@ -0,0 +1,149 @@
+package dialer
+
+import (
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// rttAlpha is the weight of a new sample in the moving average
+	rttAlpha float64 = 0.3
+	// rttErrorPenalty is the sample recorded for a failed connect
+	rttErrorPenalty time.Duration = 2 * time.Second
+)
+
+type RTTStat struct {
+	Host    string
+	IP      string
+	RTT     time.Duration
+	Samples int
+	Updated time.Time
+}
+
+// RTTCache keeps an exponentially weighted moving average of the connect time
+// per host and resolved ip, so that Dialer prefers the fastest addresses.
+type RTTCache struct {
+	mu   sync.Mutex
+	size int
+	m    map[string]*RTTStat
+}
+
+func NewRTTCache(size int) *RTTCache {
+	return &RTTCache{
+		size: size,
+		m:    make(map[string]*RTTStat),
+	}
+}
+
+func (c *RTTCache) Observe(host, ip string, rtt time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := host + "|" + ip
+	s, ok := c.m[key]
+	if !ok {
+		if len(c.m) >= c.size {
+			c.evict()
+		}
+		s = &RTTStat{Host: host, IP: ip, RTT: rtt}
+		c.m[key] = s
+	}
+
+	if s.Samples > 0 {
+		s.RTT = time.Duration(rttAlpha*float64(rtt) + (1-rttAlpha)*float64(s.RTT))
+	}
+	s.Samples++
+	s.Updated = time.Now()
+}
+
+// evict removes the least recently updated entry, c.mu must be held.
+func (c *RTTCache) evict() {
+	var oldest *RTTStat
+	var key string
+	for k, s := range c.m {
+		if oldest == nil || s.Updated.Before(oldest.Updated) {
+			oldest, key = s, k
+		}
+	}
+	delete(c.m, key)
+}
+
+func (c *RTTCache) Get(host, ip string) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if s, ok := c.m[host+"|"+ip]; ok {
+		return s.RTT, true
+	}
+	return 0, false
+}
+
+// Pick returns one of addrs ("ip:port") weighted by the inverse of its learned
+// connect time. An ip without samples is as likely as the fastest one, so it
+// gets measured.
+func (c *RTTCache) Pick(host string, addrs []string) string {
+	if len(addrs) == 1 {
+		return addrs[0]
+	}
+
+	rtts := make([]time.Duration, len(addrs))
+	var min time.Duration
+	for i, addr := range addrs {
+		ip, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			ip = addr
+		}
+		if rtt, ok := c.Get(host, ip); ok {
+			if rtt <= 0 {
+				rtt = time.Microsecond
+			}
+			rtts[i] = rtt
+			if min == 0 || rtt < min {
+				min = rtt
+			}
+		}
+	}
+	if min == 0 {
+		return addrs[0]
+	}
+
+	weights := make([]float64, len(addrs))
+	var total float64
+	for i, rtt := range rtts {
+		if rtt == 0 {
+			rtt = min
+		}
+		weights[i] = 1 / float64(rtt)
+		total += weights[i]
+	}
+
+	r := rand.Float64() * total
+	for i, w := range weights {
+		if r < w {
+			return addrs[i]
+		}
+		r -= w
+	}
+	return addrs[len(addrs)-1]
+}
+
+// Stats returns all learned connect times, ordered by host and then rtt.
+func (c *RTTCache) Stats() []RTTStat {
+	c.mu.Lock()
+	stats := make([]RTTStat, 0, len(c.m))
+	for _, s := range c.m {
+		stats = append(stats, *s)
+	}
+	c.mu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Host != stats[j].Host {
+			return stats[i].Host < stats[j].Host
+		}
+		return stats[i].RTT < stats[j].RTT
+	})
+	return stats
+}
@@ -0,0 +1,78 @@
+package dialer
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+type delayDialer struct {
+	delays map[string]time.Duration
+}
+
+func (d *delayDialer) Dial(network, address string) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(address)
+	time.Sleep(d.delays[host])
+	c1, c2 := net.Pipe()
+	c2.Close()
+	return c1, nil
+}
+
+func TestRTTCacheObserve(t *testing.T) {
+	c := NewRTTCache(2)
+
+	c.Observe("example.org", "1.1.1.1", 100*time.Millisecond)
+	c.Observe("example.org", "1.1.1.1", 200*time.Millisecond)
+	if rtt, _ := c.Get("example.org", "1.1.1.1"); rtt != 130*time.Millisecond {
+		t.Errorf("RTTCache.Get() = %s, want %s", rtt, 130*time.Millisecond)
+	}
+
+	c.Observe("example.org", "2.2.2.2", time.Millisecond)
+	c.Observe("example.org", "3.3.3.3", time.Millisecond)
+	if _, ok := c.Get("example.org", "1.1.1.1"); ok {
+		t.Errorf("RTTCache keeps the oldest entry beyond its size")
+	}
+}
+
+func TestDialerPreferFasterIP(t *testing.T) {
+	d := &Dialer{
+		Dialer: &delayDialer{
+			delays: map[string]time.Duration{
+				"127.0.0.1": 20 * time.Millisecond,
+				"127.0.0.2": time.Millisecond,
+			},
+		},
+		RetryTimes: 1,
+		DNSCache:   lrucache.NewLRUCache(16),
+		RTTCache:   NewRTTCache(16),
+	}
+	d.DNSCache.Set("example.org:80", []string{"127.0.0.1:80", "127.0.0.2:80"}, time.Now().Add(time.Hour))
+
+	for i := 0; i < 40; i++ {
+		conn, err := d.Dial("tcp", "example.org:80")
+		if err != nil {
+			t.Fatalf("Dialer.Dial() error: %v", err)
+		}
+		conn.Close()
+	}
+
+	stats := d.DNSStats()
+	if len(stats) != 2 {
+		t.Fatalf("Dialer.DNSStats() returns %d entries, want 2", len(stats))
+	}
+	if stats[0].IP != "127.0.0.2" {
+		t.Errorf("Dialer.DNSStats()[0].IP = %#v, want the faster %#v", stats[0].IP, "127.0.0.2")
+	}
+
+	fast := 0
+	for _, s := range stats {
+		if s.IP == "127.0.0.2" {
+			fast = s.Samples
+		}
+	}
+	if fast < 30 {
+		t.Errorf("faster ip dialed %d of 40 times, want at least 30", fast)
+	}
+}
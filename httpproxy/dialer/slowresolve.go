@@ -0,0 +1,50 @@
+package dialer
+
+import (
+	"net"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../helpers"
+)
+
+// slowResolveLogInterval is how often at most a Dialer warns of slow
+// resolutions, the ones in between are counted into the next warning.
+const slowResolveLogInterval = 10 * time.Second
+
+var slowResolves = helpers.Metrics.Counter("dialer_slow_resolves_total", "Resolutions slower than Dialer.SlowResolveThreshold.")
+
+// timeResolve warns of a resolution of host by resolver which took longer
+// than SlowResolveThreshold, at most once per slowResolveLogInterval.
+func (d *Dialer) timeResolve(host, resolver string, start time.Time) {
+	took := time.Since(start)
+	if d.SlowResolveThreshold <= 0 || took < d.SlowResolveThreshold {
+		return
+	}
+	slowResolves.Add(1)
+
+	d.slowMu.Lock()
+	if time.Since(d.slowLogged) < slowResolveLogInterval {
+		d.slowSuppressed++
+		d.slowMu.Unlock()
+		return
+	}
+	suppressed := d.slowSuppressed
+	d.slowLogged, d.slowSuppressed = time.Now(), 0
+	d.slowMu.Unlock()
+
+	glog.Warningf("Dialer resolve %#v by %s took %s, over SlowResolveThreshold %s (%d more slow ones suppressed)", host, resolver, took, d.SlowResolveThreshold, suppressed)
+}
+
+// resolverName names who resolves host for resolveIP in slow warnings.
+func (d *Dialer) resolverName(host, port string) string {
+	if d.QueryHTTPSRecords && port == "443" && net.ParseIP(host) == nil {
+		server := d.HTTPSServer
+		if server == "" {
+			server = DefaultHTTPSServer
+		}
+		return "https records of " + server + " and the system resolver"
+	}
+	return "the system resolver"
+}
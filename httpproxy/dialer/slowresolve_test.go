@@ -0,0 +1,46 @@
+package dialer
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+func TestDialerSlowResolveThreshold(t *testing.T) {
+	lookupIP = func(host string) ([]net.IP, error) {
+		if host == "slow.example" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		return []net.IP{net.ParseIP("192.0.2.1")}, nil
+	}
+	defer func() { lookupIP = net.LookupIP }()
+
+	d := &Dialer{
+		Dialer:               &flakyDialer{},
+		RetryTimes:           1,
+		DNSCache:             lrucache.NewLRUCache(16),
+		SlowResolveThreshold: 20 * time.Millisecond,
+	}
+
+	n := slowResolves.Value()
+	for _, address := range []string{"fast.example:80", "slow.example:80", "slow.example:443"} {
+		c, err := d.Dial("tcp", address)
+		if err != nil {
+			t.Fatalf("Dialer.Dial(%#v) error: %v", address, err)
+		}
+		c.Close()
+	}
+
+	if v := slowResolves.Value(); v != n+2 {
+		t.Errorf("dialer_slow_resolves_total = %d, want %d", v, n+2)
+	}
+	// the second slow one falls in the interval of the first warning
+	d.slowMu.Lock()
+	logged, suppressed := d.slowLogged, d.slowSuppressed
+	d.slowMu.Unlock()
+	if logged.IsZero() || suppressed != 1 {
+		t.Errorf("slow resolutions warned at %v with %d suppressed, want one warning and 1 suppressed", logged, suppressed)
+	}
+}
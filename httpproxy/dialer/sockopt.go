@@ -0,0 +1,79 @@
+package dialer
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/phuslu/glog"
+
+	"../helpers"
+)
+
+// SocketOptions are set on every socket dialed by a net.Dialer whose Control
+// is SocketOptions.Control, or by a Dialer with SocketOptions. Check must be
+// called before the first dial.
+type SocketOptions struct {
+	// PMTUDiscover is one of "want", "dont", "probe", or empty for the system default
+	PMTUDiscover string
+	// DSCP marks outgoing packets (IP_TOS/IPV6_TCLASS), 0 leaves them unmarked
+	DSCP int
+	// DSCPHosts overrides DSCP by destination host, e.g. "*.github.com"
+	DSCPHosts map[string]int
+
+	dscpMatcher *helpers.HostMatcher
+}
+
+// Check reports invalid option values.
+func (o *SocketOptions) Check() error {
+	switch o.PMTUDiscover {
+	case "", "want", "dont", "probe":
+	default:
+		return fmt.Errorf("invalid PMTUDiscover %#v, must be one of \"want\", \"dont\", \"probe\"", o.PMTUDiscover)
+	}
+
+	values := make(map[string]interface{})
+	for host, dscp := range o.DSCPHosts {
+		if dscp < 0 || dscp > 63 {
+			return fmt.Errorf("invalid DSCP %d for %#v, must be in [0, 63]", dscp, host)
+		}
+		values[host] = dscp
+	}
+	if o.DSCP < 0 || o.DSCP > 63 {
+		return fmt.Errorf("invalid DSCP %d, must be in [0, 63]", o.DSCP)
+	}
+	o.dscpMatcher = helpers.NewHostMatcherWithValue(values)
+
+	if !socketOptionsSupported && (o.PMTUDiscover != "" || o.DSCP != 0 || len(o.DSCPHosts) != 0) {
+		glog.Warningf("SocketOptions(%+v) are not supported on this platform, ignored", *o)
+	}
+
+	return nil
+}
+
+// Control is a net.Dialer.Control hook.
+func (o *SocketOptions) Control(network, address string, c syscall.RawConn) error {
+	host, _, _ := net.SplitHostPort(address)
+	return o.ControlHost(host)(network, address, c)
+}
+
+// ControlHost returns a net.Dialer.Control hook for dials to host, which may
+// differ from the resolved address seen by the hook.
+func (o *SocketOptions) ControlHost(host string) func(network, address string, c syscall.RawConn) error {
+	dscp := o.DSCP
+	if o.dscpMatcher != nil {
+		if v, ok := o.dscpMatcher.Lookup(host); ok {
+			dscp = v.(int)
+		}
+	}
+
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = o.set(fd, network, dscp)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
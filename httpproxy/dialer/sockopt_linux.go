@@ -0,0 +1,48 @@
+// +build linux
+
+package dialer
+
+import (
+	"os"
+	"strings"
+	"syscall"
+)
+
+const socketOptionsSupported = true
+
+var pmtuDiscoverModes = map[string]int{
+	"want":  syscall.IP_PMTUDISC_WANT,
+	"dont":  syscall.IP_PMTUDISC_DONT,
+	"probe": syscall.IP_PMTUDISC_PROBE,
+}
+
+func (o *SocketOptions) set(fd uintptr, network string, dscp int) error {
+	ipv6 := strings.HasSuffix(network, "6")
+
+	if mode, ok := pmtuDiscoverModes[o.PMTUDiscover]; ok {
+		var err error
+		if ipv6 {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, mode)
+		} else {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, mode)
+		}
+		if err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+
+	if dscp != 0 {
+		var err error
+		// DSCP is the upper 6 bits of the TOS/traffic class byte
+		if ipv6 {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, dscp<<2)
+		} else {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, dscp<<2)
+		}
+		if err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+// +build linux
+
+package dialer
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func getsockoptInt(t *testing.T, conn net.Conn, level, opt int) int {
+	rc, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("%T.SyscallConn() error: %v", conn, err)
+	}
+
+	var v int
+	rc.Control(func(fd uintptr) {
+		v, err = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	if err != nil {
+		t.Fatalf("getsockopt(%d, %d) error: %v", level, opt, err)
+	}
+	return v
+}
+
+func TestSocketOptionsPMTUDiscover(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	o := &SocketOptions{PMTUDiscover: "probe"}
+	if err := o.Check(); err != nil {
+		t.Fatalf("%T.Check() error: %v", o, err)
+	}
+
+	d := &net.Dialer{Control: o.Control}
+	conn, err := d.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("%T.Dial error: %v", d, err)
+	}
+	defer conn.Close()
+
+	if v := getsockoptInt(t, conn, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER); v != syscall.IP_PMTUDISC_PROBE {
+		t.Errorf("IP_MTU_DISCOVER = %d, want %d", v, syscall.IP_PMTUDISC_PROBE)
+	}
+
+	if err := (&SocketOptions{PMTUDiscover: "always"}).Check(); err == nil {
+		t.Errorf("SocketOptions.Check() accepts invalid PMTUDiscover")
+	}
+}
+
+func TestSocketOptionsDSCP(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	o := &SocketOptions{DSCP: 10, DSCPHosts: map[string]int{"localhost": 46}}
+	if err := o.Check(); err != nil {
+		t.Fatalf("%T.Check() error: %v", o, err)
+	}
+
+	d := &Dialer{
+		Dialer:        &net.Dialer{},
+		SocketOptions: o,
+	}
+
+	for host, dscp := range map[string]int{"127.0.0.1": 10, "localhost": 46} {
+		conn, err := d.Dial("tcp4", net.JoinHostPort(host, port))
+		if err != nil {
+			t.Fatalf("%T.Dial error: %v", d, err)
+		}
+
+		if v := getsockoptInt(t, conn, syscall.IPPROTO_IP, syscall.IP_TOS); v != dscp<<2 {
+			t.Errorf("IP_TOS of %#v = %#x, want %#x", host, v, dscp<<2)
+		}
+		conn.Close()
+	}
+
+	if err := (&SocketOptions{DSCP: 64}).Check(); err == nil {
+		t.Errorf("SocketOptions.Check() accepts invalid DSCP")
+	}
+}
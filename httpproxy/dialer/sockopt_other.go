@@ -0,0 +1,9 @@
+// +build !linux
+
+package dialer
+
+const socketOptionsSupported = false
+
+func (o *SocketOptions) set(fd uintptr, network string, dscp int) error {
+	return nil
+}
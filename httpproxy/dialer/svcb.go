@@ -0,0 +1,356 @@
+package dialer
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/phuslu/glog"
+)
+
+// TypeHTTPS is the DNS type of HTTPS records, SVCB records for https (RFC 9460).
+const TypeHTTPS uint16 = 65
+
+const (
+	svcParamALPN     uint16 = 1
+	svcParamPort     uint16 = 3
+	svcParamIPv4Hint uint16 = 4
+	svcParamECH      uint16 = 5
+	svcParamIPv6Hint uint16 = 6
+)
+
+// ApplyECH sets the ECHConfigList of an HTTPS record on config. It is nil
+// unless the Go TLS stack supports Encrypted Client Hello.
+var ApplyECH func(config *tls.Config, echConfigList []byte)
+
+// ECHRetryConfigs returns the retry configs of a handshake error from a server
+// which rejected ECH, and whether it did. It is nil unless the Go TLS stack
+// supports Encrypted Client Hello.
+var ECHRetryConfigs func(err error) (retryConfigList []byte, rejected bool)
+
+// An HTTPSRecord is the part of an HTTPS record a dial uses.
+type HTTPSRecord struct {
+	Priority      uint16
+	Target        string
+	ALPN          []string
+	Port          uint16
+	IPHints       []net.IP
+	ECHConfigList []byte
+	TTL           time.Duration
+}
+
+const (
+	DefaultHTTPSServer  string        = "8.8.8.8:53"
+	DefaultHTTPSTimeout time.Duration = 5 * time.Second
+
+	// httpsNegativeExpiry is how long a host without HTTPS record is cached
+	httpsNegativeExpiry time.Duration = 5 * time.Minute
+
+	// ednsUDPSize is the EDNS0 udp payload size of queries, ECH configs make
+	// HTTPS records outgrow the 512 bytes of plain dns
+	ednsUDPSize = 4096
+)
+
+// lookupHTTPS queries HTTPS records, tests fake them with it.
+var lookupHTTPS = LookupHTTPS
+
+// HTTPSRecord returns the HTTPS record of host a dial uses, the first
+// ServiceMode one for host itself, nil if it has none. Records are cached
+// for their TTL with QueryHTTPSRecords.
+func (d *Dialer) HTTPSRecord(host string) *HTTPSRecord {
+	if !d.QueryHTTPSRecords || d.HTTPSCache == nil {
+		return nil
+	}
+	if v, ok := d.HTTPSCache.Get(host); ok {
+		return v.(*HTTPSRecord)
+	}
+
+	server := d.HTTPSServer
+	if server == "" {
+		server = DefaultHTTPSServer
+	}
+
+	var r *HTTPSRecord
+	expiry := httpsNegativeExpiry
+
+	records, err := lookupHTTPS(server, host, DefaultHTTPSTimeout)
+	if err != nil {
+		glog.V(2).Infof("LookupHTTPS(%#v, %#v) error: %v", server, host, err)
+	}
+	for _, r1 := range records {
+		if r1.Target == "" || r1.Target == host {
+			r, expiry = r1, r1.TTL
+			break
+		}
+	}
+
+	d.HTTPSCache.Set(host, r, time.Now().Add(expiry))
+	return r
+}
+
+// resolveIP returns the ips to dial host:port at, the ip hints of its HTTPS
+// record if there are some.
+func (d *Dialer) resolveIP(host, port string) ([]net.IP, error) {
+	if d.SlowResolveThreshold > 0 {
+		defer d.timeResolve(host, d.resolverName(host, port), time.Now())
+	}
+	if port == "443" && net.ParseIP(host) == nil {
+		if r := d.HTTPSRecord(host); r != nil && len(r.IPHints) > 0 {
+			glog.V(3).Infof("Dial %#v at the HTTPS record ip hints %v", host, r.IPHints)
+			return r.IPHints, nil
+		}
+	}
+	return lookupIP(host)
+}
+
+// ParseHTTPSRecord parses the RDATA of an HTTPS record.
+func ParseHTTPSRecord(rdata []byte) (*HTTPSRecord, error) {
+	if len(rdata) < 2 {
+		return nil, errors.New("dialer: short HTTPS record")
+	}
+
+	r := &HTTPSRecord{Priority: binary.BigEndian.Uint16(rdata)}
+	target, n, err := readName(rdata, 2, false)
+	if err != nil {
+		return nil, err
+	}
+	r.Target = target
+
+	for b := rdata[n:]; len(b) > 0; {
+		if len(b) < 4 {
+			return nil, errors.New("dialer: short HTTPS record SvcParam")
+		}
+		key, length := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+length {
+			return nil, fmt.Errorf("dialer: HTTPS record SvcParam %d overflows", key)
+		}
+		value := b[4 : 4+length]
+		b = b[4+length:]
+
+		switch key {
+		case svcParamALPN:
+			for len(value) > 0 {
+				l := int(value[0])
+				if len(value) < 1+l {
+					return nil, errors.New("dialer: HTTPS record alpn overflows")
+				}
+				r.ALPN = append(r.ALPN, string(value[1:1+l]))
+				value = value[1+l:]
+			}
+		case svcParamPort:
+			if len(value) != 2 {
+				return nil, errors.New("dialer: invalid HTTPS record port")
+			}
+			r.Port = binary.BigEndian.Uint16(value)
+		case svcParamIPv4Hint, svcParamIPv6Hint:
+			size := net.IPv4len
+			if key == svcParamIPv6Hint {
+				size = net.IPv6len
+			}
+			if len(value) == 0 || len(value)%size != 0 {
+				return nil, fmt.Errorf("dialer: invalid HTTPS record ip hint %d", key)
+			}
+			for ; len(value) > 0; value = value[size:] {
+				r.IPHints = append(r.IPHints, net.IP(append([]byte(nil), value[:size]...)))
+			}
+		case svcParamECH:
+			r.ECHConfigList = append([]byte(nil), value...)
+		}
+	}
+
+	return r, nil
+}
+
+// LookupHTTPS queries the DNS server at server for the HTTPS records of host,
+// ordered by priority. AliasMode records, of priority 0, are left out. A
+// response truncated over udp is queried again over tcp.
+func LookupHTTPS(server, host string, timeout time.Duration) ([]*HTTPSRecord, error) {
+	deadline := time.Now().Add(timeout)
+
+	id := uint16(rand.Uint32())
+	query, err := newQuery(id, host, TypeHTTPS)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := exchangeUDP(server, query, deadline)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) >= 12 && b[2]&0x02 != 0 {
+		glog.V(3).Infof("LookupHTTPS(%#v, %#v) truncated, queries over tcp", server, host)
+		if b, err = exchangeTCP(server, query, deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	return parseHTTPSResponse(b, id)
+}
+
+func exchangeUDP(server string, query []byte, deadline time.Time) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", server, time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, ednsUDPSize)
+	n, err := conn.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	return b[:n], nil
+}
+
+// exchangeTCP sends query over tcp, where dns messages are prefixed with
+// their uint16 length.
+func exchangeTCP(server string, query []byte, deadline time.Time) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", server, time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	b := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(b, uint16(len(query)))
+	copy(b[2:], query)
+	if _, err := conn.Write(b); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return nil, err
+	}
+	b = make([]byte, binary.BigEndian.Uint16(b))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// newQuery returns the dns query id for qtype of host, with an EDNS0 OPT
+// record for responses of up to ednsUDPSize over udp.
+func newQuery(id uint16, host string, qtype uint16) ([]byte, error) {
+	b := make([]byte, 12, 12+len(host)+6+11)
+	binary.BigEndian.PutUint16(b, id)
+	// recursion desired, one question, one additional record
+	b[2] = 0x01
+	binary.BigEndian.PutUint16(b[4:], 1)
+	binary.BigEndian.PutUint16(b[10:], 1)
+
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("dialer: invalid dns name %#v", host)
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	b = append(b, 0, byte(qtype>>8), byte(qtype), 0, 1)
+	// OPT of the root, the class is the udp payload size
+	b = append(b, 0, 0, 41, byte(ednsUDPSize>>8), byte(ednsUDPSize&0xff), 0, 0, 0, 0, 0, 0)
+
+	return b, nil
+}
+
+func parseHTTPSResponse(b []byte, id uint16) ([]*HTTPSRecord, error) {
+	if len(b) < 12 || binary.BigEndian.Uint16(b) != id {
+		return nil, errors.New("dialer: invalid dns response")
+	}
+	if rcode := b[3] & 0x0f; rcode != 0 {
+		return nil, fmt.Errorf("dialer: dns response rcode %d", rcode)
+	}
+
+	qdcount, ancount := int(binary.BigEndian.Uint16(b[4:])), int(binary.BigEndian.Uint16(b[6:]))
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		_, n, err := readName(b, off, true)
+		if err != nil {
+			return nil, err
+		}
+		off = n + 4
+	}
+
+	records := make([]*HTTPSRecord, 0, ancount)
+	for i := 0; i < ancount; i++ {
+		_, n, err := readName(b, off, true)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) < n+10 {
+			return nil, errors.New("dialer: short dns answer")
+		}
+		rrtype := binary.BigEndian.Uint16(b[n:])
+		ttl := time.Duration(binary.BigEndian.Uint32(b[n+4:])) * time.Second
+		length := int(binary.BigEndian.Uint16(b[n+8:]))
+		off = n + 10 + length
+		if len(b) < off {
+			return nil, errors.New("dialer: dns answer overflows")
+		}
+		if rrtype != TypeHTTPS {
+			continue
+		}
+
+		r, err := ParseHTTPSRecord(b[n+10 : off])
+		if err != nil {
+			return nil, err
+		}
+		if r.Priority == 0 {
+			continue
+		}
+		r.TTL = ttl
+		records = append(records, r)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Priority < records[j].Priority })
+	return records, nil
+}
+
+// readName reads the dns name at off in b, following compression pointers in
+// messages, and returns it with the offset after it.
+func readName(b []byte, off int, compressed bool) (string, int, error) {
+	labels := make([]string, 0, 4)
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(b) {
+			return "", 0, errors.New("dialer: dns name overflows")
+		}
+		l := int(b[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case l&0xc0 == 0xc0 && compressed:
+			if off+1 >= len(b) || jumps > 16 {
+				return "", 0, errors.New("dialer: invalid dns name pointer")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+			jumps++
+		case l <= 63:
+			if off+1+l > len(b) {
+				return "", 0, errors.New("dialer: dns label overflows")
+			}
+			labels = append(labels, string(b[off+1:off+1+l]))
+			off += 1 + l
+		default:
+			return "", 0, errors.New("dialer: invalid dns label")
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package dialer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+// httpsResponse is a dns response to the HTTPS query id of example.org, with
+// a ServiceMode record carrying alpn and ech SvcParams after an AliasMode one.
+func httpsResponse(id uint16, ech []byte) []byte {
+	b := []byte{0, 0, 0x81, 0x80, 0, 1, 0, 2, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(b, id)
+	b = append(b, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'o', 'r', 'g', 0, 0, 65, 0, 1)
+
+	// AliasMode to svc.example.org, the owner name compressed to the question
+	alias := []byte{0, 0, 3, 's', 'v', 'c', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'o', 'r', 'g', 0}
+	b = append(b, 0xc0, 12, 0, 65, 0, 1, 0, 0, 1, 0, 0, byte(len(alias)))
+	b = append(b, alias...)
+
+	rdata := []byte{0, 1, 0}
+	rdata = append(rdata, 0, 1, 0, 6, 2, 'h', '2', 2, 'h', '3')
+	rdata = append(rdata, 0, 5, byte(len(ech)>>8), byte(len(ech)))
+	rdata = append(rdata, ech...)
+	b = append(b, 0xc0, 12, 0, 65, 0, 1, 0, 0, 0, 60, byte(len(rdata)>>8), byte(len(rdata)))
+	return append(b, rdata...)
+}
+
+var httpsQuestion = []byte{7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'o', 'r', 'g', 0, 0, 65, 0, 1}
+
+func TestLookupHTTPS(t *testing.T) {
+	ech := []byte{0, 4, 0xfe, 0x0d, 0, 0}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket error: %v", err)
+	}
+	defer conn.Close()
+
+	go func() {
+		b := make([]byte, 512)
+		n, addr, err := conn.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		// the question must be for the HTTPS record of example.org, with EDNS0
+		if !bytes.HasSuffix(b[:n], append(httpsQuestion, 0, 0, 41, 0x10, 0, 0, 0, 0, 0, 0, 0)) {
+			return
+		}
+		conn.WriteTo(httpsResponse(binary.BigEndian.Uint16(b), ech), addr)
+	}()
+
+	records, err := LookupHTTPS(conn.LocalAddr().String(), "example.org", time.Second)
+	if err != nil {
+		t.Fatalf("LookupHTTPS() error: %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("LookupHTTPS() = %d records, want the ServiceMode one", len(records))
+	}
+
+	r := records[0]
+	if r.Priority != 1 || r.Target != "" || r.TTL != time.Minute {
+		t.Errorf("LookupHTTPS() record = %+v", r)
+	}
+	if len(r.ALPN) != 2 || r.ALPN[0] != "h2" || r.ALPN[1] != "h3" {
+		t.Errorf("LookupHTTPS() record alpn = %v, want [h2 h3]", r.ALPN)
+	}
+	if !bytes.Equal(r.ECHConfigList, ech) {
+		t.Errorf("LookupHTTPS() record ech = %x, want %x", r.ECHConfigList, ech)
+	}
+}
+
+func TestLookupHTTPSTruncated(t *testing.T) {
+	ech := bytes.Repeat([]byte{0xec}, 1024)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %v", err)
+	}
+	defer ln.Close()
+	conn, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		t.Skipf("net.ListenPacket(%#v) error: %v", ln.Addr().String(), err)
+	}
+	defer conn.Close()
+
+	go func() {
+		b := make([]byte, 512)
+		n, addr, err := conn.ReadFrom(b)
+		if err != nil || n < 12 {
+			return
+		}
+		// a header with TC set and no records
+		resp := []byte{b[0], b[1], 0x83, 0x80, 0, 1, 0, 0, 0, 0, 0, 0}
+		conn.WriteTo(append(resp, httpsQuestion...), addr)
+	}()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(c, b); err != nil {
+			return
+		}
+		b = make([]byte, binary.BigEndian.Uint16(b))
+		if _, err := io.ReadFull(c, b); err != nil {
+			return
+		}
+		resp := httpsResponse(binary.BigEndian.Uint16(b), ech)
+		c.Write(append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...))
+	}()
+
+	records, err := LookupHTTPS(ln.Addr().String(), "example.org", time.Second)
+	if err != nil {
+		t.Fatalf("LookupHTTPS() error: %v", err)
+	}
+	if len(records) != 1 || !bytes.Equal(records[0].ECHConfigList, ech) {
+		t.Errorf("LookupHTTPS() of a truncated response = %+v, want the record over tcp", records)
+	}
+}
+
+func TestParseHTTPSRecordHints(t *testing.T) {
+	rdata := []byte{0, 1, 3, 's', 'v', 'c', 0}
+	rdata = append(rdata, 0, 3, 0, 2, 0x20, 0xfb)
+	rdata = append(rdata, 0, 4, 0, 8, 192, 0, 2, 1, 192, 0, 2, 2)
+	rdata = append(rdata, 0, 6, 0, 16, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1)
+	// unknown keys are skipped
+	rdata = append(rdata, 0, 9, 0, 1, 0)
+
+	r, err := ParseHTTPSRecord(rdata)
+	if err != nil {
+		t.Fatalf("ParseHTTPSRecord() error: %v", err)
+	}
+	if r.Target != "svc" || r.Port != 8443 {
+		t.Errorf("ParseHTTPSRecord() target %#v port %d, want \"svc\" 8443", r.Target, r.Port)
+	}
+
+	want := []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"}
+	if len(r.IPHints) != len(want) {
+		t.Fatalf("ParseHTTPSRecord() ip hints = %v, want %v", r.IPHints, want)
+	}
+	for i, ip := range r.IPHints {
+		if ip.String() != want[i] {
+			t.Errorf("ParseHTTPSRecord() ip hint %d = %s, want %s", i, ip, want[i])
+		}
+	}
+}
+
+func TestParseHTTPSRecordInvalid(t *testing.T) {
+	for _, rdata := range [][]byte{
+		{0},
+		{0, 1, 3, 'a'},
+		{0, 1, 0, 0, 5, 0, 9, 1},
+		{0, 1, 0, 0, 1, 0, 2, 5, 'h'},
+		{0, 1, 0, 0, 3, 0, 1, 80},
+		{0, 1, 0, 0, 4, 0, 3, 192, 0, 2},
+		{0, 1, 0, 0, 6, 0, 4, 0x20, 0x01, 0x0d, 0xb8},
+	} {
+		if r, err := ParseHTTPSRecord(rdata); err == nil {
+			t.Errorf("ParseHTTPSRecord(%x) = %+v, want an error", rdata, r)
+		}
+	}
+}
+
+func TestDialerQueryHTTPSRecords(t *testing.T) {
+	lookups := 0
+	lookupHTTPS = func(server, host string, timeout time.Duration) ([]*HTTPSRecord, error) {
+		lookups++
+		if host != "example.org" {
+			return nil, nil
+		}
+		return []*HTTPSRecord{{Priority: 1, IPHints: []net.IP{net.ParseIP("192.0.2.7")}, TTL: time.Minute}}, nil
+	}
+	lookupIP = func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("192.0.2.1")}, nil
+	}
+	defer func() {
+		lookupHTTPS = LookupHTTPS
+		lookupIP = net.LookupIP
+	}()
+
+	nd := &recordDialer{}
+	d := &Dialer{
+		Dialer:            nd,
+		RetryTimes:        1,
+		DNSCache:          lrucache.NewLRUCache(16),
+		DNSCacheExpiry:    time.Hour,
+		QueryHTTPSRecords: true,
+		HTTPSCache:        lrucache.NewLRUCache(16),
+	}
+
+	for _, c := range []struct {
+		address string
+		dial    string
+		lookups int
+	}{
+		{"example.org:443", "tcp 192.0.2.7:443", 1},
+		// no record dials the A/AAAA records
+		{"example.net:443", "tcp 192.0.2.1:443", 2},
+		// only https dials query
+		{"example.org:80", "tcp 192.0.2.1:80", 2},
+	} {
+		conn, err := d.DialContext(context.Background(), "tcp", c.address)
+		if err != nil {
+			t.Fatalf("Dialer.DialContext(%#v) error: %v", c.address, err)
+		}
+		conn.Close()
+		if got := nd.last(); got != c.dial {
+			t.Errorf("Dialer.DialContext(%#v) dials %#v, want %#v", c.address, got, c.dial)
+		}
+		if lookups != c.lookups {
+			t.Errorf("Dialer.DialContext(%#v) makes %d HTTPS lookups, want %d", c.address, lookups, c.lookups)
+		}
+	}
+
+	// records and their absence are cached
+	d.PurgeDNS("")
+	for _, host := range []string{"example.org", "example.net"} {
+		d.HTTPSRecord(host)
+	}
+	if lookups != 2 {
+		t.Errorf("Dialer.HTTPSRecord() makes %d HTTPS lookups, want 2", lookups)
+	}
+}
@@ -0,0 +1,236 @@
+package abtest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../helpers"
+	"../../proxy"
+	"../../storage"
+)
+
+const (
+	filterName string = "abtest"
+)
+
+const (
+	ModeFirstWins   string = "first-wins"
+	ModePrimaryWins string = "primary-wins"
+)
+
+type Config struct {
+	Primary       string
+	Secondary     string
+	Mode          string
+	MaxBufferSize int
+}
+
+type Filter struct {
+	Config
+	Primary   http.RoundTripper
+	Secondary http.RoundTripper
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.LookupStoreByConfig(filterName).UnmarshallJson(filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	err = filters.Register(filterName, &filters.RegisteredFilter{
+		New: func() (filters.Filter, error) {
+			return NewFilter(config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+// newTransport returns a transport to upstream proxy rawurl, or a direct one
+// if rawurl is empty.
+func newTransport(rawurl string) (*http.Transport, error) {
+	d := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	tr := &http.Transport{
+		Dial:                d.Dial,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+
+	if rawurl == "" {
+		return tr, nil
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		tr.Proxy = http.ProxyURL(u)
+	default:
+		dialer, err := proxy.FromURL(u, d, nil)
+		if err != nil {
+			return nil, err
+		}
+		tr.Dial = dialer.Dial
+	}
+
+	return tr, nil
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	switch config.Mode {
+	case ModeFirstWins, ModePrimaryWins:
+	default:
+		return nil, fmt.Errorf("abtest: unknown Mode %#v", config.Mode)
+	}
+
+	primary, err := newTransport(config.Primary)
+	if err != nil {
+		return nil, err
+	}
+
+	secondary, err := newTransport(config.Secondary)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Filter{
+		Config:    *config,
+		Primary:   primary,
+		Secondary: secondary,
+	}, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
+
+type result struct {
+	name string
+	resp *http.Response
+	err  error
+}
+
+func discard(r result) {
+	if r.resp != nil {
+		io.Copy(ioutil.Discard, r.resp.Body)
+		r.resp.Body.Close()
+	}
+}
+
+func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	if req.Method == "CONNECT" {
+		return ctx, nil, nil
+	}
+
+	helpers.FixRequestURL(req)
+
+	// Both upstreams get the full request, the slower one is discarded
+	req1 := helpers.CloneRequest(req)
+	req2 := helpers.CloneRequest(req)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	if req.Body != nil && req.Body != http.NoBody {
+		reservation := helpers.Buffers.Reserve()
+		if !reservation.Grow(int64(f.MaxBufferSize)) {
+			// no memory to tee the body, the primary gets it alone
+			glog.Warningf("%s \"ABTEST %s %s %s\" MaxBufferMemory exhausted, skips secondary", req.RemoteAddr, req.Method, req.URL.String(), req.Proto)
+			resp, err := f.Primary.RoundTrip(req1)
+			return ctx, resp, err
+		}
+		go func() {
+			wg.Wait()
+			reservation.Release()
+		}()
+
+		bodies := helpers.NewTeeReadClosers(req.Body, 2, f.MaxBufferSize)
+		req1.Body, req2.Body = bodies[0], bodies[1]
+	}
+
+	primary := make(chan result, 1)
+	secondary := make(chan result, 1)
+	go func() {
+		resp, err := f.Primary.RoundTrip(req1)
+		wg.Done()
+		primary <- result{"primary", resp, err}
+	}()
+	go func() {
+		resp, err := f.Secondary.RoundTrip(req2)
+		wg.Done()
+		secondary <- result{"secondary", resp, err}
+	}()
+
+	var r result
+	switch f.Mode {
+	case ModeFirstWins:
+		select {
+		case r = <-primary:
+			if r.err != nil {
+				glog.Warningf("%s \"ABTEST %s %s %s\" primary error: %v", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, r.err)
+				r = <-secondary
+			} else {
+				go discard(<-secondary)
+			}
+		case r = <-secondary:
+			if r.err != nil {
+				glog.Warningf("%s \"ABTEST %s %s %s\" secondary error: %v", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, r.err)
+				r = <-primary
+			} else {
+				go discard(<-primary)
+			}
+		}
+	case ModePrimaryWins:
+		r = <-primary
+		go func(r result, req *http.Request) {
+			r2 := <-secondary
+			defer discard(r2)
+			diff(req, r, r2)
+		}(r, req)
+	}
+
+	if r.err != nil {
+		return ctx, nil, r.err
+	}
+
+	glog.V(2).Infof("%s \"ABTEST %s %s %s\" %d %s from %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, r.resp.StatusCode, r.resp.Header.Get("Content-Length"), r.name)
+	return ctx, r.resp, nil
+}
+
+// diff logs how the secondary response differs from the primary one.
+func diff(req *http.Request, r1, r2 result) {
+	switch {
+	case r1.err != nil || r2.err != nil:
+		if (r1.err == nil) != (r2.err == nil) {
+			glog.Warningf("%s \"ABTEST %s %s %s\" diff: primary error=%v, secondary error=%v", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, r1.err, r2.err)
+		}
+		return
+	case r1.resp.StatusCode != r2.resp.StatusCode:
+		glog.Warningf("%s \"ABTEST %s %s %s\" diff: primary status=%d, secondary status=%d", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, r1.resp.StatusCode, r2.resp.StatusCode)
+	}
+
+	for _, key := range []string{"Content-Type", "Content-Length", "Location"} {
+		if v1, v2 := r1.resp.Header.Get(key), r2.resp.Header.Get(key); v1 != v2 {
+			glog.Warningf("%s \"ABTEST %s %s %s\" diff: primary %s=%#v, secondary %s=%#v", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, key, v1, key, v2)
+		}
+	}
+}
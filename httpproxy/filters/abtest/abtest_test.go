@@ -0,0 +1,104 @@
+package abtest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"../../filters"
+	"../../helpers"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// upstream echoes the request body after delay, and reports what it got on bodies
+func upstream(name string, delay time.Duration, bodies chan<- string) http.RoundTripper {
+	return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		b, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		bodies <- string(b)
+		time.Sleep(delay)
+		return filters.NewResponse(req, http.StatusOK, http.Header{"X-Upstream": []string{name}}, strings.NewReader(string(b))), nil
+	})
+}
+
+func TestRoundTrip(t *testing.T) {
+	var cases = []struct {
+		Mode           string
+		PrimaryDelay   time.Duration
+		SecondaryDelay time.Duration
+		Want           string
+	}{
+		{ModeFirstWins, 100 * time.Millisecond, 0, "secondary"},
+		{ModeFirstWins, 0, 100 * time.Millisecond, "primary"},
+		{ModePrimaryWins, 100 * time.Millisecond, 0, "primary"},
+	}
+
+	body := strings.Repeat("0123456789", 100*1024)
+
+	for _, c := range cases {
+		bodies := make(chan string, 2)
+		f := &Filter{
+			Config:    Config{Mode: c.Mode, MaxBufferSize: 64 * 1024},
+			Primary:   upstream("primary", c.PrimaryDelay, bodies),
+			Secondary: upstream("secondary", c.SecondaryDelay, bodies),
+		}
+
+		req, _ := http.NewRequest(http.MethodPost, "http://example.org/", strings.NewReader(body))
+		_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip(%#v) error: %v", f, c.Mode, err)
+		}
+
+		if v := resp.Header.Get("X-Upstream"); v != c.Want {
+			t.Errorf("%T.RoundTrip(%#v) return response from %#v, want %#v", f, c.Mode, v, c.Want)
+		}
+		if b, _ := ioutil.ReadAll(resp.Body); string(b) != body {
+			t.Errorf("%T.RoundTrip(%#v) return corrupted body", f, c.Mode)
+		}
+
+		for i := 0; i < 2; i++ {
+			if b := <-bodies; b != body {
+				t.Errorf("%T.RoundTrip(%#v) upstream got %d bytes body, want %d", f, c.Mode, len(b), len(body))
+			}
+		}
+	}
+}
+
+func TestRoundTripBufferMemoryExhausted(t *testing.T) {
+	helpers.Buffers.SetMax(1024)
+	defer helpers.Buffers.SetMax(0)
+
+	bodies := make(chan string, 2)
+	f := &Filter{
+		Config:    Config{Mode: ModeFirstWins, MaxBufferSize: 64 * 1024},
+		Primary:   upstream("primary", 0, bodies),
+		Secondary: upstream("secondary", 0, bodies),
+	}
+
+	body := strings.Repeat("0123456789", 10*1024)
+	req, _ := http.NewRequest(http.MethodPost, "http://example.org/", strings.NewReader(body))
+	_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+	if err != nil {
+		t.Fatalf("%T.RoundTrip() error: %v", f, err)
+	}
+
+	if v := resp.Header.Get("X-Upstream"); v != "primary" {
+		t.Errorf("%T.RoundTrip() without buffer memory return response from %#v, want primary", f, v)
+	}
+	if b, _ := ioutil.ReadAll(resp.Body); string(b) != body {
+		t.Errorf("%T.RoundTrip() return corrupted body", f)
+	}
+	if n := len(bodies); n != 1 {
+		t.Errorf("%T.RoundTrip() without buffer memory reached %d upstreams, want 1", f, n)
+	}
+}
@@ -0,0 +1,269 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/phuslu/glog"
+
+	"../../dialer"
+	"../../filters"
+	"../../helpers"
+	"../../storage"
+)
+
+const (
+	filterName string = "admin"
+)
+
+var (
+	mux = http.NewServeMux()
+)
+
+func init() {
+	HandleFunc("/metrics", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		helpers.Metrics.WriteTo(rw)
+	})
+	HandleFunc("/debug/altsvc", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(rw)
+		enc.SetIndent("", "  ")
+		enc.Encode(helpers.AltSvc.Stats())
+	})
+	HandleFunc("/admin/dns/flush", flushDNS)
+	HandleFunc("/admin/filters/enabled", setEnabled)
+	HandleFunc("/admin/upstreams", setDraining)
+}
+
+// setEnabled reports the runtime switches of the filters, and flips the one
+// of the name parameter with a POST of the enabled parameter.
+func setEnabled(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		name := req.URL.Query().Get("name")
+		if _, ok := filters.Switches()[name]; !ok {
+			http.Error(rw, "no filter switch "+name, http.StatusNotFound)
+			return
+		}
+		v, err := strconv.ParseBool(req.URL.Query().Get("enabled"))
+		if err != nil {
+			http.Error(rw, "enabled must be true or false", http.StatusBadRequest)
+			return
+		}
+		filters.SetEnabled(name, v)
+		glog.Infof("%s \"ADMIN %s %s %s\" %s enabled=%v", req.RemoteAddr, req.Method, req.RequestURI, req.Proto, name, v)
+	default:
+		rw.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(rw, "GET or POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+	enc.Encode(filters.Switches())
+}
+
+// setDraining reports the upstream proxies with their sessions, and drains the
+// one of the name parameter, or takes it back, with a POST of the draining
+// parameter. A drained upstream is draining without sessions left.
+func setDraining(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		name := req.URL.Query().Get("name")
+		u, ok := helpers.Upstreams.Lookup(name)
+		if !ok {
+			http.Error(rw, "no upstream "+name, http.StatusNotFound)
+			return
+		}
+		v, err := strconv.ParseBool(req.URL.Query().Get("draining"))
+		if err != nil {
+			http.Error(rw, "draining must be true or false", http.StatusBadRequest)
+			return
+		}
+		u.SetDraining(v)
+		glog.Infof("%s \"ADMIN %s %s %s\" %s draining=%v, %d sessions", req.RemoteAddr, req.Method, req.RequestURI, req.Proto, name, v, u.Active())
+	default:
+		rw.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(rw, "GET or POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+	enc.Encode(helpers.Upstreams.Stats())
+}
+
+type dnsFlushResult struct {
+	Addrs []string
+	Error string `json:",omitempty"`
+}
+
+// flushDNS purges the cached addresses of the host parameter, of all hosts
+// without one, from every registered dialer and resolves them again.
+func flushDNS(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	host := req.URL.Query().Get("host")
+
+	results := make(map[string]*dnsFlushResult)
+	for _, d := range dialer.Dialers() {
+		hosts := []string{host}
+		if host == "" {
+			hosts = d.DNSHosts()
+		}
+
+		d.PurgeDNS(host)
+
+		for _, h := range hosts {
+			r, ok := results[h]
+			if !ok {
+				r = &dnsFlushResult{}
+				results[h] = r
+			}
+
+			ips, err := d.Resolve(h)
+			if err != nil {
+				r.Error = err.Error()
+				continue
+			}
+			for _, ip := range ips {
+				if s := ip.String(); !contains(r.Addrs, s) {
+					r.Addrs = append(r.Addrs, s)
+				}
+			}
+		}
+	}
+
+	glog.Infof("%s \"ADMIN %s %s %s\" flushed dns of %d hosts", req.RemoteAddr, req.Method, req.RequestURI, req.Proto, len(results))
+
+	rw.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+	enc.Encode(results)
+}
+
+func contains(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle registers an admin endpoint, it is served to AllowedNets only.
+func Handle(pattern string, handler http.Handler) {
+	mux.Handle(pattern, handler)
+}
+
+func HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	mux.HandleFunc(pattern, handler)
+}
+
+type Config struct {
+	AllowedNets []string
+}
+
+type Filter struct {
+	Config
+	AllowedNets []*net.IPNet
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.LookupStoreByConfig(filterName).UnmarshallJson(filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	err = filters.Register(filterName, &filters.RegisteredFilter{
+		New: func() (filters.Filter, error) {
+			return NewFilter(config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	f := &Filter{
+		Config:      *config,
+		AllowedNets: make([]*net.IPNet, 0),
+	}
+
+	for _, s := range config.AllowedNets {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		f.AllowedNets = append(f.AllowedNets, ipnet)
+	}
+
+	return f, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
+
+func (f *Filter) Allowed(remoteAddr string) bool {
+	// the socket permissions already decided for unix socket clients
+	if remoteAddr == helpers.UnixRemoteAddr {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipnet := range f.AllowedNets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	if req.URL.Host != "" || !strings.HasPrefix(req.RequestURI, "/") {
+		return ctx, nil, nil
+	}
+
+	if _, pattern := mux.Handler(req); pattern == "" {
+		return ctx, nil, nil
+	}
+
+	if !f.Allowed(req.RemoteAddr) {
+		glog.Warningf("%s \"ADMIN %s %s %s\" forbidden", req.RemoteAddr, req.Method, req.RequestURI, req.Proto)
+		filters.MarkRejection(ctx, http.StatusForbidden)
+		return ctx, filters.NewResponse(req, http.StatusForbidden, nil, nil), nil
+	}
+
+	glog.V(2).Infof("%s \"ADMIN %s %s %s\" - -", req.RemoteAddr, req.Method, req.RequestURI, req.Proto)
+	mux.ServeHTTP(filters.GetResponseWriter(ctx), req)
+
+	return ctx, filters.DummyResponse, nil
+}
@@ -0,0 +1,244 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+
+	"../../dialer"
+	"../../filters"
+	"../../helpers"
+)
+
+func TestRoundTripMetrics(t *testing.T) {
+	f, err := NewFilter(&Config{AllowedNets: []string{"127.0.0.1/32"}})
+	if err != nil {
+		t.Fatalf("NewFilter error: %v", err)
+	}
+
+	// the registry is process wide, so the counter is checked against its
+	// value before the Add
+	counter := helpers.Metrics.Counter("admin_test_total", "")
+	want := fmt.Sprintf("admin_test_total %d\n", counter.Value()+1)
+	counter.Add(1)
+
+	for remoteAddr, code := range map[string]int{"127.0.0.1:1234": http.StatusOK, "192.168.1.2:1234": http.StatusForbidden} {
+		req, _ := http.NewRequest(http.MethodGet, "/metrics", nil)
+		req.RequestURI = "/metrics"
+		req.RemoteAddr = remoteAddr
+
+		rw := filters.NewTestResponseWriter(nil)
+		_, resp, err := f.(*Filter).RoundTrip(filters.NewTestContext(rw), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip error: %v", f, err)
+		}
+
+		switch code {
+		case http.StatusOK:
+			if resp != filters.DummyResponse || !strings.Contains(rw.Body.String(), want) {
+				t.Errorf("%T.RoundTrip(%#v) return %#v, body %#v", f, remoteAddr, resp, rw.Body.String())
+			}
+		default:
+			if resp == nil || resp.StatusCode != code {
+				t.Errorf("%T.RoundTrip(%#v) return %#v, want status %d", f, remoteAddr, resp, code)
+			}
+		}
+	}
+}
+
+func TestRoundTripAltSvc(t *testing.T) {
+	f, err := NewFilter(&Config{AllowedNets: []string{"127.0.0.1/32"}})
+	if err != nil {
+		t.Fatalf("NewFilter error: %v", err)
+	}
+
+	helpers.AltSvc.Observe("example.org:443", `h2="alt.example.org:8443"; ma=60`)
+	defer helpers.AltSvc.Forget("example.org:443")
+
+	req, _ := http.NewRequest(http.MethodGet, "/debug/altsvc", nil)
+	req.RequestURI = "/debug/altsvc"
+	req.RemoteAddr = "127.0.0.1:1234"
+
+	rw := filters.NewTestResponseWriter(nil)
+	if _, _, err := f.(*Filter).RoundTrip(filters.NewTestContext(rw), req); err != nil {
+		t.Fatalf("%T.RoundTrip error: %v", f, err)
+	}
+
+	var stats map[string][]helpers.AltSvcEntry
+	if err := json.Unmarshal(rw.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("json.Unmarshal(%#v) error: %v", rw.Body.String(), err)
+	}
+	if a := stats["example.org:443"]; len(a) != 1 || a[0].Host != "alt.example.org" || a[0].Port != "8443" {
+		t.Errorf("/debug/altsvc of example.org:443 = %v, want h2 alt.example.org:8443", a)
+	}
+}
+
+type pipeDialer struct{}
+
+func (pipeDialer) Dial(network, address string) (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	c2.Close()
+	return c1, nil
+}
+
+func TestRoundTripFlushDNS(t *testing.T) {
+	f, err := NewFilter(&Config{AllowedNets: []string{"127.0.0.1/32"}})
+	if err != nil {
+		t.Fatalf("NewFilter error: %v", err)
+	}
+
+	d := &dialer.Dialer{Dialer: pipeDialer{}, DNSCache: lrucache.NewLRUCache(16)}
+	dialer.Register(d)
+
+	c, err := d.Dial("tcp", "localhost:443")
+	if err != nil {
+		t.Fatalf("Dialer.Dial() error: %v", err)
+	}
+	c.Close()
+	// the record changed since it was cached
+	d.DNSCache.Set("localhost:443", "192.0.2.1:443", time.Now().Add(time.Hour))
+
+	for method, code := range map[string]int{http.MethodGet: http.StatusMethodNotAllowed, http.MethodPost: http.StatusOK} {
+		req, _ := http.NewRequest(method, "/admin/dns/flush?host=localhost", nil)
+		req.RequestURI = "/admin/dns/flush?host=localhost"
+		req.RemoteAddr = "127.0.0.1:1234"
+
+		rw := filters.NewTestResponseWriter(nil)
+		if _, _, err := f.(*Filter).RoundTrip(filters.NewTestContext(rw), req); err != nil {
+			t.Fatalf("%T.RoundTrip error: %v", f, err)
+		}
+		if rw.Code != code {
+			t.Fatalf("%s /admin/dns/flush code = %d, want %d", method, rw.Code, code)
+		}
+		if code != http.StatusOK {
+			continue
+		}
+
+		var results map[string]struct{ Addrs []string }
+		if err := json.Unmarshal(rw.Body.Bytes(), &results); err != nil {
+			t.Fatalf("json.Unmarshal(%#v) error: %v", rw.Body.String(), err)
+		}
+		if addrs := results["localhost"].Addrs; len(addrs) == 0 {
+			t.Errorf("/admin/dns/flush of localhost = %s, want its addresses", rw.Body.String())
+		}
+	}
+
+	if v, ok := d.DNSCache.Get("localhost:443"); ok && v == "192.0.2.1:443" {
+		t.Errorf("/admin/dns/flush keeps the stale address of localhost:443")
+	}
+}
+
+func TestRoundTripFiltersEnabled(t *testing.T) {
+	f, err := NewFilter(&Config{AllowedNets: []string{"127.0.0.1/32"}})
+	if err != nil {
+		t.Fatalf("NewFilter error: %v", err)
+	}
+
+	filters.SetEnabled("admin_test", false)
+
+	var cases = []struct {
+		Method  string
+		URI     string
+		Code    int
+		Enabled bool
+	}{
+		{http.MethodPost, "/admin/filters/enabled?name=admin_test&enabled=true", http.StatusOK, true},
+		{http.MethodGet, "/admin/filters/enabled", http.StatusOK, true},
+		{http.MethodPost, "/admin/filters/enabled?name=admin_test&enabled=maybe", http.StatusBadRequest, true},
+		{http.MethodPost, "/admin/filters/enabled?name=missing&enabled=true", http.StatusNotFound, true},
+		{http.MethodPost, "/admin/filters/enabled?name=admin_test&enabled=false", http.StatusOK, false},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.Method, c.URI, nil)
+		req.RequestURI = c.URI
+		req.RemoteAddr = "127.0.0.1:1234"
+
+		rw := filters.NewTestResponseWriter(nil)
+		if _, _, err := f.(*Filter).RoundTrip(filters.NewTestContext(rw), req); err != nil {
+			t.Fatalf("%T.RoundTrip error: %v", f, err)
+		}
+		if rw.Code != c.Code {
+			t.Errorf("%s %s code = %d, want %d", c.Method, c.URI, rw.Code, c.Code)
+		}
+		if v := filters.Enabled("admin_test"); v != c.Enabled {
+			t.Errorf("%s %s leaves admin_test enabled = %v, want %v", c.Method, c.URI, v, c.Enabled)
+		}
+		if c.Code != http.StatusOK {
+			continue
+		}
+
+		var switches map[string]bool
+		if err := json.Unmarshal(rw.Body.Bytes(), &switches); err != nil {
+			t.Fatalf("json.Unmarshal(%#v) error: %v", rw.Body.String(), err)
+		}
+		if v, ok := switches["admin_test"]; !ok || v != c.Enabled {
+			t.Errorf("%s %s = %s, want admin_test %v", c.Method, c.URI, rw.Body.String(), c.Enabled)
+		}
+	}
+}
+
+func TestRoundTripUpstreamsDraining(t *testing.T) {
+	f, err := NewFilter(&Config{AllowedNets: []string{"127.0.0.1/32"}})
+	if err != nil {
+		t.Fatalf("NewFilter error: %v", err)
+	}
+
+	u := helpers.Upstreams.Get("socks5://admin-test:1080")
+	u.Begin()
+	defer u.SetDraining(false)
+
+	var cases = []struct {
+		Method   string
+		URI      string
+		Code     int
+		Draining bool
+		Drained  bool
+	}{
+		{http.MethodPost, "/admin/upstreams?name=socks5://admin-test:1080&draining=true", http.StatusOK, true, false},
+		{http.MethodGet, "/admin/upstreams", http.StatusOK, true, false},
+		{http.MethodPost, "/admin/upstreams?name=socks5://admin-test:1080&draining=maybe", http.StatusBadRequest, true, false},
+		{http.MethodPost, "/admin/upstreams?name=socks5://missing:1080&draining=true", http.StatusNotFound, true, false},
+		// its last session ends
+		{http.MethodGet, "/admin/upstreams", http.StatusOK, true, true},
+		{http.MethodPost, "/admin/upstreams?name=socks5://admin-test:1080&draining=false", http.StatusOK, false, false},
+	}
+
+	for i, c := range cases {
+		if i == 4 {
+			u.End()
+		}
+
+		req, _ := http.NewRequest(c.Method, c.URI, nil)
+		req.RequestURI = c.URI
+		req.RemoteAddr = "127.0.0.1:1234"
+
+		rw := filters.NewTestResponseWriter(nil)
+		if _, _, err := f.(*Filter).RoundTrip(filters.NewTestContext(rw), req); err != nil {
+			t.Fatalf("%T.RoundTrip error: %v", f, err)
+		}
+		if rw.Code != c.Code {
+			t.Errorf("%s %s code = %d, want %d", c.Method, c.URI, rw.Code, c.Code)
+		}
+		if u.Draining() != c.Draining {
+			t.Errorf("%s %s leaves the upstream draining = %v, want %v", c.Method, c.URI, u.Draining(), c.Draining)
+		}
+		if c.Code != http.StatusOK {
+			continue
+		}
+
+		var stats map[string]helpers.UpstreamStats
+		if err := json.Unmarshal(rw.Body.Bytes(), &stats); err != nil {
+			t.Fatalf("json.Unmarshal(%#v) error: %v", rw.Body.String(), err)
+		}
+		if s, ok := stats["socks5://admin-test:1080"]; !ok || s.Draining != c.Draining || s.Drained != c.Drained {
+			t.Errorf("%s %s = %s, want draining %v, drained %v", c.Method, c.URI, rw.Body.String(), c.Draining, c.Drained)
+		}
+	}
+}
@@ -96,9 +96,9 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 	}
 
 	if auth := filters.String(ctx, authHeader); auth != "" {
-		if _, ok := f.ByPassHeaders.Get(auth); ok {
+		if user, ok := f.ByPassHeaders.Get(auth); ok {
 			glog.V(3).Infof("auth filter hit bypass cache %#v", auth)
-			return ctx, nil, nil
+			return filters.WithString(ctx, filters.AuthUserKey, user.(string)), nil, nil
 		}
 		parts := strings.SplitN(auth, " ", 2)
 		if len(parts) == 2 {
@@ -110,8 +110,8 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 					pass := parts[1]
 					pass1, ok := f.Basic[user]
 					if ok && pass == pass1 {
-						f.ByPassHeaders.Set(auth, struct{}{}, time.Now().Add(time.Hour))
-						return ctx, nil, nil
+						f.ByPassHeaders.Set(auth, user, time.Now().Add(time.Hour))
+						return filters.WithString(ctx, filters.AuthUserKey, user), nil, nil
 					}
 				}
 			default:
@@ -123,13 +123,6 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 
 	glog.V(1).Infof("UnAuthenticated URL %v from %#v", req.URL.String(), req.RemoteAddr)
 
-	noAuthResponse := &http.Response{
-		StatusCode:    http.StatusProxyAuthRequired,
-		Header:        http.Header{},
-		Request:       req,
-		Close:         true,
-		ContentLength: -1,
-	}
-
-	return ctx, noAuthResponse, nil
+	filters.MarkRejection(ctx, http.StatusProxyAuthRequired)
+	return ctx, filters.NewResponse(req, http.StatusProxyAuthRequired, nil, nil), nil
 }
@@ -2,11 +2,15 @@ package autoproxy
 
 import (
 	"context"
+	"crypto/x509"
 	"io/ioutil"
 	"mime"
 	"net"
 	"net/http"
 	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -34,6 +38,26 @@ type Config struct {
 		DataFile     string
 		DNSCacheSize int
 		Rules        map[string]string
+		ASNDataFile  string
+		ASNRules     map[string]string
+	}
+	BodyFilters struct {
+		Enabled          bool
+		ChunkedBodyBytes int64
+		Rules            []struct {
+			Hosts        []string
+			MinBodyBytes int64
+			MaxBodyBytes int64
+			Filter       string
+		}
+	}
+	ClientCertFilters struct {
+		Enabled bool
+		Rules   []struct {
+			Subject string
+			SAN     string
+			Filter  string
+		}
 	}
 	IndexFiles struct {
 		Enabled bool
@@ -68,12 +92,66 @@ type GFWList struct {
 	Duration time.Duration
 }
 
+// BodyRule routes requests to Hosts whose body size is within
+// [MinBodyBytes, MaxBodyBytes] to Filter, a nil Filter rejects them.
+type BodyRule struct {
+	Hosts        *helpers.HostMatcher
+	MinBodyBytes int64
+	MaxBodyBytes int64
+	Filter       filters.RoundTripFilter
+}
+
+func (r *BodyRule) Match(host string, size int64) bool {
+	if size < r.MinBodyBytes || (r.MaxBodyBytes > 0 && size > r.MaxBodyBytes) {
+		return false
+	}
+	return r.Hosts == nil || r.Hosts.Match(host)
+}
+
+// ClientCertRule routes requests whose client cert matches Subject and SAN,
+// path.Match patterns with "" matching any, to Filter. Subject matches the
+// common name or the whole subject, SAN any DNS, email, ip or URI name.
+type ClientCertRule struct {
+	Subject string
+	SAN     string
+	Filter  filters.RoundTripFilter
+}
+
+func (r *ClientCertRule) Match(cert *x509.Certificate) bool {
+	if r.Subject != "" && !matchAny(r.Subject, cert.Subject.CommonName, cert.Subject.String()) {
+		return false
+	}
+	if r.SAN != "" {
+		names := append(append([]string(nil), cert.DNSNames...), cert.EmailAddresses...)
+		for _, ip := range cert.IPAddresses {
+			names = append(names, ip.String())
+		}
+		for _, u := range cert.URIs {
+			names = append(names, u.String())
+		}
+		if !matchAny(r.SAN, names...) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(pattern string, names ...string) bool {
+	for _, name := range names {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
 type Filter struct {
 	Config
 	Store                storage.Store
 	IndexFilesEnabled    bool
 	IndexFiles           map[string]struct{}
 	ProxyPacCache        lrucache.Cache
+	ProxyPacGeneration   uint32
 	GFWListEnabled       bool
 	GFWList              *GFWList
 	MobileConfigEnabled  bool
@@ -81,10 +159,16 @@ type Filter struct {
 	BlackListSiteMatcher *helpers.HostMatcher
 	SiteFiltersEnabled   bool
 	SiteFiltersRules     *helpers.HostMatcher
+	BodyFiltersEnabled   bool
+	BodyFiltersRules     []BodyRule
+	ClientCertEnabled    bool
+	ClientCertRules      []ClientCertRule
 	RegionFiltersEnabled bool
 	RegionFiltersRules   map[string]filters.RoundTripFilter
 	RegionLocator        *ip17mon.Locator
 	RegionFilterCache    lrucache.Cache
+	ASNDatabase          *helpers.MMDB
+	ASNRules             map[uint]filters.RoundTripFilter
 	Transport            *http.Transport
 }
 
@@ -146,6 +230,8 @@ func NewFilter(config *Config) (_ filters.Filter, err error) {
 		GFWList:              &gfwlist,
 		Transport:            transport,
 		SiteFiltersEnabled:   config.SiteFilters.Enabled,
+		BodyFiltersEnabled:   config.BodyFilters.Enabled,
+		ClientCertEnabled:    config.ClientCertFilters.Enabled,
 		RegionFiltersEnabled: config.RegionFilters.Enabled,
 	}
 
@@ -168,6 +254,44 @@ func NewFilter(config *Config) (_ filters.Filter, err error) {
 		f.SiteFiltersRules = helpers.NewHostMatcherWithValue(fm)
 	}
 
+	if f.BodyFiltersEnabled {
+		for _, rule := range config.BodyFilters.Rules {
+			r := BodyRule{
+				MinBodyBytes: rule.MinBodyBytes,
+				MaxBodyBytes: rule.MaxBodyBytes,
+			}
+			if len(rule.Hosts) > 0 {
+				r.Hosts = helpers.NewHostMatcher(rule.Hosts)
+			}
+			if rule.Filter != "" {
+				f, err := filters.GetFilter(rule.Filter)
+				if err != nil {
+					glog.Fatalf("AUTOPROXY: filters.GetFilter(%#v) for BodyFilters error: %v", rule.Filter, err)
+				}
+				f1, ok := f.(filters.RoundTripFilter)
+				if !ok {
+					glog.Fatalf("AUTOPROXY: filters.GetFilter(%#v) return %T, not a RoundTripFilter", rule.Filter, f)
+				}
+				r.Filter = f1
+			}
+			f.BodyFiltersRules = append(f.BodyFiltersRules, r)
+		}
+	}
+
+	if f.ClientCertEnabled {
+		for _, rule := range config.ClientCertFilters.Rules {
+			f1, err := filters.GetFilter(rule.Filter)
+			if err != nil {
+				glog.Fatalf("AUTOPROXY: filters.GetFilter(%#v) for ClientCertFilters error: %v", rule.Filter, err)
+			}
+			f2, ok := f1.(filters.RoundTripFilter)
+			if !ok {
+				glog.Fatalf("AUTOPROXY: filters.GetFilter(%#v) return %T, not a RoundTripFilter", rule.Filter, f1)
+			}
+			f.ClientCertRules = append(f.ClientCertRules, ClientCertRule{Subject: rule.Subject, SAN: rule.SAN, Filter: f2})
+		}
+	}
+
 	if f.RegionFiltersEnabled {
 		resp, err := store.Get(f.Config.RegionFilters.DataFile, -1, -1)
 		if err != nil {
@@ -200,6 +324,33 @@ func NewFilter(config *Config) (_ filters.Filter, err error) {
 		f.RegionFiltersRules = fm
 
 		f.RegionFilterCache = lrucache.NewLRUCache(uint(f.Config.RegionFilters.DNSCacheSize))
+
+		if name := config.RegionFilters.ASNDataFile; name != "" {
+			if db, err := openASNDatabase(store, name); err != nil {
+				glog.Warningf("AUTOPROXY: open ASN database %#v error: %v, ASN rules disabled", name, err)
+			} else {
+				f.ASNDatabase = db
+				glog.Infof("AUTOPROXY: ASN database %#v loaded, type %#v", name, db.DatabaseType())
+
+				am := make(map[uint]filters.RoundTripFilter)
+				for asn, name := range config.RegionFilters.ASNRules {
+					n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(asn), "AS"), 10, 32)
+					if err != nil {
+						glog.Fatalf("AUTOPROXY: invalid ASN %#v in ASNRules: %v", asn, err)
+					}
+					f, err := filters.GetFilter(name)
+					if err != nil {
+						glog.Fatalf("AUTOPROXY: filters.GetFilter(%#v) for AS%d error: %v", name, n, err)
+					}
+					f1, ok := f.(filters.RoundTripFilter)
+					if !ok {
+						glog.Fatalf("AUTOPROXY: filters.GetFilter(%#v) return %T, not a RoundTripFilter", name, f)
+					}
+					am[uint(n)] = f1
+				}
+				f.ASNRules = am
+			}
+		}
 	}
 
 	if f.GFWListEnabled {
@@ -231,6 +382,42 @@ func (f *Filter) FindCountryByIP(ip string) (string, error) {
 	return li.Country, nil
 }
 
+// openASNDatabase memory-maps a GeoLite2-ASN database from a file store and
+// reloads it when the file changes, other stores are read into memory once.
+func openASNDatabase(store storage.Store, name string) (*helpers.MMDB, error) {
+	if fs, ok := store.(*storage.FileStore); ok {
+		db, err := helpers.OpenMMDB(filepath.Join(fs.Dirname, name))
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			for range time.Tick(10 * time.Minute) {
+				if err := db.ReloadIfModified(); err != nil {
+					glog.Warningf("AUTOPROXY: reload ASN database %#v error: %v", name, err)
+				}
+			}
+		}()
+		return db, nil
+	}
+
+	resp, err := store.Get(name, -1, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return helpers.NewMMDB(data)
+}
+
+func (f *Filter) FindASNByIP(ip string) (uint, string, error) {
+	return f.ASNDatabase.LookupASN(net.ParseIP(ip))
+}
+
 func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
 	if strings.HasPrefix(req.RequestURI, "/") {
 		return ctx, req, nil
@@ -245,6 +432,39 @@ func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Contex
 		}
 	}
 
+	if f.ClientCertEnabled {
+		if state := filters.TLSState(ctx); state != nil && len(state.PeerCertificates) > 0 {
+			cert := state.PeerCertificates[0]
+			for _, r := range f.ClientCertRules {
+				if r.Match(cert) {
+					glog.V(2).Infof("%s \"AUTOPROXY ClientCertFilters %s %s %s\" %#v with %T", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, cert.Subject.CommonName, r.Filter)
+					filters.SetRoundTripFilter(ctx, r.Filter)
+					return ctx, req, nil
+				}
+			}
+		}
+	}
+
+	if f.BodyFiltersEnabled && req.Body != nil && req.Body != http.NoBody {
+		size := req.ContentLength
+		if size < 0 {
+			size = f.Config.BodyFilters.ChunkedBodyBytes
+		}
+		for _, r := range f.BodyFiltersRules {
+			if !r.Match(host, size) {
+				continue
+			}
+			if r.Filter == nil {
+				glog.V(2).Infof("%s \"AUTOPROXY BodyFilters %s %s %s\" %d rejected", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, req.ContentLength)
+				http.Error(filters.GetResponseWriter(ctx), "request body too large", http.StatusRequestEntityTooLarge)
+				return ctx, filters.DummyRequest, nil
+			}
+			glog.V(2).Infof("%s \"AUTOPROXY BodyFilters %s %s %s\" %d with %T", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, req.ContentLength, r.Filter)
+			filters.SetRoundTripFilter(ctx, r.Filter)
+			return ctx, req, nil
+		}
+	}
+
 	if f.SiteFiltersEnabled {
 		if f1, ok := f.SiteFiltersRules.Lookup(host); ok {
 			glog.V(2).Infof("%s \"AUTOPROXY SiteFilters %s %s %s\" with %T", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, f1)
@@ -259,7 +479,18 @@ func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Contex
 		} else if ips, err := net.LookupHost(host); err == nil {
 			ip := ips[0]
 
-			if strings.Contains(ip, ":") {
+			var asn uint
+			if f.ASNDatabase != nil {
+				if n, _, err := f.FindASNByIP(ip); err == nil {
+					asn = n
+				}
+			}
+
+			if f1, ok := f.ASNRules[asn]; ok && asn != 0 {
+				glog.V(2).Infof("%s \"AUTOPROXY RegionFilters AS%d %s %s %s\" with %T", req.RemoteAddr, asn, req.Method, req.URL.String(), req.Proto, f1)
+				f.RegionFilterCache.Set(host, f1, time.Now().Add(time.Hour))
+				filters.SetRoundTripFilter(ctx, f1)
+			} else if strings.Contains(ip, ":") {
 				if f1, ok := f.RegionFiltersRules["ipv6"]; ok {
 					glog.V(2).Infof("%s \"AUTOPROXY RegionFilters IPv6 %s %s %s\" with %T", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, f1)
 					f.RegionFilterCache.Set(host, f1, time.Now().Add(time.Hour))
@@ -302,13 +533,13 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 		if _, ok := f.IndexFiles[req.URL.Path[1:]]; ok || req.URL.Path == "/" {
 			switch {
 			case f.GFWListEnabled && strings.HasSuffix(req.URL.Path, ".pac"):
-				glog.V(2).Infof("%s \"AUTOPROXY ProxyPac %s %s %s\" - -", req.RemoteAddr, req.Method, req.RequestURI, req.Proto)
+				glog.V(2).Infof("%s \"AUTOPROXY ProxyPac %s %s %s\" - -%s", req.RemoteAddr, req.Method, req.RequestURI, req.Proto, requestIDField(ctx))
 				return f.ProxyPacRoundTrip(ctx, req)
 			case f.MobileConfigEnabled && strings.HasSuffix(req.URL.Path, ".mobileconfig"):
-				glog.V(2).Infof("%s \"AUTOPROXY ProxyMobileConfig %s %s %s\" - -", req.RemoteAddr, req.Method, req.RequestURI, req.Proto)
+				glog.V(2).Infof("%s \"AUTOPROXY ProxyMobileConfig %s %s %s\" - -%s", req.RemoteAddr, req.Method, req.RequestURI, req.Proto, requestIDField(ctx))
 				return f.ProxyMobileConfigRoundTrip(ctx, req)
 			default:
-				glog.V(2).Infof("%s \"AUTOPROXY IndexFiles %s %s %s\" - -", req.RemoteAddr, req.Method, req.RequestURI, req.Proto)
+				glog.V(2).Infof("%s \"AUTOPROXY IndexFiles %s %s %s\" - -%s", req.RemoteAddr, req.Method, req.RequestURI, req.Proto, requestIDField(ctx))
 				return f.IndexFilesRoundTrip(ctx, req)
 			}
 		}
@@ -316,3 +547,12 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 
 	return ctx, nil, nil
 }
+
+// requestIDField is the " request_id=" field of the access log lines of the
+// requests autoproxy answers itself, empty without a RequestIDKey.
+func requestIDField(ctx context.Context) string {
+	if id := filters.String(ctx, filters.RequestIDKey); id != "" {
+		return " request_id=" + id
+	}
+	return ""
+}
@@ -8,6 +8,8 @@ import (
 	"mime"
 	"net/http"
 	"path/filepath"
+
+	"../../filters"
 )
 
 func (f *Filter) IndexFilesRoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
@@ -41,16 +43,7 @@ func (f *Filter) IndexFilesRoundTrip(ctx context.Context, req *http.Request) (co
 			return ctx, nil, err
 		}
 
-		return ctx, &http.Response{
-			StatusCode: http.StatusOK,
-			Header: http.Header{
-				"Content-Type": []string{"text/html"},
-			},
-			Request:       req,
-			Close:         true,
-			ContentLength: int64(b.Len()),
-			Body:          ioutil.NopCloser(b),
-		}, nil
+		return ctx, filters.NewResponse(req, http.StatusOK, http.Header{"Content-Type": []string{"text/html"}}, b), nil
 	}
 
 	resp, err := f.Store.Get(filename, -1, -1)
@@ -69,14 +62,5 @@ func (f *Filter) IndexFilesRoundTrip(ctx context.Context, req *http.Request) (co
 		contentType = http.DetectContentType(data)
 	}
 
-	return ctx, &http.Response{
-		StatusCode: http.StatusOK,
-		Header: http.Header{
-			"Content-Type": []string{contentType},
-		},
-		Request:       req,
-		Close:         true,
-		ContentLength: int64(len(data)),
-		Body:          ioutil.NopCloser(bytes.NewReader(data)),
-	}, nil
+	return ctx, filters.NewResponse(req, http.StatusOK, http.Header{"Content-Type": []string{contentType}}, bytes.NewReader(data)), nil
 }
@@ -3,7 +3,9 @@ package autoproxy
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha1"
 	"encoding/base64"
 	"fmt"
 	"io"
@@ -15,6 +17,7 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/phuslu/glog"
@@ -31,15 +34,7 @@ func (f *Filter) ProxyPacRoundTrip(ctx context.Context, req *http.Request) (cont
 
 	if v, ok := f.ProxyPacCache.Get(req.RequestURI); ok {
 		if s, ok := v.(string); ok {
-			s = fixProxyPac(s, req)
-			return ctx, &http.Response{
-				StatusCode:    http.StatusOK,
-				Header:        http.Header{},
-				Request:       req,
-				Close:         true,
-				ContentLength: int64(len(s)),
-				Body:          ioutil.NopCloser(strings.NewReader(s)),
-			}, nil
+			return ctx, f.proxyPacResponse(req, fixProxyPac(s, req)), nil
 		}
 	}
 
@@ -132,17 +127,90 @@ function FindProxyForURL(url, host) {
 	s := buf.String()
 	f.ProxyPacCache.Set(req.RequestURI, s, time.Now().Add(15*time.Minute))
 
-	s = fixProxyPac(s, req)
-	resp = &http.Response{
+	return ctx, f.proxyPacResponse(req, fixProxyPac(s, req)), nil
+}
+
+// proxyPacResponse answers req with the pac s, under a strong ETag of its
+// content and the reload generation of the rules. Polling clients sending it
+// back in If-None-Match get a 304, the ones accepting gzip a gzipped body,
+// which has an ETag of its own.
+func (f *Filter) proxyPacResponse(req *http.Request, s string) *http.Response {
+	sum := sha1.Sum([]byte(s))
+	etag := fmt.Sprintf("%x-%x", atomic.LoadUint32(&f.ProxyPacGeneration), sum[:8])
+
+	gzipped := acceptsGzip(req.Header.Get("Accept-Encoding"))
+	if gzipped {
+		etag += "-gzip"
+	}
+	etag = `"` + etag + `"`
+
+	header := http.Header{}
+	header.Set("ETag", etag)
+	header.Set("Vary", "Accept-Encoding")
+
+	if etagMatch(req.Header.Get("If-None-Match"), etag) {
+		return &http.Response{
+			StatusCode: http.StatusNotModified,
+			Header:     header,
+			Request:    req,
+			Close:      true,
+			Body:       http.NoBody,
+		}
+	}
+
+	body := []byte(s)
+	if gzipped {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write(body)
+		w.Close()
+		body = buf.Bytes()
+		header.Set("Content-Encoding", "gzip")
+	}
+
+	return &http.Response{
 		StatusCode:    http.StatusOK,
-		Header:        http.Header{},
+		Header:        header,
 		Request:       req,
 		Close:         true,
-		ContentLength: int64(len(s)),
-		Body:          ioutil.NopCloser(strings.NewReader(s)),
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
 	}
+}
 
-	return ctx, resp, nil
+// reloadProxyPac drops the generated pacs after a change of their rules, and
+// moves their ETags to the next generation.
+func (f *Filter) reloadProxyPac() {
+	atomic.AddUint32(&f.ProxyPacGeneration, 1)
+	f.ProxyPacCache.Clear()
+}
+
+// acceptsGzip reports whether an Accept-Encoding value takes gzip, without a
+// q=0 for it.
+func acceptsGzip(s string) bool {
+	for _, v := range strings.Split(s, ",") {
+		coding, params := v, ""
+		if i := strings.IndexByte(v, ';'); i >= 0 {
+			coding, params = v[:i], v[i+1:]
+		}
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		q := strings.TrimSpace(params)
+		return !(strings.HasPrefix(q, "q=0") && strings.Trim(q[3:], ".0") == "")
+	}
+	return false
+}
+
+// etagMatch reports whether an If-None-Match value lists etag, or is "*".
+func etagMatch(s, etag string) bool {
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+			return true
+		}
+	}
+	return false
 }
 
 func (f *Filter) pacUpdater() {
@@ -218,7 +286,7 @@ func (f *Filter) pacUpdater() {
 			continue
 		}
 
-		f.ProxyPacCache.Clear()
+		f.reloadProxyPac()
 
 		glog.Infof("Update %#v from %#v OK", f.GFWList.Filename, f.GFWList.URL.String())
 		resp.Body.Close()
@@ -0,0 +1,236 @@
+package autoproxy
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+
+	"../../filters"
+	"../../helpers"
+	"../../storage"
+)
+
+type upstream string
+
+func (u upstream) FilterName() string {
+	return string(u)
+}
+
+func (u upstream) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	return ctx, nil, nil
+}
+
+func TestBodyFilters(t *testing.T) {
+	f := &Filter{
+		BodyFiltersEnabled: true,
+		BodyFiltersRules: []BodyRule{
+			{Hosts: helpers.NewHostMatcher([]string{"upload.example.org"}), MinBodyBytes: 1024, Filter: upstream("bulk")},
+			{MinBodyBytes: 1 << 20, Filter: nil},
+			{MaxBodyBytes: 1024, Filter: upstream("small")},
+		},
+	}
+	f.Config.BodyFilters.ChunkedBodyBytes = 1 << 30
+
+	cases := []struct {
+		Host     string
+		Body     io.Reader
+		Length   int64
+		Filter   string
+		Rejected bool
+	}{
+		{"upload.example.org", strings.NewReader(strings.Repeat("x", 100)), 100, "small", false},
+		{"upload.example.org", strings.NewReader(strings.Repeat("x", 4096)), 4096, "bulk", false},
+		{"www.example.org", strings.NewReader(strings.Repeat("x", 4096)), 4096, "", false},
+		{"www.example.org", strings.NewReader(strings.Repeat("x", 2<<20)), 2 << 20, "", true},
+		{"upload.example.org", strings.NewReader("chunked"), -1, "bulk", false},
+		{"www.example.org", strings.NewReader("chunked"), -1, "", true},
+		{"www.example.org", nil, 0, "", false},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(http.MethodPost, "http://"+c.Host+"/", c.Body)
+		req.ContentLength = c.Length
+
+		rw := filters.NewTestResponseWriter(nil)
+		ctx, req1, err := f.Request(filters.NewTestContext(rw), req)
+		if err != nil {
+			t.Fatalf("%T.Request(%s, %d) error: %v", f, c.Host, c.Length, err)
+		}
+
+		if rejected := req1 == filters.DummyRequest; rejected != c.Rejected {
+			t.Errorf("%T.Request(%s, %d) rejected = %v, want %v", f, c.Host, c.Length, rejected, c.Rejected)
+		}
+		if c.Rejected && rw.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%T.Request(%s, %d) status = %d, want %d", f, c.Host, c.Length, rw.Code, http.StatusRequestEntityTooLarge)
+		}
+
+		name := ""
+		if f1 := filters.GetRoundTripFilter(ctx); f1 != nil {
+			name = f1.FilterName()
+		}
+		if name != c.Filter {
+			t.Errorf("%T.Request(%s, %d) routed to %#v, want %#v", f, c.Host, c.Length, name, c.Filter)
+		}
+	}
+}
+
+// newClientCert returns a self signed client cert of cn with an URI SAN.
+func newClientCert(t *testing.T, cn, uri string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey error: %v", err)
+	}
+	u, _ := url.Parse(uri)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"Example"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		URIs:         []*url.URL{u},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate error: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate error: %v", err)
+	}
+	return cert
+}
+
+func TestClientCertFilters(t *testing.T) {
+	f := &Filter{
+		ClientCertEnabled: true,
+		ClientCertRules: []ClientCertRule{
+			{Subject: "team-a", Filter: upstream("upstream-a")},
+			{SAN: "spiffe://example.org/team-b/*", Filter: upstream("upstream-b")},
+		},
+	}
+
+	cases := []struct {
+		Cert   *x509.Certificate
+		Filter string
+	}{
+		{newClientCert(t, "team-a", "spiffe://example.org/team-a/web"), "upstream-a"},
+		{newClientCert(t, "build", "spiffe://example.org/team-b/ci"), "upstream-b"},
+		{newClientCert(t, "team-c", "spiffe://example.org/team-c/web"), ""},
+		{nil, ""},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(http.MethodGet, "http://www.example.org/", nil)
+
+		ctx := filters.NewTestContext(filters.NewTestResponseWriter(nil))
+		name := "plain"
+		if c.Cert != nil {
+			name = c.Cert.Subject.CommonName
+			ctx = filters.WithTLSState(ctx, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{c.Cert}})
+		}
+
+		ctx, _, err := f.Request(ctx, req)
+		if err != nil {
+			t.Fatalf("%T.Request(%s) error: %v", f, name, err)
+		}
+
+		filter := ""
+		if f1 := filters.GetRoundTripFilter(ctx); f1 != nil {
+			filter = f1.FilterName()
+		}
+		if filter != c.Filter {
+			t.Errorf("%T.Request(%s) routed to %#v, want %#v", f, name, filter, c.Filter)
+		}
+	}
+}
+
+func TestProxyPacETag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autoproxy")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %v", err)
+	}
+	defer ln.Close()
+
+	f := &Filter{
+		Store:         &storage.FileStore{Dirname: dir},
+		ProxyPacCache: lrucache.NewLRUCache(4),
+	}
+
+	get := func(header http.Header) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodGet, "/proxy.pac", nil)
+		req.RequestURI = "/proxy.pac"
+		req.Host = "127.0.0.1:8087"
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		ctx := filters.NewContext(context.Background(), nil, ln, filters.NewTestResponseWriter(nil))
+		_, resp, err := f.ProxyPacRoundTrip(ctx, req.WithContext(ctx))
+		if err != nil {
+			t.Fatalf("%T.ProxyPacRoundTrip(%v) error: %v", f, header, err)
+		}
+		defer resp.Body.Close()
+
+		var r io.Reader = resp.Body
+		if resp.Header.Get("Content-Encoding") == "gzip" {
+			if r, err = gzip.NewReader(resp.Body); err != nil {
+				t.Fatalf("gzip.NewReader error: %v", err)
+			}
+		}
+		b, _ := ioutil.ReadAll(r)
+		return resp, string(b)
+	}
+
+	resp, pac := get(nil)
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(pac, "FindProxyForURL") || !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("GET /proxy.pac = %d ETag %s %#v, want 200 with a strong ETag", resp.StatusCode, etag, pac)
+	}
+
+	resp, body := get(http.Header{"If-None-Match": {etag}})
+	if resp.StatusCode != http.StatusNotModified || body != "" || resp.Header.Get("ETag") != etag {
+		t.Errorf("GET /proxy.pac If-None-Match %s = %d ETag %s %#v, want 304", etag, resp.StatusCode, resp.Header.Get("ETag"), body)
+	}
+
+	// the gzipped pac is another representation
+	resp, body = get(http.Header{"Accept-Encoding": {"gzip"}, "If-None-Match": {etag}})
+	gzipETag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "gzip" || body != pac || gzipETag == etag {
+		t.Errorf("GET /proxy.pac gzip = %d %s ETag %s, want 200 gzip, the pac, another ETag", resp.StatusCode, resp.Header.Get("Content-Encoding"), gzipETag)
+	}
+	if resp, _ = get(http.Header{"Accept-Encoding": {"gzip"}, "If-None-Match": {gzipETag}}); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("GET /proxy.pac gzip If-None-Match %s = %d, want 304", gzipETag, resp.StatusCode)
+	}
+
+	// the same rules keep the ETag, a reload of them moves it
+	if resp, _ = get(nil); resp.Header.Get("ETag") != etag {
+		t.Errorf("GET /proxy.pac again ETag %s, want %s", resp.Header.Get("ETag"), etag)
+	}
+	f.reloadProxyPac()
+	resp, body = get(http.Header{"If-None-Match": {etag}})
+	if resp.StatusCode != http.StatusOK || body != pac || resp.Header.Get("ETag") == etag {
+		t.Errorf("GET /proxy.pac after a reload = %d ETag %s, want 200 with a new ETag", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+}
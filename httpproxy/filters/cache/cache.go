@@ -0,0 +1,369 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../helpers"
+	"../../storage"
+)
+
+const (
+	filterName string = "cache"
+
+	// DefaultCacheSize is the number of entries for a CacheSize of 0
+	DefaultCacheSize = 1024
+)
+
+type revalidateKey struct{}
+
+type Config struct {
+	CacheSize   int
+	MaxBodySize int64
+	// MaxStale is how many seconds a stale entry is kept for revalidation
+	MaxStale int
+	// MaxStaleOnError is how many seconds past its freshness a stale entry is
+	// served instead of a 5xx or unreachable upstream, 0 to disable
+	MaxStaleOnError int
+}
+
+type Filter struct {
+	Config
+	Cache           lrucache.Cache
+	MaxStale        time.Duration
+	MaxStaleOnError time.Duration
+}
+
+type entry struct {
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func (e *entry) fresh() bool {
+	return time.Now().Before(e.expires)
+}
+
+// revalidation is a stale entry being validated against the upstream, with
+// the conditionals the client sent itself.
+type revalidation struct {
+	key    string
+	entry  *entry
+	client http.Header
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.LookupStoreByConfig(filterName).UnmarshallJson(filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	err = filters.Register(filterName, &filters.RegisteredFilter{
+		New: func() (filters.Filter, error) {
+			return NewFilter(config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	cacheSize := config.CacheSize
+	switch {
+	case cacheSize < 0:
+		return nil, fmt.Errorf("CACHE: CacheSize %d is negative", cacheSize)
+	case cacheSize == 0:
+		cacheSize = DefaultCacheSize
+	}
+
+	f := &Filter{
+		Config:          *config,
+		Cache:           lrucache.NewLRUCache(uint(cacheSize)),
+		MaxStale:        time.Duration(config.MaxStale) * time.Second,
+		MaxStaleOnError: time.Duration(config.MaxStaleOnError) * time.Second,
+	}
+
+	// keep stale entries as long as they may be served
+	if f.MaxStale < f.MaxStaleOnError {
+		f.MaxStale = f.MaxStaleOnError
+	}
+
+	return f, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
+
+func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
+	if req.Method != http.MethodGet || req.Header.Get("Authorization") != "" || req.Header.Get("Range") != "" {
+		return ctx, req, nil
+	}
+
+	helpers.FixRequestURL(req)
+
+	key := req.URL.String()
+	v, ok := f.Cache.Get(key)
+	if !ok {
+		return ctx, req, nil
+	}
+	e := v.(*entry)
+
+	if e.fresh() && !noCache(req.Header) {
+		if notModified(req.Header, e.header) {
+			glog.V(2).Infof("%s \"CACHE %s %s %s\" 304 hit", req.RemoteAddr, req.Method, req.URL.String(), req.Proto)
+			writeResponse(filters.GetResponseWriter(ctx), http.StatusNotModified, notModifiedHeader(e.header), nil)
+		} else {
+			glog.V(2).Infof("%s \"CACHE %s %s %s\" 200 hit", req.RemoteAddr, req.Method, req.URL.String(), req.Proto)
+			writeResponse(filters.GetResponseWriter(ctx), http.StatusOK, e.header, e.body)
+		}
+		return ctx, filters.DummyRequest, nil
+	}
+
+	// validate the stale entry with our own validators, the client ones are
+	// checked against the entry afterwards
+	rv := &revalidation{key: key, entry: e, client: make(http.Header)}
+	for _, name := range []string{"If-None-Match", "If-Modified-Since"} {
+		if value := req.Header.Get(name); value != "" {
+			rv.client.Set(name, value)
+		}
+		req.Header.Del(name)
+	}
+	if etag := e.header.Get("Etag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lm := e.header.Get("Last-Modified"); lm != "" {
+		req.Header.Set("If-Modified-Since", lm)
+	}
+
+	glog.V(2).Infof("%s \"CACHE %s %s %s\" revalidate", req.RemoteAddr, req.Method, req.URL.String(), req.Proto)
+	return context.WithValue(ctx, revalidateKey{}, rv), req, nil
+}
+
+func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Context, *http.Response, error) {
+	req := resp.Request
+	if req == nil || req.Method != http.MethodGet {
+		return ctx, resp, nil
+	}
+
+	rv, ok := ctx.Value(revalidateKey{}).(*revalidation)
+
+	if ok && resp.StatusCode >= http.StatusInternalServerError && f.staleOnError(rv.entry) {
+		resp.Body.Close()
+		glog.Warningf("%s \"CACHE %s %s %s\" upstream %d, serves the entry stale for %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, resp.StatusCode, time.Since(rv.entry.expires))
+
+		header := cloneHeader(rv.entry.header)
+		header.Add("Warning", `110 - "Response is Stale"`)
+
+		if notModified(rv.client, header) {
+			h := notModifiedHeader(header)
+			h.Set("Warning", header.Get("Warning"))
+			return ctx, filters.NewResponse(req, http.StatusNotModified, h, nil), nil
+		}
+		return ctx, filters.NewResponse(req, http.StatusOK, header, bytes.NewReader(rv.entry.body)), nil
+	}
+
+	if ok && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+
+		header := cloneHeader(rv.entry.header)
+		for _, name := range []string{"Cache-Control", "Date", "Etag", "Expires", "Last-Modified"} {
+			if value := resp.Header.Get(name); value != "" {
+				header.Set(name, value)
+			}
+		}
+
+		e := &entry{header: header, body: rv.entry.body, expires: freshUntil(header)}
+		f.Cache.Set(rv.key, e, e.expires.Add(f.MaxStale))
+
+		if notModified(rv.client, header) {
+			return ctx, filters.NewResponse(req, http.StatusNotModified, notModifiedHeader(header), nil), nil
+		}
+		return ctx, filters.NewResponse(req, http.StatusOK, header, bytes.NewReader(e.body)), nil
+	}
+
+	if !f.storable(req, resp) {
+		return ctx, resp, nil
+	}
+
+	// later filters edit resp.Header for this client only
+	key := req.URL.String()
+	header := cloneHeader(resp.Header)
+	resp.Body = &captureReadCloser{
+		rc:          resp.Body,
+		max:         f.MaxBodySize,
+		reservation: helpers.Buffers.Reserve(),
+		done: func(body []byte) {
+			e := &entry{header: header, body: body, expires: freshUntil(header)}
+			f.Cache.Set(key, e, e.expires.Add(f.MaxStale))
+			glog.V(2).Infof("CACHE store %#v, %d bytes, fresh until %s", key, len(body), e.expires)
+		},
+	}
+
+	return ctx, resp, nil
+}
+
+func (f *Filter) storable(req *http.Request, resp *http.Response) bool {
+	if resp.StatusCode != http.StatusOK || req.Header.Get("Authorization") != "" || req.Header.Get("Range") != "" {
+		return false
+	}
+	if resp.ContentLength > f.MaxBodySize || resp.Header.Get("Vary") != "" {
+		return false
+	}
+	// cookies are for the client they were set for
+	if len(resp.Header["Set-Cookie"]) > 0 {
+		return false
+	}
+	if resp.Header.Get("Etag") == "" && resp.Header.Get("Last-Modified") == "" {
+		return false
+	}
+
+	cc := strings.ToLower(resp.Header.Get("Cache-Control"))
+	return !strings.Contains(cc, "no-store") && !strings.Contains(cc, "private")
+}
+
+// staleOnError reports whether e may stand in for a failed upstream, within
+// MaxStaleOnError and unless the upstream asked for must-revalidate.
+func (f *Filter) staleOnError(e *entry) bool {
+	if f.MaxStaleOnError <= 0 || time.Since(e.expires) > f.MaxStaleOnError {
+		return false
+	}
+	cc := strings.ToLower(e.header.Get("Cache-Control"))
+	return !strings.Contains(cc, "must-revalidate") && !strings.Contains(cc, "proxy-revalidate")
+}
+
+func cloneHeader(header http.Header) http.Header {
+	h := make(http.Header, len(header))
+	for key, values := range header {
+		h[key] = append([]string(nil), values...)
+	}
+	return h
+}
+
+func noCache(header http.Header) bool {
+	return strings.Contains(strings.ToLower(header.Get("Cache-Control")), "no-cache") || header.Get("Pragma") == "no-cache"
+}
+
+// freshUntil returns the freshness lifetime from Cache-Control or Expires, an
+// entry without any is stale at once and revalidated before use.
+func freshUntil(header http.Header) time.Time {
+	now := time.Now()
+
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-cache":
+			return now
+		case strings.HasPrefix(directive, "s-maxage="), strings.HasPrefix(directive, "max-age="):
+			if n, err := strconv.Atoi(directive[strings.IndexByte(directive, '=')+1:]); err == nil {
+				return now.Add(time.Duration(n) * time.Second)
+			}
+		}
+	}
+
+	if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		if date, err := http.ParseTime(header.Get("Date")); err == nil {
+			return now.Add(expires.Sub(date))
+		}
+		return expires
+	}
+
+	return now
+}
+
+// notModified reports whether the client conditionals in header match the
+// entry validators, If-None-Match taking precedence over If-Modified-Since.
+func notModified(header, entryHeader http.Header) bool {
+	if inm := header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(entryHeader.Get("Etag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims, err := http.ParseTime(header.Get("If-Modified-Since")); err == nil {
+		if lm, err := http.ParseTime(entryHeader.Get("Last-Modified")); err == nil {
+			return !lm.After(ims)
+		}
+	}
+
+	return false
+}
+
+func notModifiedHeader(header http.Header) http.Header {
+	h := make(http.Header)
+	for _, name := range []string{"Cache-Control", "Date", "Etag", "Expires", "Last-Modified", "Vary"} {
+		if value := header.Get(name); value != "" {
+			h.Set(name, value)
+		}
+	}
+	return h
+}
+
+func writeResponse(rw http.ResponseWriter, status int, header http.Header, body []byte) {
+	for key, values := range header {
+		rw.Header()[key] = values
+	}
+	if status == http.StatusOK {
+		rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	rw.WriteHeader(status)
+	rw.Write(body)
+}
+
+// captureReadCloser passes the body through and hands its copy to done at
+// io.EOF, unless it grows larger than max or than reservation allows.
+type captureReadCloser struct {
+	rc          io.ReadCloser
+	buf         bytes.Buffer
+	max         int64
+	reservation *helpers.BufferReservation
+	done        func([]byte)
+	skip        bool
+}
+
+func (r *captureReadCloser) Read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	if !r.skip {
+		if int64(r.buf.Len()+n) > r.max || !r.reservation.Grow(int64(n)) {
+			r.skip = true
+			r.buf = bytes.Buffer{}
+			r.reservation.Release()
+		} else {
+			r.buf.Write(p[:n])
+		}
+		if err == io.EOF && !r.skip {
+			r.skip = true
+			// the cache is bounded by CacheSize itself
+			r.reservation.Release()
+			r.done(r.buf.Bytes())
+		}
+	}
+	return n, err
+}
+
+func (r *captureReadCloser) Close() error {
+	r.reservation.Release()
+	return r.rc.Close()
+}
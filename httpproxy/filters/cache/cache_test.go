@@ -0,0 +1,262 @@
+package cache
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"../../filters"
+	"../../helpers"
+)
+
+const testURL = "http://example.org/a.js"
+
+func newTestFilter(t *testing.T) *Filter {
+	f, err := NewFilter(&Config{CacheSize: 16, MaxBodySize: 1024, MaxStale: 60})
+	if err != nil {
+		t.Fatalf("NewFilter error: %v", err)
+	}
+	return f.(*Filter)
+}
+
+func TestNewFilterCacheSize(t *testing.T) {
+	f, err := NewFilter(&Config{MaxBodySize: 1024})
+	if err != nil {
+		t.Fatalf("NewFilter without a CacheSize error: %v", err)
+	}
+	if n := f.(*Filter).Cache.Capacity(); n != DefaultCacheSize {
+		t.Errorf("NewFilter without a CacheSize holds %d entries, want %d", n, DefaultCacheSize)
+	}
+
+	if _, err := NewFilter(&Config{CacheSize: -1}); err == nil {
+		t.Errorf("NewFilter with a negative CacheSize returns no error")
+	}
+}
+
+// store passes a response from the upstream through f and reads it fully.
+func store(t *testing.T, f *Filter, header http.Header, body string) {
+	req, _ := http.NewRequest(http.MethodGet, testURL, nil)
+	resp := filters.NewResponse(req, http.StatusOK, header, strings.NewReader(body))
+
+	_, resp, err := f.Response(context.Background(), resp)
+	if err != nil {
+		t.Fatalf("%T.Response() error: %v", f, err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+}
+
+func request(t *testing.T, f *Filter, ctx context.Context, header http.Header) (context.Context, *http.Request) {
+	req, _ := http.NewRequest(http.MethodGet, testURL, nil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	ctx, req, err := f.Request(ctx, req)
+	if err != nil {
+		t.Fatalf("%T.Request() error: %v", f, err)
+	}
+	return ctx, req
+}
+
+func TestRequestConditional(t *testing.T) {
+	f := newTestFilter(t)
+	store(t, f, http.Header{
+		"Etag":          {`"v1"`},
+		"Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT"},
+		"Cache-Control": {"max-age=60"},
+	}, "hello")
+
+	var cases = []struct {
+		header http.Header
+		code   int
+		body   string
+	}{
+		{http.Header{"If-None-Match": {`"v0", "v1"`}}, http.StatusNotModified, ""},
+		{http.Header{"If-None-Match": {`W/"v1"`}}, http.StatusNotModified, ""},
+		{http.Header{"If-None-Match": {`"v2"`}}, http.StatusOK, "hello"},
+		{http.Header{"If-None-Match": {`"v2"`}, "If-Modified-Since": {"Mon, 02 Jan 2006 15:04:05 GMT"}}, http.StatusOK, "hello"},
+		{http.Header{"If-Modified-Since": {"Tue, 03 Jan 2006 15:04:05 GMT"}}, http.StatusNotModified, ""},
+		{http.Header{"If-Modified-Since": {"Sun, 01 Jan 2006 15:04:05 GMT"}}, http.StatusOK, "hello"},
+		{http.Header{}, http.StatusOK, "hello"},
+	}
+
+	for _, c := range cases {
+		rw := filters.NewTestResponseWriter(nil)
+		_, req := request(t, f, filters.NewTestContext(rw), c.header)
+
+		if req != filters.DummyRequest {
+			t.Fatalf("%T.Request(%v) does not answer from cache", f, c.header)
+		}
+		if rw.Code != c.code || rw.Body.String() != c.body {
+			t.Errorf("%T.Request(%v) answers %d %#v, want %d %#v", f, c.header, rw.Code, rw.Body.String(), c.code, c.body)
+		}
+		if rw.Header().Get("Etag") != `"v1"` {
+			t.Errorf("%T.Request(%v) answers Etag %#v", f, c.header, rw.Header().Get("Etag"))
+		}
+	}
+}
+
+func TestRequestRevalidate(t *testing.T) {
+	f := newTestFilter(t)
+	store(t, f, http.Header{"Etag": {`"v1"`}}, "hello")
+
+	for _, c := range []struct {
+		inm  string
+		code int
+		body string
+	}{
+		{"", http.StatusOK, "hello"},
+		{`"v1"`, http.StatusNotModified, ""},
+		{`"v0"`, http.StatusOK, "hello"},
+	} {
+		header := http.Header{}
+		if c.inm != "" {
+			header.Set("If-None-Match", c.inm)
+		}
+
+		ctx, req := request(t, f, context.Background(), header)
+		if req == filters.DummyRequest {
+			t.Fatalf("%T.Request() answers a stale entry without revalidation", f)
+		}
+		if inm := req.Header.Get("If-None-Match"); inm != `"v1"` {
+			t.Fatalf("%T.Request() revalidates with If-None-Match %#v, want %#v", f, inm, `"v1"`)
+		}
+
+		upstream := filters.NewResponse(req, http.StatusNotModified, http.Header{"Etag": {`"v1"`}, "Cache-Control": {"max-age=0"}}, nil)
+		_, resp, err := f.Response(ctx, upstream)
+		if err != nil {
+			t.Fatalf("%T.Response() error: %v", f, err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != c.code || string(b) != c.body {
+			t.Errorf("%T.Response() to If-None-Match %#v returns %d %#v, want %d %#v", f, c.inm, resp.StatusCode, string(b), c.code, c.body)
+		}
+	}
+}
+
+func TestResponseNotStorable(t *testing.T) {
+	f := newTestFilter(t)
+
+	for _, header := range []http.Header{
+		{},
+		{"Etag": {`"v1"`}, "Cache-Control": {"max-age=60, no-store"}},
+		{"Etag": {`"v1"`}, "Cache-Control": {"private, max-age=60"}},
+		{"Etag": {`"v1"`}, "Vary": {"Cookie"}},
+		{"Etag": {`"v1"`}, "Cache-Control": {"max-age=60"}, "Set-Cookie": {"session=42"}},
+	} {
+		store(t, f, header, "hello")
+		if f.Cache.Len() != 0 {
+			t.Errorf("%T stores a response with header %v", f, header)
+			f.Cache.Clear()
+		}
+	}
+
+	store(t, f, http.Header{"Etag": {`"v1"`}}, strings.Repeat("x", 2048))
+	if f.Cache.Len() != 0 {
+		t.Errorf("%T stores a body over MaxBodySize", f)
+	}
+}
+
+func TestResponseStoresHeaderCopy(t *testing.T) {
+	f := newTestFilter(t)
+
+	req, _ := http.NewRequest(http.MethodGet, testURL, nil)
+	resp := filters.NewResponse(req, http.StatusOK, http.Header{"Etag": {`"v1"`}, "Cache-Control": {"max-age=60"}}, strings.NewReader("hello"))
+	_, resp, err := f.Response(context.Background(), resp)
+	if err != nil {
+		t.Fatalf("%T.Response() error: %v", f, err)
+	}
+	// a later filter edits the response of this client
+	resp.Header.Set("X-Client", "alice")
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	v, ok := f.Cache.Get(testURL)
+	if !ok {
+		t.Fatalf("%T.Response() does not store %#v", f, testURL)
+	}
+	if value := v.(*entry).header.Get("X-Client"); value != "" {
+		t.Errorf("%T stored entry has X-Client %#v set after Response", f, value)
+	}
+}
+
+func TestResponseBufferMemoryExhausted(t *testing.T) {
+	helpers.Buffers.SetMax(4)
+	defer helpers.Buffers.SetMax(0)
+
+	f := newTestFilter(t)
+
+	req, _ := http.NewRequest(http.MethodGet, testURL, nil)
+	resp := filters.NewResponse(req, http.StatusOK, http.Header{"Etag": {`"v1"`}, "Cache-Control": {"max-age=60"}}, strings.NewReader("hello world"))
+	_, resp, err := f.Response(context.Background(), resp)
+	if err != nil {
+		t.Fatalf("%T.Response() error: %v", f, err)
+	}
+	if b, _ := ioutil.ReadAll(resp.Body); string(b) != "hello world" {
+		t.Errorf("%T.Response() without buffer memory passes %#v, want %#v", f, string(b), "hello world")
+	}
+	resp.Body.Close()
+
+	if _, ok := f.Cache.Get(testURL); ok {
+		t.Errorf("%T.Response() without buffer memory still stores %#v", f, testURL)
+	}
+	if v := helpers.Buffers.InUse(); v != 0 {
+		t.Errorf("helpers.Buffers.InUse() = %d, want 0", v)
+	}
+}
+
+func TestResponseStaleOnError(t *testing.T) {
+	f, err := NewFilter(&Config{CacheSize: 16, MaxBodySize: 1024, MaxStaleOnError: 60})
+	if err != nil {
+		t.Fatalf("NewFilter error: %v", err)
+	}
+
+	for _, c := range []struct {
+		cc     string
+		status int
+		code   int
+		body   string
+	}{
+		{"max-age=0", http.StatusBadGateway, http.StatusOK, "hello"},
+		{"max-age=0", http.StatusServiceUnavailable, http.StatusOK, "hello"},
+		{"max-age=0", http.StatusNotFound, http.StatusNotFound, "upstream"},
+		{"max-age=0, must-revalidate", http.StatusBadGateway, http.StatusBadGateway, "upstream"},
+	} {
+		f.(*Filter).Cache.Clear()
+		store(t, f.(*Filter), http.Header{"Etag": {`"v1"`}, "Cache-Control": {c.cc}}, "hello")
+
+		ctx, req := request(t, f.(*Filter), context.Background(), http.Header{})
+		if req == filters.DummyRequest {
+			t.Fatalf("%T.Request() answers a stale entry without revalidation", f)
+		}
+
+		upstream := filters.NewResponse(req, c.status, http.Header{}, strings.NewReader("upstream"))
+		_, resp, err := f.(*Filter).Response(ctx, upstream)
+		if err != nil {
+			t.Fatalf("%T.Response() error: %v", f, err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != c.code || string(b) != c.body {
+			t.Errorf("%T.Response() of %s upstream %d returns %d %#v, want %d %#v", f, c.cc, c.status, resp.StatusCode, string(b), c.code, c.body)
+		}
+		if stale := resp.Header.Get("Warning") != ""; stale != (c.body == "hello") {
+			t.Errorf("%T.Response() of %s upstream %d returns Warning %#v", f, c.cc, c.status, resp.Header.Get("Warning"))
+		}
+	}
+
+	// outside MaxStaleOnError the upstream error goes through
+	f.(*Filter).MaxStaleOnError = time.Millisecond
+	f.(*Filter).Cache.Clear()
+	store(t, f.(*Filter), http.Header{"Etag": {`"v1"`}, "Cache-Control": {"max-age=0"}}, "hello")
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, req := request(t, f.(*Filter), context.Background(), http.Header{})
+	_, resp, _ := f.(*Filter).Response(ctx, filters.NewResponse(req, http.StatusBadGateway, http.Header{}, nil))
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("%T.Response() serves an entry stale beyond MaxStaleOnError, status %d", f, resp.StatusCode)
+	}
+}
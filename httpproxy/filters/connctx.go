@@ -0,0 +1,120 @@
+package filters
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// A ClientConn is the state filters keep for one inbound connection, shared
+// by every request on it, e.g. the upstream its requests are pinned to.
+type ClientConn struct {
+	mu      sync.Mutex
+	values  map[interface{}]interface{}
+	onClose []func()
+	closed  bool
+}
+
+func (c *ClientConn) Value(key interface{}) interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key]
+}
+
+// LoadOrStore returns the value of key, storing the one fn returns first if
+// there is none yet. fn runs with c locked.
+func (c *ClientConn) LoadOrStore(key interface{}, fn func() interface{}) interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if v, ok := c.values[key]; ok {
+		return v
+	}
+	v := fn()
+	if c.values == nil {
+		c.values = make(map[interface{}]interface{})
+	}
+	c.values[key] = v
+	return v
+}
+
+// OnClose runs fn once the inbound connection is closed or hijacked, at once
+// if it already is.
+func (c *ClientConn) OnClose(fn func()) {
+	c.mu.Lock()
+	if !c.closed {
+		c.onClose = append(c.onClose, fn)
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+	fn()
+}
+
+func (c *ClientConn) close() {
+	c.mu.Lock()
+	c.closed = true
+	fns := c.onClose
+	c.onClose = nil
+	c.values = nil
+	c.mu.Unlock()
+
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// ClientConns tracks the ClientConn of each inbound connection by its remote
+// address. Its ConnState method is the http.Server hook which drops them.
+type ClientConns struct {
+	mu    sync.Mutex
+	conns map[string]*ClientConn
+}
+
+func NewClientConns() *ClientConns {
+	return &ClientConns{conns: make(map[string]*ClientConn)}
+}
+
+// Get returns the ClientConn of the inbound connection from remoteAddr.
+func (cs *ClientConns) Get(remoteAddr string) *ClientConn {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	c, ok := cs.conns[remoteAddr]
+	if !ok {
+		c = &ClientConn{}
+		cs.conns[remoteAddr] = c
+	}
+	return c
+}
+
+func (cs *ClientConns) ConnState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateClosed, http.StateHijacked:
+	default:
+		return
+	}
+
+	cs.mu.Lock()
+	c, ok := cs.conns[conn.RemoteAddr().String()]
+	delete(cs.conns, conn.RemoteAddr().String())
+	cs.mu.Unlock()
+
+	if ok {
+		c.close()
+	}
+}
+
+type clientConnKey struct{}
+
+func WithClientConn(ctx context.Context, c *ClientConn) context.Context {
+	return context.WithValue(ctx, clientConnKey{}, c)
+}
+
+// GetClientConn returns the ClientConn of the inbound connection of ctx, nil
+// if it is not tracked, e.g. for unix socket clients which share one address.
+func GetClientConn(ctx context.Context) *ClientConn {
+	c, _ := ctx.Value(clientConnKey{}).(*ClientConn)
+	return c
+}
@@ -0,0 +1,58 @@
+package filters
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestClientConns(t *testing.T) {
+	conns := NewClientConns()
+
+	c := conns.Get("192.0.2.1:1000")
+	if conns.Get("192.0.2.1:1000") != c {
+		t.Fatalf("ClientConns.Get() returns another ClientConn for the same connection")
+	}
+
+	n := 0
+	v := c.LoadOrStore("key", func() interface{} { n++; return n })
+	if v1 := c.LoadOrStore("key", func() interface{} { n++; return n }); v1 != v || n != 1 {
+		t.Errorf("ClientConn.LoadOrStore() = %v after %v, fn ran %d times", v1, v, n)
+	}
+
+	// other states keep the connection
+	conns.ConnState(testConn{addr: "192.0.2.1:1000"}, http.StateIdle)
+	if c.Value("key") != v {
+		t.Fatalf("ClientConn closed before its connection")
+	}
+
+	closed := 0
+	for _, state := range []http.ConnState{http.StateHijacked, http.StateClosed} {
+		closed = 0
+		c = conns.Get("192.0.2.1:1000")
+		c.OnClose(func() { closed++ })
+		conns.ConnState(testConn{addr: "192.0.2.1:1000"}, state)
+		if closed != 1 || c.Value("key") != nil {
+			t.Errorf("ClientConn after %s ran OnClose %d times, has value %v", state, closed, c.Value("key"))
+		}
+		if conns.Get("192.0.2.1:1000") == c {
+			t.Errorf("ClientConns.Get() after %s returns the closed ClientConn", state)
+		}
+	}
+
+	// a closed ClientConn runs OnClose at once
+	c.OnClose(func() { closed++ })
+	if closed != 2 {
+		t.Errorf("ClientConn.OnClose() of a closed ClientConn does not run")
+	}
+}
+
+type testConn struct {
+	net.Conn
+	addr string
+}
+
+func (c testConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.addr)
+	return addr
+}
@@ -0,0 +1,126 @@
+package contenttypeacl
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../helpers"
+	"../../storage"
+)
+
+const (
+	filterName string = "contenttypeacl"
+)
+
+type Rule struct {
+	Hosts []string
+	// ContentTypes are media types without parameters, "type/*" for all
+	// the subtypes of type
+	ContentTypes []string
+}
+
+type Config struct {
+	Rules []Rule
+}
+
+type acl struct {
+	types map[string]struct{}
+}
+
+type Filter struct {
+	Config
+	ACLs *helpers.HostMatcher
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.LookupStoreByConfig(filterName).UnmarshallJson(filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	err = filters.Register(filterName, &filters.RegisteredFilter{
+		New: func() (filters.Filter, error) {
+			return NewFilter(config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	acls := make(map[string]interface{})
+	for _, rule := range config.Rules {
+		a := &acl{
+			types: make(map[string]struct{}),
+		}
+		for _, t := range rule.ContentTypes {
+			a.types[strings.ToLower(strings.TrimSpace(t))] = struct{}{}
+		}
+
+		for _, host := range rule.Hosts {
+			acls[host] = a
+		}
+	}
+
+	return &Filter{
+		Config: *config,
+		ACLs:   helpers.NewHostMatcherWithValue(acls),
+	}, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
+
+// allowed reports whether the media type of contentType is in a.
+func (a *acl) allowed(contentType string) bool {
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if _, ok := a.types[mediatype]; ok {
+		return true
+	}
+	if i := strings.IndexByte(mediatype, '/'); i > 0 {
+		_, ok := a.types[mediatype[:i]+"/*"]
+		return ok
+	}
+	return false
+}
+
+// Request answers 415 to requests to matching hosts with a Content-Type not
+// allowed, or a body without one. CONNECT tunnels are exempt.
+func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
+	if req.Method == http.MethodConnect {
+		return ctx, req, nil
+	}
+
+	v, ok := f.ACLs.Lookup(helpers.GetHostName(req))
+	if !ok {
+		return ctx, req, nil
+	}
+
+	contentType := req.Header.Get("Content-Type")
+	if contentType == "" {
+		if req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 {
+			return ctx, req, nil
+		}
+	} else if v.(*acl).allowed(contentType) {
+		return ctx, req, nil
+	}
+
+	glog.V(2).Infof("%s \"CONTENTTYPEACL %s %s %s\" Content-Type %#v not allowed", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, contentType)
+
+	rw := filters.GetResponseWriter(ctx)
+	http.Error(rw, "unsupported media type", http.StatusUnsupportedMediaType)
+	return ctx, filters.DummyRequest, nil
+}
@@ -0,0 +1,74 @@
+package contenttypeacl
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"../../filters"
+)
+
+func TestRequest(t *testing.T) {
+	f, err := NewFilter(&Config{
+		Rules: []Rule{
+			{
+				Hosts:        []string{"api.example.com"},
+				ContentTypes: []string{"application/json"},
+			},
+			{
+				Hosts:        []string{"*.example.org"},
+				ContentTypes: []string{"Text/*", "application/x-www-form-urlencoded"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewFilter error: %v", err)
+	}
+
+	cases := []struct {
+		method      string
+		url         string
+		contentType string
+		body        string
+		code        int
+	}{
+		{http.MethodPost, "http://api.example.com/v1", "application/json", "{}", http.StatusOK},
+		{http.MethodPost, "http://api.example.com/v1", "application/json; charset=utf-8", "{}", http.StatusOK},
+		{http.MethodPost, "http://api.example.com/v1", "APPLICATION/JSON ; charset=\"utf-8\"", "{}", http.StatusOK},
+		{http.MethodPost, "http://api.example.com/v1", "application/xml", "<a/>", http.StatusUnsupportedMediaType},
+		{http.MethodPost, "http://api.example.com/v1", "application/json; charset", "{}", http.StatusUnsupportedMediaType},
+		{http.MethodPost, "http://api.example.com/v1", "", "{}", http.StatusUnsupportedMediaType},
+		{http.MethodGet, "http://api.example.com/v1", "", "", http.StatusOK},
+		{http.MethodConnect, "https://api.example.com:443", "application/xml", "", http.StatusOK},
+		{http.MethodPut, "http://www.example.org/", "text/plain; charset=utf-8", "hi", http.StatusOK},
+		{http.MethodPut, "http://www.example.org/", "application/x-www-form-urlencoded", "a=1", http.StatusOK},
+		{http.MethodPut, "http://www.example.org/", "image/png", "png", http.StatusUnsupportedMediaType},
+		{http.MethodPost, "http://other.example.net/", "image/png", "png", http.StatusOK},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, c.url, strings.NewReader(c.body))
+		if c.body == "" {
+			req, _ = http.NewRequest(c.method, c.url, nil)
+		}
+		if c.contentType != "" {
+			req.Header.Set("Content-Type", c.contentType)
+		}
+
+		rw := filters.NewTestResponseWriter(nil)
+		_, req1, err := f.(*Filter).Request(filters.NewTestContext(rw), req)
+		if err != nil {
+			t.Fatalf("%T.Request(%s %s) error: %v", f, c.method, c.url, err)
+		}
+
+		if c.code == http.StatusOK {
+			if req1 != req {
+				t.Errorf("%T.Request(%s %s Content-Type %#v) blocked with %d", f, c.method, c.url, c.contentType, rw.Code)
+			}
+			continue
+		}
+		if req1 != filters.DummyRequest || rw.Code != c.code {
+			t.Errorf("%T.Request(%s %s Content-Type %#v) code = %d, want %d", f, c.method, c.url, c.contentType, rw.Code, c.code)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package deadletter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../helpers"
+	"../../storage"
+)
+
+const (
+	filterName string = "deadletter"
+	bodyKey    string = filterName + "/body"
+)
+
+type Config struct {
+	File           string
+	MaxFileSize    int64
+	RateLimit      int
+	IncludeConnect bool
+	IncludeBody    bool
+	MaxBodySize    int
+	ScrubHeaders   []string
+}
+
+// Record is one line of the dead-letter file.
+type Record struct {
+	Time       time.Time
+	RemoteAddr string
+	Method     string
+	URL        string
+	Proto      string
+	Header     http.Header
+	Body       []byte `json:",omitempty"`
+	StatusCode int
+	Error      string
+}
+
+type Filter struct {
+	Config
+	Sink io.Writer
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	window  time.Time
+	written int
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.LookupStoreByConfig(filterName).UnmarshallJson(filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	err = filters.Register(filterName, &filters.RegisteredFilter{
+		New: func() (filters.Filter, error) {
+			return NewFilter(config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	f := &Filter{
+		Config: *config,
+	}
+
+	if config.File != "" {
+		if err := f.open(); err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
+
+func (f *Filter) open() error {
+	file, err := os.OpenFile(f.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = fi.Size()
+	f.Sink = file
+	return nil
+}
+
+// capture keeps the first max bytes of a request body until its Response,
+// less if helpers.Buffers runs out.
+type capture struct {
+	buf         bytes.Buffer
+	max         int
+	reservation *helpers.BufferReservation
+}
+
+type captureReadCloser struct {
+	io.ReadCloser
+	c *capture
+}
+
+func (r *captureReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	c := r.c
+	if m := c.max - c.buf.Len(); m > 0 {
+		if m > n {
+			m = n
+		}
+		if c.reservation.Grow(int64(m)) {
+			c.buf.Write(p[:m])
+		} else {
+			c.max = c.buf.Len()
+		}
+	}
+	return n, err
+}
+
+func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
+	if f.IncludeBody && req.Body != nil && req.Body != http.NoBody {
+		c := &capture{max: f.MaxBodySize, reservation: helpers.Buffers.Reserve()}
+		req.Body = &captureReadCloser{req.Body, c}
+		ctx = context.WithValue(ctx, bodyKey, c)
+		// Response is skipped for hijacked and dummy responses
+		if done := req.Context().Done(); done != nil {
+			go func() {
+				<-done
+				c.reservation.Release()
+			}()
+		}
+	}
+
+	return ctx, req, nil
+}
+
+func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Context, *http.Response, error) {
+	c, _ := ctx.Value(bodyKey).(*capture)
+	if c != nil {
+		defer c.reservation.Release()
+	}
+
+	reason := filters.String(ctx, filters.RoundTripErrorKey)
+	if reason == "" || resp.Request == nil {
+		return ctx, resp, nil
+	}
+
+	req := resp.Request
+	if req.Method == "CONNECT" && !f.IncludeConnect {
+		return ctx, resp, nil
+	}
+
+	header := make(http.Header, len(req.Header))
+	for key, values := range req.Header {
+		header[key] = values
+	}
+	for _, key := range f.ScrubHeaders {
+		if _, ok := header[http.CanonicalHeaderKey(key)]; ok {
+			header.Set(key, "-")
+		}
+	}
+
+	r := &Record{
+		Time:       time.Now(),
+		RemoteAddr: req.RemoteAddr,
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		Proto:      req.Proto,
+		Header:     header,
+		StatusCode: resp.StatusCode,
+		Error:      reason,
+	}
+	if c != nil {
+		r.Body = c.buf.Bytes()
+	}
+
+	if err := f.write(r); err != nil {
+		glog.Warningf("%s \"DEADLETTER %s %s %s\" error: %v", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, err)
+	}
+
+	return ctx, resp, nil
+}
+
+// write appends r to Sink, dropping records above RateLimit per second and
+// rotating File to File.1 once it grows over MaxFileSize.
+func (f *Filter) write(r *Record) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Sink == nil {
+		return nil
+	}
+
+	if now := time.Now().Truncate(time.Second); now != f.window {
+		f.window = now
+		f.written = 0
+	}
+	if f.RateLimit > 0 && f.written >= f.RateLimit {
+		return nil
+	}
+	f.written++
+
+	if f.file != nil && f.MaxFileSize > 0 && f.size+int64(len(b)) > f.MaxFileSize {
+		f.file.Close()
+		if err := os.Rename(f.File, f.File+".1"); err != nil {
+			glog.Warningf("DEADLETTER: os.Rename(%#v) error: %v", f.File, err)
+		}
+		if err := f.open(); err != nil {
+			f.file, f.Sink = nil, nil
+			return err
+		}
+	}
+
+	n, err := f.Sink.Write(b)
+	f.size += int64(n)
+	return err
+}
@@ -0,0 +1,60 @@
+package deadletter
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"../../filters"
+)
+
+func TestResponse(t *testing.T) {
+	buf := new(bytes.Buffer)
+	f := &Filter{
+		Config: Config{
+			RateLimit:    2,
+			IncludeBody:  true,
+			MaxBodySize:  5,
+			ScrubHeaders: []string{"Authorization"},
+		},
+		Sink: buf,
+	}
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest(http.MethodPost, "http://example.org/upload", strings.NewReader("hello world"))
+		req.Header.Set("Authorization", "Basic c2VjcmV0")
+
+		ctx, req, _ := f.Request(filters.NewTestContext(nil), req)
+		ioutil.ReadAll(req.Body)
+
+		ctx = filters.WithString(ctx, filters.RoundTripErrorKey, "connection refused")
+		f.Response(ctx, filters.NewResponse(req, http.StatusBadGateway, nil, nil))
+	}
+
+	// a successful request is not recorded
+	req, _ := http.NewRequest(http.MethodGet, "http://example.org/", nil)
+	f.Response(filters.NewTestContext(nil), filters.NewResponse(req, http.StatusOK, nil, nil))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%T.Response writes %d records, want 2 by RateLimit: %s", f, len(lines), buf.String())
+	}
+
+	var r Record
+	if err := json.Unmarshal([]byte(lines[0]), &r); err != nil {
+		t.Fatalf("json.Unmarshal(%#v) error: %v", lines[0], err)
+	}
+
+	if r.URL != "http://example.org/upload" || r.Error != "connection refused" || r.StatusCode != http.StatusBadGateway {
+		t.Errorf("%T.Response records %+v", f, r)
+	}
+	if v := r.Header.Get("Authorization"); v != "-" {
+		t.Errorf("%T.Response records Authorization %#v, want it scrubbed", f, v)
+	}
+	if string(r.Body) != "hello" {
+		t.Errorf("%T.Response records body %#v, want %#v", f, string(r.Body), "hello")
+	}
+}
@@ -0,0 +1,117 @@
+package direct
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The Logging.Format values, text is the default.
+const (
+	accessLogText     string = "text"
+	accessLogCLF      string = "clf"
+	accessLogCombined string = "combined"
+)
+
+// clfTimeFormat is the timestamp of the Apache Common Log Format.
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// An accessEntry is what an access log line tells of a request, text is the
+// line of the text format. id is the RequestIDKey of the request, if any.
+type accessEntry struct {
+	req    *http.Request
+	user   string
+	id     string
+	start  time.Time
+	status int
+	size   int64
+	text   string
+}
+
+// logAccess writes the line of e to AccessLog in the Logging.Format of f.
+func (f *Filter) logAccess(e *accessEntry) {
+	if f.AccessLog == nil {
+		return
+	}
+	switch f.Config.Logging.Format {
+	case accessLogCLF, accessLogCombined:
+		f.AccessLog.Print(formatCLF(e, f.Config.Logging.Format == accessLogCombined))
+	default:
+		if e.id != "" {
+			f.AccessLog.Print(e.text + " request_id=" + e.id)
+		} else {
+			f.AccessLog.Print(e.text)
+		}
+	}
+}
+
+// formatCLF formats e in the Common Log Format, or the Combined Log Format
+// with the referer and user agent, as Apache does. Fields we do not have, as
+// ident, are "-". A request id follows quoted, as a %{X-Request-ID}i would.
+func formatCLF(e *accessEntry, combined bool) string {
+	host := e.req.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	uri := e.req.RequestURI
+	if e.req.Method == http.MethodConnect {
+		uri = e.req.Host
+	} else if e.req.URL != nil {
+		uri = e.req.URL.String()
+	}
+
+	size := "-"
+	if e.size > 0 {
+		size = strconv.FormatInt(e.size, 10)
+	}
+
+	line := fmt.Sprintf("%s - %s [%s] \"%s\" %d %s",
+		clfField(host),
+		clfField(e.user),
+		e.start.Format(clfTimeFormat),
+		clfEscape(e.req.Method+" "+uri+" "+e.req.Proto),
+		e.status,
+		size)
+	if combined {
+		line += fmt.Sprintf(" \"%s\" \"%s\"", clfEscape(e.req.Referer()), clfEscape(e.req.UserAgent()))
+	}
+	if e.id != "" {
+		line += fmt.Sprintf(" \"%s\"", clfEscape(e.id))
+	}
+	return line
+}
+
+// clfField is s for an unquoted field, "-" if it is empty.
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.Replace(clfEscape(s), " ", "\\x20", -1)
+}
+
+// clfEscape escapes s for a quoted field as Apache does, quotes and
+// backslashes with a backslash and other control bytes as \xhh. Empty quoted
+// fields are "-".
+func clfEscape(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,138 @@
+package direct
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"../../filters"
+)
+
+func TestFormatCLF(t *testing.T) {
+	start := time.Date(2000, time.October, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600))
+
+	get, _ := http.NewRequest(http.MethodGet, "http://www.example.com/apache_pb.gif?q=\"x\"", nil)
+	get.RemoteAddr = "127.0.0.1:54321"
+	get.Proto = "HTTP/1.0"
+	get.Header.Set("Referer", "http://www.example.com/start.html")
+	get.Header.Set("User-Agent", "Mozilla/4.08 [en] (Win98; I ;Nav)")
+
+	connect := &http.Request{
+		Method:     http.MethodConnect,
+		Host:       "www.example.com:443",
+		URL:        &url.URL{Host: "www.example.com:443"},
+		Proto:      "HTTP/1.1",
+		Header:     http.Header{},
+		RemoteAddr: "[::1]:54321",
+	}
+
+	cases := []struct {
+		e        accessEntry
+		combined bool
+		line     string
+	}{
+		{
+			accessEntry{req: get, user: "frank", start: start, status: 200, size: 2326},
+			false,
+			`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET http://www.example.com/apache_pb.gif?q=\"x\" HTTP/1.0" 200 2326`,
+		},
+		{
+			accessEntry{req: get, user: "frank", start: start, status: 200, size: 2326},
+			true,
+			`127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET http://www.example.com/apache_pb.gif?q=\"x\" HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 [en] (Win98; I ;Nav)"`,
+		},
+		{
+			accessEntry{req: connect, start: start, status: 200, size: 0},
+			true,
+			`::1 - - [10/Oct/2000:13:55:36 -0700] "CONNECT www.example.com:443 HTTP/1.1" 200 - "-" "-"`,
+		},
+		{
+			accessEntry{req: get, id: "f47ac10b-58cc-4372-a567-0e02b2c3d479", start: start, status: 200, size: 2326},
+			true,
+			`127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET http://www.example.com/apache_pb.gif?q=\"x\" HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 [en] (Win98; I ;Nav)" "f47ac10b-58cc-4372-a567-0e02b2c3d479"`,
+		},
+		{
+			accessEntry{req: get, user: "a \"b\"", start: start, status: 304},
+			false,
+			`127.0.0.1 - a\x20\"b\" [10/Oct/2000:13:55:36 -0700] "GET http://www.example.com/apache_pb.gif?q=\"x\" HTTP/1.0" 304 -`,
+		},
+	}
+
+	for _, c := range cases {
+		if line := formatCLF(&c.e, c.combined); line != c.line {
+			t.Errorf("formatCLF(%d, %v) = %s, want %s", c.e.status, c.combined, line, c.line)
+		}
+	}
+
+	if s := clfEscape("a\\b\"c\n\x7f"); s != `a\\b\"c\x0a\x7f` {
+		t.Errorf("clfEscape() = %s, want %s", s, `a\\b\"c\x0a\x7f`)
+	}
+}
+
+func TestLogAccessText(t *testing.T) {
+	var buf bytes.Buffer
+	f := &Filter{AccessLog: log.New(&buf, "", 0)}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+	f.logAccess(&accessEntry{req: req, text: `1.2.3.4:5 "DIRECT GET http://www.example.com/ HTTP/1.1" 200 5`})
+	f.logAccess(&accessEntry{req: req, id: "req-1", text: `1.2.3.4:5 "DIRECT GET http://www.example.com/ HTTP/1.1" 200 5`})
+
+	want := `1.2.3.4:5 "DIRECT GET http://www.example.com/ HTTP/1.1" 200 5` + "\n" +
+		`1.2.3.4:5 "DIRECT GET http://www.example.com/ HTTP/1.1" 200 5 request_id=req-1` + "\n"
+	if s := buf.String(); s != want {
+		t.Errorf("%T.logAccess() text lines = %#v, want %#v", f, s, want)
+	}
+}
+
+func TestRoundTripAccessLogCombined(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "hello")
+	}))
+	defer ts.Close()
+
+	config := new(Config)
+	config.Transport.Dialer.Timeout = 4
+	config.Transport.Dialer.DNSCacheSize = 64
+	config.Logging.Format = accessLogCombined
+	f1, err := NewFilter(config)
+	if err != nil {
+		t.Fatalf("NewFilter(%#v) error: %v", config, err)
+	}
+	f := f1.(*Filter)
+	setDial(f, net.Dial)
+
+	var buf bytes.Buffer
+	f.AccessLog = log.New(&buf, "", 0)
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/a", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("User-Agent", "curl/7.64.1")
+	ctx := filters.NewTestContext(nil)
+	ctx = filters.WithString(ctx, filters.AuthUserKey, "alice")
+	ctx = filters.WithString(ctx, filters.RequestIDKey, "req-1")
+	_, resp, err := f.RoundTrip(ctx, req.WithContext(context.Background()))
+	if err != nil {
+		t.Fatalf("%T.RoundTrip() error: %v", f, err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	re := regexp.MustCompile(`^10\.0\.0\.1 - alice \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [-+]\d{4}\] "GET ` + regexp.QuoteMeta(ts.URL) + `/a HTTP/1\.1" 200 5 "-" "curl/7\.64\.1" "req-1"\n$`)
+	if line := buf.String(); !re.MatchString(line) {
+		t.Errorf("%T combined access log %#v does not match %s", f, line, re)
+	}
+
+	config.Logging.Format = "json"
+	if _, err := NewFilter(config); err == nil {
+		t.Errorf("NewFilter() with Logging.Format %#v returns no error", config.Logging.Format)
+	}
+}
@@ -0,0 +1,123 @@
+package direct
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+
+	"../../helpers"
+)
+
+const (
+	// adaptiveErrorThreshold is the EWMA of 429/503 responses above which the
+	// limit of a host is cut
+	adaptiveErrorThreshold float64 = 0.1
+	// adaptiveIdleTimeout is how long the state of an idle host is kept
+	adaptiveIdleTimeout time.Duration = 10 * time.Minute
+)
+
+var (
+	adaptiveThrottled = helpers.Metrics.Counter("direct_adaptive_throttled_total", "Requests refused by AdaptiveThrottle.")
+	adaptiveCuts      = helpers.Metrics.Counter("direct_adaptive_cuts_total", "Halvings of a host limit by AdaptiveThrottle.")
+)
+
+// adaptiveThrottle limits the requests in flight to each host AIMD style. The
+// limit of a host halves, at most once per cooldown, while its EWMA of 429/503
+// responses is over adaptiveErrorThreshold, and grows back by one per limit
+// other responses.
+type adaptiveThrottle struct {
+	alpha    float64
+	max      float64
+	cooldown time.Duration
+
+	mu    sync.Mutex
+	hosts lrucache.Cache
+}
+
+type hostThrottle struct {
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+	errors   float64
+	cut      time.Time
+}
+
+func newAdaptiveThrottle(sensitivity float64, max int, size int) *adaptiveThrottle {
+	if sensitivity <= 0 || sensitivity > 1 {
+		sensitivity = 0.1
+	}
+	if max <= 0 {
+		max = 64
+	}
+	if size <= 0 {
+		size = 4096
+	}
+	return &adaptiveThrottle{
+		alpha:    sensitivity,
+		max:      float64(max),
+		cooldown: time.Second,
+		hosts:    lrucache.NewLRUCache(uint(size)),
+	}
+}
+
+func (t *adaptiveThrottle) host(host string) *hostThrottle {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if v, ok := t.hosts.Get(host); ok {
+		t.hosts.Set(host, v, time.Now().Add(adaptiveIdleTimeout))
+		return v.(*hostThrottle)
+	}
+	h := &hostThrottle{limit: t.max}
+	t.hosts.Set(host, h, time.Now().Add(adaptiveIdleTimeout))
+	return h
+}
+
+// acquire takes a slot of host, false if it has limit requests in flight.
+func (t *adaptiveThrottle) acquire(host string) (*hostThrottle, bool) {
+	h := t.host(host)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if float64(h.inflight) >= h.limit {
+		adaptiveThrottled.Add(1)
+		return h, false
+	}
+	h.inflight++
+	return h, true
+}
+
+// release gives the slot back with the status of the response, 0 if the
+// request failed before one, which leaves the limit as it is.
+func (t *adaptiveThrottle) release(h *hostThrottle, status int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.inflight--
+	if status == 0 {
+		return
+	}
+
+	if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+		h.errors = h.errors*(1-t.alpha) + t.alpha
+		if h.errors > adaptiveErrorThreshold && time.Since(h.cut) >= t.cooldown {
+			h.cut = time.Now()
+			if h.limit > 1 {
+				adaptiveCuts.Add(1)
+			}
+			if h.limit /= 2; h.limit < 1 {
+				h.limit = 1
+			}
+		}
+	} else {
+		h.errors *= 1 - t.alpha
+		if h.limit < t.max {
+			if h.limit += 1 / h.limit; h.limit > t.max {
+				h.limit = t.max
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package direct
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"../../filters"
+	"../../helpers"
+)
+
+func TestRoundTripAdaptiveThrottle(t *testing.T) {
+	var overloaded int32 = 1
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/block" {
+			entered <- struct{}{}
+			<-unblock
+		}
+		if atomic.LoadInt32(&overloaded) == 1 {
+			rw.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer ts.Close()
+
+	f := newTestFilter(t)
+	setDial(f, net.Dial)
+	f.Throttle = newAdaptiveThrottle(0.5, 4, 16)
+	f.Throttle.cooldown = 0
+
+	host := ts.Listener.Addr().String()
+	get := func(path string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip(%#v) error: %v", f, path, err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	limit := func() float64 {
+		h := f.Throttle.host(host)
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.limit
+	}
+
+	// 429s halve the limit down to one request in flight
+	cuts := adaptiveCuts.Value()
+	for i := 0; i < 3; i++ {
+		if resp := get("/"); resp.StatusCode != http.StatusTooManyRequests {
+			t.Fatalf("request %d returns %d, want the upstream 429", i, resp.StatusCode)
+		}
+	}
+	if v := limit(); v != 1 {
+		t.Fatalf("limit after 429s = %v, want 1", v)
+	}
+	if v := adaptiveCuts.Value() - cuts; v != 2 {
+		t.Errorf("direct_adaptive_cuts_total grows by %d, want 2", v)
+	}
+
+	// a second request while one is in flight is refused without reaching
+	// the upstream
+	done := make(chan struct{})
+	go func() {
+		get("/block")
+		close(done)
+	}()
+	<-entered
+
+	throttled := adaptiveThrottled.Value()
+	resp := get("/")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("request beyond the limit returns %d Retry-After %#v, want 503 with Retry-After", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if adaptiveThrottled.Value() != throttled+1 {
+		t.Errorf("direct_adaptive_throttled_total = %d, want %d", adaptiveThrottled.Value(), throttled+1)
+	}
+	close(unblock)
+	<-done
+
+	// successes grow the limit back to the max
+	atomic.StoreInt32(&overloaded, 0)
+	for i := 0; i < 16; i++ {
+		if resp := get("/"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d after recovery returns %d", i, resp.StatusCode)
+		}
+	}
+	if v := limit(); v != 4 {
+		t.Errorf("limit after recovery = %v, want 4", v)
+	}
+	if v := helpers.Metrics.Gauge(`direct_adaptive_limit{host="`+host+`"}`, ""); v.Value() != 0 {
+		t.Errorf("direct_adaptive_limit{host=%q} = %d, want no gauge per host", host, v.Value())
+	}
+}
@@ -0,0 +1,53 @@
+package direct
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/phuslu/glog"
+)
+
+func altSvcKey(req *http.Request) string {
+	if req.URL.Port() != "" {
+		return req.URL.Host
+	}
+	return net.JoinHostPort(req.URL.Hostname(), "443")
+}
+
+// observeAltSvc remembers the alternative services of https upstreams, Alt-Svc
+// of plain http origins is not authenticated and so ignored.
+func (f *Filter) observeAltSvc(req *http.Request, resp *http.Response) {
+	if f.AltSvc == nil || req.URL.Scheme != "https" {
+		return
+	}
+	if err := f.AltSvc.Observe(altSvcKey(req), resp.Header.Get("Alt-Svc")); err != nil {
+		glog.V(2).Infof("%s \"DIRECT %s %s %s\" ignores Alt-Svc %#v: %v", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, resp.Header.Get("Alt-Svc"), err)
+	}
+}
+
+// altSvcDialContext dials the alternative endpoint an origin advertised
+// instead, TLS still verifies the origin name so only tcp protocols apply.
+func (f *Filter) altSvcDialContext(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	protocols := []string{"http/1.1"}
+	if f.Config.Transport.HTTP2 {
+		protocols = append(protocols, "h2")
+	}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		e, ok := f.AltSvc.Lookup(address, protocols...)
+		if !ok {
+			return dial(ctx, network, address)
+		}
+
+		addr := e.Addr(address)
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			glog.Warningf("DIRECT: dial Alt-Svc %s %#v of %#v error: %v, falls back", e.Protocol, addr, address, err)
+			f.AltSvc.Forget(address)
+			return dial(ctx, network, address)
+		}
+		glog.V(2).Infof("DIRECT: dial Alt-Svc %s %#v of %#v", e.Protocol, addr, address)
+		return conn, nil
+	}
+}
@@ -0,0 +1,171 @@
+package direct
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+)
+
+// certFingerprintExpiry only bounds how long an idle host is remembered, any
+// fingerprint change is a rotation.
+const certFingerprintExpiry = 24 * time.Hour
+
+// checkCertChange compares the leaf certificate of a full handshake with the
+// one last seen for the host. On a change the session cache entry and the idle
+// conns of the host are dropped, its busy ones once their response is done.
+// Resumed sessions carry the old certificate and are not compared.
+func (f *Filter) checkCertChange(req *http.Request, resp *http.Response) {
+	if f.CertFingerprints == nil || resp.TLS == nil || resp.TLS.DidResume || len(resp.TLS.PeerCertificates) == 0 {
+		return
+	}
+
+	host := req.URL.Hostname()
+	sum := sha256.Sum256(resp.TLS.PeerCertificates[0].Raw)
+
+	if v, ok := f.CertFingerprints.Get(host); ok && v.([sha256.Size]byte) != sum {
+		glog.Infof("%s \"DIRECT %s %s %s\" certificate of %s changed, drops its TLS session and idle connections", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, host)
+		f.Transport.TLSClientConfig.ClientSessionCache.Put(host, nil)
+		f.CertConns.drop(host, sum)
+	}
+
+	f.CertFingerprints.Set(host, sum, time.Now().Add(certFingerprintExpiry))
+}
+
+// certConns keeps the TLS conns dialTLS made to each host, and which of them
+// are idle in a transport pool. http.Transport only closes the idle conns of
+// all hosts at once.
+type certConns struct {
+	mu    sync.Mutex
+	hosts map[string]map[net.Conn]*certConnState
+}
+
+type certConnState struct {
+	idle    bool
+	retired bool
+}
+
+func newCertConns() *certConns {
+	return &certConns{hosts: make(map[string]map[net.Conn]*certConnState)}
+}
+
+// track returns conn, dialed to host, which forgets the TLS conn over it once
+// closed.
+func (c *certConns) track(host string, conn net.Conn) *certConn {
+	return &certConn{Conn: conn, conns: c, host: host}
+}
+
+// add keeps tconn, the TLS conn over conn.
+func (c *certConns) add(conn *certConn, tconn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	conns, ok := c.hosts[conn.host]
+	if !ok {
+		conns = make(map[net.Conn]*certConnState)
+		c.hosts[conn.host] = conns
+	}
+	conns[tconn] = new(certConnState)
+	conn.tconn = tconn
+}
+
+func (c *certConns) remove(host string, tconn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if conns, ok := c.hosts[host]; ok {
+		delete(conns, tconn)
+		if len(conns) == 0 {
+			delete(c.hosts, host)
+		}
+	}
+}
+
+// setIdle records a conn taken from or put back to the pool, a retired one is
+// closed then.
+func (c *certConns) setIdle(host string, tconn net.Conn, idle bool) {
+	c.mu.Lock()
+	s, ok := c.hosts[host][tconn]
+	retired := false
+	if ok {
+		s.idle = idle
+		retired = s.retired
+	}
+	c.mu.Unlock()
+
+	if idle && retired {
+		tconn.Close()
+	}
+}
+
+// drop closes the idle conns to host and retires the busy ones, but those
+// which have its certificate of sum.
+func (c *certConns) drop(host string, sum [sha256.Size]byte) {
+	var idle []net.Conn
+
+	c.mu.Lock()
+	for tconn, s := range c.hosts[host] {
+		if cs, ok := tconn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+			if certs := cs.ConnectionState().PeerCertificates; len(certs) > 0 && sha256.Sum256(certs[0].Raw) == sum {
+				continue
+			}
+		}
+		if s.idle {
+			idle = append(idle, tconn)
+		} else {
+			s.retired = true
+		}
+	}
+	c.mu.Unlock()
+
+	for _, tconn := range idle {
+		tconn.Close()
+	}
+}
+
+// trace follows the conn req to host gets, until it goes back to the pool.
+// h2 conns are never put back, and not dropped.
+func (c *certConns) trace(host string) *httptrace.ClientTrace {
+	var mu sync.Mutex
+	var tconn net.Conn
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			tconn = info.Conn
+			mu.Unlock()
+			c.setIdle(host, info.Conn, false)
+		},
+		PutIdleConn: func(err error) {
+			mu.Lock()
+			conn := tconn
+			mu.Unlock()
+			if conn != nil && err == nil {
+				c.setIdle(host, conn, true)
+			}
+		},
+	}
+}
+
+// certConn is the conn under a TLS conn of certConns.
+type certConn struct {
+	net.Conn
+	conns *certConns
+	host  string
+	tconn net.Conn
+	once  sync.Once
+}
+
+func (c *certConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		if c.tconn != nil {
+			c.conns.remove(c.host, c.tconn)
+		}
+	})
+	return err
+}
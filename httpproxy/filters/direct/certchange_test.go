@@ -0,0 +1,112 @@
+package direct
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+
+	"../../filters"
+)
+
+func newTestCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey error: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate error: %v", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestRoundTripCertChange(t *testing.T) {
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "ok")
+	})
+
+	closed := make(chan struct{}, 1)
+	ts1 := httptest.NewUnstartedServer(handler)
+	ts1.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	ts1.StartTLS()
+	defer ts1.Close()
+
+	// the same host with a rotated certificate
+	ts2 := httptest.NewUnstartedServer(handler)
+	ts2.TLS = &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}}
+	ts2.StartTLS()
+	defer ts2.Close()
+
+	f := newTestFilter(t)
+	f.Transport.TLSClientConfig.InsecureSkipVerify = true
+	f.CertFingerprints = lrucache.NewLRUCache(64)
+	f.CertConns = newCertConns()
+	setDial(f, net.Dial)
+
+	// another host, whose idle conn stays
+	otherClosed := make(chan struct{}, 1)
+	ts3 := httptest.NewUnstartedServer(handler)
+	ts3.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			otherClosed <- struct{}{}
+		}
+	}
+	ts3.StartTLS()
+	defer ts3.Close()
+	_, port, _ := net.SplitHostPort(ts3.Listener.Addr().String())
+
+	for _, url := range []string{"https://localhost:" + port, ts1.URL, ts2.URL} {
+		req, _ := http.NewRequest(http.MethodGet, url+"/", nil)
+		_, resp, err := f.RoundTrip(filters.NewTestContext(nil), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip(%s) error: %v", f, url, err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%T.RoundTrip(%s) status = %d, want 200", f, url, resp.StatusCode)
+		}
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Errorf("%T.RoundTrip() keeps idle connections after a certificate change", f)
+	}
+	select {
+	case <-otherClosed:
+		t.Errorf("%T.RoundTrip() drops the idle connections of other hosts after a certificate change", f)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if cs, ok := f.Transport.TLSClientConfig.ClientSessionCache.Get("127.0.0.1"); ok && cs != nil {
+		t.Errorf("%T.RoundTrip() keeps the TLS session after a certificate change", f)
+	}
+}
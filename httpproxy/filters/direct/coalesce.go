@@ -0,0 +1,246 @@
+package direct
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+
+	"../../helpers"
+)
+
+const (
+	defaultCoalesceMaxDials int           = 2
+	defaultCoalesceWait     time.Duration = 200 * time.Millisecond
+)
+
+var coalesceWaits = helpers.Metrics.Counter("direct_coalesce_waits_total", "Requests CoalesceDials held back for a conn to reuse.")
+
+// dialCoalescer lets max requests to an upstream without conns dial it, and
+// holds the others back, for up to wait, until a conn of it is idle, so a
+// burst to a cold upstream reuses the conns of its first dials instead of
+// dialing one each. Idle conns are counted with the PutIdleConn and GotConn
+// hooks of the requests.
+type dialCoalescer struct {
+	max  int
+	wait time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*hostDials
+}
+
+type hostDials struct {
+	// live counts the conns dialed and not closed yet, idle the ones put
+	// back in the pool and not taken again, claimed the requests let
+	// through for those and dialing the ones let through to dial
+	live    int
+	idle    int
+	claimed int
+	dialing int
+	// multiplexed is set by h2 responses, a conn of theirs takes any number
+	// of requests
+	multiplexed bool
+	// changed is closed and replaced on each change of the counts
+	changed chan struct{}
+}
+
+// A coalesceTicket is what a request let through holds until it has a conn.
+type coalesceTicket struct {
+	key      string
+	claimed  bool
+	dialing  bool
+	released bool
+}
+
+type coalesceTicketKey struct{}
+
+func newDialCoalescer(max int, wait time.Duration) *dialCoalescer {
+	if max <= 0 {
+		max = defaultCoalesceMaxDials
+	}
+	if wait <= 0 {
+		wait = defaultCoalesceWait
+	}
+	return &dialCoalescer{
+		max:   max,
+		wait:  wait,
+		hosts: make(map[string]*hostDials),
+	}
+}
+
+// coalesceKey is the address the transport dials for u, without a proxy.
+func coalesceKey(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// host returns the state of key, c.mu is held.
+func (c *dialCoalescer) host(key string) *hostDials {
+	h, ok := c.hosts[key]
+	if !ok {
+		h = &hostDials{changed: make(chan struct{})}
+		c.hosts[key] = h
+	}
+	return h
+}
+
+// notify wakes the requests waiting on key, c.mu is held. Hosts without conns
+// or requests let through are dropped, nothing waits on them.
+func (c *dialCoalescer) notify(key string, h *hostDials) {
+	close(h.changed)
+	h.changed = make(chan struct{})
+	if h.live == 0 && h.claimed == 0 && h.dialing == 0 {
+		delete(c.hosts, key)
+	}
+}
+
+// admit lets t through if its upstream has an idle conn nobody claimed yet or
+// no conns and fewer than max dials, and returns what to wait on if not.
+func (c *dialCoalescer) admit(t *coalesceTicket) (<-chan struct{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	h := c.host(t.key)
+	if h.idle > h.live {
+		h.idle = h.live
+	}
+	switch {
+	case h.multiplexed:
+	case h.idle > h.claimed:
+		h.claimed++
+		t.claimed = true
+	case h.live == 0 && h.dialing < c.max:
+		h.dialing++
+		t.dialing = true
+	default:
+		return h.changed, false
+	}
+	return nil, true
+}
+
+// acquire waits until req may take an idle conn or dial, the wait or the
+// request over, and returns req with the hooks counting the conn it gets.
+func (c *dialCoalescer) acquire(req *http.Request) *http.Request {
+	t := &coalesceTicket{key: coalesceKey(req.URL)}
+
+	if changed, ok := c.admit(t); !ok {
+		coalesceWaits.Add(1)
+		timer := time.NewTimer(c.wait)
+		defer timer.Stop()
+	wait:
+		for {
+			select {
+			case <-changed:
+				if changed, ok = c.admit(t); ok {
+					break wait
+				}
+			case <-timer.C:
+				// no conn came free in time, dial anyway
+				break wait
+			case <-req.Context().Done():
+				break wait
+			}
+		}
+	}
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			h := c.host(t.key)
+			if info.Reused && h.idle > 0 {
+				h.idle--
+			}
+			c.releaseTicket(t, h)
+		},
+		PutIdleConn: func(err error) {
+			if err != nil {
+				return
+			}
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			h := c.host(t.key)
+			h.idle++
+			c.notify(t.key, h)
+		},
+	}
+	ctx := httptrace.WithClientTrace(req.Context(), trace)
+	return req.WithContext(context.WithValue(ctx, coalesceTicketKey{}, t))
+}
+
+// releaseTicket gives back what t holds, c.mu is held.
+func (c *dialCoalescer) releaseTicket(t *coalesceTicket, h *hostDials) {
+	if t.released {
+		return
+	}
+	t.released = true
+	if t.claimed {
+		h.claimed--
+	}
+	if t.dialing {
+		h.dialing--
+	}
+	c.notify(t.key, h)
+}
+
+// release gives back the ticket of a request which failed before a conn, and
+// learns from resp whether its upstream multiplexes.
+func (c *dialCoalescer) release(req *http.Request, resp *http.Response) {
+	t, ok := req.Context().Value(coalesceTicketKey{}).(*coalesceTicket)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := c.host(t.key)
+	if resp != nil && resp.ProtoMajor == 2 {
+		h.multiplexed = true
+	}
+	c.releaseTicket(t, h)
+}
+
+// dialContext counts the conns dial brings to their address.
+func (c *dialCoalescer) dialContext(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		c.mu.Lock()
+		h := c.host(address)
+		h.live++
+		c.notify(address, h)
+		c.mu.Unlock()
+
+		return &coalescedConn{Conn: conn, closed: func() {
+			c.mu.Lock()
+			h := c.host(address)
+			h.live--
+			c.notify(address, h)
+			c.mu.Unlock()
+		}}, nil
+	}
+}
+
+type coalescedConn struct {
+	net.Conn
+	once   sync.Once
+	closed func()
+}
+
+func (c *coalescedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.closed)
+	return err
+}
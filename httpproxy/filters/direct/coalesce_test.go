@@ -0,0 +1,70 @@
+package direct
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"../../filters"
+)
+
+func TestRoundTripCoalesceDials(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	const burst = 20
+
+	run := func(coalesce bool) int32 {
+		var dials int32
+		f := newTestFilter(t)
+		f.Transport.MaxIdleConnsPerHost = burst
+		// a slow dial, as to a cold upstream far away
+		setDial(f, func(network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			time.Sleep(100 * time.Millisecond)
+			return net.Dial(network, addr)
+		})
+		if coalesce {
+			f.Coalescer = newDialCoalescer(2, time.Second)
+			f.Transport.DialContext = f.Coalescer.dialContext(f.Transport.DialContext)
+		}
+		defer f.Transport.CloseIdleConnections()
+
+		var wg sync.WaitGroup
+		for i := 0; i < burst; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+				_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+				if err != nil {
+					t.Errorf("%T.RoundTrip(%#v) error: %v", f, ts.URL, err)
+					return
+				}
+				defer resp.Body.Close()
+				if b, _ := ioutil.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || string(b) != "ok" {
+					t.Errorf("%T.RoundTrip(%#v) = %d %#v, want 200 \"ok\"", f, ts.URL, resp.StatusCode, string(b))
+				}
+			}()
+		}
+		wg.Wait()
+
+		return atomic.LoadInt32(&dials)
+	}
+
+	plain, coalesced := run(false), run(true)
+	t.Logf("dials for a burst of %d: %d plain, %d coalesced", burst, plain, coalesced)
+	if coalesced > burst/2 {
+		t.Errorf("coalesced burst of %d dials %d times, want at most %d", burst, coalesced, burst/2)
+	}
+	if coalesced >= plain {
+		t.Errorf("coalesced burst dials %d times, not less than the %d without", coalesced, plain)
+	}
+}
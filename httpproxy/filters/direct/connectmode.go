@@ -0,0 +1,66 @@
+package direct
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// connectModeAuto hijacks CONNECTs of HTTP/1 clients and relays the
+	// streams of h2 ones
+	connectModeAuto   = "auto"
+	connectModeHijack = "hijack"
+	connectModeStream = "stream"
+)
+
+// connectMode returns how to take the client conn of the CONNECT req with
+// Transport.ConnectMode mode, hijack or stream. HTTP/1 clients are always
+// hijacked, they read no tunnel bytes off a response body.
+func connectMode(mode string, req *http.Request) string {
+	if req.ProtoMajor == 1 || mode == connectModeHijack {
+		return connectModeHijack
+	}
+	return connectModeStream
+}
+
+// A streamConn is the client conn of a CONNECT over an h2 stream, which can
+// not be hijacked: reads come from the request body, writes go out flushed
+// in the response body.
+type streamConn struct {
+	io.ReadCloser
+	w       io.Writer
+	flusher http.Flusher
+	remote  net.Addr
+}
+
+func newStreamConn(req *http.Request, rw http.ResponseWriter, flusher http.Flusher) *streamConn {
+	return &streamConn{
+		ReadCloser: req.Body,
+		w:          rw,
+		flusher:    flusher,
+		remote:     streamAddr(req.RemoteAddr),
+	}
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if err == nil {
+		c.flusher.Flush()
+	}
+	return n, err
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return streamAddr("") }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+// the stream ends with the handler, which is bound to the conn it came on
+func (c *streamConn) SetDeadline(t time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type streamAddr string
+
+func (a streamAddr) Network() string { return "h2" }
+func (a streamAddr) String() string  { return string(a) }
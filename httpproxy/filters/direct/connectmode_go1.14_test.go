@@ -0,0 +1,81 @@
+// +build go1.14
+
+package direct
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"../../filters"
+)
+
+// httptest serves h2 since go1.14
+func TestRoundTripConnectStream(t *testing.T) {
+	for _, mode := range []string{connectModeAuto, connectModeStream, connectModeHijack} {
+		f := newTestFilter(t)
+		f.Config.Transport.ConnectMode = mode
+		setDial(f, func(network, addr string) (net.Conn, error) {
+			c1, c2 := net.Pipe()
+			go func() {
+				defer c2.Close()
+				b := make([]byte, 4)
+				if _, err := io.ReadFull(c2, b); err == nil {
+					c2.Write(b)
+				}
+			}()
+			return c1, nil
+		})
+
+		errs := make(chan error, 1)
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			_, _, err := f.RoundTrip(filters.NewTestContext(rw), req)
+			errs <- err
+		}))
+		ts.EnableHTTP2 = true
+		ts.StartTLS()
+
+		tr := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, ForceAttemptHTTP2: true}
+		pr, pw := io.Pipe()
+		u, _ := url.Parse(ts.URL)
+		req := &http.Request{Method: http.MethodConnect, URL: u, Host: "example.org:443", Header: http.Header{}, Body: pr}
+
+		resp, err := tr.RoundTrip(req)
+		if mode == connectModeHijack {
+			// an h2 stream is no http.Hijacker, the filter must refuse it
+			if err == nil {
+				resp.Body.Close()
+			}
+			if err := <-errs; err == nil || !strings.Contains(err.Error(), "Hijacker") {
+				t.Errorf("ConnectMode %#v over h2 RoundTrip error = %v, want the http.Hijacker one", mode, err)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("ConnectMode %#v CONNECT over h2 error: %v", mode, err)
+			}
+			if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+				t.Errorf("ConnectMode %#v CONNECT over h2 = %d %s, want 200 HTTP/2.0", mode, resp.StatusCode, resp.Proto)
+			}
+
+			io.WriteString(pw, "ping")
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(resp.Body, b); err != nil || string(b) != "ping" {
+				t.Errorf("ConnectMode %#v tunnel echo = %#v %v, want %#v", mode, string(b), err, "ping")
+			}
+
+			pw.Close()
+			resp.Body.Close()
+			if err := <-errs; err != nil {
+				t.Errorf("ConnectMode %#v %T.RoundTrip() error: %v", mode, f, err)
+			}
+		}
+
+		tr.CloseIdleConnections()
+		ts.Close()
+	}
+}
@@ -0,0 +1,37 @@
+package direct
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestConnectMode(t *testing.T) {
+	cases := []struct {
+		Mode       string
+		ProtoMajor int
+		Want       string
+	}{
+		{"", 1, connectModeHijack},
+		{"", 2, connectModeStream},
+		{connectModeAuto, 1, connectModeHijack},
+		{connectModeAuto, 2, connectModeStream},
+		{connectModeHijack, 2, connectModeHijack},
+		{connectModeStream, 1, connectModeHijack},
+		{connectModeStream, 2, connectModeStream},
+	}
+
+	for _, c := range cases {
+		req := &http.Request{Method: http.MethodConnect, ProtoMajor: c.ProtoMajor}
+		if got := connectMode(c.Mode, req); got != c.Want {
+			t.Errorf("connectMode(%#v) of an HTTP/%d CONNECT = %#v, want %#v", c.Mode, c.ProtoMajor, got, c.Want)
+		}
+	}
+}
+
+func TestNewFilterConnectMode(t *testing.T) {
+	config := new(Config)
+	config.Transport.ConnectMode = "splice"
+	if _, err := NewFilter(config); err == nil {
+		t.Errorf("NewFilter() with ConnectMode %#v returns no error", config.Transport.ConnectMode)
+	}
+}
@@ -0,0 +1,159 @@
+package direct
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/phuslu/glog"
+
+	"../../helpers"
+)
+
+// maxClientHelloSize bounds the handshake records peekClientHello reads.
+const maxClientHelloSize = 64 * 1024
+
+var errMalformedClientHello = errors.New("malformed TLS ClientHello")
+
+// enforceConnectSNI reads the ClientHello a CONNECT client sends first with
+// Transport.EnforceConnectSNIMatch and passes it on to rconn if its SNI is
+// the CONNECT host, false if it is not, which is domain fronting through
+// us. Tunnels of other protocols, or TLS without SNI, go through as they are.
+// It returns the bytes written to rconn.
+func (f *Filter) enforceConnectSNI(req *http.Request, id string, lconn, rconn net.Conn) (int64, bool) {
+	b, sni, err := peekClientHello(lconn)
+	if err == nil && sni != "" && !sniMatch(sni, helpers.GetHostName(req)) {
+		err = fmt.Errorf("SNI %#v does not match the CONNECT host", sni)
+	}
+	if err != nil {
+		glog.Warningf("%s \"DIRECT %s %s %s\" id=%s tunnel torn down: %v", req.RemoteAddr, req.Method, req.Host, req.Proto, id, err)
+		return 0, false
+	}
+
+	n, err := rconn.Write(b)
+	return int64(n), err == nil
+}
+
+func sniMatch(sni, host string) bool {
+	return strings.EqualFold(strings.TrimSuffix(sni, "."), strings.TrimSuffix(host, "."))
+}
+
+// peekClientHello reads the TLS handshake records of a ClientHello from conn
+// and returns them with its SNI. If conn does not start with a handshake
+// record it returns the first byte, with no SNI.
+func peekClientHello(conn io.Reader) ([]byte, string, error) {
+	b := make([]byte, 5, 5+512)
+	if _, err := io.ReadFull(conn, b[:1]); err != nil {
+		return nil, "", err
+	}
+	if b[0] != 0x16 {
+		return b[:1], "", nil
+	}
+	if _, err := io.ReadFull(conn, b[1:]); err != nil {
+		return nil, "", err
+	}
+
+	var msg []byte
+	for {
+		hdr := b[len(b)-5:]
+		if hdr[0] != 0x16 || hdr[1] != 0x03 {
+			return nil, "", errMalformedClientHello
+		}
+		length := int(binary.BigEndian.Uint16(hdr[3:]))
+		if len(b)+length > maxClientHelloSize {
+			return nil, "", errMalformedClientHello
+		}
+
+		n := len(b)
+		b = append(b, make([]byte, length)...)
+		if _, err := io.ReadFull(conn, b[n:]); err != nil {
+			return nil, "", err
+		}
+		msg = append(msg, b[n:]...)
+
+		// the ClientHello may span several records
+		if len(msg) >= 4 && len(msg) >= 4+(int(msg[1])<<16|int(msg[2])<<8|int(msg[3])) {
+			break
+		}
+
+		n = len(b)
+		b = append(b, make([]byte, 5)...)
+		if _, err := io.ReadFull(conn, b[n:]); err != nil {
+			return nil, "", err
+		}
+	}
+
+	sni, err := parseClientHelloSNI(msg)
+	return b, sni, err
+}
+
+// parseClientHelloSNI returns the server name of the ClientHello handshake
+// message msg, "" if it has none.
+func parseClientHelloSNI(msg []byte) (string, error) {
+	if len(msg) < 4 || msg[0] != 0x01 {
+		return "", errMalformedClientHello
+	}
+	// version and random
+	b := msg[4:]
+	if len(b) < 34 {
+		return "", errMalformedClientHello
+	}
+	b = b[34:]
+
+	// session id, cipher suites and compression methods
+	for _, size := range []int{1, 2, 1} {
+		if len(b) < size {
+			return "", errMalformedClientHello
+		}
+		l := int(b[0])
+		if size == 2 {
+			l = int(binary.BigEndian.Uint16(b))
+		}
+		if len(b) < size+l {
+			return "", errMalformedClientHello
+		}
+		b = b[size+l:]
+	}
+
+	if len(b) == 0 {
+		return "", nil
+	}
+	if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+		return "", errMalformedClientHello
+	}
+	b = b[2 : 2+int(binary.BigEndian.Uint16(b))]
+
+	for len(b) >= 4 {
+		typ, l := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+l {
+			return "", errMalformedClientHello
+		}
+		ext := b[4 : 4+l]
+		b = b[4+l:]
+		if typ != 0 {
+			continue
+		}
+
+		// server_name_list of host_name entries
+		if len(ext) < 2 {
+			return "", errMalformedClientHello
+		}
+		for names := ext[2:]; len(names) >= 3; {
+			nameType, nl := names[0], int(binary.BigEndian.Uint16(names[1:]))
+			if len(names) < 3+nl {
+				return "", errMalformedClientHello
+			}
+			if nameType == 0 {
+				return string(names[3 : 3+nl]), nil
+			}
+			names = names[3+nl:]
+		}
+		return "", errMalformedClientHello
+	}
+
+	return "", nil
+}
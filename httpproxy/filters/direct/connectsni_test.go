@@ -0,0 +1,116 @@
+package direct
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"../../filters"
+)
+
+// clientHello returns the first TLS record a client for serverName sends.
+func clientHello(t *testing.T, serverName string) []byte {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go tls.Client(c1, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+
+	b := make([]byte, 64*1024)
+	n, err := c2.Read(b)
+	if err != nil {
+		t.Fatalf("read ClientHello error: %v", err)
+	}
+	c1.Close()
+	return b[:n]
+}
+
+func TestPeekClientHello(t *testing.T) {
+	hello := clientHello(t, "example.org")
+
+	// the same handshake message in two records
+	msg := hello[5:]
+	split := append([]byte{0x16, 0x03, 0x01, 0x00, 0x10}, msg[:16]...)
+	split = append(split, 0x16, 0x03, 0x01, byte((len(msg)-16)>>8), byte(len(msg)-16))
+	split = append(split, msg[16:]...)
+
+	var cases = []struct {
+		Data []byte
+		Read []byte
+		SNI  string
+	}{
+		{hello, hello, "example.org"},
+		{split, split, "example.org"},
+		{clientHello(t, ""), nil, ""},
+		{[]byte("GET / HTTP/1.1\r\n\r\n"), []byte("G"), ""},
+	}
+
+	for i, c := range cases {
+		b, sni, err := peekClientHello(bytes.NewReader(append(c.Data, "rest"...)))
+		if err != nil {
+			t.Errorf("case %d: peekClientHello() error: %v", i, err)
+			continue
+		}
+		if sni != c.SNI {
+			t.Errorf("case %d: peekClientHello() SNI = %#v, want %#v", i, sni, c.SNI)
+		}
+		if c.Read != nil && !bytes.Equal(b, c.Read) {
+			t.Errorf("case %d: peekClientHello() read %d bytes, want %d", i, len(b), len(c.Read))
+		}
+	}
+
+	if _, _, err := peekClientHello(bytes.NewReader([]byte{0x16, 0x03, 0x01, 0x00, 0x04, 0x02, 0x00, 0x00, 0x00})); err == nil {
+		t.Errorf("peekClientHello() of a ServerHello returns no error")
+	}
+}
+
+func TestRoundTripEnforceConnectSNIMatch(t *testing.T) {
+	var cases = []struct {
+		SNI       string
+		Forwarded bool
+	}{
+		{"example.org", true},
+		{"EXAMPLE.org.", true},
+		{"fronted.example.net", false},
+	}
+
+	for _, c := range cases {
+		f := newTestFilter(t)
+		f.Config.Transport.EnforceConnectSNIMatch = true
+
+		forwarded := make(chan bool, 1)
+		setDial(f, func(network, addr string) (net.Conn, error) {
+			c1, c2 := net.Pipe()
+			go func() {
+				defer c2.Close()
+				b := make([]byte, 64*1024)
+				n, _ := c2.Read(b)
+				forwarded <- n > 0 && b[0] == 0x16
+			}()
+			return c1, nil
+		})
+
+		lconn, conn := net.Pipe()
+		rw := filters.NewTestResponseWriter(lconn)
+		req, _ := http.NewRequest(http.MethodConnect, "http://example.org:443", nil)
+
+		done := make(chan struct{})
+		go func() {
+			f.RoundTrip(filters.NewTestContext(rw), req)
+			close(done)
+		}()
+		go tls.Client(conn, &tls.Config{ServerName: c.SNI, InsecureSkipVerify: true}).Handshake()
+
+		select {
+		case v := <-forwarded:
+			if v != c.Forwarded {
+				t.Errorf("CONNECT example.org:443 with SNI %#v forwarded the ClientHello = %v, want %v", c.SNI, v, c.Forwarded)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("CONNECT example.org:443 with SNI %#v hangs", c.SNI)
+		}
+		<-done
+		conn.Close()
+	}
+}
@@ -0,0 +1,17 @@
+// +build go1.14
+
+package direct
+
+import (
+	"net/http"
+)
+
+func init() {
+	setDialTLS = func(f *Filter, tr *http.Transport) {
+		tr.DialTLSContext = f.dialTLSContext(tr)
+	}
+	copyDialTLS = func(dst, src *http.Transport) {
+		dst.DialTLS = src.DialTLS
+		dst.DialTLSContext = src.DialTLSContext
+	}
+}
@@ -0,0 +1,93 @@
+// +build go1.14
+
+package direct
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"../../filters"
+)
+
+// httptest serves h2 since go1.14
+func TestRoundTripDialTLSHTTP2(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(req.Proto))
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	config := new(Config)
+	config.Transport.Dialer.Timeout = 4
+	config.Transport.HTTP2 = true
+	config.Transport.TLSClientConfig.InsecureSkipVerify = true
+	fi, err := NewFilter(config)
+	if err != nil {
+		t.Fatalf("NewFilter(%#v) error: %v", config, err)
+	}
+	f := fi.(*Filter)
+	setDial(f, net.Dial)
+	// the bundled h2 of net/http negotiates the same, without an http2 which
+	// configures transports
+	if f.Transport.TLSNextProto["h2"] == nil {
+		f.Transport.ForceAttemptHTTP2 = true
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+	if err != nil {
+		t.Fatalf("%T.RoundTrip(%#v) error: %v", f, ts.URL, err)
+	}
+	defer resp.Body.Close()
+
+	if b, _ := ioutil.ReadAll(resp.Body); resp.ProtoMajor != 2 || string(b) != "HTTP/2.0" {
+		t.Errorf("%T.RoundTrip(%#v) = %s %#v, want HTTP/2.0 through ALPN", f, ts.URL, resp.Proto, string(b))
+	}
+}
+
+// the handshake of DialTLSContext is over before net/http sees the conn, the
+// slow log has it from the trace dialTLSContext reports to.
+func TestRoundTripDialTLSTiming(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	buf := new(bytes.Buffer)
+
+	f := newTestFilter(t)
+	f.SlowThreshold = time.Millisecond
+	f.SlowLog = log.New(buf, "", 0)
+	handshake := f.TLSHandshake
+	f.TLSHandshake = func(conn net.Conn, config *tls.Config) (net.Conn, error) {
+		time.Sleep(50 * time.Millisecond)
+		return handshake(conn, config)
+	}
+	setDial(f, net.Dial)
+	f.Transport.TLSClientConfig.InsecureSkipVerify = true
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+	if err != nil {
+		t.Fatalf("%T.RoundTrip(%#v) error: %v", f, ts.URL, err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	m := regexp.MustCompile(`tls=(\S+)`).FindStringSubmatch(buf.String())
+	if m == nil {
+		t.Fatalf("%T.RoundTrip slow log = %#v, want a tls phase", f, buf.String())
+	}
+	if d, err := time.ParseDuration(m[1]); err != nil || d < 50*time.Millisecond {
+		t.Errorf("%T.RoundTrip slow log tls=%s, want the 50ms handshake of dialTLSContext", f, m[1])
+	}
+}
@@ -0,0 +1,92 @@
+package direct
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"../../filters"
+)
+
+func TestRoundTripDialTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	f := newTestFilter(t)
+	handshakes := 0
+	handshake := f.TLSHandshake
+	f.TLSHandshake = func(conn net.Conn, config *tls.Config) (net.Conn, error) {
+		handshakes++
+		return handshake(conn, config)
+	}
+	setDial(f, net.Dial)
+	f.Transport.TLSClientConfig.InsecureSkipVerify = true
+	// every request dials, the second one resumes the session of the first
+	f.Transport.DisableKeepAlives = true
+
+	for i, resume := range []bool{false, true} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+		_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip(%#v) error: %v", f, ts.URL, err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || string(b) != "ok" {
+			t.Errorf("%T.RoundTrip(%#v) #%d = %d %#v, want 200 \"ok\"", f, ts.URL, i, resp.StatusCode, string(b))
+		}
+		if resp.TLS == nil {
+			t.Fatalf("%T.RoundTrip(%#v) #%d has no TLS state", f, ts.URL, i)
+		}
+		if resp.TLS.NegotiatedProtocol != "http/1.1" {
+			t.Errorf("%T.RoundTrip(%#v) #%d negotiated %#v, want \"http/1.1\"", f, ts.URL, i, resp.TLS.NegotiatedProtocol)
+		}
+		if resp.TLS.DidResume != resume {
+			t.Errorf("%T.RoundTrip(%#v) #%d DidResume = %v, want %v", f, ts.URL, i, resp.TLS.DidResume, resume)
+		}
+	}
+
+	if handshakes != 2 {
+		t.Errorf("%T.RoundTrip(%#v) twice does %d handshakes of its own, want 2", f, ts.URL, handshakes)
+	}
+}
+
+func TestDialTLSContextCanceled(t *testing.T) {
+	// never answers the ClientHello
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	f := newTestFilter(t)
+	setDial(f, net.Dial)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = f.dialTLSContext(f.Transport)(ctx, "tcp", ln.Addr().String())
+	if err == nil {
+		t.Fatalf("%T.dialTLSContext(%#v) of a silent server returns no error", f, ln.Addr().String())
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("%T.dialTLSContext(%#v) returns after %v of a 100ms context, want the handshake aborted", f, ln.Addr().String(), d)
+	}
+}
@@ -2,15 +2,26 @@ package direct
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/cloudflare/golibs/lrucache"
 	"github.com/phuslu/glog"
+	"github.com/phuslu/net/http2"
 
 	"../../dialer"
 	"../../filters"
@@ -21,44 +32,191 @@ import (
 
 const (
 	filterName string = "direct"
+
+	// probeKeepAlive is the TCP keepalive period with ProbeIdleConns, short
+	// enough to notice NAT mappings dropped while an upstream conn sits idle
+	probeKeepAlive time.Duration = 15 * time.Second
+)
+
+var (
+	requestHeaderBytes  = helpers.Metrics.Histogram("direct_request_header_bytes", "Size of request lines and headers sent upstream.", helpers.ExponentialBuckets(256, 2, 10))
+	responseHeaderBytes = helpers.Metrics.Histogram("direct_response_header_bytes", "Size of status lines and headers received from upstream.", helpers.ExponentialBuckets(256, 2, 10))
+	requestBodyBytes    = helpers.Metrics.Histogram("direct_request_body_bytes", "Size of request bodies sent upstream.", helpers.ExponentialBuckets(1024, 4, 11))
+	responseBodyBytes   = helpers.Metrics.Histogram("direct_response_body_bytes", "Size of response bodies received from upstream.", helpers.ExponentialBuckets(1024, 4, 11))
 )
 
 type Config struct {
 	Transport struct {
 		Dialer struct {
-			Timeout        int
-			KeepAlive      int
-			DualStack      bool
-			RetryTimes     int
-			RetryDelay     float32
-			DNSCacheExpiry int
-			DNSCacheSize   uint
+			Timeout                 int
+			KeepAlive               int
+			DualStack               bool
+			RetryTimes              int
+			RetryDelay              float32
+			DNSCacheExpiry          int
+			DNSCacheSize            uint
+			RTTCacheSize            int
+			FailCacheTTL            int
+			PMTUDiscover            string
+			DSCP                    int
+			DSCPHosts               map[string]int
+			AddressFamily           string
+			AddressFamilyHeaderNets []string
+			QueryHTTPSRecords       bool
+			HTTPSRecordServer       string
+			SlowResolveThreshold    float32
+			DNSExportFile           string
 		}
 		Proxy struct {
 			Enabled bool
 			URL     string
+			Chain   []string
+		}
+		TunnelPool struct {
+			Upstreams   []string
+			Sticky      bool
+			IdleTimeout int
+			CacheSize   int
+		}
+		UpstreamRetry struct {
+			Enabled     bool
+			StatusCodes []int
+			MaxAttempts int
 		}
 		TLSClientConfig struct {
 			InsecureSkipVerify     bool
 			ClientSessionCacheSize int
+			DisableResumptionHosts []string
+			Fingerprint            string
+			DropPoolOnCertChange   bool
+			EnableECH              bool
+			ECHDNSServer           string
+		}
+		DisableKeepAlives             bool
+		DisableCompression            bool
+		TLSHandshakeTimeout           int
+		MaxIdleConnsPerHost           int
+		IdleConnTimeout               int
+		ProbeIdleConns                bool
+		DialOverrides                 map[string]string
+		ExpectContinueTimeout         float32
+		TunnelCompression             bool
+		VerifyDigest                  bool
+		MaxRedirects                  int
+		HTTP2                         bool
+		H2CHosts                      []string
+		AltSvc                        bool
+		EnableHTTP3                   bool
+		IsolateHosts                  []string
+		IsolateHeaderNets             []string
+		PreserveConnectionHeaderHosts []string
+		NormalizeFramingHosts         []string
+		PinClientConnections          bool
+		RejectIPLiterals              bool
+		MaxRequestHeaderCount         int
+		SplitClientHello              bool
+		SplitClientHelloOffset        int
+		EnforceConnectSNIMatch        bool
+		ConnectMode                   string
+		NormalizeFramingMaxBytes      int64
+		MaxBufferMemory               int64
+		MaxResponseBodyBytes          int64
+		MaxConcurrentTunnels          int
+		TunnelBurstKBps               int
+		TunnelBurstWindow             float32
+		MaxHandshakesPerSecond        int
+		AdaptiveThrottle              struct {
+			Enabled        bool
+			Sensitivity    float64
+			MaxConcurrency int
+		}
+		CoalesceDials struct {
+			Enabled  bool
+			MaxDials int
+			Wait     float32
+		}
+		TimeoutProfiles map[string]struct {
+			DialTimeout           int
+			ResponseHeaderTimeout int
+			IdleConnTimeout       int
+		}
+		Rules []struct {
+			Hosts          []string
+			TimeoutProfile string
+		}
+	}
+	Logging struct {
+		Format                 string
+		SlowThreshold          float32
+		SlowLogFile            string
+		IncludeRequestHeaders  []string
+		IncludeResponseHeaders []string
+		RedactPatterns         []string
+		Syslog                 struct {
+			Enabled   bool
+			Network   string
+			Address   string
+			Facility  string
+			Tag       string
+			AccessLog bool
+		}
+	}
+	Accounting struct {
+		FlowExport struct {
+			Enabled     bool
+			Destination string
+			QueueSize   int
 		}
-		DisableKeepAlives   bool
-		DisableCompression  bool
-		TLSHandshakeTimeout int
-		MaxIdleConnsPerHost int
 	}
 }
 
 type Filter struct {
 	Config
 	filters.RoundTripFilter
-	transport *http.Transport
+	Transport          *http.Transport
+	HTTP3              http.RoundTripper
+	H2C                http.RoundTripper
+	H2CHosts           *helpers.HostMatcher
+	AltSvc             *helpers.AltSvcCache
+	CertFingerprints   lrucache.Cache
+	CertConns          *certConns
+	ECHConfigs         lrucache.Cache
+	LookupHTTPS        func(host string) ([]*dialer.HTTPSRecord, error)
+	HTTPSRecord        func(host string) *dialer.HTTPSRecord
+	HTTPSAltSvc        lrucache.Cache
+	IsolatedTransport  *http.Transport
+	FamilyTransport    *http.Transport
+	IsolateHosts       *helpers.HostMatcher
+	IsolateNets        []*net.IPNet
+	PreserveConnection *helpers.HostMatcher
+	NormalizeFraming   *helpers.HostMatcher
+	TimeoutRoutes      []timeoutRoute
+	AddressFamilyNets  []*net.IPNet
+	Tunnels            *tunnelPool
+	UpstreamRetry      *upstreamRetry
+	TunnelLimit        *tunnelLimiter
+	Throttle           *adaptiveThrottle
+	HandshakeLimit     *handshakeLimiter
+	TLSHandshake       func(net.Conn, *tls.Config) (net.Conn, error)
+	Coalescer          *dialCoalescer
+	SlowThreshold      time.Duration
+	SlowLog            *log.Logger
+	AccessLog          *log.Logger
+	FlowExport         *flowExporter
+	LogRequestHeaders  []string
+	LogResponseHeaders []string
+	LogRedact          []*regexp.Regexp
 }
 
 func init() {
 	filename := filterName + ".json"
 	config := new(Config)
-	err := storage.LookupStoreByConfig(filterName).UnmarshallJson(filename, config)
+	store := storage.LookupStoreByConfig(filterName)
+	unmarshall := store.UnmarshallJson
+	if storage.StrictConfig(filterName) {
+		unmarshall = store.UnmarshallJsonStrict
+	}
+	err := unmarshall(filename, config)
 	if err != nil {
 		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
 	}
@@ -75,17 +233,57 @@ func init() {
 }
 
 func NewFilter(config *Config) (filters.Filter, error) {
+	sockopts := &dialer.SocketOptions{
+		PMTUDiscover: config.Transport.Dialer.PMTUDiscover,
+		DSCP:         config.Transport.Dialer.DSCP,
+		DSCPHosts:    config.Transport.Dialer.DSCPHosts,
+	}
+	if err := sockopts.Check(); err != nil {
+		glog.Fatalf("DIRECT: Transport.Dialer error: %v", err)
+	}
+	if !dialer.ValidAddressFamily(config.Transport.Dialer.AddressFamily) {
+		glog.Fatalf("DIRECT: Transport.Dialer.AddressFamily %#v is not \"ipv4\" or \"ipv6\"", config.Transport.Dialer.AddressFamily)
+	}
+
+	// shared by every filter buffering bodies, direct owns the knob being the
+	// one transport always configured
+	helpers.Buffers.SetMax(config.Transport.MaxBufferMemory)
+
+	keepAlive := time.Duration(config.Transport.Dialer.KeepAlive) * time.Second
+	if config.Transport.ProbeIdleConns && (keepAlive <= 0 || keepAlive > probeKeepAlive) {
+		keepAlive = probeKeepAlive
+	}
+
+	switch config.Transport.ConnectMode {
+	case "", connectModeAuto, connectModeHijack, connectModeStream:
+	default:
+		return nil, fmt.Errorf("DIRECT: unknown Transport.ConnectMode %#v", config.Transport.ConnectMode)
+	}
+
+	dnsCache, err := dialer.NewDNSCache(config.Transport.Dialer.DNSCacheSize)
+	if err != nil {
+		return nil, fmt.Errorf("DIRECT: Transport.Dialer.DNSCacheSize error: %v", err)
+	}
+	// the other per host caches, which a DNSCacheSize of 0 does not turn off
+	cacheSize := config.Transport.Dialer.DNSCacheSize
+	if cacheSize == 0 {
+		cacheSize = dialer.DefaultDNSCacheSize
+	}
+
 	d := &dialer.Dialer{
 		Dialer: &net.Dialer{
-			KeepAlive: time.Duration(config.Transport.Dialer.KeepAlive) * time.Second,
+			KeepAlive: keepAlive,
 			Timeout:   time.Duration(config.Transport.Dialer.Timeout) * time.Second,
 			DualStack: config.Transport.Dialer.DualStack,
 		},
 		RetryTimes:     config.Transport.Dialer.RetryTimes,
 		RetryDelay:     time.Duration(config.Transport.Dialer.RetryDelay*1000) * time.Second,
-		DNSCache:       lrucache.NewLRUCache(config.Transport.Dialer.DNSCacheSize),
+		DNSCache:       dnsCache,
 		DNSCacheExpiry: time.Duration(config.Transport.Dialer.DNSCacheExpiry) * time.Second,
 		LoopbackAddrs:  make(map[string]struct{}),
+		SocketOptions:  sockopts,
+		DialOverrides:  config.Transport.DialOverrides,
+		AddressFamily:  config.Transport.Dialer.AddressFamily,
 	}
 
 	if ips, err := helpers.LocalInterfaceIPs(); err == nil {
@@ -94,44 +292,354 @@ func NewFilter(config *Config) (filters.Filter, error) {
 		}
 	}
 
+	if config.Transport.Dialer.SlowResolveThreshold > 0 {
+		d.SlowResolveThreshold = time.Duration(config.Transport.Dialer.SlowResolveThreshold*1000) * time.Millisecond
+	}
+
+	if config.Transport.Dialer.FailCacheTTL > 0 {
+		d.FailCache = lrucache.NewLRUCache(cacheSize)
+		d.FailCacheTTL = time.Duration(config.Transport.Dialer.FailCacheTTL) * time.Second
+	}
+
+	if config.Transport.Dialer.RTTCacheSize > 0 {
+		d.RTTCache = dialer.NewRTTCache(config.Transport.Dialer.RTTCacheSize)
+	}
+
+	if config.Transport.Dialer.QueryHTTPSRecords {
+		d.QueryHTTPSRecords = true
+		d.HTTPSServer = config.Transport.Dialer.HTTPSRecordServer
+		d.HTTPSCache = lrucache.NewLRUCache(cacheSize)
+	}
+
+	if config.Transport.Dialer.DNSExportFile != "" {
+		d.DNSExportFile = config.Transport.Dialer.DNSExportFile
+		n, err := d.ImportDNSFile()
+		if err != nil {
+			glog.Warningf("DIRECT: import DNS cache from %#v error: %v", d.DNSExportFile, err)
+		} else if n > 0 {
+			glog.Infof("DIRECT: imported %d DNS cache entries from %#v", n, d.DNSExportFile)
+		}
+	}
+
+	dialer.Register(d)
+
 	tr := &http.Transport{
-		Dial: d.Dial,
+		DialContext: d.DialContext,
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: config.Transport.TLSClientConfig.InsecureSkipVerify,
 			ClientSessionCache: tls.NewLRUClientSessionCache(config.Transport.TLSClientConfig.ClientSessionCacheSize),
 		},
 		TLSHandshakeTimeout: time.Duration(config.Transport.TLSHandshakeTimeout) * time.Second,
 		MaxIdleConnsPerHost: config.Transport.MaxIdleConnsPerHost,
-		DisableCompression:  config.Transport.DisableCompression,
+		IdleConnTimeout:     time.Duration(config.Transport.IdleConnTimeout) * time.Second,
+		// an upstream may reject "Expect: 100-continue" with a final status, then
+		// the body is never read from the client
+		ExpectContinueTimeout: time.Duration(config.Transport.ExpectContinueTimeout*1000) * time.Millisecond,
+		DisableCompression:    config.Transport.DisableCompression,
 	}
 
 	if config.Transport.Proxy.Enabled {
-		fixedURL, err := url.Parse(config.Transport.Proxy.URL)
-		if err != nil {
-			glog.Fatalf("url.Parse(%#v) error: %s", config.Transport.Proxy.URL, err)
-		}
+		var dialer proxy.Dialer
+		var name string
 
-		switch fixedURL.Scheme {
-		case "http", "https":
-			tr.Proxy = http.ProxyURL(fixedURL)
-			tr.Dial = nil
-			tr.DialTLS = nil
-		default:
-			dialer, err := proxy.FromURL(fixedURL, d, nil)
+		if chain := config.Transport.Proxy.Chain; len(chain) > 0 {
+			urls := make([]*url.URL, len(chain))
+			for i, s := range chain {
+				u, err := url.Parse(s)
+				if err != nil {
+					glog.Fatalf("url.Parse(%#v) error: %s", s, err)
+				}
+				urls[i] = u
+			}
+
+			var err error
+			dialer, err = proxy.FromURLs(urls, d, nil)
+			if err != nil {
+				glog.Fatalf("proxy.FromURLs(%#v) error: %s", chain, err)
+			}
+			name = strings.Join(chain, " -> ")
+		} else {
+			fixedURL, err := url.Parse(config.Transport.Proxy.URL)
 			if err != nil {
-				glog.Fatalf("proxy.FromURL(%#v) error: %s", fixedURL.String(), err)
+				glog.Fatalf("url.Parse(%#v) error: %s", config.Transport.Proxy.URL, err)
+			}
+
+			switch fixedURL.Scheme {
+			case "http", "https":
+				tr.Proxy = http.ProxyURL(fixedURL)
+				tr.Dial = nil
+				tr.DialContext = nil
+				tr.DialTLS = nil
+			default:
+				dialer, err = proxy.FromURL(fixedURL, d, nil)
+				if err != nil {
+					glog.Fatalf("proxy.FromURL(%#v) error: %s", fixedURL.String(), err)
+				}
+				name = fixedURL.String()
+			}
+		}
+
+		if dialer != nil {
+			if config.Transport.TunnelCompression && !proxy.WithTunnelCompression(dialer) {
+				glog.Fatalf("DIRECT: TunnelCompression=%v is not supported by proxy %#v", config.Transport.TunnelCompression, name)
 			}
 
 			tr.Dial = dialer.Dial
+			tr.DialContext = nil
 			tr.DialTLS = nil
 			tr.Proxy = nil
 		}
 	}
 
-	return &Filter{
-		Config:    *config,
-		transport: tr,
-	}, nil
+	// h2 upstreams keep gRPC end to end, with its trailers and full duplex streams
+	if config.Transport.HTTP2 && tr.Proxy == nil {
+		if err := http2.ConfigureTransport(tr); err != nil {
+			glog.Fatalf("DIRECT: http2.ConfigureTransport(%#v) error: %v", tr, err)
+		}
+	}
+
+	f := &Filter{
+		Config:        *config,
+		Transport:     tr,
+		TunnelLimit:   &tunnelLimiter{max: config.Transport.MaxConcurrentTunnels},
+		SlowThreshold: time.Duration(config.Logging.SlowThreshold*1000) * time.Millisecond,
+	}
+
+	if hosts := config.Transport.TLSClientConfig.DisableResumptionHosts; len(hosts) > 0 {
+		tr.TLSClientConfig.ClientSessionCache = &sessionCache{
+			ClientSessionCache: tr.TLSClientConfig.ClientSessionCache,
+			skip:               helpers.NewHostMatcher(hosts),
+		}
+	}
+
+	if c := config.Transport.AdaptiveThrottle; c.Enabled {
+		f.Throttle = newAdaptiveThrottle(c.Sensitivity, c.MaxConcurrency, int(cacheSize))
+	}
+
+	// through a proxy the dials are not to the upstreams
+	if c := config.Transport.CoalesceDials; c.Enabled && tr.DialContext != nil {
+		f.Coalescer = newDialCoalescer(c.MaxDials, time.Duration(c.Wait*float32(time.Second)))
+		tr.DialContext = f.Coalescer.dialContext(tr.DialContext)
+	}
+
+	if fingerprint := config.Transport.TLSClientConfig.Fingerprint; fingerprint != "" {
+		handshake, ok := dialer.ClientHelloProfiles[fingerprint]
+		if !ok {
+			return nil, fmt.Errorf("DIRECT: TLSClientConfig.Fingerprint %#v is not a registered ClientHello profile, browser ones need a build with -tags utls", fingerprint)
+		}
+		if tr.Proxy != nil {
+			return nil, fmt.Errorf("DIRECT: TLSClientConfig.Fingerprint %#v does not work with a http(s) Proxy", fingerprint)
+		}
+		f.TLSHandshake = handshake
+	}
+
+	if config.Transport.TLSClientConfig.EnableECH {
+		if config.Transport.TLSClientConfig.Fingerprint != "" || tr.Proxy != nil {
+			return nil, fmt.Errorf("DIRECT: TLSClientConfig.EnableECH does not work with a Fingerprint or a http(s) Proxy")
+		}
+		if dialer.ApplyECH == nil {
+			glog.Warningf("DIRECT: TLSClientConfig.EnableECH needs a binary built with go1.23 or later, dials with plain SNI")
+		}
+		server := config.Transport.TLSClientConfig.ECHDNSServer
+		if server == "" {
+			server = "8.8.8.8:53"
+		}
+		timeout := time.Duration(config.Transport.Dialer.Timeout) * time.Second
+		f.LookupHTTPS = func(host string) ([]*dialer.HTTPSRecord, error) {
+			return dialer.LookupHTTPS(server, host, timeout)
+		}
+		f.ECHConfigs = lrucache.NewLRUCache(cacheSize)
+		f.TLSHandshake = f.echHandshake
+	}
+
+	// queued in dialTLS, so handshakes of any ClientHello profile count
+	if rate := config.Transport.MaxHandshakesPerSecond; rate > 0 {
+		if tr.Proxy != nil {
+			return nil, fmt.Errorf("DIRECT: Transport.MaxHandshakesPerSecond does not work with a http(s) Proxy")
+		}
+		f.HandshakeLimit = newHandshakeLimiter(rate)
+	}
+
+	// the TLS dials are ours, unless a http(s) Proxy tunnels them
+	if tr.Proxy == nil {
+		if f.TLSHandshake == nil {
+			f.TLSHandshake = tlsHandshake
+		}
+		setDialTLS(f, tr)
+	}
+
+	// prior knowledge h2 over plain tcp, for origins which speak nothing else
+	if len(config.Transport.H2CHosts) > 0 {
+		if tr.Proxy != nil {
+			return nil, fmt.Errorf("DIRECT: Transport.H2CHosts does not work with a http(s) Proxy")
+		}
+		f.H2CHosts = helpers.NewHostMatcher(config.Transport.H2CHosts)
+		f.H2C = newH2C(f.dial, tr)
+	}
+
+	if config.Transport.TLSClientConfig.DropPoolOnCertChange {
+		// the conns are tracked in dialTLS
+		if tr.Proxy != nil {
+			return nil, fmt.Errorf("DIRECT: Transport.TLSClientConfig.DropPoolOnCertChange does not work with a http(s) Proxy")
+		}
+		f.CertConns = newCertConns()
+		// as many hosts as tls.NewLRUClientSessionCache keeps sessions of
+		size := config.Transport.TLSClientConfig.ClientSessionCacheSize
+		if size <= 0 {
+			size = 64
+		}
+		f.CertFingerprints = lrucache.NewLRUCache(uint(size))
+	}
+
+	if upstreams := config.Transport.TunnelPool.Upstreams; len(upstreams) > 0 {
+		dialers := make([]proxy.Dialer, len(upstreams))
+		names := make([]string, len(upstreams))
+		for i, s := range upstreams {
+			u, err := url.Parse(s)
+			if err != nil {
+				glog.Fatalf("url.Parse(%#v) error: %s", s, err)
+			}
+			dialers[i], err = proxy.FromURL(u, d, nil)
+			if err != nil {
+				glog.Fatalf("proxy.FromURL(%#v) error: %s", s, err)
+			}
+			// without the credentials, for the logs
+			names[i] = u.Scheme + "://" + u.Host
+		}
+		pool := config.Transport.TunnelPool
+		f.Tunnels = newTunnelPool(dialers, names, pool.Sticky, time.Duration(pool.IdleTimeout)*time.Second, pool.CacheSize)
+	}
+
+	if c := config.Transport.UpstreamRetry; c.Enabled {
+		if f.Tunnels == nil || len(f.Tunnels.dialers) < 2 {
+			return nil, fmt.Errorf("DIRECT: Transport.UpstreamRetry needs two TunnelPool upstreams or more")
+		}
+		if tr.Proxy != nil {
+			return nil, fmt.Errorf("DIRECT: Transport.UpstreamRetry does not work with a http(s) Proxy")
+		}
+		f.UpstreamRetry = newUpstreamRetry(f, f.Tunnels, c.StatusCodes, c.MaxAttempts)
+	}
+
+	if config.Transport.EnableHTTP3 {
+		if NewHTTP3RoundTripper == nil {
+			return nil, fmt.Errorf("DIRECT: Transport.EnableHTTP3 is set but no HTTP/3 RoundTripper is built in, build with -tags quic")
+		}
+		if config.Transport.Proxy.Enabled {
+			return nil, fmt.Errorf("DIRECT: Transport.EnableHTTP3 does not work with a Proxy")
+		}
+		f.HTTP3 = NewHTTP3RoundTripper(tr.TLSClientConfig.Clone(), sockopts)
+		f.AltSvc = helpers.AltSvc
+		if d.QueryHTTPSRecords {
+			f.HTTPSRecord = d.HTTPSRecord
+			f.HTTPSAltSvc = lrucache.NewLRUCache(cacheSize)
+		}
+	}
+
+	if config.Transport.AltSvc {
+		f.AltSvc = helpers.AltSvc
+		if tr.DialContext != nil {
+			tr.DialContext = f.altSvcDialContext(tr.DialContext)
+		}
+	}
+
+	for _, s := range config.Transport.Dialer.AddressFamilyHeaderNets {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("DIRECT: Transport.Dialer.AddressFamilyHeaderNets %#v error: %v", s, err)
+		}
+		f.AddressFamilyNets = append(f.AddressFamilyNets, ipnet)
+	}
+
+	for _, s := range config.Transport.IsolateHeaderNets {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("DIRECT: Transport.IsolateHeaderNets %#v error: %v", s, err)
+		}
+		f.IsolateNets = append(f.IsolateNets, ipnet)
+	}
+
+	// pooled conns may be of the other family
+	if len(config.Transport.IsolateHosts) > 0 || len(f.IsolateNets) > 0 || len(f.AddressFamilyNets) > 0 {
+		f.IsolatedTransport = newIsolatedTransport(tr)
+		// with a TLS config of its own
+		if tr.Proxy == nil {
+			setDialTLS(f, f.IsolatedTransport)
+		}
+		// DialTLS dials without the ctx which carries the family
+		if len(f.AddressFamilyNets) > 0 && f.IsolatedTransport.DialTLS != nil {
+			f.FamilyTransport = newIsolatedTransport(tr)
+			f.FamilyTransport.DialTLS = nil
+		}
+		if len(config.Transport.IsolateHosts) > 0 {
+			f.IsolateHosts = helpers.NewHostMatcher(config.Transport.IsolateHosts)
+		}
+	}
+
+	if len(config.Transport.PreserveConnectionHeaderHosts) > 0 {
+		f.PreserveConnection = helpers.NewHostMatcher(config.Transport.PreserveConnectionHeaderHosts)
+	}
+
+	if len(config.Transport.NormalizeFramingHosts) > 0 {
+		f.NormalizeFraming = helpers.NewHostMatcher(config.Transport.NormalizeFramingHosts)
+	}
+
+	if len(config.Transport.Rules) > 0 {
+		routes, err := newTimeoutRoutes(tr, config)
+		if err != nil {
+			return nil, err
+		}
+		// with the dial timeout of their profile
+		for _, route := range routes {
+			if route.transport.Proxy == nil {
+				setDialTLS(f, route.transport)
+			}
+		}
+		f.TimeoutRoutes = routes
+	}
+
+	if config.Logging.SlowLogFile != "" {
+		file, err := os.OpenFile(config.Logging.SlowLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			glog.Fatalf("DIRECT: os.OpenFile(%#v) error: %v", config.Logging.SlowLogFile, err)
+		}
+		f.SlowLog = log.New(file, "", log.LstdFlags)
+	}
+
+	f.LogRequestHeaders = canonicalHeaderKeys(config.Logging.IncludeRequestHeaders)
+	f.LogResponseHeaders = canonicalHeaderKeys(config.Logging.IncludeResponseHeaders)
+	redact, err := compileRedactPatterns(config.Logging.RedactPatterns)
+	if err != nil {
+		return nil, err
+	}
+	f.LogRedact = redact
+
+	switch config.Logging.Format {
+	case "", accessLogText, accessLogCLF, accessLogCombined:
+	default:
+		return nil, fmt.Errorf("DIRECT: Logging.Format %#v is not text, clf or combined", config.Logging.Format)
+	}
+
+	// syslog servers timestamp records themselves
+	if c := config.Logging.Syslog; c.Enabled {
+		w, err := helpers.NewSyslogWriter(c.Network, c.Address, c.Facility, c.Tag)
+		if err != nil {
+			glog.Fatalf("DIRECT: NewSyslogWriter(%#v, %#v) error: %v", c.Network, c.Address, err)
+		}
+		f.SlowLog = log.New(w, "SLOW ", 0)
+		if c.AccessLog {
+			f.AccessLog = log.New(w, "", 0)
+		}
+	}
+
+	if c := config.Accounting.FlowExport; c.Enabled {
+		w, err := openFlowDestination(c.Destination)
+		if err != nil {
+			return nil, fmt.Errorf("DIRECT: Accounting.FlowExport.Destination %#v error: %v", c.Destination, err)
+		}
+		f.FlowExport = newFlowExporter(w, c.QueueSize)
+	}
+
+	return f, nil
 }
 
 func (f *Filter) FilterName() string {
@@ -139,18 +647,62 @@ func (f *Filter) FilterName() string {
 }
 
 func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	if f.Config.Transport.RejectIPLiterals {
+		if host := requestHost(req); isIPLiteral(host) {
+			glog.V(2).Infof("%s \"DIRECT %s %s %s\" rejected, %s is an ip literal", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, host)
+			body := fmt.Sprintf("DIRECT: %s %s: ip literal hosts are not allowed\n", req.Method, host)
+			filters.MarkRejection(ctx, http.StatusForbidden)
+			return ctx, filters.NewResponse(req, http.StatusForbidden, http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}}, strings.NewReader(body)), nil
+		}
+	}
+
+	// before the hijack of CONNECTs, which can answer no more
+	if max := f.Config.Transport.MaxRequestHeaderCount; max > 0 {
+		if n := headerFieldCount(req.Header); n > max {
+			glog.Warningf("%s \"DIRECT %s %s %s\" rejected, %d header fields over MaxRequestHeaderCount %d", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, n, max)
+			body := fmt.Sprintf("DIRECT: %s %s: %d header fields, at most %d are allowed\n", req.Method, requestHost(req), n, max)
+			return ctx, filters.NewResponse(req, http.StatusRequestHeaderFieldsTooLarge, http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}}, strings.NewReader(body)), nil
+		}
+	}
+
 	switch req.Method {
 	case "CONNECT":
-		glog.V(2).Infof("%s \"DIRECT %s %s %s\" - -", req.RemoteAddr, req.Method, req.Host, req.Proto)
-		rconn, err := f.transport.Dial("tcp", req.Host)
+		id := newTunnelID()
+		glog.V(2).Infof("%s \"DIRECT %s %s %s\" CONNECT-OPEN id=%s host=%s", req.RemoteAddr, req.Method, req.Host, req.Proto, id, req.Host)
+		// refused before dialing, so a flood holds no fds beyond the limit
+		if !f.TunnelLimit.acquire() {
+			glog.Warningf("%s \"DIRECT %s %s %s\" id=%s refused, %d tunnels open", req.RemoteAddr, req.Method, req.Host, req.Proto, id, f.Config.Transport.MaxConcurrentTunnels)
+			body := fmt.Sprintf("DIRECT: %s %s: too many tunnels\n", req.Method, req.Host)
+			return ctx, filters.NewResponse(req, http.StatusServiceUnavailable, http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}}, strings.NewReader(body)), nil
+		}
+		defer f.TunnelLimit.release()
+
+		if family := f.addressFamily(req); family != "" {
+			glog.V(2).Infof("%s \"DIRECT %s %s %s\" id=%s over %s", req.RemoteAddr, req.Method, req.Host, req.Proto, id, family)
+			ctx = dialer.WithAddressFamily(ctx, family)
+		}
+
+		start := time.Now()
+		var rconn net.Conn
+		var upstream int
+		var err error
+		if f.Tunnels != nil {
+			rconn, upstream, err = f.Tunnels.dial(ctx, req, id)
+		} else {
+			rconn, err = f.dial(ctx, "tcp", req.Host)
+		}
 		if err != nil {
-			return ctx, nil, err
+			glog.Warningf("%s \"DIRECT %s %s %s\" id=%s dial error: %v", req.RemoteAddr, req.Method, req.Host, req.Proto, id, err)
+			ctx = filters.WithString(ctx, filters.RoundTripErrorKey, err.Error())
+			return ctx, dialErrorResponse(req, err), nil
 		}
 
 		rw := filters.GetResponseWriter(ctx)
 
+		// h2 streams can not be hijacked off their conn, they are relayed
+		mode := connectMode(f.Config.Transport.ConnectMode, req)
 		hijacker, ok := rw.(http.Hijacker)
-		if !ok {
+		if !ok && mode == connectModeHijack {
 			return ctx, nil, fmt.Errorf("http.ResponseWriter(%#v) does not implments http.Hijacker", rw)
 		}
 
@@ -159,25 +711,222 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 			return ctx, nil, fmt.Errorf("http.ResponseWriter(%#v) does not implments http.Flusher", rw)
 		}
 
+		compression := f.Config.Transport.TunnelCompression && req.Header.Get(proxy.TunnelCompressionHeader) == proxy.TunnelCompressionDeflate
+		if compression {
+			rw.Header().Set(proxy.TunnelCompressionHeader, proxy.TunnelCompressionDeflate)
+		}
+
 		rw.WriteHeader(http.StatusOK)
 		flusher.Flush()
 
-		lconn, _, err := hijacker.Hijack()
-		if err != nil {
+		var lconn net.Conn
+		if mode == connectModeStream {
+			lconn = newStreamConn(req, rw, flusher)
+		} else if lconn, _, err = hijacker.Hijack(); err != nil {
+			rconn.Close()
 			return ctx, nil, fmt.Errorf("%#v.Hijack() error: %v", hijacker, err)
 		}
-		defer lconn.Close()
+		if compression {
+			lconn = proxy.NewDeflateConn(lconn)
+		}
+		if f.Config.Transport.SplitClientHello {
+			rconn = newSplitHelloConn(rconn, f.Config.Transport.SplitClientHelloOffset)
+		}
+
+		var upSrc, downSrc io.Reader = lconn, rconn
+		if kbps := f.Config.Transport.TunnelBurstKBps; kbps > 0 {
+			window := time.Duration(f.Config.Transport.TunnelBurstWindow*1000) * time.Millisecond
+			upSrc, downSrc = newBurstReader(lconn, kbps, window), newBurstReader(rconn, kbps, window)
+		}
 
-		go helpers.IoCopy(rconn, lconn)
-		helpers.IoCopy(lconn, rconn)
+		up := make(chan int64, 1)
+		go func() {
+			var n int64
+			if f.Config.Transport.EnforceConnectSNIMatch {
+				var ok bool
+				if n, ok = f.enforceConnectSNI(req, id, lconn, rconn); !ok {
+					lconn.Close()
+					rconn.Close()
+					up <- n
+					return
+				}
+			}
+			n1, _ := helpers.IoCopy(rconn, upSrc)
+			up <- n + n1
+		}()
+		down, _ := helpers.IoCopy(lconn, downSrc)
+
+		// unblock the upstream copy, then both byte counts are final
+		lconn.Close()
+		rconn.Close()
+
+		bytesUp, end := <-up, time.Now()
+		duration := end.Sub(start)
+		if f.Tunnels != nil {
+			f.Tunnels.touch(clientIP(req), upstream)
+		}
+		if f.FlowExport != nil {
+			clientIP, clientPort := splitFlowAddr(req.RemoteAddr)
+			upstreamIP, upstreamPort := splitFlowAddr(rconn.RemoteAddr().String())
+			f.FlowExport.export(&flowRecord{
+				ID:           id,
+				Host:         req.Host,
+				Protocol:     "tcp",
+				ClientIP:     clientIP,
+				ClientPort:   clientPort,
+				UpstreamIP:   upstreamIP,
+				UpstreamPort: upstreamPort,
+				BytesUp:      bytesUp,
+				BytesDown:    down,
+				Start:        start.UnixNano() / int64(time.Millisecond),
+				End:          end.UnixNano() / int64(time.Millisecond),
+			})
+		}
+		glog.V(2).Infof("%s \"DIRECT %s %s %s\" CONNECT-CLOSE id=%s bytes_up=%d bytes_down=%d duration=%s", req.RemoteAddr, req.Method, req.Host, req.Proto, id, bytesUp, down, duration)
+		if f.AccessLog != nil {
+			f.logAccess(&accessEntry{
+				req:    req,
+				user:   filters.String(ctx, filters.AuthUserKey),
+				id:     filters.String(ctx, filters.RequestIDKey),
+				start:  start,
+				status: http.StatusOK,
+				size:   down,
+				text:   fmt.Sprintf("%s \"DIRECT %s %s %s\" 200 bytes_up=%d bytes_down=%d duration=%s%s", req.RemoteAddr, req.Method, req.Host, req.Proto, bytesUp, down, duration, f.headerFields(req.Header, nil)),
+			})
+		}
 
 		return ctx, filters.DummyResponse, nil
 	default:
 		helpers.FixRequestURL(req)
-		resp, err := f.transport.RoundTrip(req)
+		req = f.removeHopHeaders(req)
+
+		if f.isolate(req) {
+			glog.V(2).Infof("%s \"DIRECT %s %s %s\" on an isolated connection", req.RemoteAddr, req.Method, req.URL.String(), req.Proto)
+			req = req.WithContext(context.WithValue(req.Context(), isolateKey{}, true))
+			req.Close = true
+		}
+
+		if family := f.addressFamily(req); family != "" {
+			glog.V(2).Infof("%s \"DIRECT %s %s %s\" on an isolated connection over %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, family)
+			ctx1 := dialer.WithAddressFamily(req.Context(), family)
+			ctx1 = context.WithValue(ctx1, familyKey{}, family)
+			req = req.WithContext(context.WithValue(ctx1, isolateKey{}, true))
+			req.Close = true
+		}
+
+		var pinned *pinnedTransport
+		req, pinned = f.pin(ctx, req)
+
+		var timing *helpers.RequestTiming
+		if f.SlowThreshold > 0 {
+			var trace *httptrace.ClientTrace
+			timing, trace = helpers.NewRequestTiming()
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		}
+		if f.CertConns != nil && req.URL.Scheme == "https" {
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), f.CertConns.trace(req.URL.Hostname())))
+		}
+
+		requestHeaderBytes.Observe(float64(helpers.RequestHeaderSize(req)))
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = helpers.NewCountReadCloser(req.Body, func(n int64) {
+				requestBodyBytes.Observe(float64(n))
+			})
+		}
+
+		// the slot is held until the response header, the answer the limit
+		// adapts to
+		var throttle *hostThrottle
+		if f.Throttle != nil {
+			var ok bool
+			if throttle, ok = f.Throttle.acquire(req.URL.Host); !ok {
+				glog.Warningf("%s \"DIRECT %s %s %s\" throttled, upstream answers 429/503", req.RemoteAddr, req.Method, req.URL.String(), req.Proto)
+				if pinned != nil {
+					pinned.end()
+				}
+				body := fmt.Sprintf("DIRECT: %s %s: throttled after upstream 429/503 responses\n", req.Method, req.URL.String())
+				return ctx, filters.NewResponse(req, http.StatusServiceUnavailable, http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}, "Retry-After": []string{"1"}}, strings.NewReader(body)), nil
+			}
+		}
+
+		// a burst to a cold upstream waits for the conns of its first dials
+		if f.Coalescer != nil {
+			req = f.Coalescer.acquire(req)
+		}
+
+		start := time.Now()
+		resp, err := f.roundTrip(req)
+		if pinned != nil {
+			if err != nil {
+				pinned.end()
+			} else {
+				resp.Body = pinned.body(resp.Body)
+			}
+		}
+
+		if f.Coalescer != nil {
+			f.Coalescer.release(req, resp)
+		}
+
+		if throttle != nil {
+			status := 0
+			if err == nil {
+				status = resp.StatusCode
+			}
+			f.Throttle.release(throttle, status)
+		}
 
 		if err != nil {
-			return ctx, nil, err
+			if timing != nil {
+				f.logSlow(req, timing, "error=%v", err)
+			}
+			glog.Warningf("%s \"DIRECT %s %s %s\" error: %v", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, err)
+			ctx = filters.WithString(ctx, filters.RoundTripErrorKey, err.Error())
+			return ctx, errorResponse(req, err), nil
+		}
+
+		if max := f.Config.Transport.MaxResponseBodyBytes; max > 0 {
+			if resp.ContentLength > max {
+				resp.Body.Close()
+				err = fmt.Errorf("response body of %d bytes exceeds MaxResponseBodyBytes %d", resp.ContentLength, max)
+				glog.Warningf("%s \"DIRECT %s %s %s\" error: %v", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, err)
+				ctx = filters.WithString(ctx, filters.RoundTripErrorKey, err.Error())
+				return ctx, errorResponse(req, err), nil
+			}
+			// unknown lengths are cut at max, and the client conn dropped
+			resp.Body = helpers.NewLimitedReadCloser(resp.Body, max)
+		}
+
+		if resp, err = f.normalizeFraming(req, resp); err != nil {
+			glog.Warningf("%s \"DIRECT %s %s %s\" error: %v", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, err)
+			ctx = filters.WithString(ctx, filters.RoundTripErrorKey, err.Error())
+			return ctx, errorResponse(req, err), nil
+		}
+
+		responseHeaderBytes.Observe(float64(helpers.ResponseHeaderSize(resp)))
+		resp.Body = helpers.NewCountReadCloser(resp.Body, func(n int64) {
+			responseBodyBytes.Observe(float64(n))
+			if f.AccessLog != nil {
+				f.logAccess(&accessEntry{
+					req:    req,
+					user:   filters.String(ctx, filters.AuthUserKey),
+					id:     filters.String(ctx, filters.RequestIDKey),
+					start:  start,
+					status: resp.StatusCode,
+					size:   n,
+					text:   fmt.Sprintf("%s \"DIRECT %s %s %s\" %d %d%s%s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, resp.StatusCode, n, tlsFields(resp.TLS), f.headerFields(req.Header, resp.Header)),
+				})
+			}
+			if timing != nil {
+				f.logSlow(req, timing, "%d %d", resp.StatusCode, n)
+			}
+		})
+
+		// Content-MD5/Digest of 206 responses do not cover the partial body, and
+		// HEAD or empty responses have no body to check the digest of the GET
+		// one against
+		if f.Config.Transport.VerifyDigest && resp.StatusCode == http.StatusOK && !resp.Uncompressed && req.Method != http.MethodHead && resp.ContentLength != 0 {
+			resp.Body = helpers.NewDigestReadCloser(resp.Body, resp.Header)
 		}
 
 		if req.RemoteAddr != "" {
@@ -187,3 +936,239 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 		return ctx, resp, err
 	}
 }
+
+func (f *Filter) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if f.Transport.DialContext != nil {
+		return f.Transport.DialContext(ctx, network, address)
+	}
+	return f.Transport.Dial(network, address)
+}
+
+// setDialTLS makes tr dial its TLS conns with dialTLS, go1.14 builds hand the
+// ctx of the request to dialTLSContext instead.
+var setDialTLS = func(f *Filter, tr *http.Transport) {
+	tr.DialTLS = f.dialTLS(tr)
+}
+
+// copyDialTLS makes dst dial its TLS conns as src does.
+var copyDialTLS = func(dst, src *http.Transport) {
+	dst.DialTLS = src.DialTLS
+}
+
+// dialTLS is dialTLSContext for the DialTLS of go1.13 and before, which is
+// not handed the ctx of the request.
+func (f *Filter) dialTLS(tr *http.Transport) func(network, address string) (net.Conn, error) {
+	dial := f.dialTLSContext(tr)
+	return func(network, address string) (net.Conn, error) {
+		return dial(context.Background(), network, address)
+	}
+}
+
+// dialTLSContext returns the DialTLSContext of tr, which dials with its
+// DialContext, waits for MaxHandshakesPerSecond and hands the conn to
+// f.TLSHandshake with the tls.Config of the upstream, under the
+// TLSHandshakeTimeout of tr. The transport negotiates h2 from the ALPN of the
+// *tls.Conn it returns. An upstream rejecting ECH is dialed once more, with
+// the retry configs it gave.
+func (f *Filter) dialTLSContext(tr *http.Transport) func(ctx context.Context, network, address string) (net.Conn, error) {
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		wait := f.lookupECH(address)
+
+		var conn net.Conn
+		var err error
+		if tr.DialContext != nil {
+			conn, err = tr.DialContext(ctx, network, address)
+		} else {
+			conn, err = tr.Dial(network, address)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if f.HandshakeLimit != nil {
+			if err := f.HandshakeLimit.wait(tr.TLSHandshakeTimeout); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+
+		if timeout := tr.TLSHandshakeTimeout; timeout > 0 {
+			conn.SetDeadline(time.Now().Add(timeout))
+		}
+
+		var tracked *certConn
+		if f.CertConns != nil {
+			host, _, _ := net.SplitHostPort(address)
+			tracked = f.CertConns.track(host, conn)
+			conn = tracked
+		}
+
+		wait()
+		// a canceled request aborts the handshake through the deadline
+		done := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				conn.SetDeadline(time.Now())
+			case <-done:
+			}
+		}()
+		// net/http traces the handshake of a custom dialer only after it
+		// returns, so report the one done here to the trace of the request
+		trace := httptrace.ContextClientTrace(ctx)
+		if trace != nil && trace.TLSHandshakeStart != nil {
+			trace.TLSHandshakeStart()
+		}
+		tconn, err := f.TLSHandshake(conn, f.tlsConfig(tr, address))
+		close(done)
+		<-stopped
+		if err == nil {
+			err = ctx.Err()
+		}
+		if trace != nil && trace.TLSHandshakeDone != nil {
+			var state tls.ConnectionState
+			if c, ok := tconn.(interface{ ConnectionState() tls.ConnectionState }); ok && err == nil {
+				state = c.ConnectionState()
+			}
+			trace.TLSHandshakeDone(state, err)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		if tracked != nil {
+			f.CertConns.add(tracked, tconn)
+		}
+
+		return tconn, nil
+	}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if _, ok := err.(*echRetryError); ok {
+			glog.V(2).Infof("DIRECT: %s rejects ECH, %v, retries", address, err)
+			conn, err = dial(ctx, network, address)
+		}
+		return conn, err
+	}
+}
+
+// tlsConfig returns the tls.Config to dial the upstream at address with, the
+// one of tr with its server name. It shares the ClientSessionCache of tr, so
+// sessions resume across conns.
+func (f *Filter) tlsConfig(tr *http.Transport, address string) *tls.Config {
+	config := tr.TLSClientConfig.Clone()
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			config.ServerName = host
+		}
+	}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"http/1.1"}
+	}
+	return config
+}
+
+// tlsHandshake is the crypto/tls handshake, of dialTLS without a ClientHello
+// profile or ECH.
+func tlsHandshake(conn net.Conn, config *tls.Config) (net.Conn, error) {
+	tconn := tls.Client(conn, config)
+	if err := tconn.Handshake(); err != nil {
+		return nil, err
+	}
+	return tconn, nil
+}
+
+// tlsFields formats the parameters of the upstream TLS conn for the access
+// log, empty for plain http upstreams.
+func tlsFields(state *tls.ConnectionState) string {
+	if state == nil {
+		return ""
+	}
+
+	version := helpers.TLSVersionName(state.Version)
+	if version == "" {
+		version = fmt.Sprintf("0x%04x", state.Version)
+	}
+	cipher := helpers.CipherName(state.CipherSuite)
+	if cipher == "" {
+		cipher = fmt.Sprintf("0x%04x", state.CipherSuite)
+	}
+	alpn := state.NegotiatedProtocol
+	if alpn == "" {
+		alpn = "-"
+	}
+
+	return fmt.Sprintf(" tls_version=%s tls_cipher=%s tls_resumed=%t alpn=%s", version, cipher, state.DidResume, alpn)
+}
+
+// logSlow logs req with its timing breakdown if it took longer than SlowThreshold.
+func (f *Filter) logSlow(req *http.Request, timing *helpers.RequestTiming, format string, a ...interface{}) {
+	if time.Since(timing.Start) < f.SlowThreshold {
+		return
+	}
+
+	msg := fmt.Sprintf("%s \"DIRECT %s %s %s\" %s %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, fmt.Sprintf(format, a...), timing)
+	if f.SlowLog != nil {
+		f.SlowLog.Print(msg)
+	} else {
+		glog.Warningf("SLOW %s", msg)
+	}
+}
+
+// newTunnelID returns a short random id pairing the open and close log lines
+// of a tunnel.
+func newTunnelID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// dialErrorResponse answers a CONNECT request with a status matching the dial
+// error, before anything is hijacked.
+func dialErrorResponse(req *http.Request, err error) *http.Response {
+	status := http.StatusBadGateway
+	reason := "connect failed"
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		status = http.StatusGatewayTimeout
+		reason = "connect timeout"
+	} else {
+		if oe, ok := err.(*net.OpError); ok {
+			err1 := oe.Err
+			if se, ok := err1.(*os.SyscallError); ok {
+				err1 = se.Err
+			}
+			switch err1.(type) {
+			case *net.DNSError:
+				reason = "dns lookup failed"
+			case syscall.Errno:
+				if err1 == syscall.ECONNREFUSED {
+					reason = "connection refused"
+				}
+			}
+		}
+		if _, ok := err.(*net.DNSError); ok {
+			reason = "dns lookup failed"
+		}
+	}
+
+	body := fmt.Sprintf("DIRECT: %s %s: %s\n", req.Method, req.Host, reason)
+	return filters.NewResponse(req, status, http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}}, strings.NewReader(body))
+}
+
+// errorResponse answers a request failed upstream, so that ResponseFilters see it.
+func errorResponse(req *http.Request, err error) *http.Response {
+	status := http.StatusBadGateway
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		status = http.StatusGatewayTimeout
+	}
+
+	body := fmt.Sprintf("DIRECT: %s %s: %v\n", req.Method, req.URL.String(), err)
+	return filters.NewResponse(req, status, http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}}, strings.NewReader(body))
+}
@@ -0,0 +1,684 @@
+package direct
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"../../dialer"
+	"../../filters"
+	"../../helpers"
+)
+
+func newTestFilter(t *testing.T) *Filter {
+	config := new(Config)
+	config.Transport.Dialer.Timeout = 4
+	config.Transport.Dialer.DNSCacheSize = 64
+
+	f, err := NewFilter(config)
+	if err != nil {
+		t.Fatalf("NewFilter(%#v) error: %v", config, err)
+	}
+
+	return f.(*Filter)
+}
+
+func setDial(f *Filter, dial func(network, addr string) (net.Conn, error)) {
+	f.Transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dial(network, addr)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "hello "+req.URL.Path)
+	}))
+	defer ts.Close()
+
+	f := newTestFilter(t)
+	setDial(f, net.Dial)
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/world", nil)
+	_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+	if err != nil {
+		t.Fatalf("%T.RoundTrip(%#v) error: %v", f, req.URL.String(), err)
+	}
+	defer resp.Body.Close()
+
+	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(b) != "hello /world" {
+		t.Errorf("%T.RoundTrip(%#v) return %d %#v", f, req.URL.String(), resp.StatusCode, string(b))
+	}
+}
+
+func TestRoundTripConnect(t *testing.T) {
+	f := newTestFilter(t)
+	setDial(f, func(network, addr string) (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		go func() {
+			defer c2.Close()
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(c2, b); err == nil {
+				c2.Write(b)
+			}
+		}()
+		return c1, nil
+	})
+
+	lconn, conn := net.Pipe()
+	defer conn.Close()
+	rw := filters.NewTestResponseWriter(lconn)
+
+	req, _ := http.NewRequest(http.MethodConnect, "http://example.org:443", nil)
+
+	done := make(chan *http.Response, 1)
+	go func() {
+		_, resp, err := f.RoundTrip(filters.NewTestContext(rw), req)
+		if err != nil {
+			t.Errorf("%T.RoundTrip(%#v) error: %v", f, req.Host, err)
+		}
+		done <- resp
+	}()
+
+	io.WriteString(conn, "ping")
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatalf("io.ReadFull(%T) error: %v", conn, err)
+	}
+	if string(b) != "ping" {
+		t.Errorf("CONNECT tunnel echo = %#v, want %#v", string(b), "ping")
+	}
+
+	if resp := <-done; resp != filters.DummyResponse {
+		t.Errorf("%T.RoundTrip(%#v) return %#v, want filters.DummyResponse", f, req.Host, resp)
+	}
+	if rw.Code != http.StatusOK || !rw.Hijacked {
+		t.Errorf("CONNECT ResponseWriter code=%d hijacked=%v", rw.Code, rw.Hijacked)
+	}
+}
+
+func TestNewTunnelID(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := newTunnelID()
+		if len(id) != 12 || seen[id] {
+			t.Fatalf("newTunnelID() = %#v, want 12 unique hex digits", id)
+		}
+		seen[id] = true
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRoundTripConnectDialError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	refused := ln.Addr().String()
+	ln.Close()
+
+	var cases = []struct {
+		Dial   func(network, addr string) (net.Conn, error)
+		Status int
+		Reason string
+	}{
+		{
+			net.Dial,
+			http.StatusBadGateway,
+			"connection refused",
+		},
+		{
+			func(network, addr string) (net.Conn, error) {
+				return nil, &net.OpError{Op: "dial", Net: network, Err: timeoutError{}}
+			},
+			http.StatusGatewayTimeout,
+			"connect timeout",
+		},
+		{
+			func(network, addr string) (net.Conn, error) {
+				return nil, &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Err: "no such host", Name: "example.invalid"}}
+			},
+			http.StatusBadGateway,
+			"dns lookup failed",
+		},
+	}
+
+	for _, c := range cases {
+		f := newTestFilter(t)
+		setDial(f, c.Dial)
+
+		rw := filters.NewTestResponseWriter(nil)
+		req, _ := http.NewRequest(http.MethodConnect, "http://"+refused, nil)
+
+		_, resp, err := f.RoundTrip(filters.NewTestContext(rw), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip(%#v) error: %v", f, req.Host, err)
+		}
+
+		b, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != c.Status || !strings.Contains(string(b), c.Reason) {
+			t.Errorf("%T.RoundTrip(%#v) return %d %#v, want %d %#v", f, req.Host, resp.StatusCode, string(b), c.Status, c.Reason)
+		}
+		if rw.Hijacked {
+			t.Errorf("%T.RoundTrip(%#v) hijacked the connection on dial error", f, req.Host)
+		}
+	}
+}
+
+func TestRoundTripVerifyDigest(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// md5("hello world"), the body is tampered for /tampered
+		rw.Header().Set("Content-MD5", "XrY7u+Ae7tCTyyK7j1rNww==")
+		switch req.URL.Path {
+		case "/tampered":
+			io.WriteString(rw, "hello w0rld")
+		case "/empty":
+			rw.Header().Set("Content-Length", "0")
+		case "/nocontent":
+			rw.WriteHeader(http.StatusNoContent)
+		default:
+			rw.Header().Set("Content-Length", "11")
+			if req.Method != http.MethodHead {
+				io.WriteString(rw, "hello world")
+			}
+		}
+	}))
+	defer ts.Close()
+
+	f := newTestFilter(t)
+	f.Config.Transport.VerifyDigest = true
+	setDial(f, net.Dial)
+
+	cases := []struct {
+		method string
+		path   string
+		err    error
+	}{
+		{http.MethodGet, "/", nil},
+		{http.MethodGet, "/tampered", helpers.ErrDigestMismatch},
+		// bodiless responses carry the digest of the GET body
+		{http.MethodHead, "/", nil},
+		{http.MethodGet, "/empty", nil},
+		{http.MethodGet, "/nocontent", nil},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, ts.URL+c.path, nil)
+		_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip(%s %#v) error: %v", f, c.method, req.URL.String(), err)
+		}
+
+		_, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != c.err {
+			t.Errorf("%T.RoundTrip(%s %#v) body error %v, want %v", f, c.method, req.URL.String(), err, c.err)
+		}
+	}
+}
+
+func TestRoundTripMetrics(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.Copy(rw, req.Body)
+	}))
+	defer ts.Close()
+
+	f := newTestFilter(t)
+	setDial(f, net.Dial)
+
+	histograms := []*helpers.Histogram{requestHeaderBytes, responseHeaderBytes, requestBodyBytes, responseBodyBytes}
+	counts := make([]uint64, len(histograms))
+	for i, h := range histograms {
+		counts[i] = h.Count()
+	}
+	sum := responseBodyBytes.Sum()
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL, strings.NewReader("hello world"))
+	_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+	if err != nil {
+		t.Fatalf("%T.RoundTrip(%#v) error: %v", f, req.URL.String(), err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	for i, h := range histograms {
+		if h.Count() != counts[i]+1 {
+			t.Errorf("%T.RoundTrip observes histogram #%d %d times, want 1", f, i, h.Count()-counts[i])
+		}
+	}
+	if n := responseBodyBytes.Sum() - sum; n != 11 {
+		t.Errorf("%T.RoundTrip counts %v response body bytes, want %v", f, n, 11)
+	}
+}
+
+func TestRoundTripSlowLog(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		io.WriteString(rw, "hello")
+	}))
+	defer ts.Close()
+
+	buf := new(bytes.Buffer)
+
+	f := newTestFilter(t)
+	f.SlowThreshold = 50 * time.Millisecond
+	f.SlowLog = log.New(buf, "", 0)
+	setDial(f, net.Dial)
+
+	for _, path := range []string{"/fast", "/slow"} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip(%#v) error: %v", f, req.URL.String(), err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	s := buf.String()
+	if !strings.Contains(s, "/slow") || !strings.Contains(s, "ttfb=") || strings.Contains(s, "/fast") {
+		t.Errorf("%T.RoundTrip slow log = %#v", f, s)
+	}
+}
+
+func TestRoundTripError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	refused := ln.Addr().String()
+	ln.Close()
+
+	f := newTestFilter(t)
+	setDial(f, net.Dial)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+refused+"/", nil)
+	ctx, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+	if err != nil {
+		t.Fatalf("%T.RoundTrip(%#v) error: %v", f, req.URL.String(), err)
+	}
+
+	if resp.StatusCode != http.StatusBadGateway || filters.String(ctx, filters.RoundTripErrorKey) == "" {
+		t.Errorf("%T.RoundTrip(%#v) return %d, error %#v", f, req.URL.String(), resp.StatusCode, filters.String(ctx, filters.RoundTripErrorKey))
+	}
+}
+
+func TestRoundTripIdleConnTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	// the first conn turns into a black hole after one response, as if a NAT
+	// mapping was dropped while it was idle
+	go func() {
+		for i := 0; ; i++ {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn, blackhole bool) {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				for {
+					req, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+					io.Copy(ioutil.Discard, req.Body)
+					io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+					if blackhole {
+						time.Sleep(time.Minute)
+						return
+					}
+				}
+			}(c, i == 0)
+		}
+	}()
+
+	f := newTestFilter(t)
+	f.Transport.IdleConnTimeout = 50 * time.Millisecond
+	f.Transport.ResponseHeaderTimeout = 2 * time.Second
+	setDial(f, net.Dial)
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+ln.Addr().String()+"/", nil)
+		_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip(%#v) error: %v", f, req.URL.String(), err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%T.RoundTrip #%d uses a broken idle conn, status %d", f, i, resp.StatusCode)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestRoundTripDialOverrides(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, req.Host+" "+req.TLS.ServerName)
+	}))
+	defer ts.Close()
+
+	config := new(Config)
+	config.Transport.Dialer.DNSCacheSize = 64
+	config.Transport.TLSClientConfig.InsecureSkipVerify = true
+	config.Transport.DialOverrides = map[string]string{
+		"example.org": ts.Listener.Addr().String(),
+	}
+
+	f1, err := NewFilter(config)
+	if err != nil {
+		t.Fatalf("NewFilter(%#v) error: %v", config, err)
+	}
+	f := f1.(*Filter)
+
+	req, _ := http.NewRequest(http.MethodGet, "https://example.org/", nil)
+	_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+	if err != nil {
+		t.Fatalf("%T.RoundTrip(%#v) error: %v", f, req.URL.String(), err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "example.org example.org" {
+		t.Errorf("%T.RoundTrip(%#v) upstream got Host and SNI %#v", f, req.URL.String(), string(b))
+	}
+
+	// CONNECT is dialed to the override too, the TLS server sees the SNI of the client
+	lconn, conn := net.Pipe()
+	defer conn.Close()
+	rw := filters.NewTestResponseWriter(lconn)
+
+	req, _ = http.NewRequest(http.MethodConnect, "http://example.org:443", nil)
+	go f.RoundTrip(filters.NewTestContext(rw), req)
+
+	tc := tls.Client(conn, &tls.Config{ServerName: "example.org", InsecureSkipVerify: true})
+	if err := tc.Handshake(); err != nil {
+		t.Fatalf("CONNECT %#v tls handshake error: %v", req.Host, err)
+	}
+	if _, err := io.WriteString(tc, "GET / HTTP/1.1\r\nHost: example.org\r\nConnection: close\r\n\r\n"); err != nil {
+		t.Fatalf("CONNECT %#v write error: %v", req.Host, err)
+	}
+	resp, err = http.ReadResponse(bufio.NewReader(tc), nil)
+	if err != nil {
+		t.Fatalf("CONNECT %#v http.ReadResponse error: %v", req.Host, err)
+	}
+	b, _ = ioutil.ReadAll(resp.Body)
+	if string(b) != "example.org example.org" {
+		t.Errorf("CONNECT %#v upstream got Host and SNI %#v", req.Host, string(b))
+	}
+}
+
+func TestRoundTripExpectContinueRejected(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if _, err := http.ReadRequest(bufio.NewReader(c)); err != nil {
+			return
+		}
+		io.WriteString(c, "HTTP/1.1 417 Expectation Failed\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	}()
+
+	f := newTestFilter(t)
+	f.Transport.ExpectContinueTimeout = 5 * time.Second
+	setDial(f, net.Dial)
+
+	// the client body never comes, the upstream rejects it before
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, "http://"+ln.Addr().String()+"/upload", pr)
+	req.ContentLength = 1024
+	req.Header.Set("Expect", "100-continue")
+
+	start := time.Now()
+	_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+	if err != nil {
+		t.Fatalf("%T.RoundTrip(%#v) error: %v", f, req.URL.String(), err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusExpectationFailed {
+		t.Errorf("%T.RoundTrip(%#v) return status %d, want %d", f, req.URL.String(), resp.StatusCode, http.StatusExpectationFailed)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("%T.RoundTrip(%#v) stalls %s on a rejected Expect", f, req.URL.String(), d)
+	}
+}
+
+func TestRoundTripFingerprint(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "hello")
+	}))
+	defer ts.Close()
+
+	var serverName string
+	dialer.ClientHelloProfiles["test"] = func(conn net.Conn, config *tls.Config) (net.Conn, error) {
+		serverName = config.ServerName
+		config.InsecureSkipVerify = true
+		tconn := tls.Client(conn, config)
+		return tconn, tconn.Handshake()
+	}
+	defer delete(dialer.ClientHelloProfiles, "test")
+
+	config := new(Config)
+	config.Transport.Dialer.Timeout = 4
+	config.Transport.TLSClientConfig.Fingerprint = "test"
+	f, err := NewFilter(config)
+	if err != nil {
+		t.Fatalf("NewFilter(%#v) error: %v", config, err)
+	}
+	setDial(f.(*Filter), net.Dial)
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+	_, resp, err := f.(*Filter).RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+	if err != nil {
+		t.Fatalf("%T.RoundTrip(%#v) error: %v", f, req.URL.String(), err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(b) != "hello" {
+		t.Errorf("%T.RoundTrip(%#v) return %d %#v", f, req.URL.String(), resp.StatusCode, string(b))
+	}
+	if serverName != "127.0.0.1" {
+		t.Errorf("ClientHello profile called with ServerName %#v, want %#v", serverName, "127.0.0.1")
+	}
+
+	config.Transport.TLSClientConfig.Fingerprint = "unknown"
+	if _, err := NewFilter(config); err == nil {
+		t.Errorf("NewFilter() with an unknown Fingerprint returns no error")
+	}
+}
+
+func TestRoundTripAccessLogTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "hello")
+	}))
+	defer ts.Close()
+
+	f := newTestFilter(t)
+	f.Transport.TLSClientConfig.InsecureSkipVerify = true
+	setDial(f, net.Dial)
+
+	var buf bytes.Buffer
+	f.AccessLog = log.New(&buf, "", 0)
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+	_, resp, err := f.RoundTrip(filters.NewTestContext(nil), req)
+	if err != nil {
+		t.Fatalf("%T.RoundTrip() error: %v", f, err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	line := buf.String()
+	for _, field := range []string{"tls_version=TLS1.", "tls_cipher=TLS_", "tls_resumed=false", "alpn="} {
+		if !strings.Contains(line, field) {
+			t.Errorf("%T access log %#v lacks %#v", f, line, field)
+		}
+	}
+	if strings.Contains(line, "0x") {
+		t.Errorf("%T access log %#v has unnamed TLS parameters", f, line)
+	}
+}
+
+func TestRoundTripAccessLogHeaders(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Header().Set("X-Backend-Id", "web-7")
+		rw.Header().Set("Set-Cookie", "session=42")
+		io.WriteString(rw, "hello")
+	}))
+	defer ts.Close()
+
+	config := new(Config)
+	config.Transport.Dialer.Timeout = 4
+	config.Transport.Dialer.DNSCacheSize = 64
+	config.Logging.IncludeRequestHeaders = []string{"authorization", "x-missing"}
+	config.Logging.IncludeResponseHeaders = []string{"Content-Type", "x-backend-id"}
+	config.Logging.RedactPatterns = []string{`(?i)bearer \S+`}
+	f1, err := NewFilter(config)
+	if err != nil {
+		t.Fatalf("NewFilter(%#v) error: %v", config, err)
+	}
+	f := f1.(*Filter)
+	setDial(f, net.Dial)
+
+	var buf bytes.Buffer
+	f.AccessLog = log.New(&buf, "", 0)
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	req.Header.Set("Cookie", "session=42")
+	_, resp, err := f.RoundTrip(filters.NewTestContext(nil), req)
+	if err != nil {
+		t.Fatalf("%T.RoundTrip() error: %v", f, err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	line := buf.String()
+	for _, field := range []string{`req_authorization="[REDACTED]"`, `resp_content_type="text/plain"`, `resp_x_backend_id="web-7"`} {
+		if !strings.Contains(line, field) {
+			t.Errorf("%T access log %#v lacks %#v", f, line, field)
+		}
+	}
+	for _, s := range []string{"s3cr3t", "session", "x_missing"} {
+		if strings.Contains(line, s) {
+			t.Errorf("%T access log %#v has %#v", f, line, s)
+		}
+	}
+
+	config.Logging.RedactPatterns = []string{"("}
+	if _, err := NewFilter(config); err == nil {
+		t.Errorf("NewFilter() with an invalid RedactPatterns regexp returns no error")
+	}
+}
+
+func TestRoundTripMaxResponseBodyBytes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body := strings.Repeat("x", 64)
+		if req.URL.Path == "/chunked" {
+			// no Content-Length once flushed before the body
+			rw.(http.Flusher).Flush()
+		} else {
+			rw.Header().Set("Content-Length", "64")
+		}
+		io.WriteString(rw, body)
+	}))
+	defer ts.Close()
+
+	f := newTestFilter(t)
+	f.Config.Transport.MaxResponseBodyBytes = 16
+	setDial(f, net.Dial)
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/known", nil)
+	_, resp, err := f.RoundTrip(filters.NewTestContext(nil), req)
+	if err != nil {
+		t.Fatalf("%T.RoundTrip() error: %v", f, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("%T.RoundTrip() of a known length over the limit returns %d, want %d", f, resp.StatusCode, http.StatusBadGateway)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, ts.URL+"/chunked", nil)
+	_, resp, err = f.RoundTrip(filters.NewTestContext(nil), req)
+	if err != nil {
+		t.Fatalf("%T.RoundTrip() error: %v", f, err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != -1 {
+		t.Fatalf("%T.RoundTrip() of an unknown length returns %d with length %d", f, resp.StatusCode, resp.ContentLength)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if len(b) != 16 || err != helpers.ErrBodyTooLarge {
+		t.Errorf("%T.RoundTrip() body over the limit reads %d bytes, %v, want 16 bytes, %v", f, len(b), err, helpers.ErrBodyTooLarge)
+	}
+}
+
+func TestNewFilterDNSCacheSize(t *testing.T) {
+	config := new(Config)
+	config.Transport.Dialer.Timeout = 4
+	config.Transport.Dialer.FailCacheTTL = 1
+
+	f, err := NewFilter(config)
+	if err != nil {
+		t.Fatalf("NewFilter() with DNSCacheSize 0 error: %v", err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer ts.Close()
+
+	// the loopback guard holds without a DNSCache
+	req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	_, resp, err := f.(*Filter).RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+	if err != nil || resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("RoundTrip() to a loopback address with DNSCacheSize 0 = %v, %v, want 502", resp, err)
+	}
+	resp.Body.Close()
+
+	// the transport dials and the other caches work without a DNSCache
+	dialers := dialer.Dialers()
+	delete(dialers[len(dialers)-1].LoopbackAddrs, "127.0.0.1")
+	req, _ = http.NewRequest(http.MethodGet, ts.URL, nil)
+	_, resp, err = f.(*Filter).RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("RoundTrip() with DNSCacheSize 0 = %v, %v", resp, err)
+	}
+	resp.Body.Close()
+
+	config.Transport.Dialer.DNSCacheSize = dialer.MaxDNSCacheSize + 1
+	if _, err := NewFilter(config); err == nil {
+		t.Errorf("NewFilter() with DNSCacheSize %d returns no error", config.Transport.Dialer.DNSCacheSize)
+	}
+}
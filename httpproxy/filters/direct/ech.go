@@ -0,0 +1,104 @@
+package direct
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../../dialer"
+)
+
+const (
+	// echConfigExpiry bounds how long the HTTPS record of a host, or its
+	// absence, is trusted, the record TTL if it is shorter
+	echConfigExpiry time.Duration = 10 * time.Minute
+)
+
+// echHandshake hides the server name in an Encrypted Client Hello when the
+// host publishes an ECH config in its HTTPS record, plain SNI otherwise.
+func (f *Filter) echHandshake(conn net.Conn, config *tls.Config) (net.Conn, error) {
+	if list := f.echConfigList(config.ServerName); list != nil && dialer.ApplyECH != nil {
+		glog.V(3).Infof("DIRECT: dials %#v with Encrypted Client Hello", config.ServerName)
+		dialer.ApplyECH(config, list)
+	}
+
+	tconn := tls.Client(conn, config)
+	if err := tconn.Handshake(); err != nil {
+		if dialer.ECHRetryConfigs == nil {
+			return nil, err
+		}
+		// the config of the HTTPS record is stale
+		if retry, ok := dialer.ECHRetryConfigs(err); ok && config.ServerName != "" {
+			f.ECHConfigs.Del(config.ServerName)
+			if len(retry) > 0 {
+				f.ECHConfigs.Set(config.ServerName, retry, time.Now().Add(echConfigExpiry))
+				return nil, &echRetryError{err}
+			}
+		}
+		return nil, err
+	}
+	return tconn, nil
+}
+
+// echRetryError is a handshake which failed as the server rejected ECH, to
+// be retried with the configs it gave.
+type echRetryError struct {
+	err error
+}
+
+func (e *echRetryError) Error() string {
+	return e.err.Error()
+}
+
+// lookupECH starts the HTTPS record lookup of the host at address alongside
+// the dial, the wait it returns blocks until its ECH config is cached.
+func (f *Filter) lookupECH(address string) (wait func()) {
+	host, _, err := net.SplitHostPort(address)
+	if f.ECHConfigs == nil || f.LookupHTTPS == nil || err != nil || net.ParseIP(host) != nil {
+		return func() {}
+	}
+	if _, ok := f.ECHConfigs.Get(host); ok {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		f.echConfigList(host)
+		close(done)
+	}()
+	return func() { <-done }
+}
+
+// echConfigList returns the ECHConfigList of host, nil if it has none or its
+// HTTPS record lookup fails.
+func (f *Filter) echConfigList(host string) []byte {
+	if host == "" || net.ParseIP(host) != nil {
+		return nil
+	}
+
+	if v, ok := f.ECHConfigs.Get(host); ok {
+		return v.([]byte)
+	}
+
+	var list []byte
+	expiry := echConfigExpiry
+
+	records, err := f.LookupHTTPS(host)
+	if err != nil {
+		glog.V(2).Infof("DIRECT: LookupHTTPS(%#v) error: %v", host, err)
+	}
+	for _, r := range records {
+		if r.ECHConfigList != nil && (r.Target == "" || r.Target == host) {
+			list = r.ECHConfigList
+			if r.TTL < expiry {
+				expiry = r.TTL
+			}
+			break
+		}
+	}
+
+	f.ECHConfigs.Set(host, list, time.Now().Add(expiry))
+	return list
+}
@@ -0,0 +1,96 @@
+// +build go1.24
+
+package direct
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+
+	"../../dialer"
+	"../../filters"
+)
+
+// newECHKey returns an X25519, HKDF-SHA256, AES-128-GCM ECHConfig of id
+// with its key.
+func newECHKey(t *testing.T, id byte, publicName string) tls.EncryptedClientHelloKey {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdh.GenerateKey() error: %v", err)
+	}
+	pub := key.PublicKey().Bytes()
+
+	contents := []byte{id, 0x00, 0x20, byte(len(pub) >> 8), byte(len(pub))}
+	contents = append(contents, pub...)
+	contents = append(contents, 0, 4, 0, 1, 0, 1, 0, byte(len(publicName)))
+	contents = append(contents, publicName...)
+	contents = append(contents, 0, 0)
+
+	config := []byte{0xfe, 0x0d, 0, 0}
+	binary.BigEndian.PutUint16(config[2:], uint16(len(contents)))
+	return tls.EncryptedClientHelloKey{Config: append(config, contents...), PrivateKey: key.Bytes(), SendAsRetry: true}
+}
+
+func echConfigList(keys ...tls.EncryptedClientHelloKey) []byte {
+	var b []byte
+	for _, k := range keys {
+		b = append(b, k.Config...)
+	}
+	return append([]byte{byte(len(b) >> 8), byte(len(b))}, b...)
+}
+
+func TestRoundTripECHRetryConfigs(t *testing.T) {
+	stale, current := newECHKey(t, 1, "example.com"), newECHKey(t, 2, "example.com")
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, req.TLS.ServerName)
+	}))
+	ts.TLS = &tls.Config{EncryptedClientHelloKeys: []tls.EncryptedClientHelloKey{current}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	f := newTestFilter(t)
+	// a rejected ECH handshake verifies the certificate of the public name
+	f.Transport.TLSClientConfig.RootCAs = x509.NewCertPool()
+	f.Transport.TLSClientConfig.RootCAs.AddCert(ts.Certificate())
+	f.TLSHandshake = f.echHandshake
+	f.ECHConfigs = lrucache.NewLRUCache(16)
+	setDial(f, func(network, addr string) (net.Conn, error) {
+		return net.Dial(network, ts.Listener.Addr().String())
+	})
+	lookups := 0
+	f.LookupHTTPS = func(host string) ([]*dialer.HTTPSRecord, error) {
+		lookups++
+		return []*dialer.HTTPSRecord{{Priority: 1, ECHConfigList: echConfigList(stale), TTL: time.Minute}}, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, (&url.URL{Scheme: "https", Host: net.JoinHostPort("ech.example.com", port), Path: "/"}).String(), nil)
+		_, resp, err := f.RoundTrip(filters.NewTestContext(nil), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip() error: %v", f, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.TLS == nil || !resp.TLS.ECHAccepted {
+			t.Fatalf("%T.RoundTrip() #%d with a stale ECH config = %d %+v, want it retried with ECH", f, i, resp.StatusCode, resp.TLS)
+		}
+		f.Transport.CloseIdleConnections()
+	}
+	// the retry configs take the place of the rejected ones
+	if lookups != 1 {
+		t.Errorf("%T looked HTTPS records up %d times, want 1", f, lookups)
+	}
+}
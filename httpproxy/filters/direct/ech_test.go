@@ -0,0 +1,76 @@
+package direct
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/cloudflare/golibs/lrucache"
+
+	"../../dialer"
+	"../../filters"
+)
+
+func TestRoundTripECH(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "ok")
+	}))
+	defer ts.Close()
+
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	f := newTestFilter(t)
+	f.Transport.TLSClientConfig.InsecureSkipVerify = true
+	f.TLSHandshake = f.echHandshake
+	f.ECHConfigs = lrucache.NewLRUCache(16)
+	// every name is the test server
+	setDial(f, func(network, addr string) (net.Conn, error) {
+		return net.Dial(network, ts.Listener.Addr().String())
+	})
+
+	lookups := 0
+	f.LookupHTTPS = func(host string) ([]*dialer.HTTPSRecord, error) {
+		lookups++
+		switch host {
+		case "ech.example.org":
+			// not a valid ECHConfigList, the handshake fails if it is used
+			return []*dialer.HTTPSRecord{{Priority: 1, ECHConfigList: []byte{0, 1, 0}}}, nil
+		case "plain.example.org":
+			return []*dialer.HTTPSRecord{{Priority: 1, ALPN: []string{"h2"}}}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	roundTrip := func(host string) int {
+		req, _ := http.NewRequest(http.MethodGet, (&url.URL{Scheme: "https", Host: net.JoinHostPort(host, port), Path: "/"}).String(), nil)
+		_, resp, err := f.RoundTrip(filters.NewTestContext(nil), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip(%s) error: %v", f, host, err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// without an ECH config the handshake falls back to plain SNI
+	for _, host := range []string{"plain.example.org", "other.example.org", "other.example.org"} {
+		if code := roundTrip(host); code != http.StatusOK {
+			t.Errorf("%T.RoundTrip(%s) without ECH config returns %d", f, host, code)
+		}
+	}
+	if lookups != 2 {
+		t.Errorf("%T looked HTTPS records up %d times, want 2 with the failed one cached", f, lookups)
+	}
+
+	if dialer.ApplyECH != nil {
+		f.Transport.CloseIdleConnections()
+		if code := roundTrip("ech.example.org"); code != http.StatusBadGateway {
+			t.Errorf("%T.RoundTrip() with an invalid ECH config returns %d, want it handshaking with ECH", f, code)
+		}
+	}
+}
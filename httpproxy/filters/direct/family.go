@@ -0,0 +1,47 @@
+package direct
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"../../dialer"
+)
+
+// AddressFamilyHeader asks to dial the upstream of one request over "ipv4"
+// or "ipv6" only, it is honored from AddressFamilyHeaderNets and never sent
+// upstream.
+const AddressFamilyHeader = "X-Proxy-Address-Family"
+
+type familyKey struct{}
+
+// addressFamily returns the address family req asks for with the
+// AddressFamilyHeader it strips, "" if it asks for none or is not trusted.
+func (f *Filter) addressFamily(req *http.Request) string {
+	v := strings.ToLower(strings.TrimSpace(req.Header.Get(AddressFamilyHeader)))
+	req.Header.Del(AddressFamilyHeader)
+
+	if v == "" || !dialer.ValidAddressFamily(v) || !fromNets(req, f.AddressFamilyNets) {
+		return ""
+	}
+	return v
+}
+
+// fromNets reports whether the client of req is an ip of nets.
+func fromNets(req *http.Request, nets []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package direct
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"../../dialer"
+	"../../filters"
+)
+
+func TestRoundTripAddressFamilyHeader(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, req.Header.Get(AddressFamilyHeader))
+	}))
+	defer ts.Close()
+
+	config := new(Config)
+	config.Transport.Dialer.Timeout = 4
+	config.Transport.Dialer.DNSCacheSize = 64
+	config.Transport.Dialer.AddressFamilyHeaderNets = []string{"10.0.0.0/8"}
+	f1, err := NewFilter(config)
+	if err != nil {
+		t.Fatalf("NewFilter(%#v) error: %v", config, err)
+	}
+	f := f1.(*Filter)
+
+	// the upstream is a loopback one
+	d := &dialer.Dialer{Dialer: &net.Dialer{}, RetryTimes: 1}
+	f.Transport.DialContext = d.DialContext
+	f.IsolatedTransport.DialContext = d.DialContext
+	if f.FamilyTransport != nil {
+		f.FamilyTransport.DialContext = d.DialContext
+	}
+
+	for _, c := range []struct {
+		remoteAddr string
+		family     string
+		code       int
+	}{
+		{"10.0.0.1:1234", "ipv4", http.StatusOK},
+		// the upstream has no ipv6 address
+		{"10.0.0.1:1234", "ipv6", http.StatusBadGateway},
+		{"10.0.0.1:1234", "IPv6", http.StatusBadGateway},
+		// ignored from untrusted clients
+		{"192.0.2.1:1234", "ipv6", http.StatusOK},
+		{"10.0.0.1:1234", "ipv5", http.StatusOK},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+		req.RemoteAddr = c.remoteAddr
+		req.Header.Set(AddressFamilyHeader, c.family)
+
+		_, resp, err := f.RoundTrip(filters.NewTestContext(nil), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip() error: %v", f, err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != c.code {
+			t.Errorf("%T.RoundTrip() from %s over %#v returns %d %#v, want %d", f, c.remoteAddr, c.family, resp.StatusCode, string(b), c.code)
+		}
+		if resp.StatusCode == http.StatusOK && len(b) != 0 {
+			t.Errorf("%T.RoundTrip() forwards %s: %#v upstream", f, AddressFamilyHeader, string(b))
+		}
+	}
+}
+
+func TestRoundTripAddressFamilyHeaderTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "ok")
+	}))
+	defer ts.Close()
+
+	config := new(Config)
+	config.Transport.Dialer.Timeout = 4
+	config.Transport.Dialer.AddressFamilyHeaderNets = []string{"10.0.0.0/8"}
+	config.Transport.TLSClientConfig.InsecureSkipVerify = true
+	f1, err := NewFilter(config)
+	if err != nil {
+		t.Fatalf("NewFilter(%#v) error: %v", config, err)
+	}
+	f := f1.(*Filter)
+
+	// the upstream is a loopback one
+	d := &dialer.Dialer{Dialer: &net.Dialer{}, RetryTimes: 1}
+	f.Transport.DialContext = d.DialContext
+	f.IsolatedTransport.DialContext = d.DialContext
+	if f.FamilyTransport != nil {
+		f.FamilyTransport.DialContext = d.DialContext
+	}
+
+	for _, c := range []struct {
+		family string
+		code   int
+	}{
+		{"ipv4", http.StatusOK},
+		// the TLS dial honors the family as well
+		{"ipv6", http.StatusBadGateway},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set(AddressFamilyHeader, c.family)
+
+		_, resp, err := f.RoundTrip(filters.NewTestContext(nil), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip() error: %v", f, err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != c.code {
+			t.Errorf("%T.RoundTrip(%#v) over %#v returns %d %#v, want %d", f, ts.URL, c.family, resp.StatusCode, string(b), c.code)
+		}
+	}
+}
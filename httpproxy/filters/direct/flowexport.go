@@ -0,0 +1,102 @@
+package direct
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/phuslu/glog"
+
+	"../../helpers"
+)
+
+// defaultFlowQueueSize is the FlowExport.QueueSize of 0.
+const defaultFlowQueueSize = 1024
+
+var (
+	flowRecordsExported = helpers.Metrics.Counter("direct_flow_records_total", "Flow records sent to Accounting.FlowExport.")
+	flowRecordsDropped  = helpers.Metrics.Counter("direct_flow_records_dropped_total", "Flow records dropped with the Accounting.FlowExport queue full.")
+)
+
+// A flowRecord is what Accounting.FlowExport tells of a closed CONNECT tunnel,
+// NetFlow style.
+type flowRecord struct {
+	ID       string
+	Host     string
+	Protocol string
+	// the upstream is the conn dialed, a TunnelPool or Proxy one for them
+	ClientIP     string
+	ClientPort   string
+	UpstreamIP   string
+	UpstreamPort string
+	BytesUp      int64
+	BytesDown    int64
+	// Start and End are unix times in milliseconds
+	Start int64
+	End   int64
+}
+
+// flowExporter writes flow records to its destination as JSON lines, one
+// per datagram for udp, off the tunnels closing. Records beyond the queue
+// are dropped rather than held up.
+type flowExporter struct {
+	w       io.Writer
+	records chan *flowRecord
+}
+
+// openFlowDestination opens a FlowExport.Destination, udp://host:port or
+// the path of a file to append to.
+func openFlowDestination(destination string) (io.Writer, error) {
+	if strings.HasPrefix(destination, "udp://") {
+		return net.Dial("udp", strings.TrimPrefix(destination, "udp://"))
+	}
+	return os.OpenFile(destination, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
+
+func newFlowExporter(w io.Writer, size int) *flowExporter {
+	if size <= 0 {
+		size = defaultFlowQueueSize
+	}
+	e := &flowExporter{
+		w:       w,
+		records: make(chan *flowRecord, size),
+	}
+	go e.run()
+	return e
+}
+
+func (e *flowExporter) export(r *flowRecord) {
+	select {
+	case e.records <- r:
+	default:
+		flowRecordsDropped.Add(1)
+	}
+}
+
+func (e *flowExporter) run() {
+	for r := range e.records {
+		b, err := json.Marshal(r)
+		if err != nil {
+			glog.Warningf("DIRECT: json.Marshal(%#v) error: %v", r, err)
+			continue
+		}
+		// a collector down refuses every datagram, not worth a warning each
+		if _, err := e.w.Write(append(b, '\n')); err != nil {
+			glog.V(2).Infof("DIRECT: flow record write error: %v", err)
+			continue
+		}
+		flowRecordsExported.Add(1)
+	}
+}
+
+// splitFlowAddr splits addr into ip and port, or returns it whole if it is
+// no host:port.
+func splitFlowAddr(addr string) (string, string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, ""
+	}
+	return host, port
+}
@@ -0,0 +1,117 @@
+package direct
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"../../filters"
+)
+
+func TestRoundTripConnectFlowExport(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(c, b); err == nil {
+			c.Write(append(b, b...))
+		}
+	}()
+
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket() error: %v", err)
+	}
+	defer collector.Close()
+
+	f := newTestFilter(t)
+	setDial(f, func(network, addr string) (net.Conn, error) {
+		return net.Dial(network, ln.Addr().String())
+	})
+	w, err := openFlowDestination("udp://" + collector.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("openFlowDestination() error: %v", err)
+	}
+	f.FlowExport = newFlowExporter(w, 0)
+
+	lconn, conn := net.Pipe()
+	rw := filters.NewTestResponseWriter(lconn)
+	req, _ := http.NewRequest(http.MethodConnect, "http://example.org:443", nil)
+	req.RemoteAddr = "192.0.2.1:40000"
+
+	before := time.Now().UnixNano() / int64(time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		f.RoundTrip(filters.NewTestContext(rw), req)
+		close(done)
+	}()
+
+	io.WriteString(conn, "ping")
+	io.ReadFull(conn, make([]byte, 8))
+	conn.Close()
+	<-done
+
+	collector.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 4096)
+	n, _, err := collector.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("no flow record: %v", err)
+	}
+	var r flowRecord
+	if err := json.Unmarshal(b[:n], &r); err != nil {
+		t.Fatalf("json.Unmarshal(%#v) error: %v", string(b[:n]), err)
+	}
+
+	upstreamIP, upstreamPort, _ := net.SplitHostPort(ln.Addr().String())
+	if r.Host != "example.org:443" || r.Protocol != "tcp" || r.ID == "" {
+		t.Errorf("flow record host=%#v protocol=%#v id=%#v", r.Host, r.Protocol, r.ID)
+	}
+	if r.ClientIP != "192.0.2.1" || r.ClientPort != "40000" || r.UpstreamIP != upstreamIP || r.UpstreamPort != upstreamPort {
+		t.Errorf("flow record client=%s:%s upstream=%s:%s, want 192.0.2.1:40000 and %s", r.ClientIP, r.ClientPort, r.UpstreamIP, r.UpstreamPort, ln.Addr())
+	}
+	if r.BytesUp != 4 || r.BytesDown != 8 {
+		t.Errorf("flow record bytes up=%d down=%d, want 4 and 8", r.BytesUp, r.BytesDown)
+	}
+	if r.Start < before || r.End < r.Start {
+		t.Errorf("flow record start=%d end=%d, want start >= %d and end >= start", r.Start, r.End, before)
+	}
+}
+
+type blockingWriter struct {
+	entered chan struct{}
+	unblock chan struct{}
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	w.entered <- struct{}{}
+	<-w.unblock
+	return len(b), nil
+}
+
+func TestFlowExporterDrops(t *testing.T) {
+	w := &blockingWriter{entered: make(chan struct{}, 2), unblock: make(chan struct{})}
+	e := newFlowExporter(w, 1)
+
+	dropped := flowRecordsDropped.Value()
+	// one record in the write, one queued, the third dropped
+	e.export(&flowRecord{ID: "1"})
+	<-w.entered
+	e.export(&flowRecord{ID: "2"})
+	e.export(&flowRecord{ID: "3"})
+	if v := flowRecordsDropped.Value(); v != dropped+1 {
+		t.Errorf("direct_flow_records_dropped_total = %d, want %d", v, dropped+1)
+	}
+
+	close(w.unblock)
+}
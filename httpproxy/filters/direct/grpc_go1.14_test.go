@@ -0,0 +1,66 @@
+// +build go1.14
+
+package direct
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"../../filters"
+)
+
+// httptest serves h2 since go1.14
+func TestRoundTripGRPCTrailers(t *testing.T) {
+	// a gRPC echo server, replying the length prefixed message it got
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Type") != "application/grpc" {
+			http.Error(rw, "not grpc", http.StatusUnsupportedMediaType)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/grpc")
+		rw.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		msg, _ := ioutil.ReadAll(req.Body)
+		rw.Write(msg)
+		rw.Header().Set("Grpc-Status", "0")
+		rw.Header().Set("Grpc-Message", "OK")
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	config := new(Config)
+	config.Transport.Dialer.Timeout = 4
+	config.Transport.TLSClientConfig.InsecureSkipVerify = true
+	config.Transport.HTTP2 = true
+	f, err := NewFilter(config)
+	if err != nil {
+		t.Fatalf("NewFilter(%#v) error: %v", config, err)
+	}
+	setDial(f.(*Filter), net.Dial)
+
+	msg := []byte{0, 0, 0, 0, 5, 'h', 'e', 'l', 'l', 'o'}
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/echo.Echo/Say", bytes.NewReader(msg))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+
+	_, resp, err := f.(*Filter).RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+	if err != nil {
+		t.Fatalf("%T.RoundTrip(%#v) error: %v", f, req.URL.String(), err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(b, msg) {
+		t.Errorf("%T.RoundTrip(%#v) return %d %#v", f, req.URL.String(), resp.StatusCode, b)
+	}
+	if status := resp.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Errorf("%T.RoundTrip(%#v) trailer Grpc-Status = %#v, want %#v", f, req.URL.String(), status, "0")
+	}
+	if message := resp.Trailer.Get("Grpc-Message"); message != "OK" {
+		t.Errorf("%T.RoundTrip(%#v) trailer Grpc-Message = %#v, want %#v", f, req.URL.String(), message, "OK")
+	}
+}
@@ -0,0 +1,129 @@
+// +build go1.24
+
+package direct
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"../../filters"
+	"../../helpers"
+)
+
+func TestRoundTripH1ClientH2COrigin(t *testing.T) {
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor != 2 {
+			http.Error(rw, "h2 only", http.StatusHTTPVersionNotSupported)
+			return
+		}
+		b, _ := ioutil.ReadAll(req.Body)
+		rw.Header().Set("Trailer", "Grpc-Status")
+		rw.Header().Set("Content-Type", "application/grpc")
+		io.WriteString(rw, "echo "+string(b))
+		rw.Header().Set("Grpc-Status", "0")
+	}))
+	origin.Config.Protocols = new(http.Protocols)
+	origin.Config.Protocols.SetUnencryptedHTTP2(true)
+	origin.Start()
+	defer origin.Close()
+
+	config := new(Config)
+	config.Transport.Dialer.Timeout = 4
+	config.Transport.Dialer.DNSCacheSize = 64
+	config.Transport.H2CHosts = []string{"127.0.0.1"}
+	f1, err := NewFilter(config)
+	if err != nil {
+		t.Fatalf("NewFilter(%#v) error: %v", config, err)
+	}
+	f := f1.(*Filter)
+	setDial(f, net.Dial)
+
+	req, _ := http.NewRequest(http.MethodPost, origin.URL+"/", strings.NewReader("ping"))
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/1.1", 1, 1
+	req.Header.Set("Connection", "keep-alive")
+	_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+	if err != nil {
+		t.Fatalf("%T.RoundTrip() error: %v", f, err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(b) != "echo ping" {
+		t.Fatalf("h1 request to a h2c origin returns %d %#v", resp.StatusCode, string(b))
+	}
+	if resp.ProtoMajor != 2 {
+		t.Errorf("h1 request to a h2c origin went over %s", resp.Proto)
+	}
+	if v := resp.Trailer.Get("Grpc-Status"); v != "0" {
+		t.Errorf("h1 request to a h2c origin has trailer Grpc-Status %#v, want \"0\"", v)
+	}
+}
+
+func TestRoundTripH2ClientH1Origin(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor != 1 {
+			http.Error(rw, "h1 only", http.StatusHTTPVersionNotSupported)
+			return
+		}
+		rw.Header().Set("Trailer", "X-Checksum")
+		io.WriteString(rw, "hello "+req.Host)
+		rw.Header().Set("X-Checksum", "42")
+	}))
+	defer origin.Close()
+
+	f := newTestFilter(t)
+	setDial(f, net.Dial)
+
+	// the front end the h2 client speaks to, relaying like the httpproxy Handler
+	front := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req.URL.Scheme, req.URL.Host = "http", origin.Listener.Addr().String()
+		_, resp, err := f.RoundTrip(filters.NewTestContext(rw), req)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		for key, values := range resp.Header {
+			rw.Header()[key] = values
+		}
+		for key := range resp.Trailer {
+			rw.Header().Add("Trailer", key)
+		}
+		rw.WriteHeader(resp.StatusCode)
+		helpers.IoCopy(rw, resp.Body)
+		for key, values := range resp.Trailer {
+			rw.Header()[key] = values
+		}
+	}))
+	front.EnableHTTP2 = true
+	front.StartTLS()
+	defer front.Close()
+
+	client := front.Client()
+	client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}}
+	client.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+
+	resp, err := client.Get(front.URL + "/")
+	if err != nil {
+		t.Fatalf("h2 client Get() error: %v", err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("client went over %s, want HTTP/2", resp.Proto)
+	}
+	// the client Host goes upstream as is
+	if resp.StatusCode != http.StatusOK || string(b) != "hello "+front.Listener.Addr().String() {
+		t.Errorf("h2 client request to a h1 origin returns %d %#v", resp.StatusCode, string(b))
+	}
+	if v := resp.Trailer.Get("X-Checksum"); v != "42" {
+		t.Errorf("h2 client request to a h1 origin has trailer X-Checksum %#v, want \"42\"", v)
+	}
+}
@@ -0,0 +1,24 @@
+package direct
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"github.com/phuslu/net/http2"
+)
+
+// newH2C returns the prior knowledge h2c transport of H2CHosts, which dials
+// with dial and compresses as tr does. The DialTLS of http2.Transport is not
+// handed the ctx of the request, go1.24 builds speak h2c with a std transport
+// which dials with it instead.
+var newH2C = func(dial func(ctx context.Context, network, address string) (net.Conn, error), tr *http.Transport) http.RoundTripper {
+	return &http2.Transport{
+		AllowHTTP:          true,
+		DisableCompression: tr.DisableCompression,
+		DialTLS: func(network, address string, _ *tls.Config) (net.Conn, error) {
+			return dial(context.Background(), network, address)
+		},
+	}
+}
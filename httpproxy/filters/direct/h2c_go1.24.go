@@ -0,0 +1,21 @@
+// +build go1.24
+
+package direct
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+func init() {
+	newH2C = func(dial func(ctx context.Context, network, address string) (net.Conn, error), tr *http.Transport) http.RoundTripper {
+		tr1 := &http.Transport{
+			DialContext:        dial,
+			DisableCompression: tr.DisableCompression,
+			Protocols:          new(http.Protocols),
+		}
+		tr1.Protocols.SetUnencryptedHTTP2(true)
+		return tr1
+	}
+}
@@ -0,0 +1,65 @@
+package direct
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"../../helpers"
+)
+
+var errHandshakeRate = errors.New("too many tls handshakes, over Transport.MaxHandshakesPerSecond")
+
+var (
+	tlsHandshakes        = helpers.Metrics.Counter("direct_tls_handshakes_total", "Upstream TLS handshakes started under MaxHandshakesPerSecond.")
+	tlsHandshakesQueued  = helpers.Metrics.Counter("direct_tls_handshakes_queued_total", "Upstream TLS handshakes MaxHandshakesPerSecond held back.")
+	tlsHandshakesRefused = helpers.Metrics.Counter("direct_tls_handshakes_refused_total", "Upstream TLS handshakes MaxHandshakesPerSecond refused after a wait over TLSHandshakeTimeout.")
+)
+
+// handshakeLimiter is a token bucket of a second of handshakes, refilled at
+// rate per second. It keeps the time the next token is free at, which lags
+// now by at most the bucket size while tokens are left.
+type handshakeLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	burst    int
+	next     time.Time
+
+	// the clock, time.Now and time.Sleep but in tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func newHandshakeLimiter(rate int) *handshakeLimiter {
+	return &handshakeLimiter{
+		interval: time.Second / time.Duration(rate),
+		burst:    rate,
+		now:      time.Now,
+		sleep:    time.Sleep,
+	}
+}
+
+// wait blocks until a handshake may start, errHandshakeRate if that takes
+// longer than max, 0 for no limit.
+func (l *handshakeLimiter) wait(max time.Duration) error {
+	l.mu.Lock()
+	now := l.now()
+	if earliest := now.Add(-time.Duration(l.burst-1) * l.interval); l.next.Before(earliest) {
+		l.next = earliest
+	}
+	delay := l.next.Sub(now)
+	if max > 0 && delay > max {
+		l.mu.Unlock()
+		tlsHandshakesRefused.Add(1)
+		return errHandshakeRate
+	}
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	if delay > 0 {
+		tlsHandshakesQueued.Add(1)
+		l.sleep(delay)
+	}
+	tlsHandshakes.Add(1)
+	return nil
+}
@@ -0,0 +1,101 @@
+package direct
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"../../filters"
+)
+
+// fakeClock stands still and records the sleeps of a handshakeLimiter.
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	slept []time.Duration
+}
+
+func newFakeClock(l *handshakeLimiter) *fakeClock {
+	c := &fakeClock{now: time.Unix(1500000000, 0)}
+	l.now = func() time.Time {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.now
+	}
+	l.sleep = func(d time.Duration) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.slept = append(c.slept, d)
+	}
+	return c
+}
+
+func TestRoundTripMaxHandshakesPerSecond(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	const rate, burst = 50, 75
+
+	f := newTestFilter(t)
+	setDial(f, net.Dial)
+	f.Transport.TLSClientConfig.InsecureSkipVerify = true
+	f.Transport.DisableKeepAlives = true
+	f.HandshakeLimit = newHandshakeLimiter(rate)
+	// the handshakes all start at one instant, however slow the dials are
+	clock := newFakeClock(f.HandshakeLimit)
+
+	handshakes, queued := tlsHandshakes.Value(), tlsHandshakesQueued.Value()
+
+	var wg sync.WaitGroup
+	for i := 0; i < burst; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+			_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+			if err != nil {
+				t.Errorf("%T.RoundTrip(%#v) error: %v", f, ts.URL, err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	if n := tlsHandshakes.Value() - handshakes; n != burst {
+		t.Errorf("direct_tls_handshakes_total grew by %d, want %d", n, burst)
+	}
+	// a second's worth at once, the rest at rate
+	if n := tlsHandshakesQueued.Value() - queued; n != burst-rate {
+		t.Errorf("direct_tls_handshakes_queued_total grew by %d for a burst of %d, want %d", n, burst, burst-rate)
+	}
+	var longest time.Duration
+	for _, d := range clock.slept {
+		if d > longest {
+			longest = d
+		}
+	}
+	if want := time.Duration(burst-rate) * time.Second / rate; longest != want {
+		t.Errorf("%d handshakes at %d a second wait up to %v, want %v", burst, rate, longest, want)
+	}
+}
+
+func TestHandshakeLimiterRefuses(t *testing.T) {
+	l := newHandshakeLimiter(1)
+	if err := l.wait(time.Millisecond); err != nil {
+		t.Fatalf("handshakeLimiter.wait() error: %v", err)
+	}
+
+	refused := tlsHandshakesRefused.Value()
+	if err := l.wait(time.Millisecond); err != errHandshakeRate {
+		t.Errorf("handshakeLimiter.wait() = %v, want %v", err, errHandshakeRate)
+	}
+	if tlsHandshakesRefused.Value() != refused+1 {
+		t.Errorf("direct_tls_handshakes_refused_total not counted")
+	}
+}
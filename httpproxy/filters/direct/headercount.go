@@ -0,0 +1,15 @@
+package direct
+
+import (
+	"net/http"
+)
+
+// headerFieldCount returns the number of field lines of h, a repeated name
+// counts once per value.
+func headerFieldCount(h http.Header) int {
+	n := 0
+	for _, values := range h {
+		n += len(values)
+	}
+	return n
+}
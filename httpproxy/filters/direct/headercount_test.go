@@ -0,0 +1,67 @@
+package direct
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"../../filters"
+)
+
+func TestRoundTripMaxRequestHeaderCount(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	f := newTestFilter(t)
+	f.Config.Transport.MaxRequestHeaderCount = 8
+	dialed := 0
+	setDial(f, func(network, addr string) (net.Conn, error) {
+		dialed++
+		return net.Dial(network, addr)
+	})
+
+	newHeader := func(n int) http.Header {
+		h := http.Header{}
+		// repeated names count per value
+		for i := 0; i < n; i++ {
+			h.Add(fmt.Sprintf("X-Flood-%d", i%3), "1")
+		}
+		return h
+	}
+
+	cases := []struct {
+		method  string
+		headers int
+		code    int
+	}{
+		{http.MethodGet, 8, http.StatusOK},
+		{http.MethodGet, 9, http.StatusRequestHeaderFieldsTooLarge},
+		{http.MethodGet, 1000, http.StatusRequestHeaderFieldsTooLarge},
+		{http.MethodConnect, 9, http.StatusRequestHeaderFieldsTooLarge},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, ts.URL+"/", nil)
+		if c.method == http.MethodConnect {
+			req.Host = ts.Listener.Addr().String()
+		}
+		req.Header = newHeader(c.headers)
+
+		rw := filters.NewTestResponseWriter(nil)
+		_, resp, err := f.RoundTrip(filters.NewTestContext(rw), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip(%s with %d headers) error: %v", f, c.method, c.headers, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.code || rw.Hijacked {
+			t.Errorf("RoundTrip(%s with %d headers) returns %d hijacked=%v, want %d", c.method, c.headers, resp.StatusCode, rw.Hijacked, c.code)
+		}
+	}
+	if dialed != 1 {
+		t.Errorf("requests dialed %d times, want only the one within the limit", dialed)
+	}
+}
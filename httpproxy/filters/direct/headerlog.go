@@ -0,0 +1,68 @@
+package direct
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// redactedValue replaces the parts of logged header values which match a
+// Logging.RedactPatterns regexp.
+const redactedValue = "[REDACTED]"
+
+// headerFields formats the Logging.IncludeRequestHeaders and
+// IncludeResponseHeaders values present in reqHeader and respHeader for the
+// access log, e.g. ` req_content_type="text/plain"`.
+func (f *Filter) headerFields(reqHeader, respHeader http.Header) string {
+	if len(f.LogRequestHeaders) == 0 && len(f.LogResponseHeaders) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	for _, c := range []struct {
+		prefix string
+		names  []string
+		header http.Header
+	}{
+		{"req_", f.LogRequestHeaders, reqHeader},
+		{"resp_", f.LogResponseHeaders, respHeader},
+	} {
+		if c.header == nil {
+			continue
+		}
+		for _, name := range c.names {
+			values, ok := c.header[name]
+			if !ok {
+				continue
+			}
+			value := strings.Join(values, ", ")
+			for _, re := range f.LogRedact {
+				value = re.ReplaceAllString(value, redactedValue)
+			}
+			fmt.Fprintf(&b, " %s%s=%q", c.prefix, strings.Replace(strings.ToLower(name), "-", "_", -1), value)
+		}
+	}
+
+	return b.String()
+}
+
+func canonicalHeaderKeys(names []string) []string {
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = http.CanonicalHeaderKey(name)
+	}
+	return keys
+}
+
+func compileRedactPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("DIRECT: Logging.RedactPatterns %#v error: %v", pattern, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
@@ -0,0 +1,79 @@
+package direct
+
+import (
+	"net/http"
+	"strings"
+
+	"../../helpers"
+)
+
+// hopHeaders are meant for the client connection only, RFC 7230 6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Te",
+	"Upgrade",
+}
+
+// removeHopHeaders returns req without its hop-by-hop headers and those its
+// Connection header names, unless the host is in Transport.PreserveConnectionHeaderHosts,
+// which still never get Proxy-Connection.
+// "Te: trailers" is an end to end ask for gRPC trailers and an upgrade is
+// handed to the transport as "Connection: Upgrade", so both are kept.
+func (f *Filter) removeHopHeaders(req *http.Request) *http.Request {
+	if f.PreserveConnection != nil && f.PreserveConnection.Match(req.URL.Hostname()) {
+		// about the proxy hop, never meant for the upstream
+		if _, ok := req.Header["Proxy-Connection"]; ok {
+			req = helpers.CloneRequest(req)
+			req.Header.Del("Proxy-Connection")
+		}
+		return req
+	}
+
+	found := false
+	for _, key := range hopHeaders {
+		if _, ok := req.Header[key]; ok {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return req
+	}
+
+	// the server still reads Connection of the client request, e.g. for
+	// HTTP/1.0 keep-alive
+	req = helpers.CloneRequest(req)
+
+	upgrade := false
+	for _, v := range req.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			token = strings.TrimSpace(token)
+			if strings.EqualFold(token, "upgrade") {
+				upgrade = true
+				continue
+			}
+			if token != "" {
+				req.Header.Del(token)
+			}
+		}
+	}
+
+	te := req.Header.Get("Te")
+	u := req.Header.Get("Upgrade")
+
+	for _, key := range hopHeaders {
+		req.Header.Del(key)
+	}
+
+	if strings.EqualFold(strings.TrimSpace(te), "trailers") {
+		req.Header.Set("Te", "trailers")
+	}
+	if upgrade && u != "" {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", u)
+	}
+
+	return req
+}
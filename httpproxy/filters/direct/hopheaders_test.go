@@ -0,0 +1,63 @@
+package direct
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"../../filters"
+	"../../helpers"
+)
+
+func TestRoundTripHopHeaders(t *testing.T) {
+	var got http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got = req.Header
+	}))
+	defer ts.Close()
+
+	f := newTestFilter(t)
+	setDial(f, net.Dial)
+	f.PreserveConnection = helpers.NewHostMatcher([]string{"localhost"})
+
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	cases := []struct {
+		host     string
+		preserve bool
+	}{
+		{"127.0.0.1", false},
+		{"localhost", true},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+net.JoinHostPort(c.host, port)+"/", nil)
+		req.Header.Set("Connection", "keep-alive, X-Hop")
+		req.Header.Set("Keep-Alive", "timeout=5")
+		req.Header.Set("X-Hop", "1")
+		req.Header.Set("Te", "trailers")
+		req.Header.Set("Proxy-Connection", "keep-alive")
+
+		_, resp, err := f.RoundTrip(filters.NewTestContext(nil), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip(%s) error: %v", f, c.host, err)
+		}
+		resp.Body.Close()
+
+		for _, key := range []string{"Connection", "Keep-Alive", "X-Hop"} {
+			if v := got.Get(key); (v != "") != c.preserve {
+				t.Errorf("%T.RoundTrip(%s) sends %s: %#v, want preserved=%v", f, c.host, key, v, c.preserve)
+			}
+		}
+		if v := got.Get("Proxy-Connection"); v != "" {
+			t.Errorf("%T.RoundTrip(%s) sends Proxy-Connection: %#v", f, c.host, v)
+		}
+		if v := got.Get("Te"); v != "trailers" {
+			t.Errorf("%T.RoundTrip(%s) sends Te: %#v, want trailers", f, c.host, v)
+		}
+		if req.Header.Get("Connection") == "" {
+			t.Errorf("%T.RoundTrip(%s) strips Connection of the client request", f, c.host)
+		}
+	}
+}
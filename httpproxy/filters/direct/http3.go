@@ -0,0 +1,153 @@
+package direct
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../../dialer"
+)
+
+// NewHTTP3RoundTripper returns the RoundTripper for upstreams which advertise
+// h3 in Alt-Svc, the quic-go one of http3_quic.go in builds with -tags quic.
+// It owns its UDP sockets, sockopts carries the Transport.Dialer socket
+// options for them. Transport.EnableHTTP3 fails without one.
+var NewHTTP3RoundTripper func(config *tls.Config, sockopts *dialer.SocketOptions) http.RoundTripper
+
+// observe learns what an upstream response tells about its origin.
+func (f *Filter) observe(req *http.Request, resp *http.Response) {
+	f.observeAltSvc(req, resp)
+	f.checkCertChange(req, resp)
+}
+
+// transportRoundTrip sends https requests to known h3 upstreams over HTTP/3
+// with EnableHTTP3, falling back to Transport if that fails. Isolated requests
+// always go to IsolatedTransport, or FamilyTransport over an address family.
+// Plain http ones go to H2CHosts over h2c, ones matching Rules to the
+// transport of their timeout profile and pinned ones to the transport of their
+// client connection, with UpstreamRetry through the TunnelPool upstreams over
+// transports like these.
+func (f *Filter) transportRoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Context().Value(isolateKey{}) != nil {
+		if f.FamilyTransport != nil && req.Context().Value(familyKey{}) != nil {
+			return f.FamilyTransport.RoundTrip(req)
+		}
+		return f.IsolatedTransport.RoundTrip(req)
+	}
+
+	tr := f.selectTransport(req)
+	if f.UpstreamRetry != nil {
+		if tr == nil {
+			tr = f.Transport
+		}
+		resp, err := f.UpstreamRetry.roundTrip(req, tr)
+		if err == nil {
+			f.observe(req, resp)
+		}
+		return resp, err
+	}
+	if tr != nil {
+		resp, err := tr.RoundTrip(req)
+		if err == nil {
+			f.observe(req, resp)
+		}
+		return resp, err
+	}
+
+	if f.HTTP3 == nil || req.URL.Scheme != "https" {
+		resp, err := f.Transport.RoundTrip(req)
+		if err == nil {
+			f.observe(req, resp)
+		}
+		return resp, err
+	}
+
+	f.seedAltSvc(req)
+
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	if e, ok := f.AltSvc.Lookup(altSvcKey(req), "h3"); ok && (!hasBody || req.GetBody != nil) {
+		req1 := req.WithContext(req.Context())
+		u := *req.URL
+		u.Host = e.Addr(altSvcKey(req))
+		req1.URL = &u
+		if req1.Host == "" {
+			req1.Host = req.URL.Host
+		}
+
+		resp, err := f.HTTP3.RoundTrip(req1)
+		if err == nil {
+			f.observe(req, resp)
+			return resp, nil
+		}
+
+		glog.Warningf("%s \"DIRECT %s %s %s\" HTTP/3 to %s error: %v, falls back", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, u.Host, err)
+		f.AltSvc.Forget(altSvcKey(req))
+
+		if hasBody {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	resp, err := f.Transport.RoundTrip(req)
+	if err == nil {
+		f.observe(req, resp)
+	}
+	return resp, err
+}
+
+// selectTransport returns the transport of H2CHosts, Rules or the client
+// connection for req, nil if it goes to Transport.
+func (f *Filter) selectTransport(req *http.Request) http.RoundTripper {
+	if f.H2C != nil && req.URL.Scheme == "http" && f.H2CHosts.Match(req.URL.Hostname()) {
+		return f.H2C
+	}
+	if tr := f.routeTransport(req); tr != nil {
+		return tr
+	}
+	if tr, ok := req.Context().Value(pinKey{}).(*http.Transport); ok {
+		return tr
+	}
+	return nil
+}
+
+// seedAltSvc takes h3 from the HTTPS record of an origin Alt-Svc told nothing
+// of yet, so its first request already goes over HTTP/3. An origin is seeded
+// once per record TTL, a failed h3 falls back as if learned from Alt-Svc.
+func (f *Filter) seedAltSvc(req *http.Request) {
+	if f.HTTPSRecord == nil {
+		return
+	}
+
+	key := altSvcKey(req)
+	if _, ok := f.HTTPSAltSvc.Get(key); ok {
+		return
+	}
+	if _, ok := f.AltSvc.Lookup(key, "h3"); ok {
+		return
+	}
+
+	r := f.HTTPSRecord(req.URL.Hostname())
+	if r == nil {
+		f.HTTPSAltSvc.Set(key, struct{}{}, time.Now().Add(time.Minute))
+		return
+	}
+	f.HTTPSAltSvc.Set(key, struct{}{}, time.Now().Add(r.TTL))
+
+	for _, alpn := range r.ALPN {
+		if alpn != "h3" {
+			continue
+		}
+		port := r.Port
+		if port == 0 {
+			port = 443
+		}
+		glog.V(2).Infof("%s \"DIRECT %s %s %s\" HTTPS record advertises h3 on port %d", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, port)
+		f.AltSvc.Observe(key, fmt.Sprintf("h3=\":%d\"; ma=%d", port, int(r.TTL/time.Second)))
+		return
+	}
+}
@@ -0,0 +1,64 @@
+// +build quic
+
+package direct
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+
+	"../../dialer"
+)
+
+func init() {
+	NewHTTP3RoundTripper = newQUICRoundTripper
+}
+
+// quicRoundTripper is the quic-go HTTP/3 transport of builds with -tags quic.
+// Its conns share one UDP socket, opened with the socket options on the first
+// dial.
+type quicRoundTripper struct {
+	*http3.Transport
+
+	sockopts *dialer.SocketOptions
+
+	mu  sync.Mutex
+	udp *quic.Transport
+}
+
+func newQUICRoundTripper(config *tls.Config, sockopts *dialer.SocketOptions) http.RoundTripper {
+	rt := &quicRoundTripper{sockopts: sockopts}
+	rt.Transport = &http3.Transport{
+		TLSClientConfig: config,
+		QUICConfig:      &quic.Config{},
+		Dial:            rt.dial,
+	}
+	return rt
+}
+
+func (rt *quicRoundTripper) dial(ctx context.Context, addr string, tlsConfig *tls.Config, config *quic.Config) (*quic.Conn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	rt.mu.Lock()
+	if rt.udp == nil {
+		lc := net.ListenConfig{Control: rt.sockopts.Control}
+		conn, err := lc.ListenPacket(ctx, "udp", ":0")
+		if err != nil {
+			rt.mu.Unlock()
+			return nil, err
+		}
+		rt.udp = &quic.Transport{Conn: conn}
+	}
+	udp := rt.udp
+	rt.mu.Unlock()
+
+	return udp.DialEarly(ctx, udpAddr, tlsConfig, config)
+}
@@ -0,0 +1,69 @@
+// +build quic
+
+package direct
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/quic-go/quic-go/http3"
+
+	"../../filters"
+)
+
+// an h1 origin announces the h3 one beside it on loopback, which quic-go
+// serves with the same certificate
+func TestRoundTripHTTP3Loopback(t *testing.T) {
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(req.Proto))
+	})
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket error: %v", err)
+	}
+	defer udp.Close()
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Alt-Svc", fmt.Sprintf(`h3=":%d"; ma=60`, udp.LocalAddr().(*net.UDPAddr).Port))
+		handler(rw, req)
+	}))
+	ts.StartTLS()
+	defer ts.Close()
+
+	h3 := &http3.Server{
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(ts.TLS.Clone()),
+	}
+	go h3.Serve(udp)
+	defer h3.Close()
+
+	config := new(Config)
+	config.Transport.Dialer.Timeout = 4
+	config.Transport.EnableHTTP3 = true
+	config.Transport.TLSClientConfig.InsecureSkipVerify = true
+	fi, err := NewFilter(config)
+	if err != nil {
+		t.Fatalf("NewFilter(%#v) error: %v", config, err)
+	}
+	f := fi.(*Filter)
+	setDial(f, net.Dial)
+
+	for i, proto := range []string{"HTTP/1.1", "HTTP/3.0"} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+		_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip(%#v) #%d error: %v", f, ts.URL, i, err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.Proto != proto || string(b) != proto {
+			t.Errorf("%T.RoundTrip(%#v) #%d = %s %#v, want %s", f, ts.URL, i, resp.Proto, string(b), proto)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package direct
+
+import (
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+
+	"../../dialer"
+	"../../filters"
+	"../../helpers"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestRoundTripHTTP3(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Alt-Svc", `h3=":8443"; ma=60`)
+		rw.Write([]byte("h1"))
+	}))
+	defer ts.Close()
+
+	f := newTestFilter(t)
+	f.Transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	setDial(f, net.Dial)
+
+	var h3down bool
+	var h3host string
+	f.AltSvc = helpers.NewAltSvcCache(16)
+	f.HTTP3 = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		h3host = req.URL.Host
+		if h3down {
+			return nil, errors.New("no recent network activity")
+		}
+		return filters.NewResponse(req, http.StatusOK, http.Header{}, strings.NewReader("h3")), nil
+	})
+
+	get := func() string {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+		_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip() error: %v", f, err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	if v := get(); v != "h1" {
+		t.Errorf("first request went over %#v, want %#v", v, "h1")
+	}
+
+	if v := get(); v != "h3" {
+		t.Errorf("request after Alt-Svc went over %#v, want %#v", v, "h3")
+	}
+	if !strings.HasSuffix(h3host, ":8443") {
+		t.Errorf("HTTP/3 request dialed %#v, want the Alt-Svc port 8443", h3host)
+	}
+
+	h3down = true
+	if v := get(); v != "h1" {
+		t.Errorf("request with HTTP/3 down went over %#v, want fallback %#v", v, "h1")
+	}
+}
+
+func TestRoundTripAltSvc(t *testing.T) {
+	alt := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("alt " + req.Host))
+	}))
+	defer alt.Close()
+
+	_, altPort, _ := net.SplitHostPort(alt.Listener.Addr().String())
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Alt-Svc", `h3=":8443", http%2F1.1=":`+altPort+`"; ma=60`)
+		rw.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+
+	f := newTestFilter(t)
+	f.Transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	f.AltSvc = helpers.NewAltSvcCache(16)
+	setDial(f, net.Dial)
+	f.Transport.DialContext = f.altSvcDialContext(f.Transport.DialContext)
+
+	get := func() string {
+		req, _ := http.NewRequest(http.MethodGet, origin.URL+"/", nil)
+		_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip() error: %v", f, err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	if v := get(); v != "origin" {
+		t.Errorf("first request answered by %#v, want %#v", v, "origin")
+	}
+
+	if _, ok := f.AltSvc.Lookup(origin.Listener.Addr().String(), "http/1.1"); !ok {
+		t.Fatalf("AltSvc.Lookup(%#v) found no http/1.1 alternative, stats: %v", origin.Listener.Addr().String(), f.AltSvc.Stats())
+	}
+
+	f.Transport.CloseIdleConnections()
+	if v, want := get(), "alt "+origin.Listener.Addr().String(); v != want {
+		t.Errorf("request after Alt-Svc answered by %#v, want %#v", v, want)
+	}
+}
+
+func TestRoundTripHTTPSRecordH3(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("h1"))
+	}))
+	defer ts.Close()
+
+	f := newTestFilter(t)
+	f.Transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	setDial(f, net.Dial)
+
+	var lookups int
+	var h3host string
+	f.AltSvc = helpers.NewAltSvcCache(16)
+	f.HTTPSAltSvc = lrucache.NewLRUCache(16)
+	f.HTTPSRecord = func(host string) *dialer.HTTPSRecord {
+		lookups++
+		return &dialer.HTTPSRecord{Priority: 1, ALPN: []string{"h3", "h2"}, Port: 8443, TTL: time.Minute}
+	}
+	f.HTTP3 = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		h3host = req.URL.Host
+		return nil, errors.New("no recent network activity")
+	})
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+		_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip() error: %v", f, err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != "h1" {
+			t.Errorf("request %d went over %#v, want fallback %#v", i, string(b), "h1")
+		}
+	}
+
+	if !strings.HasSuffix(h3host, ":8443") {
+		t.Errorf("first request tried HTTP/3 at %#v, want the HTTPS record port 8443", h3host)
+	}
+	// a failed h3 is not seeded again within the record TTL
+	if lookups != 1 {
+		t.Errorf("HTTPSRecord called %d times, want 1", lookups)
+	}
+}
+
+func TestNewFilterEnableHTTP3(t *testing.T) {
+	defer func(v func(*tls.Config, *dialer.SocketOptions) http.RoundTripper) { NewHTTP3RoundTripper = v }(NewHTTP3RoundTripper)
+
+	config := new(Config)
+	config.Transport.EnableHTTP3 = true
+	config.Transport.TLSClientConfig.InsecureSkipVerify = true
+
+	NewHTTP3RoundTripper = nil
+	if _, err := NewFilter(config); err == nil {
+		t.Errorf("NewFilter(EnableHTTP3) without an HTTP/3 RoundTripper returns no error")
+	}
+
+	var h3config *tls.Config
+	var h3sockopts *dialer.SocketOptions
+	NewHTTP3RoundTripper = func(config *tls.Config, sockopts *dialer.SocketOptions) http.RoundTripper {
+		h3config, h3sockopts = config, sockopts
+		return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			return filters.NewResponse(req, http.StatusOK, http.Header{}, strings.NewReader("h3")), nil
+		})
+	}
+	f, err := NewFilter(config)
+	if err != nil {
+		t.Fatalf("NewFilter(EnableHTTP3) error: %v", err)
+	}
+	f1 := f.(*Filter)
+	if f1.HTTP3 == nil || f1.AltSvc == nil {
+		t.Errorf("NewFilter(EnableHTTP3) sets HTTP3 %v and AltSvc %v, want both", f1.HTTP3, f1.AltSvc)
+	}
+	if h3config == nil || !h3config.InsecureSkipVerify || h3config == f1.Transport.TLSClientConfig {
+		t.Errorf("NewFilter(EnableHTTP3) passes TLS config %+v, want a copy of the Transport one", h3config)
+	}
+	if h3sockopts == nil {
+		t.Errorf("NewFilter(EnableHTTP3) passes no socket options")
+	}
+}
@@ -0,0 +1,49 @@
+package direct
+
+import (
+	"net/http"
+)
+
+// IsolateHeader asks for a dedicated upstream connection, it is honored from
+// Transport.IsolateHeaderNets and never sent upstream.
+const IsolateHeader = "X-Goproxy-Isolate"
+
+type isolateKey struct{}
+
+// isolate reports whether req must not share an upstream connection, by
+// IsolateHosts or the IsolateHeader it strips.
+func (f *Filter) isolate(req *http.Request) bool {
+	v := req.Header.Get(IsolateHeader)
+	req.Header.Del(IsolateHeader)
+
+	if f.IsolatedTransport == nil {
+		return false
+	}
+	if v != "" && v != "0" && fromNets(req, f.IsolateNets) {
+		return true
+	}
+	return f.IsolateHosts != nil && f.IsolateHosts.Match(req.URL.Hostname())
+}
+
+// newIsolatedTransport returns a transport like tr which dials every request
+// afresh and closes the connection after the response. It resumes no TLS
+// sessions, which would link the requests again.
+func newIsolatedTransport(tr *http.Transport) *http.Transport {
+	config := tr.TLSClientConfig.Clone()
+	if config != nil {
+		config.ClientSessionCache = nil
+	}
+
+	tr1 := &http.Transport{
+		Proxy:                 tr.Proxy,
+		DialContext:           tr.DialContext,
+		Dial:                  tr.Dial,
+		TLSClientConfig:       config,
+		TLSHandshakeTimeout:   tr.TLSHandshakeTimeout,
+		ExpectContinueTimeout: tr.ExpectContinueTimeout,
+		DisableCompression:    tr.DisableCompression,
+		DisableKeepAlives:     true,
+	}
+	copyDialTLS(tr1, tr)
+	return tr1
+}
@@ -0,0 +1,126 @@
+package direct
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"../../filters"
+)
+
+func TestRoundTripIsolate(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if v := req.Header.Get(IsolateHeader); v != "" {
+			t.Errorf("upstream got %s: %#v", IsolateHeader, v)
+		}
+		rw.Write([]byte(req.RemoteAddr))
+	}))
+	defer ts.Close()
+
+	config := new(Config)
+	config.Transport.Dialer.Timeout = 4
+	config.Transport.Dialer.DNSCacheSize = 64
+	config.Transport.IsolateHosts = []string{"isolated.example.org"}
+	config.Transport.IsolateHeaderNets = []string{"10.0.0.0/8"}
+
+	f1, err := NewFilter(config)
+	if err != nil {
+		t.Fatalf("NewFilter(%#v) error: %v", config, err)
+	}
+	f := f1.(*Filter)
+
+	dial := func(network, addr string) (net.Conn, error) {
+		return net.Dial(network, ts.Listener.Addr().String())
+	}
+	setDial(f, dial)
+	f.IsolatedTransport.DialContext = f.Transport.DialContext
+
+	get := func(host string, header bool) string {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		if header {
+			req.Header.Set(IsolateHeader, "1")
+		}
+		_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip(%#v) error: %v", f, host, err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	pooled := get("www.example.org", false)
+	if v := get("www.example.org", false); v != pooled {
+		t.Fatalf("plain requests used connections %s and %s, want one pooled", pooled, v)
+	}
+
+	seen := map[string]bool{pooled: true}
+	for _, c := range []struct {
+		host   string
+		header bool
+	}{
+		{"isolated.example.org", false},
+		{"isolated.example.org", false},
+		{"www.example.org", true},
+		{"www.example.org", true},
+	} {
+		v := get(c.host, c.header)
+		if seen[v] {
+			t.Errorf("isolated request to %s (header %v) reused connection %s", c.host, c.header, v)
+		}
+		seen[v] = true
+	}
+
+	if v := get("www.example.org", false); v != pooled {
+		t.Errorf("plain request after isolated ones used %s, want the pooled %s", v, pooled)
+	}
+
+	// the header is stripped but not honored from other clients
+	req, _ := http.NewRequest(http.MethodGet, "http://www.example.org/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set(IsolateHeader, "1")
+	_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+	if err != nil {
+		t.Fatalf("%T.RoundTrip() error: %v", f, err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != pooled {
+		t.Errorf("%s from an untrusted client used %s, want the pooled %s", IsolateHeader, string(b), pooled)
+	}
+}
+
+func TestRoundTripIsolateTLSSession(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	config := new(Config)
+	config.Transport.Dialer.Timeout = 4
+	config.Transport.IsolateHosts = []string{"127.0.0.1"}
+	config.Transport.TLSClientConfig.InsecureSkipVerify = true
+	config.Transport.TLSClientConfig.ClientSessionCacheSize = 16
+	f1, err := NewFilter(config)
+	if err != nil {
+		t.Fatalf("NewFilter(%#v) error: %v", config, err)
+	}
+	f := f1.(*Filter)
+	setDial(f, net.Dial)
+	f.IsolatedTransport.DialContext = f.Transport.DialContext
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+		_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip(%#v) error: %v", f, ts.URL, err)
+		}
+		resp.Body.Close()
+		if resp.TLS == nil || resp.TLS.DidResume {
+			t.Errorf("isolated request #%d resumes a TLS session: %#v", i, resp.TLS)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package direct
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// requestHost returns the host req goes to, the CONNECT authority or the
+// host of its url, with the port if it has one.
+func requestHost(req *http.Request) string {
+	if req.Method == http.MethodConnect || req.URL.Host == "" {
+		return req.Host
+	}
+	return req.URL.Host
+}
+
+// isIPLiteral reports whether host, with or without a port, is an ipv4 or a
+// bracketed ipv6 address rather than a name. The ipv4 forms inet_aton takes,
+// 127.1 or 2130706433, count too, resolvers dial them as addresses.
+func isIPLiteral(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	// zoned ipv6, fe80::1%eth0
+	if i := strings.LastIndexByte(host, '%'); i > 0 {
+		host = host[:i]
+	}
+	return net.ParseIP(host) != nil || isInetAton(host)
+}
+
+// isInetAton reports whether host is one to four dot separated numbers, each
+// decimal, octal with a leading 0 or hex with a leading 0x.
+func isInetAton(host string) bool {
+	parts := strings.Split(host, ".")
+	if len(parts) > 4 {
+		return false
+	}
+	for _, part := range parts {
+		digits := "0123456789"
+		switch {
+		case len(part) > 2 && (part[:2] == "0x" || part[:2] == "0X"):
+			part, digits = part[2:], "0123456789abcdefABCDEF"
+		case len(part) > 1 && part[0] == '0':
+			digits = "01234567"
+		}
+		if part == "" || strings.Trim(part, digits) != "" {
+			return false
+		}
+	}
+	return true
+}
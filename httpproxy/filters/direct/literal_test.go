@@ -0,0 +1,101 @@
+package direct
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"../../filters"
+)
+
+func TestIsIPLiteral(t *testing.T) {
+	var cases = []struct {
+		Host    string
+		Literal bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.1:443", true},
+		{"[2001:db8::1]", true},
+		{"[2001:db8::1]:443", true},
+		{"2001:db8::1", true},
+		{"[fe80::1%eth0]:80", true},
+		{"127.1", true},
+		{"127.1:80", true},
+		{"2130706433", true},
+		{"0x7f.0.0.1", true},
+		{"0177.0.0.1:443", true},
+		{"0x7f000001", true},
+		{"1.2.3.4.5", false},
+		{"0x", false},
+		{"08.1", false},
+		{"127.1.", false},
+		{"example.org", false},
+		{"example.org:443", false},
+		{"192.0.2.1.example.org", false},
+		{"", false},
+	}
+
+	for _, c := range cases {
+		if v := isIPLiteral(c.Host); v != c.Literal {
+			t.Errorf("isIPLiteral(%#v) = %v, want %v", c.Host, v, c.Literal)
+		}
+	}
+}
+
+func TestRoundTripRejectIPLiterals(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("named"))
+	}))
+	defer ts.Close()
+
+	f := newTestFilter(t)
+	f.Config.Transport.RejectIPLiterals = true
+	dialed := 0
+	setDial(f, func(network, addr string) (net.Conn, error) {
+		dialed++
+		return net.Dial(network, ts.Listener.Addr().String())
+	})
+
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	for _, u := range []string{ts.URL + "/", "http://[::1]:" + port + "/"} {
+		req, _ := http.NewRequest(http.MethodGet, u, nil)
+		_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip(%#v) error: %v", f, u, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("RoundTrip(%#v) returns %d, want 403", u, resp.StatusCode)
+		}
+	}
+
+	for _, host := range []string{"192.0.2.1:443", "[2001:db8::1]:443"} {
+		req, _ := http.NewRequest(http.MethodConnect, "", nil)
+		req.Host = host
+		rw := filters.NewTestResponseWriter(nil)
+		_, resp, err := f.RoundTrip(filters.NewTestContext(rw), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip(CONNECT %#v) error: %v", f, host, err)
+		}
+		if resp.StatusCode != http.StatusForbidden || rw.Hijacked {
+			t.Errorf("RoundTrip(CONNECT %#v) returns %d hijacked=%v, want 403", host, resp.StatusCode, rw.Hijacked)
+		}
+	}
+	if dialed != 0 {
+		t.Errorf("ip literal requests dialed %d times", dialed)
+	}
+
+	// a name passes
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:"+port+"/", nil)
+	_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+	if err != nil {
+		t.Fatalf("%T.RoundTrip(localhost) error: %v", f, err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "named" {
+		t.Errorf("RoundTrip(localhost) returns %d %#v, want 200 \"named\"", resp.StatusCode, string(body))
+	}
+}
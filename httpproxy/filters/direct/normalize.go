@@ -0,0 +1,86 @@
+package direct
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/phuslu/glog"
+
+	"../../helpers"
+)
+
+// defaultNormalizeFramingMaxBytes is the NormalizeFramingMaxBytes of 0.
+const defaultNormalizeFramingMaxBytes int64 = 1 << 20
+
+// normalizeFraming reads the chunked body of resp from a NormalizeFramingHosts
+// origin in full, and hands it to the client with a Content-Length instead of
+// whatever chunks the origin framed it in, or in chunks of ours if it has
+// trailers. Bodies over max or beyond the buffer budget stream through as
+// they came. The buffer is held of the budget until the body is closed.
+func (f *Filter) normalizeFraming(req *http.Request, resp *http.Response) (*http.Response, error) {
+	if f.NormalizeFraming == nil || resp.ContentLength >= 0 || req.Method == http.MethodHead || !f.NormalizeFraming.Match(req.URL.Hostname()) {
+		return resp, nil
+	}
+
+	max := f.Config.Transport.NormalizeFramingMaxBytes
+	if max <= 0 {
+		max = defaultNormalizeFramingMaxBytes
+	}
+
+	reservation := helpers.Buffers.Reserve()
+
+	var buf bytes.Buffer
+	for {
+		// up to one byte over max tells an oversized body
+		n := max + 1 - int64(buf.Len())
+		if n > 32*1024 {
+			n = 32 * 1024
+		}
+		if !reservation.Grow(n) {
+			glog.Warningf("%s \"DIRECT %s %s %s\" no buffer memory left to normalize the framing, streams the body", req.RemoteAddr, req.Method, req.URL.String(), req.Proto)
+			break
+		}
+		_, err := io.CopyN(&buf, resp.Body, n)
+		if err == io.EOF {
+			resp.Body.Close()
+			resp.Body = &reservedBody{ioutil.NopCloser(&buf), reservation}
+			// trailers need chunks, which are ours now
+			if len(resp.Trailer) == 0 {
+				resp.ContentLength = int64(buf.Len())
+				resp.TransferEncoding = nil
+				resp.Header.Set("Content-Length", strconv.Itoa(buf.Len()))
+			}
+			glog.V(2).Infof("%s \"DIRECT %s %s %s\" normalized the framing of a %d bytes body", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, buf.Len())
+			return resp, nil
+		}
+		if err != nil {
+			reservation.Release()
+			resp.Body.Close()
+			return nil, err
+		}
+		if int64(buf.Len()) > max {
+			glog.V(2).Infof("%s \"DIRECT %s %s %s\" body over NormalizeFramingMaxBytes %d, streams it", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, max)
+			break
+		}
+	}
+
+	resp.Body = &reservedBody{struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(&buf, resp.Body), resp.Body}, reservation}
+	return resp, nil
+}
+
+// reservedBody gives the reservation of its buffered bytes back on Close.
+type reservedBody struct {
+	io.ReadCloser
+	reservation *helpers.BufferReservation
+}
+
+func (b *reservedBody) Close() error {
+	b.reservation.Release()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,93 @@
+package direct
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"../../filters"
+	"../../helpers"
+)
+
+// oddChunkedServer answers every request with a chunked body split in one
+// byte and zero padded chunks with extensions, as the broken origins do.
+func oddChunkedServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n" +
+					"1;ext=a\r\nh\r\n0001\r\ne\r\n3 \r\nllo\r\n000C;x\r\n, framing!!!\r\n0\r\n\r\n"))
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestRoundTripNormalizeFraming(t *testing.T) {
+	ln := oddChunkedServer(t)
+	defer ln.Close()
+
+	f := newTestFilter(t)
+	setDial(f, net.Dial)
+
+	get := func() *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+ln.Addr().String()+"/", nil)
+		_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip() error: %v", f, err)
+		}
+		return resp
+	}
+
+	const body = "hello, framing!!!"
+	for _, c := range []struct {
+		hosts  []string
+		max    int64
+		length int64
+	}{
+		{nil, 0, -1},
+		{[]string{"127.0.0.1"}, 0, int64(len(body))},
+		// oversized bodies stream through
+		{[]string{"127.0.0.1"}, 4, -1},
+	} {
+		f.NormalizeFraming = nil
+		if c.hosts != nil {
+			f.NormalizeFraming = helpers.NewHostMatcher(c.hosts)
+		}
+		f.Config.Transport.NormalizeFramingMaxBytes = c.max
+
+		resp := get()
+		b, err := ioutil.ReadAll(resp.Body)
+		if c.hosts != nil && helpers.Buffers.InUse() == 0 {
+			t.Errorf("NormalizeFramingHosts %v max %d gives the buffer back before the body is closed", c.hosts, c.max)
+		}
+		resp.Body.Close()
+		if err != nil || string(b) != body {
+			t.Errorf("NormalizeFramingHosts %v max %d body = %#v, %v, want %#v", c.hosts, c.max, string(b), err, body)
+		}
+		if resp.ContentLength != c.length {
+			t.Errorf("NormalizeFramingHosts %v max %d ContentLength = %d, want %d", c.hosts, c.max, resp.ContentLength, c.length)
+		}
+		if c.length >= 0 && (resp.Header.Get("Content-Length") != "17" || len(resp.TransferEncoding) != 0) {
+			t.Errorf("NormalizeFramingHosts %v normalized header %v, TransferEncoding %v", c.hosts, resp.Header, resp.TransferEncoding)
+		}
+	}
+
+	if v := helpers.Buffers.InUse(); v != 0 {
+		t.Errorf("helpers.Buffers.InUse() = %d, want 0", v)
+	}
+}
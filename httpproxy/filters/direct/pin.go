@@ -0,0 +1,157 @@
+package direct
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+
+	"github.com/phuslu/glog"
+	"github.com/phuslu/net/http2"
+
+	"../../filters"
+)
+
+type pinKey struct{}
+
+// pin sends the requests of one inbound connection over a transport of its
+// own with Transport.PinClientConnections, so keepalive clients keep the same
+// upstream connection for as long as they keep theirs. The transport closes
+// its conns once the client connection closes and its last response is done,
+// the caller ends the one of req with the pinnedTransport returned.
+func (f *Filter) pin(ctx context.Context, req *http.Request) (*http.Request, *pinnedTransport) {
+	if !f.Config.Transport.PinClientConnections || req.Context().Value(isolateKey{}) != nil {
+		return req, nil
+	}
+
+	c := filters.GetClientConn(ctx)
+	if c == nil {
+		return req, nil
+	}
+
+	created := false
+	p := c.LoadOrStore(pinKey{}, func() interface{} {
+		created = true
+		return f.newPinnedTransport()
+	}).(*pinnedTransport)
+	if created {
+		c.OnClose(p.clientClosed)
+	}
+
+	p.begin()
+	req = req.WithContext(context.WithValue(req.Context(), pinKey{}, p.Transport))
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{GotConn: p.gotConn})), p
+}
+
+// pinnedTransport is the transport of one client connection, with the
+// responses in flight over it and the conns it got.
+type pinnedTransport struct {
+	*http.Transport
+	f *Filter
+
+	mu     sync.Mutex
+	active int
+	closed bool
+	conns  map[net.Conn]struct{}
+}
+
+// newPinnedTransport returns a transport like f.Transport which keeps one idle
+// conn per upstream.
+func (f *Filter) newPinnedTransport() *pinnedTransport {
+	tr := f.Transport
+	tr1 := &http.Transport{
+		Proxy:                 tr.Proxy,
+		DialContext:           tr.DialContext,
+		Dial:                  tr.Dial,
+		TLSClientConfig:       tr.TLSClientConfig,
+		TLSHandshakeTimeout:   tr.TLSHandshakeTimeout,
+		DisableKeepAlives:     tr.DisableKeepAlives,
+		ExpectContinueTimeout: tr.ExpectContinueTimeout,
+		DisableCompression:    tr.DisableCompression,
+		IdleConnTimeout:       tr.IdleConnTimeout,
+		MaxIdleConnsPerHost:   1,
+	}
+	copyDialTLS(tr1, tr)
+	// it shares the TLS config announcing h2 to upstreams
+	if f.Config.Transport.HTTP2 && tr1.Proxy == nil {
+		if err := http2.ConfigureTransport(tr1); err != nil {
+			glog.Warningf("DIRECT: http2.ConfigureTransport() of a pinned transport error: %v", err)
+		}
+	}
+	return &pinnedTransport{
+		Transport: tr1,
+		f:         f,
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+func (p *pinnedTransport) begin() {
+	p.mu.Lock()
+	p.active++
+	p.mu.Unlock()
+}
+
+// end is called once the response of a request begun is done, or it failed.
+func (p *pinnedTransport) end() {
+	p.mu.Lock()
+	p.active--
+	done := p.closed && p.active == 0
+	p.mu.Unlock()
+
+	if done {
+		p.close()
+	}
+}
+
+// body ends the response with body once it is closed.
+func (p *pinnedTransport) body(body io.ReadCloser) io.ReadCloser {
+	return &pinnedBody{ReadCloser: body, p: p}
+}
+
+func (p *pinnedTransport) gotConn(info httptrace.GotConnInfo) {
+	p.mu.Lock()
+	p.conns[info.Conn] = struct{}{}
+	p.mu.Unlock()
+}
+
+func (p *pinnedTransport) clientClosed() {
+	p.mu.Lock()
+	p.closed = true
+	done := p.active == 0
+	p.mu.Unlock()
+
+	if done {
+		p.close()
+	}
+}
+
+// close closes every conn of the transport, the idle ones and those only
+// about to be put back idle after the last response.
+func (p *pinnedTransport) close() {
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = make(map[net.Conn]struct{})
+	p.mu.Unlock()
+
+	p.CloseIdleConnections()
+	for conn := range conns {
+		conn.Close()
+	}
+	if p.f.UpstreamRetry != nil {
+		p.f.UpstreamRetry.forget(p.Transport)
+	}
+}
+
+type pinnedBody struct {
+	io.ReadCloser
+	p    *pinnedTransport
+	once sync.Once
+}
+
+func (b *pinnedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.p.end)
+	return err
+}
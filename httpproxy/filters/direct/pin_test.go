@@ -0,0 +1,140 @@
+package direct
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"../../filters"
+)
+
+// addrConn is an inbound conn only known by its remote address.
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func TestRoundTripPinClientConnections(t *testing.T) {
+	closed := make(chan string, 4)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(req.RemoteAddr))
+	}))
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- conn.RemoteAddr().String()
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	f := newTestFilter(t)
+	f.Config.Transport.PinClientConnections = true
+	setDial(f, net.Dial)
+
+	conns := filters.NewClientConns()
+	client1 := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}
+	client2 := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 2000}
+
+	get := func(client net.Addr) string {
+		ctx := filters.NewTestContext(filters.NewTestResponseWriter(nil))
+		ctx = filters.WithClientConn(ctx, conns.Get(client.String()))
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+		req = req.WithContext(ctx)
+		_, resp, err := f.RoundTrip(ctx, req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip() error: %v", f, err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	upstream1 := get(client1)
+	if v := get(client1); v != upstream1 {
+		t.Errorf("requests of one client connection went over upstream connections %s and %s", upstream1, v)
+	}
+
+	upstream2 := get(client2)
+	if upstream2 == upstream1 {
+		t.Errorf("requests of two client connections share upstream connection %s", upstream1)
+	}
+
+	// the pinned upstream connection closes with its client connection
+	conns.ConnState(addrConn{addr: client1}, http.StateClosed)
+	select {
+	case addr := <-closed:
+		if addr != upstream1 {
+			t.Errorf("closing the client connection closed upstream connection %s, want %s", addr, upstream1)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("closing the client connection left upstream connection %s open", upstream1)
+	}
+
+	if v := get(client1); v == upstream1 {
+		t.Errorf("a new client connection from the same address reuses the closed upstream connection")
+	}
+
+}
+
+func TestRoundTripPinClientConnectionsInFlight(t *testing.T) {
+	closed := make(chan string, 4)
+	proceed := make(chan struct{})
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("head "))
+		rw.(http.Flusher).Flush()
+		<-proceed
+		rw.Write([]byte("tail"))
+	}))
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- conn.RemoteAddr().String()
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	f := newTestFilter(t)
+	f.Config.Transport.PinClientConnections = true
+	setDial(f, net.Dial)
+
+	conns := filters.NewClientConns()
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}
+	ctx := filters.NewTestContext(filters.NewTestResponseWriter(nil))
+	ctx = filters.WithClientConn(ctx, conns.Get(client.String()))
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+	req = req.WithContext(ctx)
+	_, resp, err := f.RoundTrip(ctx, req)
+	if err != nil {
+		t.Fatalf("%T.RoundTrip() error: %v", f, err)
+	}
+
+	// the client connection closes while the response streams
+	conns.ConnState(addrConn{addr: client}, http.StateClosed)
+	close(proceed)
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "head tail" {
+		t.Errorf("response streaming over a closed client connection = %#v, want \"head tail\"", string(b))
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Errorf("the upstream connection of a response finished after its client connection closed is left open")
+	}
+}
+
+func TestPinnedTransport(t *testing.T) {
+	f := newTestFilter(t)
+	f.Transport.DisableKeepAlives = true
+	if p := f.newPinnedTransport(); !p.DisableKeepAlives || p.MaxIdleConnsPerHost != 1 {
+		t.Errorf("pinned transport DisableKeepAlives = %v MaxIdleConnsPerHost = %d, want true and 1", p.DisableKeepAlives, p.MaxIdleConnsPerHost)
+	}
+}
@@ -0,0 +1,71 @@
+package direct
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"../../filters"
+)
+
+func TestRoundTripPoolsPerEndpoint(t *testing.T) {
+	var conns [2]int32
+	servers := make([]*httptest.Server, 2)
+	for i := range servers {
+		i := i
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte{'0' + byte(i)})
+		}))
+		ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt32(&conns[i], 1)
+			}
+		}
+		ts.Start()
+		defer ts.Close()
+		servers[i] = ts
+	}
+
+	f := newTestFilter(t)
+	setDial(f, func(network, addr string) (net.Conn, error) {
+		// localhost is the loopback ip of the servers
+		return net.Dial(network, strings.Replace(addr, "localhost", "127.0.0.1", 1))
+	})
+
+	get := func(u string) string {
+		req, _ := http.NewRequest(http.MethodGet, u, nil)
+		_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip(%#v) error: %v", f, u, err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return string(b)
+	}
+
+	_, port0, _ := net.SplitHostPort(servers[0].Listener.Addr().String())
+	_, port1, _ := net.SplitHostPort(servers[1].Listener.Addr().String())
+
+	// the same endpoint, spelled in other cases, shares one conn
+	for _, u := range []string{"http://localhost:" + port0 + "/", "http://LOCALHOST:" + port0 + "/a", "http://Localhost:" + port0 + "/b"} {
+		if v := get(u); v != "0" {
+			t.Errorf("GET %s answered by server %s, want 0", u, v)
+		}
+	}
+	// another port of the same host never gets a conn of the first
+	for _, u := range []string{"http://localhost:" + port1 + "/", "http://localhost:" + port1 + "/a"} {
+		if v := get(u); v != "1" {
+			t.Errorf("GET %s answered by server %s, want 1", u, v)
+		}
+	}
+
+	for i := range conns {
+		if n := atomic.LoadInt32(&conns[i]); n != 1 {
+			t.Errorf("server %d got %d conns, want 1", i, n)
+		}
+	}
+}
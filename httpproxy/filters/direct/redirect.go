@@ -0,0 +1,87 @@
+package direct
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/phuslu/glog"
+)
+
+var errRedirectLoop = errors.New("redirect loop")
+
+func isRedirect(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// roundTrip is Transport.RoundTrip, following upstream redirects itself with
+// MaxRedirects > 0. Requests with a body, and https to http redirects, are
+// passed to the client as is.
+func (f *Filter) roundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := f.transportRoundTrip(req)
+
+	max := f.Config.Transport.MaxRedirects
+	if err != nil || max <= 0 || (req.Body != nil && req.Body != http.NoBody) {
+		return resp, err
+	}
+
+	visited := map[string]struct{}{req.URL.String(): {}}
+	for i := 0; isRedirect(resp.StatusCode); i++ {
+		loc := resp.Header.Get("Location")
+		if loc == "" {
+			break
+		}
+
+		u, err := req.URL.Parse(loc)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			break
+		}
+		if req.URL.Scheme == "https" && u.Scheme == "http" {
+			glog.Warningf("%s \"DIRECT %s %s %s\" refuses to follow downgrade to %#v", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, u.String())
+			break
+		}
+
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+
+		if _, ok := visited[u.String()]; ok {
+			return nil, fmt.Errorf("%v to %s", errRedirectLoop, u.String())
+		}
+		if i >= max {
+			return nil, fmt.Errorf("stopped after %d redirects", max)
+		}
+		visited[u.String()] = struct{}{}
+
+		glog.V(2).Infof("%s \"DIRECT %s %s %s\" follows %d to %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, resp.StatusCode, u.String())
+
+		req1 := req.WithContext(req.Context())
+		req1.URL = u
+		req1.Host = u.Host
+		req1.Header = make(http.Header, len(req.Header))
+		for key, values := range req.Header {
+			req1.Header[key] = values
+		}
+		if u.Host != req.URL.Host {
+			// like http.Client, never leak credentials to another host
+			req1.Header.Del("Authorization")
+			req1.Header.Del("Cookie")
+		}
+		if resp.StatusCode == http.StatusSeeOther && req1.Method != http.MethodHead {
+			req1.Method = http.MethodGet
+		}
+		req = req1
+
+		resp, err = f.transportRoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return resp, nil
+}
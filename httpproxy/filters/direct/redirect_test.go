@@ -0,0 +1,101 @@
+package direct
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"../../filters"
+)
+
+func TestRoundTripMaxRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/a", func(rw http.ResponseWriter, req *http.Request) {
+		http.Redirect(rw, req, "/b", http.StatusFound)
+	})
+	mux.HandleFunc("/b", func(rw http.ResponseWriter, req *http.Request) {
+		http.Redirect(rw, req, "/c", http.StatusSeeOther)
+	})
+	mux.HandleFunc("/c", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("final " + req.Method))
+	})
+	mux.HandleFunc("/loop1", func(rw http.ResponseWriter, req *http.Request) {
+		http.Redirect(rw, req, "/loop2", http.StatusFound)
+	})
+	mux.HandleFunc("/loop2", func(rw http.ResponseWriter, req *http.Request) {
+		http.Redirect(rw, req, "/loop1", http.StatusFound)
+	})
+	mux.HandleFunc("/chain/", func(rw http.ResponseWriter, req *http.Request) {
+		http.Redirect(rw, req, req.URL.Path+"x", http.StatusTemporaryRedirect)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	f := newTestFilter(t)
+	f.Config.Transport.MaxRedirects = 3
+	setDial(f, net.Dial)
+
+	var cases = []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/a", http.StatusOK, "final GET"},
+		{"/loop1", http.StatusBadGateway, "redirect loop"},
+		{"/chain/", http.StatusBadGateway, "stopped after 3 redirects"},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+c.path, nil)
+		_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip(%#v) error: %v", f, c.path, err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != c.status || !strings.Contains(string(b), c.body) {
+			t.Errorf("%T.RoundTrip(%#v) return %d %#v, want %d %#v", f, c.path, resp.StatusCode, string(b), c.status, c.body)
+		}
+	}
+
+	// redirects are passed through by default
+	f.Config.Transport.MaxRedirects = 0
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/loop1", nil)
+	_, resp, _ := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("%T.RoundTrip(%#v) without MaxRedirects return %d, want %d", f, "/loop1", resp.StatusCode, http.StatusFound)
+	}
+}
+
+func TestRoundTripRedirectDowngrade(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		t.Errorf("https to http redirect followed to %s", req.URL.String())
+	}))
+	defer plain.Close()
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.Redirect(rw, req, plain.URL+"/", http.StatusFound)
+	}))
+	defer ts.Close()
+
+	f := newTestFilter(t)
+	f.Config.Transport.MaxRedirects = 3
+	f.Transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	setDial(f, net.Dial)
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+	_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+	if err != nil {
+		t.Fatalf("%T.RoundTrip(%#v) error: %v", f, req.URL.String(), err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("%T.RoundTrip(%#v) return %d, want the %d passed through", f, req.URL.String(), resp.StatusCode, http.StatusFound)
+	}
+}
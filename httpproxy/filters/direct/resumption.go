@@ -0,0 +1,39 @@
+package direct
+
+import (
+	"crypto/tls"
+	"net"
+
+	"../../helpers"
+)
+
+// sessionCache is the client session cache of the upstream TLS conns, which
+// neither offers nor stores sessions of DisableResumptionHosts, so those get
+// a full handshake every time.
+type sessionCache struct {
+	tls.ClientSessionCache
+	skip *helpers.HostMatcher
+}
+
+func (c *sessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	if c.skip.Match(sessionHost(sessionKey)) {
+		return nil, false
+	}
+	return c.ClientSessionCache.Get(sessionKey)
+}
+
+func (c *sessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	if c.skip.Match(sessionHost(sessionKey)) {
+		return
+	}
+	c.ClientSessionCache.Put(sessionKey, cs)
+}
+
+// sessionHost returns the host of a session key, the ServerName of the conn
+// or its address without one.
+func sessionHost(sessionKey string) string {
+	if host, _, err := net.SplitHostPort(sessionKey); err == nil {
+		return host
+	}
+	return sessionKey
+}
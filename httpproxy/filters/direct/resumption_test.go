@@ -0,0 +1,57 @@
+package direct
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"../../filters"
+)
+
+func TestRoundTripDisableResumptionHosts(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	for _, c := range []struct {
+		hosts  []string
+		resume bool
+	}{
+		{nil, true},
+		{[]string{"127.0.0.1"}, false},
+	} {
+		config := new(Config)
+		config.Transport.Dialer.Timeout = 4
+		config.Transport.Dialer.DNSCacheSize = 64
+		config.Transport.TLSClientConfig.InsecureSkipVerify = true
+		config.Transport.TLSClientConfig.ClientSessionCacheSize = 16
+		config.Transport.TLSClientConfig.DisableResumptionHosts = c.hosts
+		f1, err := NewFilter(config)
+		if err != nil {
+			t.Fatalf("NewFilter(%#v) error: %v", config, err)
+		}
+		f := f1.(*Filter)
+		setDial(f, net.Dial)
+
+		resumed := false
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+			_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+			if err != nil {
+				t.Fatalf("%T.RoundTrip() error: %v", f, err)
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			resumed = resp.TLS.DidResume
+			// a new conn for the next request
+			f.Transport.CloseIdleConnections()
+		}
+
+		if resumed != c.resume {
+			t.Errorf("DisableResumptionHosts %v: second conn resumed = %v, want %v", c.hosts, resumed, c.resume)
+		}
+	}
+}
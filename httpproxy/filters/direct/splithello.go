@@ -0,0 +1,45 @@
+package direct
+
+import (
+	"net"
+	"sync"
+)
+
+// defaultSplitClientHelloOffset is the SplitClientHelloOffset of 0, one byte
+// past the TLS record header.
+const defaultSplitClientHelloOffset = 6
+
+// splitHelloConn writes the first TLS handshake record written to it, the
+// ClientHello of a CONNECT tunnel, in two writes split at offset, which leave
+// as two TCP segments as Go conns have TCP_NODELAY set. Other first writes
+// and any later ones go through as they are.
+type splitHelloConn struct {
+	net.Conn
+	offset int
+	once   sync.Once
+}
+
+func newSplitHelloConn(conn net.Conn, offset int) net.Conn {
+	if offset <= 0 {
+		offset = defaultSplitClientHelloOffset
+	}
+	return &splitHelloConn{Conn: conn, offset: offset}
+}
+
+func (c *splitHelloConn) Write(b []byte) (int, error) {
+	split := false
+	c.once.Do(func() {
+		// a handshake record of TLS 1.x, 0x16 0x03 0x0?
+		split = len(b) > c.offset && b[0] == 0x16 && b[1] == 0x03
+	})
+	if !split {
+		return c.Conn.Write(b)
+	}
+
+	n, err := c.Conn.Write(b[:c.offset])
+	if err != nil {
+		return n, err
+	}
+	m, err := c.Conn.Write(b[c.offset:])
+	return n + m, err
+}
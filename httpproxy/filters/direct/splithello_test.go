@@ -0,0 +1,63 @@
+package direct
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+type recordConn struct {
+	net.Conn
+	writes [][]byte
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.writes = append(c.writes, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func TestSplitHelloConn(t *testing.T) {
+	hello := append([]byte{0x16, 0x03, 0x01, 0x00, 0x20, 0x01}, bytes.Repeat([]byte{'h'}, 31)...)
+
+	cases := []struct {
+		offset int
+		first  []byte
+		writes []int
+	}{
+		{0, hello, []int{6, len(hello) - 6}},
+		{11, hello, []int{11, len(hello) - 11}},
+		// an offset past the record leaves it whole
+		{len(hello), hello, []int{len(hello)}},
+		// not a TLS handshake record
+		{0, []byte("GET / HTTP/1.1\r\n\r\n"), []int{18}},
+		{0, []byte{0x17, 0x03, 0x03, 0x00, 0x10, 0x00, 0x00}, []int{7}},
+	}
+
+	for _, c := range cases {
+		rc := &recordConn{}
+		conn := newSplitHelloConn(rc, c.offset)
+
+		n, err := conn.Write(c.first)
+		if err != nil || n != len(c.first) {
+			t.Fatalf("splitHelloConn(%d).Write(%#v) = %d, %v", c.offset, c.first[:6], n, err)
+		}
+		// only the first write is split
+		conn.Write(hello)
+
+		if len(rc.writes) != len(c.writes)+1 {
+			t.Errorf("splitHelloConn(%d) made %d writes, want %d", c.offset, len(rc.writes), len(c.writes)+1)
+			continue
+		}
+		for i, l := range c.writes {
+			if len(rc.writes[i]) != l {
+				t.Errorf("splitHelloConn(%d) write %d is %d bytes, want %d", c.offset, i, len(rc.writes[i]), l)
+			}
+		}
+		if got := bytes.Join(rc.writes[:len(c.writes)], nil); !bytes.Equal(got, c.first) {
+			t.Errorf("splitHelloConn(%d) wrote %#v, want %#v", c.offset, got, c.first)
+		}
+		if last := rc.writes[len(rc.writes)-1]; !bytes.Equal(last, hello) {
+			t.Errorf("splitHelloConn(%d) split a later write into %#v", c.offset, last)
+		}
+	}
+}
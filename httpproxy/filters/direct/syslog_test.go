@@ -0,0 +1,67 @@
+// +build !windows,!plan9
+
+package direct
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"../../filters"
+)
+
+func TestRoundTripSyslogAccessLog(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket error: %v", err)
+	}
+	defer conn.Close()
+
+	config := new(Config)
+	config.Transport.Dialer.Timeout = 4
+	config.Transport.Dialer.DNSCacheSize = 64
+	config.Logging.Syslog.Enabled = true
+	config.Logging.Syslog.Network = "udp"
+	config.Logging.Syslog.Address = conn.LocalAddr().String()
+	config.Logging.Syslog.Facility = "local1"
+	config.Logging.Syslog.Tag = "goproxy"
+	config.Logging.Syslog.AccessLog = true
+
+	f1, err := NewFilter(config)
+	if err != nil {
+		t.Fatalf("NewFilter(%#v) error: %v", config, err)
+	}
+	f := f1.(*Filter)
+	setDial(f, net.Dial)
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/hello", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+	if err != nil {
+		t.Fatalf("%T.RoundTrip() error: %v", f, err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b := make([]byte, 2048)
+	n, _, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("syslog listener ReadFrom error: %v", err)
+	}
+
+	// local1.info is 17*8+6
+	record := string(b[:n])
+	if !strings.HasPrefix(record, "<142>") || !strings.Contains(record, "127.0.0.1:1234 \"DIRECT GET "+ts.URL+"/hello HTTP/1.1\" 200 5") {
+		t.Errorf("syslog access log record = %#v", record)
+	}
+}
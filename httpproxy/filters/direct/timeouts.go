@@ -0,0 +1,100 @@
+package direct
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/phuslu/net/http2"
+
+	"../../helpers"
+)
+
+// A timeoutRoute sends requests to its hosts over a transport with the
+// timeouts of a Transport.TimeoutProfiles entry.
+type timeoutRoute struct {
+	hosts     *helpers.HostMatcher
+	transport *http.Transport
+}
+
+// newTimeoutRoutes builds a transport like tr for each timeout profile
+// Transport.Rules name, shared by the rules naming the same one.
+func newTimeoutRoutes(tr *http.Transport, config *Config) ([]timeoutRoute, error) {
+	transports := make(map[string]*http.Transport)
+	routes := make([]timeoutRoute, 0, len(config.Transport.Rules))
+
+	for i, rule := range config.Transport.Rules {
+		if rule.TimeoutProfile == "" {
+			continue
+		}
+		tr1, ok := transports[rule.TimeoutProfile]
+		if !ok {
+			p, ok := config.Transport.TimeoutProfiles[rule.TimeoutProfile]
+			if !ok {
+				return nil, fmt.Errorf("DIRECT: Transport.Rules[%d] names an unknown TimeoutProfile %#v", i, rule.TimeoutProfile)
+			}
+			tr1 = newTimeoutTransport(tr,
+				time.Duration(p.DialTimeout)*time.Second,
+				time.Duration(p.ResponseHeaderTimeout)*time.Second,
+				time.Duration(p.IdleConnTimeout)*time.Second)
+			// it shares the TLS config announcing h2 to upstreams
+			if config.Transport.HTTP2 && tr1.Proxy == nil {
+				if err := http2.ConfigureTransport(tr1); err != nil {
+					return nil, fmt.Errorf("DIRECT: http2.ConfigureTransport(%#v) error: %v", rule.TimeoutProfile, err)
+				}
+			}
+			transports[rule.TimeoutProfile] = tr1
+		}
+		routes = append(routes, timeoutRoute{helpers.NewHostMatcher(rule.Hosts), tr1})
+	}
+
+	return routes, nil
+}
+
+// newTimeoutTransport returns a transport like tr with the non zero timeouts
+// given. The dial timeout cuts the one of the Dialer short, it does not apply
+// to dials through a socks Proxy.
+func newTimeoutTransport(tr *http.Transport, dial, responseHeader, idleConn time.Duration) *http.Transport {
+	tr1 := &http.Transport{
+		Proxy:                 tr.Proxy,
+		DialContext:           tr.DialContext,
+		Dial:                  tr.Dial,
+		TLSClientConfig:       tr.TLSClientConfig,
+		TLSHandshakeTimeout:   tr.TLSHandshakeTimeout,
+		ExpectContinueTimeout: tr.ExpectContinueTimeout,
+		DisableCompression:    tr.DisableCompression,
+		DisableKeepAlives:     tr.DisableKeepAlives,
+		MaxIdleConnsPerHost:   tr.MaxIdleConnsPerHost,
+		IdleConnTimeout:       tr.IdleConnTimeout,
+		ResponseHeaderTimeout: responseHeader,
+	}
+	copyDialTLS(tr1, tr)
+
+	if idleConn > 0 {
+		tr1.IdleConnTimeout = idleConn
+	}
+
+	if dialContext := tr.DialContext; dial > 0 && dialContext != nil {
+		tr1.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(ctx, dial)
+			defer cancel()
+			return dialContext(ctx, network, address)
+		}
+	}
+
+	return tr1
+}
+
+// routeTransport returns the transport of the first Rules entry matching the
+// host of req, nil if none does.
+func (f *Filter) routeTransport(req *http.Request) *http.Transport {
+	host := req.URL.Hostname()
+	for _, r := range f.TimeoutRoutes {
+		if r.hosts.Match(host) {
+			return r.transport
+		}
+	}
+	return nil
+}
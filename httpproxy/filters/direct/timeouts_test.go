@@ -0,0 +1,87 @@
+package direct
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"../../filters"
+)
+
+func TestRoundTripTimeoutProfiles(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		time.Sleep(1500 * time.Millisecond)
+		rw.Write([]byte("slow"))
+	}))
+	defer ts.Close()
+
+	config := new(Config)
+	config.Transport.Dialer.Timeout = 4
+	config.Transport.Dialer.DNSCacheSize = 64
+	config.Transport.TimeoutProfiles = map[string]struct {
+		DialTimeout           int
+		ResponseHeaderTimeout int
+		IdleConnTimeout       int
+	}{
+		"short": {ResponseHeaderTimeout: 1},
+		"long":  {ResponseHeaderTimeout: 4},
+	}
+	config.Transport.Rules = []struct {
+		Hosts          []string
+		TimeoutProfile string
+	}{
+		{[]string{"short.example"}, "short"},
+		{[]string{"long.example", "*.long.example"}, "long"},
+	}
+
+	f1, err := NewFilter(config)
+	if err != nil {
+		t.Fatalf("NewFilter(%#v) error: %v", config, err)
+	}
+	f := f1.(*Filter)
+
+	if len(f.TimeoutRoutes) != 2 || f.TimeoutRoutes[0].transport == f.TimeoutRoutes[1].transport {
+		t.Fatalf("NewFilter made %d TimeoutRoutes, want 2 of their own transport", len(f.TimeoutRoutes))
+	}
+	// every name is the test server
+	for _, r := range f.TimeoutRoutes {
+		r.transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial(network, ts.Listener.Addr().String())
+		}
+	}
+
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	roundTrip := func(host string) (*http.Response, error) {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+host+":"+port+"/", nil)
+		_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+		return resp, err
+	}
+
+	resp, err := roundTrip("short.example")
+	if err != nil {
+		t.Fatalf("RoundTrip with the short profile error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("RoundTrip with the short profile returns %d, want a 504 timeout", resp.StatusCode)
+	}
+
+	resp, err = roundTrip("www.long.example")
+	if err != nil {
+		t.Fatalf("RoundTrip with the long profile error: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "slow" {
+		t.Errorf("RoundTrip with the long profile body = %#v, want \"slow\"", string(body))
+	}
+
+	config.Transport.Rules[0].TimeoutProfile = "missing"
+	if _, err := NewFilter(config); err == nil {
+		t.Errorf("NewFilter with an unknown TimeoutProfile returns no error")
+	}
+}
@@ -0,0 +1,60 @@
+package direct
+
+import (
+	"io"
+	"time"
+
+	"../../helpers"
+)
+
+// defaultTunnelBurstWindow is the TunnelBurstWindow of 0.
+const defaultTunnelBurstWindow time.Duration = time.Second
+
+var tunnelBurstWaits = helpers.Metrics.Counter("direct_tunnel_burst_waits_total", "Tunnel reads TunnelBurstKBps held back after a burst.")
+
+// burstReader shapes the reads of a tunnel direction with a token bucket of
+// window worth of rate bytes a second: a burst up to the bucket goes through
+// at once, then reads sustain rate.
+type burstReader struct {
+	r      io.Reader
+	rate   float64
+	size   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBurstReader(r io.Reader, kbps int, window time.Duration) *burstReader {
+	if window <= 0 {
+		window = defaultTunnelBurstWindow
+	}
+	rate := float64(kbps) * 1024
+	size := rate * window.Seconds()
+	return &burstReader{r: r, rate: rate, size: size, tokens: size, last: time.Now()}
+}
+
+func (b *burstReader) Read(p []byte) (int, error) {
+	if max := int(b.size); max > 0 && len(p) > max {
+		p = p[:max]
+	}
+	n, err := b.r.Read(p)
+	if n > 0 {
+		b.take(n)
+	}
+	return n, err
+}
+
+// take spends n tokens, sleeping off a debt at rate.
+func (b *burstReader) take(n int) {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.size {
+		b.tokens = b.size
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens < 0 {
+		tunnelBurstWaits.Add(1)
+		time.Sleep(time.Duration(-b.tokens / b.rate * float64(time.Second)))
+	}
+}
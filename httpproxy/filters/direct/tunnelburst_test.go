@@ -0,0 +1,45 @@
+package direct
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// zeros reads zeros forever.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestBurstReader(t *testing.T) {
+	const kbps, window = 200, 250 * time.Millisecond
+	// a bucket of 50KB, refilled at 200KB a second
+	r := newBurstReader(zeros{}, kbps, window)
+
+	waits := tunnelBurstWaits.Value()
+	start := time.Now()
+	if _, err := io.CopyN(ioutil.Discard, r, 50*1024); err != nil {
+		t.Fatalf("io.CopyN(burst) error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("a burst of the bucket size took %v, want it at once", elapsed)
+	}
+
+	// the next 100KB go at the sustained rate, half a second
+	start = time.Now()
+	if _, err := io.CopyN(ioutil.Discard, r, 100*1024); err != nil {
+		t.Fatalf("io.CopyN(sustained) error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 900*time.Millisecond {
+		t.Errorf("100KB after the burst took %v, want about 500ms at %dKB/s", elapsed, kbps)
+	}
+	if tunnelBurstWaits.Value() == waits {
+		t.Errorf("direct_tunnel_burst_waits_total did not grow")
+	}
+}
@@ -0,0 +1,47 @@
+package direct
+
+import (
+	"sync"
+
+	"../../helpers"
+)
+
+var (
+	tunnelsOpen     = helpers.Metrics.Gauge("direct_tunnels", "CONNECT tunnels open.")
+	tunnelsPeak     = helpers.Metrics.Gauge("direct_tunnels_peak", "Most CONNECT tunnels open at once.")
+	tunnelsRejected = helpers.Metrics.Counter("direct_tunnels_rejected_total", "CONNECT tunnels refused by MaxConcurrentTunnels.")
+)
+
+// tunnelLimiter counts the open CONNECT tunnels, refusing more than max of
+// them, 0 for unlimited.
+type tunnelLimiter struct {
+	mu   sync.Mutex
+	max  int
+	n    int
+	peak int
+}
+
+func (l *tunnelLimiter) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.max > 0 && l.n >= l.max {
+		tunnelsRejected.Add(1)
+		return false
+	}
+
+	l.n++
+	if l.n > l.peak {
+		l.peak = l.n
+		tunnelsPeak.Set(int64(l.peak))
+	}
+	tunnelsOpen.Set(int64(l.n))
+	return true
+}
+
+func (l *tunnelLimiter) release() {
+	l.mu.Lock()
+	l.n--
+	tunnelsOpen.Set(int64(l.n))
+	l.mu.Unlock()
+}
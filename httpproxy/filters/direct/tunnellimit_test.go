@@ -0,0 +1,70 @@
+package direct
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"../../filters"
+)
+
+func TestRoundTripMaxConcurrentTunnels(t *testing.T) {
+	const max = 2
+
+	f := newTestFilter(t)
+	f.TunnelLimit = &tunnelLimiter{max: max}
+
+	var dials int32
+	upstreams := make(chan net.Conn, max+1)
+	setDial(f, func(network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		c1, c2 := net.Pipe()
+		upstreams <- c2
+		return c1, nil
+	})
+
+	// max tunnels held open by their clients
+	done := make(chan struct{}, max)
+	conns := make([]net.Conn, 0, 2*max)
+	for i := 0; i < max; i++ {
+		lconn, conn := net.Pipe()
+		conns = append(conns, conn)
+		req, _ := http.NewRequest(http.MethodConnect, "http://example.org:443", nil)
+		go func() {
+			f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(lconn)), req)
+			done <- struct{}{}
+		}()
+		conns = append(conns, <-upstreams)
+	}
+
+	req, _ := http.NewRequest(http.MethodConnect, "http://example.org:443", nil)
+	_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+	if err != nil {
+		t.Fatalf("%T.RoundTrip(%#v) error: %v", f, req.Host, err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("CONNECT over %d open tunnels returns %d, want %d", max, resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if n := atomic.LoadInt32(&dials); n != max {
+		t.Errorf("CONNECT over %d open tunnels dialed, %d dials", max, n)
+	}
+	if n := tunnelsOpen.Value(); n != max {
+		t.Errorf("direct_tunnels = %d, want %d", n, max)
+	}
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	for i := 0; i < max; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("CONNECT tunnel is not closed with its conns")
+		}
+	}
+	if n, peak := tunnelsOpen.Value(), tunnelsPeak.Value(); n != 0 || peak < max {
+		t.Errorf("direct_tunnels = %d, direct_tunnels_peak = %d after the tunnels closed", n, peak)
+	}
+}
@@ -0,0 +1,156 @@
+package direct
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+	"github.com/phuslu/glog"
+
+	"../../helpers"
+	"../../proxy"
+)
+
+var errUpstreamsDraining = errors.New("all TunnelPool upstreams are draining")
+
+// tunnelPool spreads CONNECT tunnels over upstream proxies. With an affinity
+// cache the tunnels of a client ip stay on the upstream it was first given
+// until the client is idle for idleTimeout. Draining upstreams, set in the
+// admin API, get no new tunnels.
+type tunnelPool struct {
+	dialers     []proxy.Dialer
+	names       []string
+	upstreams   []*helpers.Upstream
+	next        uint32
+	affinity    lrucache.Cache
+	idleTimeout time.Duration
+}
+
+func newTunnelPool(dialers []proxy.Dialer, names []string, sticky bool, idleTimeout time.Duration, size int) *tunnelPool {
+	p := &tunnelPool{
+		dialers:     dialers,
+		names:       names,
+		idleTimeout: idleTimeout,
+	}
+	for _, name := range names {
+		p.upstreams = append(p.upstreams, helpers.Upstreams.Get(name))
+	}
+	if p.idleTimeout <= 0 {
+		p.idleTimeout = 10 * time.Minute
+	}
+	if size <= 0 {
+		size = 4096
+	}
+	if sticky {
+		p.affinity = lrucache.NewLRUCache(uint(size))
+	}
+	return p
+}
+
+// pick returns the index of the upstream for a tunnel of req, -1 if all of
+// them are draining.
+func (p *tunnelPool) pick(req *http.Request) int {
+	if p.affinity == nil {
+		return p.roundRobin()
+	}
+
+	client := clientIP(req)
+	if v, ok := p.affinity.Get(client); ok && !p.upstreams[v.(int)].Draining() {
+		i := v.(int)
+		p.touch(client, i)
+		return i
+	}
+
+	i := p.roundRobin()
+	if i >= 0 {
+		p.touch(client, i)
+	}
+	return i
+}
+
+// roundRobin returns the next upstream not draining, -1 if there is none.
+func (p *tunnelPool) roundRobin() int {
+	for range p.dialers {
+		i := int(atomic.AddUint32(&p.next, 1)-1) % len(p.dialers)
+		if !p.upstreams[i].Draining() {
+			return i
+		}
+	}
+	return -1
+}
+
+// after returns the first upstream after i not draining, -1 if there is none.
+func (p *tunnelPool) after(i int) int {
+	for n := 1; n < len(p.dialers); n++ {
+		if j := (i + n) % len(p.dialers); !p.upstreams[j].Draining() {
+			return j
+		}
+	}
+	return -1
+}
+
+// dial connects a tunnel of req through the upstream picked for it, which
+// counts it as a session until the conn is closed. The upstream hop is dialed
+// with ctx, so with its address family and the dialer FailCache. A sticky
+// client whose upstream fails to dial moves on to the next one.
+func (p *tunnelPool) dial(ctx context.Context, req *http.Request, id string) (net.Conn, int, error) {
+	i := p.pick(req)
+	if i < 0 {
+		return nil, i, errUpstreamsDraining
+	}
+
+	for n := 0; ; n++ {
+		glog.V(2).Infof("%s \"DIRECT %s %s %s\" id=%s via upstream %s", req.RemoteAddr, req.Method, req.Host, req.Proto, id, p.names[i])
+		conn, err := proxy.DialContext(ctx, p.dialers[i], "tcp", req.Host)
+		if err == nil {
+			p.upstreams[i].Begin()
+			return &sessionConn{Conn: conn, upstream: p.upstreams[i]}, i, nil
+		}
+		if p.affinity == nil || ctx.Err() != nil {
+			return nil, i, err
+		}
+
+		client := clientIP(req)
+		p.affinity.Del(client)
+		j := p.after(i)
+		if j < 0 || n+1 >= len(p.dialers) {
+			return nil, i, err
+		}
+		glog.Warningf("%s \"DIRECT %s %s %s\" id=%s upstream %s dial error: %v, moves to %s", req.RemoteAddr, req.Method, req.Host, req.Proto, id, p.names[i], err, p.names[j])
+		i = j
+		p.touch(client, i)
+	}
+}
+
+// sessionConn ends its session of upstream once closed.
+type sessionConn struct {
+	net.Conn
+	upstream *helpers.Upstream
+	once     sync.Once
+}
+
+func (c *sessionConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.upstream.End)
+	return err
+}
+
+// touch keeps the upstream of client for another idleTimeout, open tunnels
+// touch it again when they close.
+func (p *tunnelPool) touch(client string, i int) {
+	if p.affinity != nil {
+		p.affinity.Set(client, i, time.Now().Add(p.idleTimeout))
+	}
+}
+
+func clientIP(req *http.Request) string {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
@@ -0,0 +1,177 @@
+package direct
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"../../helpers"
+	"../../proxy"
+)
+
+// countDialer fails every dial, counting them.
+type countDialer struct {
+	mu    sync.Mutex
+	dials int
+}
+
+func (d *countDialer) Dial(network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dials++
+	d.mu.Unlock()
+	return nil, errors.New("refused")
+}
+
+func TestTunnelPoolSticky(t *testing.T) {
+	d1, d2 := &pipeDialer{}, &pipeDialer{}
+	p := newTunnelPool([]proxy.Dialer{d1, d2}, []string{"d1", "d2"}, true, time.Minute, 16)
+
+	connect := func(remoteAddr string) {
+		req, _ := http.NewRequest(http.MethodConnect, "http://example.org:443", nil)
+		req.RemoteAddr = remoteAddr
+		conn, _, err := p.dial(context.Background(), req, "t1")
+		if err != nil {
+			t.Fatalf("tunnelPool.dial(%#v) error: %v", req.Host, err)
+		}
+		conn.Close()
+	}
+
+	for i := 0; i < 5; i++ {
+		connect(fmt.Sprintf("10.0.0.1:%d", 1000+i))
+	}
+	if !(d1.dials == 5 && d2.dials == 0) {
+		t.Errorf("CONNECTs of one client dialed upstreams %d and %d times, want all on one", d1.dials, d2.dials)
+	}
+
+	// another client gets the next upstream, and keeps it
+	connect("10.0.0.2:1000")
+	connect("10.0.0.2:2000")
+	if d2.dials != 2 {
+		t.Errorf("CONNECTs of a second client dialed the second upstream %d times, want 2", d2.dials)
+	}
+
+	// an idle client may be moved
+	p.affinity.Del("10.0.0.1")
+	connect("10.0.0.1:1000")
+	if d1.dials+d2.dials != 8 {
+		t.Errorf("CONNECTs dialed upstreams %d and %d times, want 8 in total", d1.dials, d2.dials)
+	}
+}
+
+func TestTunnelPoolStickyDialError(t *testing.T) {
+	d1, d2 := &countDialer{}, &pipeDialer{}
+	p := newTunnelPool([]proxy.Dialer{d1, d2}, []string{"d1", "d2"}, true, time.Minute, 16)
+
+	req, _ := http.NewRequest(http.MethodConnect, "http://example.org:443", nil)
+	req.RemoteAddr = "10.0.0.1:1000"
+
+	// the first upstream fails, the client moves to the second and stays
+	for n := 0; n < 3; n++ {
+		conn, i, err := p.dial(context.Background(), req, "t1")
+		if err != nil || i != 1 {
+			t.Fatalf("tunnelPool.dial() #%d = %d, %v, want upstream 1", n, i, err)
+		}
+		conn.Close()
+	}
+	if d1.dials != 1 || d2.dials != 3 {
+		t.Errorf("tunnels dialed upstreams %d and %d times, want 1 and 3", d1.dials, d2.dials)
+	}
+
+	// with every upstream failing the dial error is returned
+	p = newTunnelPool([]proxy.Dialer{&countDialer{}, &countDialer{}}, []string{"d1", "d2"}, true, time.Minute, 16)
+	if _, _, err := p.dial(context.Background(), req, "t2"); err == nil {
+		t.Errorf("tunnelPool.dial() with every upstream failing returns no error")
+	}
+	if _, ok := p.affinity.Get("10.0.0.1"); ok {
+		t.Errorf("tunnelPool.dial() with every upstream failing keeps the affinity of the client")
+	}
+}
+
+func TestTunnelPoolRoundRobin(t *testing.T) {
+	p := newTunnelPool([]proxy.Dialer{&countDialer{}, &countDialer{}}, []string{"d1", "d2"}, false, 0, 0)
+
+	req, _ := http.NewRequest(http.MethodConnect, "http://example.org:443", nil)
+	req.RemoteAddr = "10.0.0.1:1000"
+	if a, b := p.pick(req), p.pick(req); a == b {
+		t.Errorf("tunnelPool.pick() without Sticky returns %d twice", a)
+	}
+}
+
+// pipeDialer dials pipes echoing what is written to them, counting them.
+type pipeDialer struct {
+	mu    sync.Mutex
+	dials int
+}
+
+func (d *pipeDialer) Dial(network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dials++
+	d.mu.Unlock()
+	c1, c2 := net.Pipe()
+	go func() {
+		io.Copy(c2, c2)
+		c2.Close()
+	}()
+	return c1, nil
+}
+
+func TestTunnelPoolDraining(t *testing.T) {
+	d1, d2 := &pipeDialer{}, &pipeDialer{}
+	p := newTunnelPool([]proxy.Dialer{d1, d2}, []string{"drain-1", "drain-2"}, true, time.Minute, 16)
+	u1, u2 := helpers.Upstreams.Get("drain-1"), helpers.Upstreams.Get("drain-2")
+	defer u1.SetDraining(false)
+	defer u2.SetDraining(false)
+
+	req, _ := http.NewRequest(http.MethodConnect, "http://example.org:443", nil)
+	req.RemoteAddr = "10.0.0.1:1000"
+
+	conn, i, err := p.dial(context.Background(), req, "t1")
+	if err != nil || i != 0 {
+		t.Fatalf("tunnelPool.dial() = %d, %v, want upstream 0", i, err)
+	}
+
+	// the client sticks to drain-1 until it drains
+	u1.SetDraining(true)
+	for n := 0; n < 4; n++ {
+		c, i, err := p.dial(context.Background(), req, "t2")
+		if err != nil || i != 1 {
+			t.Fatalf("tunnelPool.dial() while drain-1 drains = %d, %v, want upstream 1", i, err)
+		}
+		c.Close()
+	}
+	if d1.dials != 1 || d2.dials != 4 {
+		t.Errorf("tunnels dialed upstreams %d and %d times, want 1 and 4", d1.dials, d2.dials)
+	}
+	if u2.Active() != 0 {
+		t.Errorf("drain-2 has %d sessions after its tunnels closed, want 0", u2.Active())
+	}
+
+	// the tunnel opened before goes on
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("tunnel of a draining upstream Write() error: %v", err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Fatalf("tunnel of a draining upstream reads %#v, %v, want \"ping\"", string(b), err)
+	}
+	if s := helpers.Upstreams.Stats()["drain-1"]; !s.Draining || s.Active != 1 || s.Drained {
+		t.Errorf("drain-1 stats with a tunnel open = %+v, want draining with 1 session", s)
+	}
+
+	conn.Close()
+	conn.Close()
+	if s := helpers.Upstreams.Stats()["drain-1"]; s.Active != 0 || !s.Drained {
+		t.Errorf("drain-1 stats after its tunnel closed = %+v, want drained", s)
+	}
+
+	u2.SetDraining(true)
+	if _, _, err := p.dial(context.Background(), req, "t3"); err != errUpstreamsDraining {
+		t.Errorf("tunnelPool.dial() with all upstreams draining error = %v, want %v", err, errUpstreamsDraining)
+	}
+}
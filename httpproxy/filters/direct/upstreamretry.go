@@ -0,0 +1,211 @@
+package direct
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/phuslu/glog"
+	"github.com/phuslu/net/http2"
+
+	"../../helpers"
+	"../../proxy"
+)
+
+// defaultUpstreamRetryStatusCodes are the UpstreamRetry.StatusCodes of none.
+var defaultUpstreamRetryStatusCodes = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+var upstreamRetries = helpers.Metrics.Counter("direct_upstream_retries_total", "Requests UpstreamRetry sent again through another TunnelPool upstream.")
+
+// upstreamRetry sends plain requests through the TunnelPool upstreams too,
+// and idempotent ones failed or answered with a retry status again through
+// the next upstream, up to attempts in all. It sends them over transports like
+// the one the Filter would pick otherwise, which dial through one upstream.
+type upstreamRetry struct {
+	f        *Filter
+	pool     *tunnelPool
+	statuses map[int]struct{}
+	attempts int
+
+	mu         sync.Mutex
+	transports map[upstreamTransportKey]http.RoundTripper
+}
+
+type upstreamTransportKey struct {
+	base http.RoundTripper
+	i    int
+}
+
+// upstreamKey is the index of the TunnelPool upstream a dial goes through.
+type upstreamKey struct{}
+
+// newUpstreamRetry makes the DialContext of f.Transport dial through the
+// upstream its ctx asks for, the transports copied from it after do as well.
+func newUpstreamRetry(f *Filter, pool *tunnelPool, statuses []int, attempts int) *upstreamRetry {
+	if len(statuses) == 0 {
+		statuses = defaultUpstreamRetryStatusCodes
+	}
+	if attempts <= 0 {
+		attempts = len(pool.dialers)
+	}
+
+	r := &upstreamRetry{
+		f:          f,
+		pool:       pool,
+		statuses:   make(map[int]struct{}),
+		attempts:   attempts,
+		transports: make(map[upstreamTransportKey]http.RoundTripper),
+	}
+	for _, code := range statuses {
+		r.statuses[code] = struct{}{}
+	}
+
+	dialContext, dial := f.Transport.DialContext, f.Transport.Dial
+	f.Transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if i, ok := ctx.Value(upstreamKey{}).(int); ok {
+			return proxy.DialContext(ctx, pool.dialers[i], network, address)
+		}
+		if dialContext != nil {
+			return dialContext(ctx, network, address)
+		}
+		return dial(network, address)
+	}
+	return r
+}
+
+// transport returns a transport like base whose conns are all dialed through
+// upstream i, made on first use.
+func (r *upstreamRetry) transport(base http.RoundTripper, i int) http.RoundTripper {
+	key := upstreamTransportKey{base, i}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if tr, ok := r.transports[key]; ok {
+		return tr
+	}
+
+	withUpstream := func(ctx context.Context) context.Context {
+		return context.WithValue(ctx, upstreamKey{}, i)
+	}
+
+	var tr http.RoundTripper
+	switch base := base.(type) {
+	case *http.Transport:
+		dialContext := base.DialContext
+		tr1 := newTimeoutTransport(base, 0, base.ResponseHeaderTimeout, 0)
+		tr1.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialContext(withUpstream(ctx), network, address)
+		}
+		if r.f.TLSHandshake != nil {
+			setDialTLS(r.f, tr1)
+		}
+		if r.f.Config.Transport.HTTP2 {
+			if err := http2.ConfigureTransport(tr1); err != nil {
+				glog.Warningf("DIRECT: http2.ConfigureTransport(upstream %s) error: %v", r.pool.names[i], err)
+			}
+		}
+		tr = tr1
+	default:
+		// H2CHosts
+		tr = newH2C(func(ctx context.Context, network, address string) (net.Conn, error) {
+			return r.f.dial(withUpstream(ctx), network, address)
+		}, r.f.Transport)
+	}
+
+	r.transports[key] = tr
+	return tr
+}
+
+// forget drops the transports made from base, which goes away.
+func (r *upstreamRetry) forget(base http.RoundTripper) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, tr := range r.transports {
+		if key.base == base {
+			if tr, ok := tr.(interface{ CloseIdleConnections() }); ok {
+				tr.CloseIdleConnections()
+			}
+			delete(r.transports, key)
+		}
+	}
+}
+
+// retryable reports whether req may be sent twice, idempotent and without a
+// body, which could not be read again.
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return req.Body == nil || req.Body == http.NoBody
+	}
+	return false
+}
+
+// roundTrip sends req through the upstreams over transports like base, until
+// one answers or the client gives up.
+func (r *upstreamRetry) roundTrip(req *http.Request, base http.RoundTripper) (*http.Response, error) {
+	attempts := r.attempts
+	if !retryable(req) {
+		attempts = 1
+	}
+
+	i := r.pool.pick(req)
+	if i < 0 {
+		return nil, errUpstreamsDraining
+	}
+	for n := 1; ; n++ {
+		resp, err := r.send(i, req, base)
+		// draining upstreams are not retried through
+		next := r.pool.after(i)
+		if n >= attempts || next < 0 || req.Context().Err() != nil {
+			return resp, err
+		}
+		if err == nil {
+			if _, ok := r.statuses[resp.StatusCode]; !ok {
+				return resp, nil
+			}
+			// drained, the conn goes back to the pool of that upstream
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		if err != nil {
+			glog.V(2).Infof("%s \"DIRECT %s %s %s\" via upstream %s error: %v, retries via %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, r.pool.names[i], err, r.pool.names[next])
+		} else {
+			glog.V(2).Infof("%s \"DIRECT %s %s %s\" via upstream %s answers %d, retries via %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, r.pool.names[i], resp.StatusCode, r.pool.names[next])
+		}
+		upstreamRetries.Add(1)
+		i = next
+	}
+}
+
+// send sends req through upstream i, a session of it until the response body
+// is closed.
+func (r *upstreamRetry) send(i int, req *http.Request, base http.RoundTripper) (*http.Response, error) {
+	upstream := r.pool.upstreams[i]
+	upstream.Begin()
+	resp, err := r.transport(base, i).RoundTrip(req)
+	if err != nil {
+		upstream.End()
+		return nil, err
+	}
+	resp.Body = &sessionBody{ReadCloser: resp.Body, upstream: upstream}
+	return resp, nil
+}
+
+// sessionBody ends its session of upstream once closed.
+type sessionBody struct {
+	io.ReadCloser
+	upstream *helpers.Upstream
+	once     sync.Once
+}
+
+func (b *sessionBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.upstream.End)
+	return err
+}
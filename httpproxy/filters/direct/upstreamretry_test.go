@@ -0,0 +1,154 @@
+package direct
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"../../filters"
+	"../../proxy"
+)
+
+type fixedDialer string
+
+func (d fixedDialer) Dial(network, addr string) (net.Conn, error) {
+	return net.Dial(network, string(d))
+}
+
+func TestRoundTripUpstreamRetry(t *testing.T) {
+	var failed int32
+	down := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&failed, 1)
+		http.Error(rw, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("ok"))
+	}))
+	defer up.Close()
+
+	f := newTestFilter(t)
+	dialers := []proxy.Dialer{fixedDialer(down.Listener.Addr().String()), fixedDialer(up.Listener.Addr().String())}
+	pool := newTunnelPool(dialers, []string{"down", "up"}, false, 0, 0)
+
+	cases := []struct {
+		method string
+		code   int
+		failed int32
+	}{
+		// the pool hands out down first, then up
+		{http.MethodGet, http.StatusOK, 1},
+		{http.MethodGet, http.StatusOK, 0},
+		{http.MethodPost, http.StatusServiceUnavailable, 1},
+		{http.MethodPost, http.StatusOK, 0},
+	}
+
+	f.UpstreamRetry = newUpstreamRetry(f, pool, []int{http.StatusServiceUnavailable}, 0)
+	for i, c := range cases {
+		atomic.StoreInt32(&failed, 0)
+		var body io.Reader
+		if c.method == http.MethodPost {
+			body = strings.NewReader("a=1")
+		}
+		req, _ := http.NewRequest(c.method, "http://example.org/", body)
+		_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+		if err != nil {
+			t.Fatalf("%T.RoundTrip(%s) error: %v", f, c.method, err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != c.code || atomic.LoadInt32(&failed) != c.failed {
+			t.Errorf("request %d %s = %d %#v after %d 503s, want %d after %d", i, c.method, resp.StatusCode, string(b), atomic.LoadInt32(&failed), c.code, c.failed)
+		}
+	}
+
+	// one attempt in all leaves the 503 to the client
+	f.UpstreamRetry = newUpstreamRetry(f, newTunnelPool(dialers, []string{"down", "up"}, false, 0, 0), nil, 1)
+	req, _ := http.NewRequest(http.MethodGet, "http://example.org/", nil)
+	_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+	if err != nil {
+		t.Fatalf("%T.RoundTrip() error: %v", f, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || atomic.LoadInt32(&failed) != 1 {
+		t.Errorf("MaxAttempts 1 = %d after %d attempts, want 503 after 1", resp.StatusCode, atomic.LoadInt32(&failed))
+	}
+}
+
+func TestRoundTripUpstreamRetryTimeoutProfile(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		time.Sleep(1500 * time.Millisecond)
+		rw.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("ok"))
+	}))
+	defer up.Close()
+
+	config := new(Config)
+	config.Transport.Dialer.Timeout = 4
+	config.Transport.TimeoutProfiles = map[string]struct {
+		DialTimeout           int
+		ResponseHeaderTimeout int
+		IdleConnTimeout       int
+	}{
+		"short": {ResponseHeaderTimeout: 1},
+	}
+	config.Transport.Rules = []struct {
+		Hosts          []string
+		TimeoutProfile string
+	}{
+		{[]string{"example.org"}, "short"},
+	}
+	f1, err := NewFilter(config)
+	if err != nil {
+		t.Fatalf("NewFilter(%#v) error: %v", config, err)
+	}
+	f := f1.(*Filter)
+
+	dialers := []proxy.Dialer{fixedDialer(slow.Listener.Addr().String()), fixedDialer(up.Listener.Addr().String())}
+	f.UpstreamRetry = newUpstreamRetry(f, newTunnelPool(dialers, []string{"slow", "up"}, false, 0, 0), nil, 0)
+	// as NewFilter does after UpstreamRetry
+	if f.TimeoutRoutes, err = newTimeoutRoutes(f.Transport, config); err != nil {
+		t.Fatalf("newTimeoutRoutes() error: %v", err)
+	}
+
+	// the slow upstream is out of the ResponseHeaderTimeout of the rule
+	req, _ := http.NewRequest(http.MethodGet, "http://example.org/", nil)
+	_, resp, err := f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+	if err != nil {
+		t.Fatalf("%T.RoundTrip() error: %v", f, err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(b) != "ok" {
+		t.Errorf("%T.RoundTrip() via a slow upstream = %d %#v, want 200 \"ok\" via the next one", f, resp.StatusCode, string(b))
+	}
+
+	// a request the client gave up on is not retried
+	atomic.StoreUint32(&f.UpstreamRetry.pool.next, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	req, _ = http.NewRequest(http.MethodGet, "http://example.org/", nil)
+	req = req.WithContext(ctx)
+	start := time.Now()
+	_, resp, err = f.RoundTrip(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+	if err == nil {
+		b, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Errorf("%T.RoundTrip() after the client gave up = 200 %#v", f, string(b))
+		}
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("%T.RoundTrip() after the client gave up took %s", f, d)
+	}
+}
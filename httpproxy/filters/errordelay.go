@@ -0,0 +1,70 @@
+package filters
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// An ErrorDelay holds back the rejections of the proxy itself, its 403, 407
+// and 429 responses, by Delay plus up to Jitter, so scanners probing for an
+// open proxy pay for every guess while clients which rarely hit them barely
+// notice. Upstream responses of those statuses pass at once.
+type ErrorDelay struct {
+	Delay  time.Duration
+	Jitter time.Duration
+}
+
+// errorDelayState is the ErrorDelay of one request, with the rejection a
+// filter answered it with.
+type errorDelayState struct {
+	delay  *ErrorDelay
+	status int
+}
+
+type errorDelayKey struct{}
+
+// WithErrorDelay makes the rejections of the request of ctx wait d out.
+func WithErrorDelay(ctx context.Context, d *ErrorDelay) context.Context {
+	return context.WithValue(ctx, errorDelayKey{}, &errorDelayState{delay: d})
+}
+
+// MarkRejection records that a filter answers the request of ctx with status
+// itself, the handler calls DelayRejection for it after the request frees its
+// queue slot, while the small response is still buffered.
+func MarkRejection(ctx context.Context, status int) {
+	if s, ok := ctx.Value(errorDelayKey{}).(*errorDelayState); ok {
+		s.status = status
+	}
+}
+
+// DelayRejection waits out the ErrorDelay of ctx if a filter marked a 403,
+// 407 or 429 rejection, or until ctx is done.
+func DelayRejection(ctx context.Context) {
+	s, _ := ctx.Value(errorDelayKey{}).(*errorDelayState)
+	if s == nil {
+		return
+	}
+	switch s.status {
+	case http.StatusForbidden, http.StatusProxyAuthRequired, http.StatusTooManyRequests:
+	default:
+		return
+	}
+
+	d := s.delay
+	delay := d.Delay
+	if d.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(d.Jitter)))
+	}
+	if delay <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,46 @@
+package filters
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDelayRejection(t *testing.T) {
+	d := &ErrorDelay{Delay: 100 * time.Millisecond, Jitter: 50 * time.Millisecond}
+
+	for _, status := range []int{http.StatusForbidden, http.StatusProxyAuthRequired, http.StatusTooManyRequests} {
+		ctx := WithErrorDelay(context.Background(), d)
+		MarkRejection(ctx, status)
+		start := time.Now()
+		DelayRejection(ctx)
+		if elapsed := time.Since(start); elapsed < d.Delay || elapsed > d.Delay+d.Jitter+time.Second {
+			t.Errorf("DelayRejection() of a marked %d waits %s, want %s plus up to %s", status, elapsed, d.Delay, d.Jitter)
+		}
+	}
+
+	// unmarked responses, e.g. upstream 403s, pass at once
+	start := time.Now()
+	DelayRejection(WithErrorDelay(context.Background(), d))
+	for _, status := range []int{http.StatusOK, http.StatusBadGateway} {
+		ctx := WithErrorDelay(context.Background(), d)
+		MarkRejection(ctx, status)
+		DelayRejection(ctx)
+	}
+	MarkRejection(context.Background(), http.StatusForbidden)
+	DelayRejection(context.Background())
+	if elapsed := time.Since(start); elapsed >= d.Delay {
+		t.Errorf("DelayRejection() of other statuses, unmarked or without ErrorDelay waits %s", elapsed)
+	}
+
+	// a client gone stops the wait
+	ctx, cancel := context.WithCancel(WithErrorDelay(context.Background(), d))
+	MarkRejection(ctx, http.StatusForbidden)
+	cancel()
+	start = time.Now()
+	DelayRejection(ctx)
+	if elapsed := time.Since(start); elapsed >= d.Delay {
+		t.Errorf("DelayRejection() with a done context waits %s", elapsed)
+	}
+}
@@ -1,9 +1,13 @@
 package filters
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"strings"
 	"sync"
 )
 
@@ -12,6 +16,18 @@ var (
 	DummyResponse *http.Response = &http.Response{}
 )
 
+const (
+	// RoundTripErrorKey is set by a RoundTripFilter which answers a failed
+	// request with a synthesized error response, use String(ctx, RoundTripErrorKey)
+	RoundTripErrorKey string = "roundtrip/error"
+	// RequestIDKey is the id the requestid filter gave a request, for logs
+	// and other filters to refer to it, use String(ctx, RequestIDKey)
+	RequestIDKey string = "request/id"
+	// AuthUserKey is the user the auth filter authenticated a request as, for
+	// the access logs, use String(ctx, AuthUserKey)
+	AuthUserKey string = "auth/user"
+)
+
 type Filter interface {
 	FilterName() string
 }
@@ -81,3 +97,44 @@ func GetFilter(name string) (Filter, error) {
 
 	return filter, nil
 }
+
+// NewResponse returns a synthesized response to req, for RoundTripFilters which
+// answer a request by themselves. ContentLength is known for *bytes.Buffer,
+// *bytes.Reader and *strings.Reader bodies, otherwise it is -1.
+func NewResponse(req *http.Request, status int, header http.Header, body io.Reader) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Request:       req,
+		Close:         true,
+		ContentLength: -1,
+	}
+
+	switch v := body.(type) {
+	case nil:
+		resp.ContentLength = 0
+		body = bytes.NewReader(nil)
+	case *bytes.Buffer:
+		resp.ContentLength = int64(v.Len())
+	case *bytes.Reader:
+		resp.ContentLength = int64(v.Len())
+	case *strings.Reader:
+		resp.ContentLength = int64(v.Len())
+	}
+
+	if rc, ok := body.(io.ReadCloser); ok {
+		resp.Body = rc
+	} else {
+		resp.Body = ioutil.NopCloser(body)
+	}
+
+	return resp
+}
@@ -0,0 +1,58 @@
+package filters
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNewResponse(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "http://example.org/", nil)
+
+	var cases = []struct {
+		Status        int
+		Body          string
+		ContentLength int64
+		UseReader     bool
+	}{
+		{http.StatusOK, "hello world", 11, false},
+		{http.StatusNotFound, "", 0, false},
+		{http.StatusForbidden, "chunked", -1, true},
+	}
+
+	for _, c := range cases {
+		header := http.Header{"Content-Type": []string{"text/plain"}}
+
+		var resp *http.Response
+		switch {
+		case c.UseReader:
+			resp = NewResponse(req, c.Status, header, bufio.NewReader(strings.NewReader(c.Body)))
+		case c.Body == "":
+			resp = NewResponse(req, c.Status, header, nil)
+		default:
+			resp = NewResponse(req, c.Status, header, strings.NewReader(c.Body))
+		}
+
+		if resp.Request != req || resp.ContentLength != c.ContentLength {
+			t.Errorf("NewResponse(%d, %#v) Request=%p ContentLength=%d", c.Status, c.Body, resp.Request, resp.ContentLength)
+		}
+
+		buf := new(bytes.Buffer)
+		if err := resp.Write(buf); err != nil {
+			t.Fatalf("%T.Write error: %v", resp, err)
+		}
+
+		resp1, err := http.ReadResponse(bufio.NewReader(buf), req)
+		if err != nil {
+			t.Fatalf("http.ReadResponse(%#v) error: %v", buf.String(), err)
+		}
+
+		b, _ := ioutil.ReadAll(resp1.Body)
+		if resp1.StatusCode != c.Status || string(b) != c.Body || resp1.Header.Get("Content-Type") != "text/plain" {
+			t.Errorf("NewResponse(%d, %#v) written as %d %#v", c.Status, c.Body, resp1.StatusCode, string(b))
+		}
+	}
+}
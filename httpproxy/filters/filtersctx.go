@@ -2,6 +2,7 @@ package filters
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
 	"net/http"
 )
@@ -76,3 +77,17 @@ func Bool(ctx context.Context, name string) (bool, bool) {
 
 	return v, true
 }
+
+type tlsStateKey struct{}
+
+// WithTLSState carries the state of the TLS conn req came in on, for filters
+// routing on the client certificate.
+func WithTLSState(ctx context.Context, state *tls.ConnectionState) context.Context {
+	return context.WithValue(ctx, tlsStateKey{}, state)
+}
+
+// TLSState returns the inbound TLS conn state, nil for plain conns.
+func TLSState(ctx context.Context) *tls.ConnectionState {
+	state, _ := ctx.Value(tlsStateKey{}).(*tls.ConnectionState)
+	return state
+}
@@ -0,0 +1,65 @@
+package filters
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// NewTestContext returns a filter context for unit tests, so that
+// GetResponseWriter works without a running Handler.
+func NewTestContext(rw http.ResponseWriter) context.Context {
+	return NewContext(context.Background(), nil, nil, rw)
+}
+
+// TestResponseWriter records a response like httptest.ResponseRecorder, and
+// implements http.Hijacker by handing out Conn.
+type TestResponseWriter struct {
+	Code      int
+	HeaderMap http.Header
+	Body      *bytes.Buffer
+	Flushed   bool
+	Conn      net.Conn
+	Hijacked  bool
+}
+
+// NewTestResponseWriter returns a TestResponseWriter, conn may be nil if the
+// filter under test never hijacks.
+func NewTestResponseWriter(conn net.Conn) *TestResponseWriter {
+	return &TestResponseWriter{
+		Code:      http.StatusOK,
+		HeaderMap: make(http.Header),
+		Body:      new(bytes.Buffer),
+		Conn:      conn,
+	}
+}
+
+func (rw *TestResponseWriter) Header() http.Header {
+	return rw.HeaderMap
+}
+
+func (rw *TestResponseWriter) Write(b []byte) (int, error) {
+	return rw.Body.Write(b)
+}
+
+func (rw *TestResponseWriter) WriteHeader(code int) {
+	rw.Code = code
+}
+
+func (rw *TestResponseWriter) Flush() {
+	rw.Flushed = true
+}
+
+func (rw *TestResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if rw.Conn == nil {
+		return nil, nil, errors.New("TestResponseWriter: no connection to hijack")
+	}
+	if rw.Hijacked {
+		return nil, nil, errors.New("TestResponseWriter: connection already hijacked")
+	}
+	rw.Hijacked = true
+	return rw.Conn, bufio.NewReadWriter(bufio.NewReader(rw.Conn), bufio.NewWriter(rw.Conn)), nil
+}
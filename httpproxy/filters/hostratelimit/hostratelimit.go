@@ -0,0 +1,170 @@
+package hostratelimit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+	"github.com/juju/ratelimit"
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../helpers"
+	"../../storage"
+)
+
+const (
+	filterName string = "hostratelimit"
+)
+
+type Limit struct {
+	// requests per second, 0 for no limit
+	Rate  float64
+	Burst int
+}
+
+type Config struct {
+	Default Limit
+	Hosts   map[string]Limit
+	// "delay" requests over the rate up to MaxDelay milliseconds or "reject" them
+	Mode        string
+	MaxDelay    int
+	IdleTimeout int
+	CacheSize   int
+}
+
+type Filter struct {
+	Config
+	Hosts       *helpers.HostMatcher
+	Reject      bool
+	MaxDelay    time.Duration
+	IdleTimeout time.Duration
+
+	mu      sync.Mutex
+	buckets lrucache.Cache
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.LookupStoreByConfig(filterName).UnmarshallJson(filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	err = filters.Register(filterName, &filters.RegisteredFilter{
+		New: func() (filters.Filter, error) {
+			return NewFilter(config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	f := &Filter{
+		Config:      *config,
+		MaxDelay:    time.Duration(config.MaxDelay) * time.Millisecond,
+		IdleTimeout: time.Duration(config.IdleTimeout) * time.Second,
+	}
+
+	switch config.Mode {
+	case "", "delay":
+	case "reject":
+		f.Reject = true
+		f.MaxDelay = 0
+	default:
+		return nil, fmt.Errorf("%s: unknown Mode %#v", filterName, config.Mode)
+	}
+
+	hosts := make(map[string]interface{})
+	for host, limit := range config.Hosts {
+		hosts[host] = limit
+	}
+	f.Hosts = helpers.NewHostMatcherWithValue(hosts)
+
+	if f.IdleTimeout <= 0 {
+		f.IdleTimeout = 10 * time.Minute
+	}
+
+	size := config.CacheSize
+	if size <= 0 {
+		size = 8192
+	}
+	f.buckets = lrucache.NewLRUCache(uint(size))
+
+	return f, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
+
+func (f *Filter) limit(host string) Limit {
+	if v, ok := f.Hosts.Lookup(host); ok {
+		return v.(Limit)
+	}
+	return f.Default
+}
+
+// bucket returns the token bucket of host, a bucket unused for IdleTimeout is
+// evicted and comes back full.
+func (f *Filter) bucket(host string, limit Limit) *ratelimit.Bucket {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var b *ratelimit.Bucket
+	if v, ok := f.buckets.Get(host); ok {
+		b = v.(*ratelimit.Bucket)
+	} else {
+		burst := int64(limit.Burst)
+		if burst <= 0 {
+			burst = int64(limit.Rate)
+			if burst < 1 {
+				burst = 1
+			}
+		}
+		b = ratelimit.NewBucketWithRate(limit.Rate, burst)
+	}
+	f.buckets.Set(host, b, time.Now().Add(f.IdleTimeout))
+
+	return b
+}
+
+func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
+	host := helpers.GetHostName(req)
+
+	limit := f.limit(host)
+	if limit.Rate <= 0 {
+		return ctx, req, nil
+	}
+
+	wait, ok := f.bucket(host, limit).TakeMaxDuration(1, f.MaxDelay)
+	if !ok {
+		glog.V(2).Infof("%s \"HOSTRATELIMIT %s %s %s\" exceeds %g requests per second to %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, limit.Rate, host)
+		rw := filters.GetResponseWriter(ctx)
+		rw.Header().Set("Retry-After", strconv.Itoa(int(1/limit.Rate)+1))
+		filters.MarkRejection(ctx, http.StatusTooManyRequests)
+		http.Error(rw, "too many requests to "+host, http.StatusTooManyRequests)
+		return ctx, filters.DummyRequest, nil
+	}
+
+	if wait > 0 {
+		glog.V(2).Infof("%s \"HOSTRATELIMIT %s %s %s\" delayed %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx, filters.DummyRequest, nil
+		}
+	}
+
+	return ctx, req, nil
+}
@@ -0,0 +1,88 @@
+package hostratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"../../filters"
+)
+
+func TestRequestReject(t *testing.T) {
+	f, err := NewFilter(&Config{
+		Hosts: map[string]Limit{
+			"api.example.com": {Rate: 10, Burst: 10},
+		},
+		Mode: "reject",
+	})
+	if err != nil {
+		t.Fatalf("NewFilter error: %v", err)
+	}
+
+	var passed, rejected int64
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// every client counts against the same host
+			req, _ := http.NewRequest(http.MethodGet, "http://api.example.com/", nil)
+			req.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", i)
+			rw := filters.NewTestResponseWriter(nil)
+
+			_, req1, err := f.(*Filter).Request(filters.NewTestContext(rw), req)
+			if err != nil {
+				t.Errorf("%T.Request() error: %v", f, err)
+			}
+			if req1 == filters.DummyRequest {
+				if rw.Code != http.StatusTooManyRequests {
+					t.Errorf("%T.Request() code = %d, want 429", f, rw.Code)
+				}
+				atomic.AddInt64(&rejected, 1)
+			} else {
+				atomic.AddInt64(&passed, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// the test may run long enough to refill a token
+	if passed < 10 || passed > 11 {
+		t.Errorf("%T.Request() passed %d of 50 requests to a host limited to 10, rejected %d", f, passed, rejected)
+	}
+
+	for i := 0; i < 20; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+		_, req1, _ := f.(*Filter).Request(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+		if req1 == filters.DummyRequest {
+			t.Fatalf("%T.Request() limits www.example.com without a limit", f)
+		}
+	}
+}
+
+func TestRequestDelay(t *testing.T) {
+	f, err := NewFilter(&Config{
+		Default:  Limit{Rate: 20, Burst: 1},
+		MaxDelay: 1000,
+	})
+	if err != nil {
+		t.Fatalf("NewFilter error: %v", err)
+	}
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+		_, req1, _ := f.(*Filter).Request(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+		if req1 == filters.DummyRequest {
+			t.Fatalf("%T.Request() rejects a request within MaxDelay", f)
+		}
+	}
+
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Errorf("%T.Request() sent 5 requests in %s, want them spaced 50ms apart", f, d)
+	}
+}
@@ -0,0 +1,96 @@
+package httpsredirect
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../helpers"
+	"../../storage"
+)
+
+const (
+	filterName string = "httpsredirect"
+)
+
+type Config struct {
+	Hosts      []string
+	StatusCode int
+}
+
+type Filter struct {
+	Config
+	HostMatcher *helpers.HostMatcher
+	StatusCode  int
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.LookupStoreByConfig(filterName).UnmarshallJson(filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	err = filters.Register(filterName, &filters.RegisteredFilter{
+		New: func() (filters.Filter, error) {
+			return NewFilter(config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	f := &Filter{
+		Config:      *config,
+		HostMatcher: helpers.NewHostMatcher(config.Hosts),
+		StatusCode:  config.StatusCode,
+	}
+
+	switch f.StatusCode {
+	case 0:
+		f.StatusCode = http.StatusMovedPermanently
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil, fmt.Errorf("%s: StatusCode %d is not a redirect", filterName, config.StatusCode)
+	}
+
+	return f, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
+
+func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
+	if req.Method == http.MethodConnect || req.TLS != nil || req.URL.Scheme == "https" {
+		return ctx, req, nil
+	}
+
+	host := helpers.GetHostName(req)
+	if !f.HostMatcher.Match(host) {
+		return ctx, req, nil
+	}
+
+	// the https equivalent drops an explicit :80, other ports are kept
+	u := *req.URL
+	u.Scheme = "https"
+	u.Host = req.Host
+	if h, port, err := net.SplitHostPort(req.Host); err == nil && port == "80" {
+		u.Host = h
+	}
+
+	glog.V(2).Infof("%s \"HTTPSREDIRECT %s %s %s\" %d %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, f.StatusCode, u.String())
+
+	rw := filters.GetResponseWriter(ctx)
+	rw.Header().Set("Location", u.String())
+	rw.WriteHeader(f.StatusCode)
+	return ctx, filters.DummyRequest, nil
+}
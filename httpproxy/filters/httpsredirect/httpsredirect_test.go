@@ -0,0 +1,59 @@
+package httpsredirect
+
+import (
+	"net/http"
+	"testing"
+
+	"../../filters"
+)
+
+func TestRequest(t *testing.T) {
+	f, err := NewFilter(&Config{
+		Hosts:      []string{"www.example.com", "*.example.org"},
+		StatusCode: http.StatusPermanentRedirect,
+	})
+	if err != nil {
+		t.Fatalf("NewFilter error: %v", err)
+	}
+
+	cases := []struct {
+		method   string
+		url      string
+		location string
+	}{
+		{http.MethodGet, "http://www.example.com/a?b=c", "https://www.example.com/a?b=c"},
+		{http.MethodPost, "http://www.example.com:80/", "https://www.example.com/"},
+		{http.MethodGet, "http://api.example.org:8080/x", "https://api.example.org:8080/x"},
+		{http.MethodGet, "http://example.net/", ""},
+		{http.MethodGet, "https://www.example.com/", ""},
+		{http.MethodConnect, "http://www.example.com:443", ""},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, c.url, nil)
+		rw := filters.NewTestResponseWriter(nil)
+
+		_, req1, err := f.(*Filter).Request(filters.NewTestContext(rw), req)
+		if err != nil {
+			t.Fatalf("%T.Request(%s %s) error: %v", f, c.method, c.url, err)
+		}
+
+		if c.location == "" {
+			if req1 != req {
+				t.Errorf("%T.Request(%s %s) redirects to %#v, want pass through", f, c.method, c.url, rw.Header().Get("Location"))
+			}
+			continue
+		}
+
+		if req1 != filters.DummyRequest || rw.Code != http.StatusPermanentRedirect {
+			t.Errorf("%T.Request(%s %s) code = %d, want %d", f, c.method, c.url, rw.Code, http.StatusPermanentRedirect)
+		}
+		if location := rw.Header().Get("Location"); location != c.location {
+			t.Errorf("%T.Request(%s %s) Location = %#v, want %#v", f, c.method, c.url, location, c.location)
+		}
+	}
+
+	if _, err := NewFilter(&Config{StatusCode: http.StatusOK}); err == nil {
+		t.Errorf("NewFilter(StatusCode: 200) returns no error")
+	}
+}
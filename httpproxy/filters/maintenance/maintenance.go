@@ -0,0 +1,126 @@
+package maintenance
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../storage"
+)
+
+const (
+	filterName string = "maintenance"
+)
+
+type Config struct {
+	// Enabled is the mode at start, POST /admin/filters/enabled flips it
+	Enabled     bool
+	StatusCode  int
+	ContentType string
+	Body        string
+	RetryAfter  int
+	BypassNets  []string
+}
+
+type Filter struct {
+	Config
+	BypassNets []*net.IPNet
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.LookupStoreByConfig(filterName).UnmarshallJson(filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	err = filters.Register(filterName, &filters.RegisteredFilter{
+		New: func() (filters.Filter, error) {
+			return NewFilter(config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	f := &Filter{
+		Config: *config,
+	}
+
+	if f.StatusCode == 0 {
+		f.StatusCode = http.StatusServiceUnavailable
+	}
+	if f.ContentType == "" {
+		f.ContentType = "text/plain; charset=utf-8"
+	}
+
+	for _, s := range config.BypassNets {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		f.BypassNets = append(f.BypassNets, ipnet)
+	}
+
+	filters.SetEnabled(filterName, config.Enabled)
+
+	return f, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
+
+func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
+	if !filters.Enabled(filterName) || f.bypass(req) {
+		return ctx, req, nil
+	}
+
+	glog.V(2).Infof("%s \"MAINTENANCE %s %s %s\" %d", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, f.StatusCode)
+
+	rw := filters.GetResponseWriter(ctx)
+	rw.Header().Set("Content-Type", f.ContentType)
+	rw.Header().Set("Cache-Control", "no-store")
+	if f.RetryAfter > 0 {
+		rw.Header().Set("Retry-After", strconv.Itoa(f.RetryAfter))
+	}
+	rw.WriteHeader(f.StatusCode)
+	if req.Method != http.MethodHead {
+		rw.Write([]byte(f.Body))
+	}
+	return ctx, filters.DummyRequest, nil
+}
+
+// bypass reports whether req comes from BypassNets, or is for the admin
+// endpoints, which stay up to turn maintenance off.
+func (f *Filter) bypass(req *http.Request) bool {
+	if req.URL.Host == "" && strings.HasPrefix(req.URL.Path, "/admin/") {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipnet := range f.BypassNets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package maintenance
+
+import (
+	"net/http"
+	"testing"
+
+	"../../filters"
+)
+
+func TestRequest(t *testing.T) {
+	f, err := NewFilter(&Config{
+		Enabled:    true,
+		Body:       "down for maintenance",
+		RetryAfter: 60,
+		BypassNets: []string{"10.0.0.0/8"},
+	})
+	if err != nil {
+		t.Fatalf("NewFilter error: %v", err)
+	}
+	defer filters.SetEnabled(filterName, false)
+
+	request := func(method, url, remoteAddr string) (*http.Request, *filters.TestResponseWriter, *http.Request) {
+		req, _ := http.NewRequest(method, url, nil)
+		req.RemoteAddr = remoteAddr
+		rw := filters.NewTestResponseWriter(nil)
+		_, req1, err := f.(*Filter).Request(filters.NewTestContext(rw), req)
+		if err != nil {
+			t.Fatalf("%T.Request(%s %s) error: %v", f, method, url, err)
+		}
+		return req, rw, req1
+	}
+
+	cases := []struct {
+		method     string
+		url        string
+		remoteAddr string
+		blocked    bool
+	}{
+		{http.MethodGet, "http://www.example.org/", "192.0.2.1:1234", true},
+		{http.MethodConnect, "https://www.example.org:443", "192.0.2.1:1234", true},
+		{http.MethodGet, "http://www.example.org/", "10.1.2.3:1234", false},
+		{http.MethodConnect, "https://www.example.org:443", "10.1.2.3:1234", false},
+		// the admin endpoints stay up to turn it off
+		{http.MethodPost, "/admin/maintenance?enabled=false", "192.0.2.1:1234", false},
+	}
+
+	for _, c := range cases {
+		req, rw, req1 := request(c.method, c.url, c.remoteAddr)
+		if !c.blocked {
+			if req1 != req {
+				t.Errorf("%T.Request(%s %s) from %s blocked, code %d", f, c.method, c.url, c.remoteAddr, rw.Code)
+			}
+			continue
+		}
+		if req1 != filters.DummyRequest || rw.Code != http.StatusServiceUnavailable {
+			t.Errorf("%T.Request(%s %s) from %s code = %d, want 503", f, c.method, c.url, c.remoteAddr, rw.Code)
+		}
+		if rw.Header().Get("Retry-After") != "60" || rw.Body.String() != "down for maintenance" {
+			t.Errorf("%T.Request(%s %s) Retry-After=%#v body=%#v", f, c.method, c.url, rw.Header().Get("Retry-After"), rw.Body.String())
+		}
+	}
+
+	// inactive, everyone is proxied
+	filters.SetEnabled(filterName, false)
+	if req, rw, req1 := request(http.MethodGet, "http://www.example.org/", "192.0.2.1:1234"); req1 != req {
+		t.Errorf("%T.Request() with maintenance off blocked, code %d", f, rw.Code)
+	}
+}
@@ -0,0 +1,117 @@
+package methodacl
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../helpers"
+	"../../storage"
+)
+
+const (
+	filterName string = "methodacl"
+)
+
+type Rule struct {
+	Hosts        []string
+	Methods      []string
+	AllowConnect bool
+}
+
+type Config struct {
+	Rules []Rule
+}
+
+type acl struct {
+	methods      map[string]struct{}
+	allow        string
+	allowConnect bool
+}
+
+type Filter struct {
+	Config
+	ACLs *helpers.HostMatcher
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.LookupStoreByConfig(filterName).UnmarshallJson(filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	err = filters.Register(filterName, &filters.RegisteredFilter{
+		New: func() (filters.Filter, error) {
+			return NewFilter(config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	acls := make(map[string]interface{})
+	for _, rule := range config.Rules {
+		a := &acl{
+			methods:      make(map[string]struct{}),
+			allowConnect: rule.AllowConnect,
+		}
+
+		allow := make([]string, 0, len(rule.Methods)+1)
+		for _, method := range rule.Methods {
+			method = strings.ToUpper(method)
+			if _, ok := a.methods[method]; ok || method == http.MethodConnect {
+				continue
+			}
+			a.methods[method] = struct{}{}
+			allow = append(allow, method)
+		}
+		if rule.AllowConnect {
+			allow = append(allow, http.MethodConnect)
+		}
+		a.allow = strings.Join(allow, ", ")
+
+		for _, host := range rule.Hosts {
+			acls[host] = a
+		}
+	}
+
+	return &Filter{
+		Config: *config,
+		ACLs:   helpers.NewHostMatcherWithValue(acls),
+	}, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
+
+func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
+	v, ok := f.ACLs.Lookup(helpers.GetHostName(req))
+	if !ok {
+		return ctx, req, nil
+	}
+
+	a := v.(*acl)
+	if req.Method == http.MethodConnect {
+		if a.allowConnect {
+			return ctx, req, nil
+		}
+	} else if _, ok := a.methods[req.Method]; ok {
+		return ctx, req, nil
+	}
+
+	glog.V(2).Infof("%s \"METHODACL %s %s %s\" not allowed, Allow: %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, a.allow)
+
+	rw := filters.GetResponseWriter(ctx)
+	rw.Header().Set("Allow", a.allow)
+	http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+	return ctx, filters.DummyRequest, nil
+}
@@ -0,0 +1,67 @@
+package methodacl
+
+import (
+	"net/http"
+	"testing"
+
+	"../../filters"
+)
+
+func TestRequest(t *testing.T) {
+	f, err := NewFilter(&Config{
+		Rules: []Rule{
+			{
+				Hosts:   []string{"static.example.com"},
+				Methods: []string{"get", "HEAD"},
+			},
+			{
+				Hosts:        []string{"*.example.org"},
+				Methods:      []string{"GET"},
+				AllowConnect: true,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewFilter error: %v", err)
+	}
+
+	cases := []struct {
+		method string
+		url    string
+		code   int
+		allow  string
+	}{
+		{http.MethodGet, "http://static.example.com/a.js", http.StatusOK, ""},
+		{http.MethodHead, "http://static.example.com/a.js", http.StatusOK, ""},
+		{http.MethodPost, "http://static.example.com/a.js", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{http.MethodDelete, "http://static.example.com/a.js", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{http.MethodConnect, "https://static.example.com:443", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{http.MethodConnect, "https://www.example.org:443", http.StatusOK, ""},
+		{http.MethodPut, "http://www.example.org/", http.StatusMethodNotAllowed, "GET, CONNECT"},
+		{http.MethodPost, "http://www.example.net/", http.StatusOK, ""},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, c.url, nil)
+		rw := filters.NewTestResponseWriter(nil)
+
+		_, req1, err := f.(*Filter).Request(filters.NewTestContext(rw), req)
+		if err != nil {
+			t.Fatalf("%T.Request(%s %s) error: %v", f, c.method, c.url, err)
+		}
+
+		switch c.code {
+		case http.StatusOK:
+			if req1 != req {
+				t.Errorf("%T.Request(%s %s) rejected, code %d", f, c.method, c.url, rw.Code)
+			}
+		default:
+			if req1 != filters.DummyRequest || rw.Code != c.code {
+				t.Errorf("%T.Request(%s %s) code = %d, want %d", f, c.method, c.url, rw.Code, c.code)
+			}
+			if allow := rw.Header().Get("Allow"); allow != c.allow {
+				t.Errorf("%T.Request(%s %s) Allow = %#v, want %#v", f, c.method, c.url, allow, c.allow)
+			}
+		}
+	}
+}
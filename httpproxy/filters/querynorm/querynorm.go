@@ -0,0 +1,209 @@
+package querynorm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../helpers"
+	"../../storage"
+)
+
+const (
+	filterName string = "querynorm"
+)
+
+const (
+	dedupNone  = ""
+	dedupExact = "exact"
+	dedupFirst = "first"
+	dedupLast  = "last"
+)
+
+type Rule struct {
+	Hosts []string
+	// Sort orders the parameters by name, repeated ones keep their order
+	Sort bool
+	// Drop are path.Match patterns of parameter names, e.g. "utm_*"
+	Drop []string
+	// Dedup collapses repeated parameters, "exact" the ones with the same
+	// value, "first" or "last" keeps that value of each name, "" none
+	Dedup string
+	// Exempt are parameters whose order matters, they are neither sorted nor
+	// deduplicated and follow the others as they came
+	Exempt []string
+}
+
+type Config struct {
+	Rules []Rule
+}
+
+type rule struct {
+	Rule
+	exempt map[string]struct{}
+}
+
+type Filter struct {
+	Config
+	Rules *helpers.HostMatcher
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.LookupStoreByConfig(filterName).UnmarshallJson(filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	err = filters.Register(filterName, &filters.RegisteredFilter{
+		New: func() (filters.Filter, error) {
+			return NewFilter(config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	rules := make(map[string]interface{})
+	for i, r := range config.Rules {
+		switch r.Dedup {
+		case dedupNone, dedupExact, dedupFirst, dedupLast:
+		default:
+			return nil, fmt.Errorf("%s: Rules[%d] unknown Dedup %#v", filterName, i, r.Dedup)
+		}
+		for _, pattern := range r.Drop {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%s: Rules[%d] invalid Drop pattern %#v: %v", filterName, i, pattern, err)
+			}
+		}
+
+		r1 := &rule{Rule: r, exempt: make(map[string]struct{})}
+		for _, name := range r.Exempt {
+			r1.exempt[name] = struct{}{}
+		}
+
+		for _, host := range r.Hosts {
+			rules[host] = r1
+		}
+	}
+
+	return &Filter{
+		Config: *config,
+		Rules:  helpers.NewHostMatcherWithValue(rules),
+	}, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
+
+// param is a query parameter as it came, with its unescaped name.
+type param struct {
+	raw  string
+	name string
+	// value is the raw one, escapes are compared as they are
+	value string
+}
+
+func (r *rule) dropped(name string) bool {
+	for _, pattern := range r.Drop {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// normalize returns rawQuery with the parameters of r dropped, deduplicated
+// and sorted. The parameters left are not escaped again.
+func (r *rule) normalize(rawQuery string) string {
+	var params, exempt []param
+	for _, raw := range strings.Split(rawQuery, "&") {
+		if raw == "" {
+			continue
+		}
+		p := param{raw: raw, name: raw}
+		if i := strings.IndexByte(raw, '='); i >= 0 {
+			p.name, p.value = raw[:i], raw[i+1:]
+		}
+		if name, err := url.QueryUnescape(p.name); err == nil {
+			p.name = name
+		}
+
+		if r.dropped(p.name) {
+			continue
+		}
+		if _, ok := r.exempt[p.name]; ok {
+			exempt = append(exempt, p)
+			continue
+		}
+		params = append(params, p)
+	}
+
+	params = r.dedup(params)
+	if r.Sort {
+		sort.SliceStable(params, func(i, j int) bool { return params[i].name < params[j].name })
+	}
+
+	parts := make([]string, 0, len(params)+len(exempt))
+	for _, p := range append(params, exempt...) {
+		parts = append(parts, p.raw)
+	}
+	return strings.Join(parts, "&")
+}
+
+func (r *rule) dedup(params []param) []param {
+	if r.Dedup == dedupNone {
+		return params
+	}
+
+	// the index in params1 of the value each name keeps
+	seen := make(map[string]int)
+	params1 := params[:0:0]
+	for _, p := range params {
+		key := p.name
+		if r.Dedup == dedupExact {
+			key += "=" + p.value
+		}
+		i, ok := seen[key]
+		switch {
+		case !ok:
+			seen[key] = len(params1)
+			params1 = append(params1, p)
+		case r.Dedup == dedupLast:
+			params1[i] = p
+		}
+	}
+	return params1
+}
+
+// Request normalizes the query string of requests to matching hosts before
+// they go upstream. CONNECT tunnels are exempt.
+func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
+	if req.Method == http.MethodConnect || req.URL.RawQuery == "" {
+		return ctx, req, nil
+	}
+
+	v, ok := f.Rules.Lookup(helpers.GetHostName(req))
+	if !ok {
+		return ctx, req, nil
+	}
+
+	if q := v.(*rule).normalize(req.URL.RawQuery); q != req.URL.RawQuery {
+		glog.V(2).Infof("%s \"QUERYNORM %s %s %s\" query %#v", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, q)
+		req.URL.RawQuery = q
+	}
+
+	return ctx, req, nil
+}
@@ -0,0 +1,79 @@
+package querynorm
+
+import (
+	"net/http"
+	"testing"
+
+	"../../filters"
+)
+
+func TestRequest(t *testing.T) {
+	f, err := NewFilter(&Config{
+		Rules: []Rule{
+			{
+				Hosts: []string{"www.example.com"},
+				Sort:  true,
+				Drop:  []string{"utm_*", "fbclid"},
+				Dedup: dedupExact,
+			},
+			{
+				Hosts:  []string{"*.example.org"},
+				Sort:   true,
+				Dedup:  dedupLast,
+				Exempt: []string{"step"},
+			},
+			{
+				Hosts: []string{"first.example.net"},
+				Dedup: dedupFirst,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewFilter error: %v", err)
+	}
+
+	cases := []struct {
+		method string
+		url    string
+		query  string
+	}{
+		// sorting, repeated names keep their order
+		{http.MethodGet, "http://www.example.com/?b=2&a=1&c=3", "a=1&b=2&c=3"},
+		{http.MethodGet, "http://www.example.com/?tag=z&id=1&tag=a", "id=1&tag=z&tag=a"},
+		// dropping, escaped names too
+		{http.MethodGet, "http://www.example.com/?utm_source=x&q=go&fbclid=abc&utm%5Fmedium=y", "q=go"},
+		{http.MethodGet, "http://www.example.com/?utm_source=x", ""},
+		// dedup of the same pairs, values and escapes kept as they came
+		{http.MethodGet, "http://www.example.com/?q=a%20b&q=a%20b&q=c", "q=a%20b&q=c"},
+		{http.MethodGet, "http://www.example.com/?flag&flag&&x=1", "flag&x=1"},
+		// the last value wins, exempt parameters keep their order at the end
+		{http.MethodGet, "http://www.example.org/?step=2&b=1&step=1&a=1&b=2", "a=1&b=2&step=2&step=1"},
+		{http.MethodGet, "http://first.example.net/?z=1&y=1&z=2", "z=1&y=1"},
+		// other hosts and CONNECT are left alone
+		{http.MethodGet, "http://other.example.net/?b=2&a=1&b=2", "b=2&a=1&b=2"},
+		{http.MethodConnect, "https://www.example.com:443/?b=2&a=1", "b=2&a=1"},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, c.url, nil)
+
+		_, req1, err := f.(*Filter).Request(filters.NewTestContext(filters.NewTestResponseWriter(nil)), req)
+		if err != nil {
+			t.Fatalf("%T.Request(%s %s) error: %v", f, c.method, c.url, err)
+		}
+		if req1.URL.RawQuery != c.query {
+			t.Errorf("%T.Request(%s %s) query = %#v, want %#v", f, c.method, c.url, req1.URL.RawQuery, c.query)
+		}
+	}
+}
+
+func TestNewFilterInvalid(t *testing.T) {
+	for _, r := range []Rule{
+		{Hosts: []string{"www.example.com"}, Dedup: "most"},
+		{Hosts: []string{"www.example.com"}, Drop: []string{"utm_["}},
+	} {
+		if _, err := NewFilter(&Config{Rules: []Rule{r}}); err == nil {
+			t.Errorf("NewFilter(%+v) error = nil", r)
+		}
+	}
+}
@@ -2,13 +2,18 @@ package auth
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/juju/ratelimit"
 	"github.com/phuslu/glog"
 
 	"../../filters"
+	"../../helpers"
 	"../../storage"
 )
 
@@ -20,13 +25,31 @@ type Config struct {
 	Threshold int
 	Rate      int
 	Capacity  int
+	Requests  struct {
+		Limit    int
+		Window   int
+		FailOpen bool
+	}
+	Store struct {
+		Type      string
+		CacheSize int
+		Redis     struct {
+			Address  string
+			Password string
+			DB       int
+			Timeout  int
+		}
+	}
 }
 
 type Filter struct {
 	Config
-	Threshold int64
-	Rate      float64
-	Capacity  int64
+	Threshold     int64
+	Rate          float64
+	Capacity      int64
+	RequestLimit  int64
+	RequestWindow time.Duration
+	Store         RateStore
 }
 
 func init() {
@@ -60,6 +83,30 @@ func NewFilter(config *Config) (filters.Filter, error) {
 		f.Capacity = int64(config.Rate) * 1024
 	}
 
+	if config.Requests.Limit > 0 {
+		f.RequestLimit = int64(config.Requests.Limit)
+		f.RequestWindow = time.Duration(config.Requests.Window) * time.Second
+		if f.RequestWindow <= 0 {
+			f.RequestWindow = time.Minute
+		}
+
+		switch config.Store.Type {
+		case "", "memory":
+			size := config.Store.CacheSize
+			if size <= 0 {
+				size = 8192
+			}
+			f.Store = NewMemoryRateStore(uint(size))
+		case "redis":
+			f.Store = NewRedisRateStore(config.Store.Redis.Address,
+				config.Store.Redis.Password,
+				config.Store.Redis.DB,
+				time.Duration(config.Store.Redis.Timeout)*time.Millisecond)
+		default:
+			return nil, fmt.Errorf("%s: unknown store type %#v", filterName, config.Store.Type)
+		}
+	}
+
 	return f, nil
 }
 
@@ -67,6 +114,43 @@ func (f *Filter) FilterName() string {
 	return filterName
 }
 
+func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
+	// unix socket clients have no ip to tell them apart
+	if f.RequestLimit <= 0 || req.RemoteAddr == "" || req.RemoteAddr == helpers.UnixRemoteAddr {
+		return ctx, req, nil
+	}
+
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+
+	// fixed windows, so that every instance sharing the store counts the same key
+	window := time.Now().UnixNano() / int64(f.RequestWindow)
+	key := "goproxy:ratelimit:" + ip + ":" + strconv.FormatInt(window, 10)
+
+	n, err := f.Store.Incr(key, f.RequestWindow)
+	if err != nil {
+		glog.Warningf("%s \"RATELIMIT %s %s %s\" store error: %v", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, err)
+		if f.Config.Requests.FailOpen {
+			return ctx, req, nil
+		}
+		http.Error(filters.GetResponseWriter(ctx), "rate limit store unavailable", http.StatusServiceUnavailable)
+		return ctx, filters.DummyRequest, nil
+	}
+
+	if n > f.RequestLimit {
+		glog.V(2).Infof("%s \"RATELIMIT %s %s %s\" %d requests exceed %d per %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, n, f.RequestLimit, f.RequestWindow)
+		rw := filters.GetResponseWriter(ctx)
+		rw.Header().Set("Retry-After", strconv.FormatInt(int64((f.RequestWindow-time.Duration(time.Now().UnixNano()%int64(f.RequestWindow)))/time.Second)+1, 10))
+		filters.MarkRejection(ctx, http.StatusTooManyRequests)
+		http.Error(rw, "too many requests", http.StatusTooManyRequests)
+		return ctx, filters.DummyRequest, nil
+	}
+
+	return ctx, req, nil
+}
+
 func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Context, *http.Response, error) {
 
 	if f.Rate > 0 && resp.ContentLength > f.Threshold {
@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"../../filters"
+)
+
+// redisStub serves AUTH, SELECT, INCR, PEXPIRE and GET, just enough for
+// redisRateStore.
+type redisStub struct {
+	ln      net.Listener
+	mu      sync.Mutex
+	values  map[string]int64
+	expires map[string]string
+}
+
+func newRedisStub(t *testing.T) *redisStub {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+
+	s := &redisStub{
+		ln:      ln,
+		values:  make(map[string]int64),
+		expires: make(map[string]string),
+	}
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+
+	return s
+}
+
+func (s *redisStub) serve(c net.Conn) {
+	defer c.Close()
+
+	br := bufio.NewReader(c)
+	for {
+		v, err := readRedisReply(br)
+		if err != nil {
+			return
+		}
+
+		var args []string
+		for _, arg := range v.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+
+		s.mu.Lock()
+		switch args[0] {
+		case "AUTH", "SELECT":
+			io.WriteString(c, "+OK\r\n")
+		case "INCR":
+			s.values[args[1]]++
+			io.WriteString(c, ":"+strconv.FormatInt(s.values[args[1]], 10)+"\r\n")
+		case "PEXPIRE":
+			s.expires[args[1]] = args[2]
+			io.WriteString(c, ":1\r\n")
+		case "GET":
+			if n, ok := s.values[args[1]]; ok {
+				b := strconv.FormatInt(n, 10)
+				io.WriteString(c, "$"+strconv.Itoa(len(b))+"\r\n"+b+"\r\n")
+			} else {
+				io.WriteString(c, "$-1\r\n")
+			}
+		default:
+			io.WriteString(c, "-ERR unknown command\r\n")
+		}
+		s.mu.Unlock()
+	}
+}
+
+func TestMemoryRateStore(t *testing.T) {
+	s := NewMemoryRateStore(16)
+
+	for i := int64(1); i <= 3; i++ {
+		if n, err := s.Incr("a", time.Minute); err != nil || n != i {
+			t.Errorf("memoryRateStore.Incr() = %d, %v, want %d", n, err, i)
+		}
+	}
+	if n, _ := s.Get("a"); n != 3 {
+		t.Errorf("memoryRateStore.Get() = %d, want 3", n)
+	}
+
+	s.Incr("b", -time.Second)
+	if n, _ := s.Get("b"); n != 0 {
+		t.Errorf("memoryRateStore.Get() of expired key = %d, want 0", n)
+	}
+}
+
+func TestRedisRateStore(t *testing.T) {
+	stub := newRedisStub(t)
+	defer stub.ln.Close()
+
+	s := NewRedisRateStore(stub.ln.Addr().String(), "secret", 1, time.Second)
+
+	for i := int64(1); i <= 3; i++ {
+		if n, err := s.Incr("a", 1500*time.Millisecond); err != nil || n != i {
+			t.Errorf("redisRateStore.Incr() = %d, %v, want %d", n, err, i)
+		}
+	}
+	if n, err := s.Get("a"); err != nil || n != 3 {
+		t.Errorf("redisRateStore.Get() = %d, %v, want 3", n, err)
+	}
+	if n, err := s.Get("b"); err != nil || n != 0 {
+		t.Errorf("redisRateStore.Get() of missing key = %d, %v, want 0", n, err)
+	}
+
+	stub.mu.Lock()
+	ttl := stub.expires["a"]
+	stub.mu.Unlock()
+	if ttl != "1500" {
+		t.Errorf("redisRateStore PEXPIRE ttl = %#v, want %#v", ttl, "1500")
+	}
+}
+
+func newTestFilter(t *testing.T, limit int, store RateStore, failOpen bool) *Filter {
+	config := new(Config)
+	config.Requests.Limit = limit
+	config.Requests.Window = 60
+	config.Requests.FailOpen = failOpen
+
+	f, err := NewFilter(config)
+	if err != nil {
+		t.Fatalf("NewFilter() error: %v", err)
+	}
+	f1 := f.(*Filter)
+	if store != nil {
+		f1.Store = store
+	}
+	return f1
+}
+
+func doRequest(f *Filter) (*http.Request, *filters.TestResponseWriter) {
+	rw := filters.NewTestResponseWriter(nil)
+	req, _ := http.NewRequest(http.MethodGet, "http://example.org/", nil)
+	req.RemoteAddr = "192.168.1.2:1234"
+	_, req, _ = f.Request(filters.NewTestContext(rw), req)
+	return req, rw
+}
+
+func TestRequestLimit(t *testing.T) {
+	stub := newRedisStub(t)
+	defer stub.ln.Close()
+
+	// two filters sharing one store behave like two proxy instances
+	store := NewRedisRateStore(stub.ln.Addr().String(), "", 0, time.Second)
+	f1 := newTestFilter(t, 3, store, true)
+	f2 := newTestFilter(t, 3, store, true)
+
+	for i, f := range []*Filter{f1, f2, f1} {
+		if req, _ := doRequest(f); req == filters.DummyRequest {
+			t.Fatalf("request #%d rejected below the limit", i+1)
+		}
+	}
+
+	req, rw := doRequest(f2)
+	if req != filters.DummyRequest || rw.Code != http.StatusTooManyRequests {
+		t.Errorf("request over the limit returns code %d, want %d", rw.Code, http.StatusTooManyRequests)
+	}
+	if rw.Header().Get("Retry-After") == "" {
+		t.Errorf("request over the limit has no Retry-After header")
+	}
+}
+
+func TestRequestLimitStoreUnavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	store := NewRedisRateStore(addr, "", 0, time.Second)
+
+	if req, _ := doRequest(newTestFilter(t, 1, store, true)); req == filters.DummyRequest {
+		t.Errorf("FailOpen filter rejects requests when the store is unavailable")
+	}
+
+	req, rw := doRequest(newTestFilter(t, 1, store, false))
+	if req != filters.DummyRequest || rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("fail closed filter returns code %d, want %d", rw.Code, http.StatusServiceUnavailable)
+	}
+}
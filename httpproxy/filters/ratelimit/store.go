@@ -0,0 +1,228 @@
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+// RateStore keeps the request counters, shared by all proxy instances when
+// it is backed by a server.
+type RateStore interface {
+	// Incr increments key and returns its new value, a new key expires after ttl.
+	Incr(key string, ttl time.Duration) (int64, error)
+	Get(key string) (int64, error)
+}
+
+type memoryRateStore struct {
+	mu    sync.Mutex
+	cache lrucache.Cache
+}
+
+func NewMemoryRateStore(size uint) RateStore {
+	return &memoryRateStore{
+		cache: lrucache.NewLRUCache(size),
+	}
+}
+
+type memoryCounter struct {
+	n      int64
+	expiry time.Time
+}
+
+func (s *memoryRateStore) Incr(key string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := &memoryCounter{expiry: time.Now().Add(ttl)}
+	if v, ok := s.cache.GetNotStale(key); ok {
+		c = v.(*memoryCounter)
+	}
+	c.n++
+	s.cache.Set(key, c, c.expiry)
+
+	return c.n, nil
+}
+
+func (s *memoryRateStore) Get(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.cache.GetNotStale(key); ok {
+		return v.(*memoryCounter).n, nil
+	}
+	return 0, nil
+}
+
+// redisRateStore talks RESP to a redis server over one connection, which is
+// redialed after any error.
+type redisRateStore struct {
+	Address  string
+	Password string
+	DB       int
+	Timeout  time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func NewRedisRateStore(address, password string, db int, timeout time.Duration) RateStore {
+	return &redisRateStore{
+		Address:  address,
+		Password: password,
+		DB:       db,
+		Timeout:  timeout,
+	}
+}
+
+func (s *redisRateStore) Incr(key string, ttl time.Duration) (int64, error) {
+	v, err := s.do("INCR", key)
+	if err != nil {
+		return 0, err
+	}
+
+	n, ok := v.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: INCR %#v returns %#v", key, v)
+	}
+
+	if n == 1 {
+		if _, err := s.do("PEXPIRE", key, strconv.FormatInt(int64(ttl/time.Millisecond), 10)); err != nil {
+			return 0, err
+		}
+	}
+
+	return n, nil
+}
+
+func (s *redisRateStore) Get(key string) (int64, error) {
+	v, err := s.do("GET", key)
+	if err != nil || v == nil {
+		return 0, err
+	}
+
+	b, ok := v.([]byte)
+	if !ok {
+		return 0, fmt.Errorf("redis: GET %#v returns %#v", key, v)
+	}
+	return strconv.ParseInt(string(b), 10, 64)
+}
+
+func (s *redisRateStore) do(args ...string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		if err := s.dial(); err != nil {
+			return nil, err
+		}
+	}
+
+	v, err := s.roundTrip(args...)
+	if _, ok := err.(redisError); !ok && err != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return v, err
+}
+
+func (s *redisRateStore) dial() error {
+	conn, err := net.DialTimeout("tcp", s.Address, s.Timeout)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.br = bufio.NewReader(conn)
+
+	if s.Password != "" {
+		if _, err := s.roundTrip("AUTH", s.Password); err != nil {
+			conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+
+	if s.DB != 0 {
+		if _, err := s.roundTrip("SELECT", strconv.Itoa(s.DB)); err != nil {
+			conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+
+	return nil
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func (s *redisRateStore) roundTrip(args ...string) (interface{}, error) {
+	if s.Timeout > 0 {
+		s.conn.SetDeadline(time.Now().Add(s.Timeout))
+	}
+
+	b := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b = append(b, "$"+strconv.Itoa(len(arg))+"\r\n"+arg+"\r\n"...)
+	}
+	if _, err := s.conn.Write(b); err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(s.br)
+}
+
+func readRedisReply(br *bufio.Reader) (interface{}, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = readRedisReply(br); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply %#v", line)
+	}
+}
@@ -0,0 +1,151 @@
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../storage"
+)
+
+const (
+	filterName string = "requestid"
+
+	maxRequestIDLength = 128
+)
+
+type Config struct {
+	Header       string
+	TrustInbound bool
+	TrustedNets  []string
+}
+
+type Filter struct {
+	Config
+	Header      string
+	TrustedNets []*net.IPNet
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.LookupStoreByConfig(filterName).UnmarshallJson(filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	err = filters.Register(filterName, &filters.RegisteredFilter{
+		New: func() (filters.Filter, error) {
+			return NewFilter(config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	f := &Filter{
+		Config: *config,
+		Header: http.CanonicalHeaderKey(config.Header),
+	}
+
+	if f.Header == "" {
+		f.Header = "X-Request-Id"
+	}
+
+	for _, s := range config.TrustedNets {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		f.TrustedNets = append(f.TrustedNets, ipnet)
+	}
+
+	return f, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
+
+// Trusted reports whether ids sent by remoteAddr are kept.
+func (f *Filter) Trusted(remoteAddr string) bool {
+	if !f.TrustInbound {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipnet := range f.TrustedNets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// valid rejects ids which would bloat or break log lines.
+func valid(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] >= 0x7f || id[i] == '"' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random UUID version 4.
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
+	if req.Method == http.MethodConnect {
+		return ctx, req, nil
+	}
+
+	id := filters.String(ctx, filters.RequestIDKey)
+	if id == "" {
+		if v := req.Header.Get(f.Header); valid(v) && f.Trusted(req.RemoteAddr) {
+			id = v
+		} else {
+			id = newRequestID()
+		}
+		ctx = filters.WithString(ctx, filters.RequestIDKey, id)
+	}
+
+	glog.V(3).Infof("%s \"REQUESTID %s %s %s\" %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, id)
+	req.Header.Set(f.Header, id)
+
+	return ctx, req, nil
+}
+
+func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Context, *http.Response, error) {
+	if id := filters.String(ctx, filters.RequestIDKey); id != "" {
+		resp.Header.Set(f.Header, id)
+	}
+	return ctx, resp, nil
+}
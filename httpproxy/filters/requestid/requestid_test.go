@@ -0,0 +1,84 @@
+package requestid
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+
+	"../../filters"
+)
+
+var uuidRegexp = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestRequest(t *testing.T) {
+	f, err := NewFilter(&Config{
+		TrustInbound: true,
+		TrustedNets:  []string{"10.0.0.0/8"},
+	})
+	if err != nil {
+		t.Fatalf("NewFilter error: %v", err)
+	}
+
+	cases := []struct {
+		remoteAddr string
+		inbound    string
+		keep       bool
+	}{
+		{"10.1.2.3:1234", "abc-123", true},
+		{"192.0.2.1:1234", "abc-123", false},
+		{"10.1.2.3:1234", "", false},
+		{"10.1.2.3:1234", "bad id", false},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+		req.RemoteAddr = c.remoteAddr
+		if c.inbound != "" {
+			req.Header.Set("X-Request-ID", c.inbound)
+		}
+
+		ctx, req1, err := f.(*Filter).Request(filters.NewTestContext(nil), req)
+		if err != nil {
+			t.Fatalf("%T.Request(%s, %#v) error: %v", f, c.remoteAddr, c.inbound, err)
+		}
+
+		id := req1.Header.Get("X-Request-ID")
+		if c.keep && id != c.inbound {
+			t.Errorf("%T.Request(%s, %#v) X-Request-ID = %#v, want preserved", f, c.remoteAddr, c.inbound, id)
+		}
+		if !c.keep && !uuidRegexp.MatchString(id) {
+			t.Errorf("%T.Request(%s, %#v) X-Request-ID = %#v, want generated", f, c.remoteAddr, c.inbound, id)
+		}
+		if v := filters.String(ctx, filters.RequestIDKey); v != id {
+			t.Errorf("%T.Request(%s, %#v) context id = %#v, want %#v", f, c.remoteAddr, c.inbound, v, id)
+		}
+
+		resp := &http.Response{Header: http.Header{}}
+		_, resp, err = f.(*Filter).Response(ctx, resp)
+		if err != nil {
+			t.Fatalf("%T.Response() error: %v", f, err)
+		}
+		if v := resp.Header.Get("X-Request-ID"); v != id {
+			t.Errorf("%T.Response() X-Request-ID = %#v, want %#v", f, v, id)
+		}
+	}
+}
+
+func TestRequestContextID(t *testing.T) {
+	f, err := NewFilter(&Config{Header: "X-Trace-Id"})
+	if err != nil {
+		t.Fatalf("NewFilter error: %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+	req.Header.Set("X-Trace-Id", "from-client")
+	ctx := filters.WithString(filters.NewTestContext(nil), filters.RequestIDKey, "from-context")
+
+	_, req1, err := f.(*Filter).Request(ctx, req)
+	if err != nil {
+		t.Fatalf("%T.Request() error: %v", f, err)
+	}
+	if id := req1.Header.Get("X-Trace-Id"); id != "from-context" {
+		t.Errorf("%T.Request() X-Trace-Id = %#v, want the context id", f, id)
+	}
+}
@@ -0,0 +1,116 @@
+package secheaders
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../helpers"
+	"../../storage"
+)
+
+const (
+	filterName string = "secheaders"
+)
+
+type Rule struct {
+	Hosts []string
+	// Headers maps a header name, e.g. X-Frame-Options, to the value set
+	Headers map[string]string
+	// Override replaces the values upstreams set, instead of keeping them
+	Override bool
+}
+
+type Config struct {
+	Rules []Rule
+}
+
+type rule struct {
+	hosts    *helpers.HostMatcher
+	headers  map[string]string
+	override bool
+}
+
+type Filter struct {
+	Config
+	rules []*rule
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.LookupStoreByConfig(filterName).UnmarshallJson(filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	err = filters.Register(filterName, &filters.RegisteredFilter{
+		New: func() (filters.Filter, error) {
+			return NewFilter(config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	f := &Filter{
+		Config: *config,
+	}
+
+	for _, r := range config.Rules {
+		r1 := &rule{
+			hosts:    helpers.NewHostMatcher(r.Hosts),
+			headers:  make(map[string]string),
+			override: r.Override,
+		}
+		for key, value := range r.Headers {
+			r1.headers[http.CanonicalHeaderKey(key)] = value
+		}
+		f.rules = append(f.rules, r1)
+	}
+
+	return f, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
+
+// Response sets the headers of the first rule matching the host, CONNECT
+// tunnels are left alone. Strict-Transport-Security only goes on https
+// responses, browsers ignore it over plain http.
+func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Context, *http.Response, error) {
+	req := resp.Request
+	if req == nil || req.Method == http.MethodConnect {
+		return ctx, resp, nil
+	}
+
+	host := helpers.GetHostName(req)
+	for _, r := range f.rules {
+		if !r.hosts.Match(host) {
+			continue
+		}
+
+		secure := req.TLS != nil || req.URL.Scheme == "https"
+		for key, value := range r.headers {
+			if key == "Strict-Transport-Security" && !secure {
+				continue
+			}
+			if _, ok := resp.Header[key]; ok && !r.override {
+				continue
+			}
+			if resp.Header == nil {
+				resp.Header = http.Header{}
+			}
+			resp.Header.Set(key, value)
+		}
+		break
+	}
+
+	return ctx, resp, nil
+}
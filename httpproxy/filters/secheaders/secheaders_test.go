@@ -0,0 +1,84 @@
+package secheaders
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"../../filters"
+)
+
+func TestResponse(t *testing.T) {
+	headers := map[string]string{
+		"strict-transport-security": "max-age=31536000",
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "DENY",
+		"Referrer-Policy":           "no-referrer",
+		"Permissions-Policy":        "camera=()",
+	}
+	f, err := NewFilter(&Config{
+		Rules: []Rule{
+			{Hosts: []string{"override.example.com"}, Headers: headers, Override: true},
+			{Hosts: []string{"*.example.com"}, Headers: headers},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewFilter error: %v", err)
+	}
+
+	cases := []struct {
+		method   string
+		url      string
+		upstream http.Header
+		want     http.Header
+	}{
+		// injects them all over https
+		{http.MethodGet, "https://www.example.com/", http.Header{}, http.Header{
+			"Strict-Transport-Security": {"max-age=31536000"},
+			"X-Content-Type-Options":    {"nosniff"},
+			"X-Frame-Options":           {"DENY"},
+			"Referrer-Policy":           {"no-referrer"},
+			"Permissions-Policy":        {"camera=()"},
+		}},
+		// keeps the ones the upstream set, HSTS not over plain http
+		{http.MethodGet, "http://www.example.com/", http.Header{
+			"X-Frame-Options": {"SAMEORIGIN"},
+			"Referrer-Policy": {"origin"},
+		}, http.Header{
+			"X-Content-Type-Options": {"nosniff"},
+			"X-Frame-Options":        {"SAMEORIGIN"},
+			"Referrer-Policy":        {"origin"},
+			"Permissions-Policy":     {"camera=()"},
+		}},
+		// Override replaces them
+		{http.MethodGet, "https://override.example.com/", http.Header{
+			"X-Frame-Options":           {"SAMEORIGIN"},
+			"Strict-Transport-Security": {"max-age=0"},
+		}, http.Header{
+			"Strict-Transport-Security": {"max-age=31536000"},
+			"X-Content-Type-Options":    {"nosniff"},
+			"X-Frame-Options":           {"DENY"},
+			"Referrer-Policy":           {"no-referrer"},
+			"Permissions-Policy":        {"camera=()"},
+		}},
+		{http.MethodGet, "https://www.example.org/", http.Header{}, http.Header{}},
+		{http.MethodConnect, "https://www.example.com:443", http.Header{}, http.Header{}},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, c.url, nil)
+		resp := filters.NewResponse(req, http.StatusOK, c.upstream, strings.NewReader(""))
+
+		_, resp, err := f.(*Filter).Response(context.Background(), resp)
+		if err != nil {
+			t.Fatalf("%T.Response(%s %s) error: %v", f, c.method, c.url, err)
+		}
+
+		for _, key := range []string{"Strict-Transport-Security", "X-Content-Type-Options", "X-Frame-Options", "Referrer-Policy", "Permissions-Policy"} {
+			if v, want := resp.Header.Get(key), c.want.Get(key); v != want {
+				t.Errorf("%T.Response(%s %s) %s = %#v, want %#v", f, c.method, c.url, key, v, want)
+			}
+		}
+	}
+}
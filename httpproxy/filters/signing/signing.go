@@ -0,0 +1,145 @@
+package signing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../helpers"
+	"../../storage"
+)
+
+const (
+	filterName string = "signing"
+)
+
+// A Signer adds authentication to an upstream request. body is the request
+// body if it was buffered, or nil if it is empty or too large to buffer.
+type Signer interface {
+	Sign(req *http.Request, body []byte, buffered bool) error
+}
+
+// ErrBodyTooLarge is returned by a Signer which needs the body and was not
+// handed it, the request is answered with a 413.
+var ErrBodyTooLarge = errors.New("signing: request body is too large to sign")
+
+// Schemes maps Rule.Scheme to a Signer constructor, other packages may add theirs.
+var Schemes = map[string]func(rule *Rule) (Signer, error){
+	"aws-sigv4": NewSigV4Signer,
+}
+
+type Rule struct {
+	Hosts           []string
+	Scheme          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Region          string
+	Service         string
+}
+
+type Config struct {
+	Rules       []Rule
+	MaxBodySize int64
+}
+
+type Filter struct {
+	Config
+	Signers *helpers.HostMatcher
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.LookupStoreByConfig(filterName).UnmarshallJson(filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	err = filters.Register(filterName, &filters.RegisteredFilter{
+		New: func() (filters.Filter, error) {
+			return NewFilter(config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	signers := make(map[string]interface{})
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+
+		newSigner, ok := Schemes[rule.Scheme]
+		if !ok {
+			return nil, fmt.Errorf("signing: unknown Scheme %#v", rule.Scheme)
+		}
+
+		signer, err := newSigner(rule)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, host := range rule.Hosts {
+			signers[host] = signer
+		}
+	}
+
+	return &Filter{
+		Config:  *config,
+		Signers: helpers.NewHostMatcherWithValue(signers),
+	}, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
+
+func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
+	if req.Method == "CONNECT" {
+		return ctx, req, nil
+	}
+
+	v, ok := f.Signers.Lookup(helpers.GetHostName(req))
+	if !ok {
+		return ctx, req, nil
+	}
+
+	var body []byte
+	buffered := true
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.ContentLength < 0 || req.ContentLength > f.MaxBodySize {
+			buffered = false
+		} else {
+			var err error
+			body, err = ioutil.ReadAll(req.Body)
+			req.Body.Close()
+			if err != nil {
+				return ctx, nil, err
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+	}
+
+	helpers.FixRequestURL(req)
+
+	if err := v.(Signer).Sign(req, body, buffered); err != nil {
+		if err == ErrBodyTooLarge {
+			glog.V(2).Infof("%s \"SIGNING %s %s %s\" %d rejected", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, req.ContentLength)
+			http.Error(filters.GetResponseWriter(ctx), "request body too large", http.StatusRequestEntityTooLarge)
+			return ctx, filters.DummyRequest, nil
+		}
+		return ctx, nil, err
+	}
+
+	glog.V(2).Infof("%s \"SIGNING %s %s %s\" with %T", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, v)
+	return ctx, req, nil
+}
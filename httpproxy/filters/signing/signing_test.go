@@ -0,0 +1,60 @@
+package signing
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"../../filters"
+)
+
+func TestRequestBodyTooLarge(t *testing.T) {
+	rule := &Rule{
+		Hosts:           []string{"example.amazonaws.com"},
+		Scheme:          "aws-sigv4",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		Region:          "us-east-1",
+		Service:         "service",
+	}
+
+	cases := []struct {
+		Service  string
+		Length   int64
+		Rejected bool
+	}{
+		{"service", 4, false},
+		{"service", 1024, true},
+		{"service", -1, true},
+		{"s3", 1024, false},
+		{"s3", -1, false},
+	}
+
+	for _, c := range cases {
+		rule.Service = c.Service
+		fi, err := NewFilter(&Config{Rules: []Rule{*rule}, MaxBodySize: 16})
+		if err != nil {
+			t.Fatalf("NewFilter(%#v) error: %v", rule, err)
+		}
+		f := fi.(*Filter)
+
+		req, _ := http.NewRequest(http.MethodPut, "https://example.amazonaws.com/", strings.NewReader("body"))
+		req.ContentLength = c.Length
+
+		rw := filters.NewTestResponseWriter(nil)
+		_, req1, err := f.Request(filters.NewTestContext(rw), req)
+		if err != nil {
+			t.Fatalf("%T.Request(%s, %d) error: %v", f, c.Service, c.Length, err)
+		}
+
+		if rejected := req1 == filters.DummyRequest; rejected != c.Rejected {
+			t.Errorf("%T.Request(%s, %d) rejected = %v, want %v", f, c.Service, c.Length, rejected, c.Rejected)
+		}
+		if c.Rejected && rw.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%T.Request(%s, %d) status = %d, want %d", f, c.Service, c.Length, rw.Code, http.StatusRequestEntityTooLarge)
+		}
+		if !c.Rejected && req1.Header.Get("Authorization") == "" {
+			t.Errorf("%T.Request(%s, %d) is not signed", f, c.Service, c.Length)
+		}
+	}
+}
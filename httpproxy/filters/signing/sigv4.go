@@ -0,0 +1,180 @@
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm       = "AWS4-HMAC-SHA256"
+	sigV4UnsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// SigV4Signer signs requests with AWS Signature Version 4.
+type SigV4Signer struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Region          string
+	Service         string
+	Now             func() time.Time
+}
+
+func NewSigV4Signer(rule *Rule) (Signer, error) {
+	if rule.AccessKeyID == "" || rule.SecretAccessKey == "" || rule.Region == "" || rule.Service == "" {
+		return nil, errors.New("signing: aws-sigv4 needs AccessKeyID, SecretAccessKey, Region and Service")
+	}
+
+	return &SigV4Signer{
+		AccessKeyID:     rule.AccessKeyID,
+		SecretAccessKey: rule.SecretAccessKey,
+		SessionToken:    rule.SessionToken,
+		Region:          rule.Region,
+		Service:         rule.Service,
+		Now:             time.Now,
+	}, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// sigV4Escape escapes s as RFC 3986 unreserved characters, which differs from
+// url.QueryEscape for ' ' and '~'.
+func sigV4Escape(s string, encodeSlash bool) string {
+	b := make([]byte, 0, len(s)*3)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b = append(b, c)
+		case c == '/' && !encodeSlash:
+			b = append(b, c)
+		default:
+			b = append(b, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+	return string(b)
+}
+
+func (s *SigV4Signer) canonicalQuery(u *url.URL) string {
+	query := u.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, sigV4Escape(key, true)+"="+sigV4Escape(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func (s *SigV4Signer) Sign(req *http.Request, body []byte, buffered bool) error {
+	now := s.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	payloadHash := sigV4UnsignedPayload
+	if buffered {
+		payloadHash = sha256Hex(body)
+	} else if s.Service != "s3" {
+		return ErrBodyTooLarge
+	}
+
+	req.Header.Del("Authorization")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+	if s.Service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	// sign the host, content and x-amz-* headers only, a proxy in the path
+	// may change the others
+	headers := map[string]string{"host": host}
+	for key, values := range req.Header {
+		key = strings.ToLower(key)
+		if key == "content-type" || key == "content-md5" || strings.HasPrefix(key, "x-amz-") {
+			trimmed := make([]string, len(values))
+			for i, v := range values {
+				trimmed[i] = strings.Join(strings.Fields(v), " ")
+			}
+			headers[key] = strings.Join(trimmed, ",")
+		}
+	}
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	canonicalHeaders := ""
+	for _, key := range keys {
+		canonicalHeaders += key + ":" + headers[key] + "\n"
+	}
+	signedHeaders := strings.Join(keys, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	// every service but s3 encodes the escaped path segments once more
+	if s.Service != "s3" {
+		path = sigV4Escape(path, false)
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		s.canonicalQuery(req.URL),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date, s.Region, s.Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, s.Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", sigV4Algorithm, s.AccessKeyID, scope, signedHeaders, signature))
+
+	return nil
+}
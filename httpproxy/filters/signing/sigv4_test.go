@@ -0,0 +1,127 @@
+package signing
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// from the AWS Signature Version 4 test suite
+func TestSigV4Signer(t *testing.T) {
+	s := &SigV4Signer{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		Region:          "us-east-1",
+		Service:         "service",
+		Now: func() time.Time {
+			return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+		},
+	}
+
+	var cases = []struct {
+		Name          string
+		Method        string
+		URL           string
+		Body          string
+		Header        http.Header
+		Authorization string
+	}{
+		{
+			"get-vanilla",
+			http.MethodGet,
+			"https://example.amazonaws.com/",
+			"",
+			nil,
+			"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			"get-vanilla-query-order-key-case",
+			http.MethodGet,
+			"https://example.amazonaws.com/?Param2=value2&Param1=value1",
+			"",
+			nil,
+			"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+		{
+			"post-vanilla",
+			http.MethodPost,
+			"https://example.amazonaws.com/",
+			"",
+			nil,
+			"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+		{
+			"get-vanilla-utf8-query",
+			http.MethodGet,
+			"https://example.amazonaws.com/?%E1%88%B4=bar",
+			"",
+			nil,
+			"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=2cdec8eed098649ff3a119c94853b13c643bcf08f8b0a1d91e12c9027818dd04",
+		},
+		// the suite encodes paths once, these sign /example%2520space/,
+		// /%25E1%2588%25B4 and /example%252Fpath/ as the SDKs do for
+		// services other than s3
+		{
+			"get-space",
+			http.MethodGet,
+			"https://example.amazonaws.com/example space/",
+			"",
+			nil,
+			"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=446b817944c553435b35e813c261ff4e161fff982d1bacdef1c87f6785dd1662",
+		},
+		{
+			"get-utf8",
+			http.MethodGet,
+			"https://example.amazonaws.com/\u1234",
+			"",
+			nil,
+			"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=697b34846207a3f72246f99d74ae1ee4fe54f44bb06730c58a0d339eb079596d",
+		},
+		{
+			"get-slash-encoded",
+			http.MethodGet,
+			"https://example.amazonaws.com/example%2Fpath/",
+			"",
+			nil,
+			"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=da64fe83197c3364aa849609d76c7e5a7772194a93088cf908cc36f5f5ab4e43",
+		},
+		// the suite signs My-Header1, only the x-amz-* headers are signed here
+		{
+			"get-header-value-order",
+			http.MethodGet,
+			"https://example.amazonaws.com/",
+			"",
+			http.Header{"X-Amz-Meta-Header1": {"value4", "value1", "value3", "value2"}},
+			"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date;x-amz-meta-header1, Signature=33c7aa4972e4e09524b2a61987e26a08c28ff4867a8c85255b1f114e383c4c59",
+		},
+		{
+			"get-header-value-trim",
+			http.MethodGet,
+			"https://example.amazonaws.com/",
+			"",
+			http.Header{"X-Amz-Meta-Header1": {" value1"}, "X-Amz-Meta-Header2": {` "a   b   c" `}},
+			"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date;x-amz-meta-header1;x-amz-meta-header2, Signature=ad23698ddebcfe557a618157ecf2c8e86739f054c261b862a0a65a75505758df",
+		},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.Method, c.URL, strings.NewReader(c.Body))
+		for key, values := range c.Header {
+			req.Header[key] = append([]string(nil), values...)
+		}
+		if err := s.Sign(req, []byte(c.Body), true); err != nil {
+			t.Fatalf("%T.Sign(%#v) error: %v", s, c.Name, err)
+		}
+
+		if v := req.Header.Get("Authorization"); v != c.Authorization {
+			t.Errorf("%T.Sign(%#v) Authorization=%#v, want %#v", s, c.Name, v, c.Authorization)
+		}
+		for key, values := range c.Header {
+			if !reflect.DeepEqual(req.Header[key], values) {
+				t.Errorf("%T.Sign(%#v) rewrites %s to %#v, want %#v", s, c.Name, key, req.Header[key], values)
+			}
+		}
+	}
+}
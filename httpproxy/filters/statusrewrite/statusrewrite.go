@@ -0,0 +1,141 @@
+package statusrewrite
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../helpers"
+	"../../storage"
+)
+
+const (
+	filterName string = "statusrewrite"
+)
+
+type Rule struct {
+	Hosts []string
+	// Status maps an upstream status code to the one sent to the client
+	Status map[string]int
+	// Body replaces the body of rewritten responses if it is set
+	Body string
+}
+
+type Config struct {
+	Rules []Rule
+}
+
+type rule struct {
+	Rule
+	hosts  *helpers.HostMatcher
+	status map[int]int
+}
+
+type Filter struct {
+	Config
+	rules []*rule
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.LookupStoreByConfig(filterName).UnmarshallJson(filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	err = filters.Register(filterName, &filters.RegisteredFilter{
+		New: func() (filters.Filter, error) {
+			return NewFilter(config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	f := &Filter{
+		Config: *config,
+	}
+
+	for _, r := range config.Rules {
+		r1 := &rule{
+			Rule:   r,
+			hosts:  helpers.NewHostMatcher(r.Hosts),
+			status: make(map[int]int),
+		}
+		for from, to := range r.Status {
+			code, err := strconv.Atoi(from)
+			if err != nil || code < 100 || code > 999 {
+				return nil, fmt.Errorf("%s: invalid status code %#v", filterName, from)
+			}
+			if to < 100 || to > 999 {
+				return nil, fmt.Errorf("%s: invalid status code %d for %s", filterName, to, from)
+			}
+			r1.status[code] = to
+		}
+		f.rules = append(f.rules, r1)
+	}
+
+	return f, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
+
+func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Context, *http.Response, error) {
+	req := resp.Request
+	if req == nil || req.Method == http.MethodConnect {
+		return ctx, resp, nil
+	}
+
+	host := helpers.GetHostName(req)
+	for _, r := range f.rules {
+		if !r.hosts.Match(host) {
+			continue
+		}
+		code, ok := r.status[resp.StatusCode]
+		if !ok {
+			continue
+		}
+
+		glog.V(2).Infof("%s \"STATUSREWRITE %s %s %s\" %d -> %d", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, resp.StatusCode, code)
+
+		resp.StatusCode = code
+		resp.Status = fmt.Sprintf("%d %s", code, http.StatusText(code))
+
+		// these statuses must not have a body
+		if code < 200 || code == http.StatusNoContent || code == http.StatusNotModified {
+			setBody(resp, "")
+		} else if r.Body != "" {
+			setBody(resp, r.Body)
+		}
+		break
+	}
+
+	return ctx, resp, nil
+}
+
+func setBody(resp *http.Response, body string) {
+	if resp.Body != nil {
+		resp.Body.Close()
+	}
+	resp.Body = ioutil.NopCloser(strings.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Del("Content-Encoding")
+	if len(body) == 0 {
+		resp.Header.Del("Content-Length")
+		resp.Header.Del("Content-Type")
+	}
+}
@@ -0,0 +1,67 @@
+package statusrewrite
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"../../filters"
+)
+
+func TestResponse(t *testing.T) {
+	f, err := NewFilter(&Config{
+		Rules: []Rule{
+			{Hosts: []string{"api.example.com"}, Status: map[string]int{"509": 429}, Body: "slow down"},
+			{Hosts: []string{"*.example.com"}, Status: map[string]int{"204": 200, "200": 204}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewFilter error: %v", err)
+	}
+
+	cases := []struct {
+		method string
+		url    string
+		status int
+		code   int
+		body   string
+	}{
+		{http.MethodGet, "http://api.example.com/", 509, http.StatusTooManyRequests, "slow down"},
+		{http.MethodGet, "http://api.example.com/", http.StatusNoContent, http.StatusOK, ""},
+		{http.MethodGet, "http://www.example.com/", http.StatusOK, http.StatusNoContent, ""},
+		{http.MethodGet, "http://www.example.com/", 509, 509, "upstream"},
+		{http.MethodGet, "http://www.example.org/", http.StatusOK, http.StatusOK, "upstream"},
+		{http.MethodConnect, "http://api.example.com:443", 509, 509, "upstream"},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, c.url, nil)
+		body := "upstream"
+		if c.status == http.StatusNoContent {
+			body = ""
+		}
+		resp := filters.NewResponse(req, c.status, http.Header{}, strings.NewReader(body))
+
+		_, resp, err := f.(*Filter).Response(context.Background(), resp)
+		if err != nil {
+			t.Fatalf("%T.Response(%s %s) error: %v", f, c.method, c.url, err)
+		}
+
+		b, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != c.code || string(b) != c.body {
+			t.Errorf("%T.Response(%s %s %d) = %d %#v, want %d %#v", f, c.method, c.url, c.status, resp.StatusCode, string(b), c.code, c.body)
+		}
+		if resp.Status != "" && !strings.HasSuffix(resp.Status, http.StatusText(resp.StatusCode)) {
+			t.Errorf("%T.Response(%s %s %d) status line %#v", f, c.method, c.url, c.status, resp.Status)
+		}
+		if resp.ContentLength != int64(len(c.body)) {
+			t.Errorf("%T.Response(%s %s %d) ContentLength = %d, want %d", f, c.method, c.url, c.status, resp.ContentLength, len(c.body))
+		}
+	}
+
+	if _, err := NewFilter(&Config{Rules: []Rule{{Status: map[string]int{"abc": 200}}}}); err == nil {
+		t.Errorf("NewFilter(Status: abc) returns no error")
+	}
+}
@@ -35,6 +35,8 @@ type Config struct {
 	Ports   []int
 	Ignores []string
 	Sites   []string
+	// HTTP2 offers h2 to clients, the profile must enable HTTP2 as well
+	HTTP2 bool
 }
 
 type Filter struct {
@@ -204,6 +206,9 @@ func (f *Filter) issue(host string) (_ *tls.Config, err error) {
 		config = &tls.Config{
 			Certificates: []tls.Certificate{*cert},
 		}
+		if f.Config.HTTP2 {
+			config.(*tls.Config).NextProtos = []string{"h2", "http/1.1"}
+		}
 		f.TLSConfigCache.Set(name, config, time.Now().Add(f.CAExpiry))
 	}
 	return config.(*tls.Config), nil
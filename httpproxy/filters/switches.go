@@ -0,0 +1,38 @@
+package filters
+
+import (
+	"sync"
+)
+
+var (
+	switchesMu sync.Mutex
+	switches   = make(map[string]bool)
+)
+
+// SetEnabled flips the runtime switch of the filter name, e.g. maintenance,
+// which the filter consults on every request. The admin API sets them.
+func SetEnabled(name string, enabled bool) {
+	switchesMu.Lock()
+	switches[name] = enabled
+	switchesMu.Unlock()
+}
+
+// Enabled reports whether the runtime switch of the filter name is on.
+func Enabled(name string) bool {
+	switchesMu.Lock()
+	defer switchesMu.Unlock()
+	return switches[name]
+}
+
+// Switches returns the names of the filters with a runtime switch and their
+// states.
+func Switches() map[string]bool {
+	switchesMu.Lock()
+	defer switchesMu.Unlock()
+
+	m := make(map[string]bool, len(switches))
+	for name, v := range switches {
+		m[name] = v
+	}
+	return m
+}
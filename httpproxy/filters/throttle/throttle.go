@@ -0,0 +1,210 @@
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../helpers"
+	"../../storage"
+)
+
+const (
+	filterName string = "throttle"
+
+	ruleKey string = "throttle.rule"
+)
+
+// Profiles are the presets of Chrome DevTools network throttling.
+var Profiles = map[string]Rule{
+	"slow-3g": {Latency: 2000, DownKbps: 400, UpKbps: 400},
+	"fast-3g": {Latency: 563, DownKbps: 1440, UpKbps: 675},
+}
+
+type Rule struct {
+	Hosts []string
+	// Paths are path prefixes, empty for all paths
+	Paths   []string
+	Profile string
+	// Latency in milliseconds before the response starts
+	Latency  int
+	DownKbps int
+	UpKbps   int
+}
+
+type Config struct {
+	Rules []Rule
+}
+
+type rule struct {
+	Rule
+	hosts   *helpers.HostMatcher
+	latency time.Duration
+}
+
+type Filter struct {
+	Config
+	rules []*rule
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.LookupStoreByConfig(filterName).UnmarshallJson(filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	err = filters.Register(filterName, &filters.RegisteredFilter{
+		New: func() (filters.Filter, error) {
+			return NewFilter(config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	f := &Filter{
+		Config: *config,
+	}
+
+	for _, r := range config.Rules {
+		if r.Profile != "" {
+			p, ok := Profiles[r.Profile]
+			if !ok {
+				return nil, fmt.Errorf("%s: unknown Profile %#v", filterName, r.Profile)
+			}
+			r.Latency, r.DownKbps, r.UpKbps = p.Latency, p.DownKbps, p.UpKbps
+		}
+
+		f.rules = append(f.rules, &rule{
+			Rule:    r,
+			hosts:   helpers.NewHostMatcher(r.Hosts),
+			latency: time.Duration(r.Latency) * time.Millisecond,
+		})
+	}
+
+	return f, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
+
+func (f *Filter) match(req *http.Request) *rule {
+	host := helpers.GetHostName(req)
+	for _, r := range f.rules {
+		if !r.hosts.Match(host) {
+			continue
+		}
+		if len(r.Paths) == 0 {
+			return r
+		}
+		for _, path := range r.Paths {
+			if strings.HasPrefix(req.URL.Path, path) {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
+	if req.Method == http.MethodConnect {
+		return ctx, req, nil
+	}
+
+	r := f.match(req)
+	if r == nil {
+		return ctx, req, nil
+	}
+
+	glog.V(2).Infof("%s \"THROTTLE %s %s %s\" latency=%s down=%dkbps up=%dkbps", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, r.latency, r.DownKbps, r.UpKbps)
+
+	if r.UpKbps > 0 && req.Body != nil && req.Body != http.NoBody {
+		req.Body = NewThrottleReadCloser(req.Body, r.UpKbps)
+	}
+
+	return context.WithValue(ctx, ruleKey, r), req, nil
+}
+
+func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Context, *http.Response, error) {
+	r, ok := ctx.Value(ruleKey).(*rule)
+	if !ok {
+		return ctx, resp, nil
+	}
+
+	if r.latency > 0 {
+		timer := time.NewTimer(r.latency)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			if resp.Body != nil {
+				resp.Body.Close()
+			}
+			return ctx, nil, ctx.Err()
+		}
+	}
+
+	if r.DownKbps > 0 && resp.Body != nil {
+		resp.Body = NewThrottleReadCloser(resp.Body, r.DownKbps)
+	}
+
+	return ctx, resp, nil
+}
+
+type throttleReadCloser struct {
+	rc    io.ReadCloser
+	rate  float64 // bytes per second
+	chunk int
+	start time.Time
+	n     int64
+}
+
+// NewThrottleReadCloser caps reading rc to kbps kilobits per second, in chunks
+// of a tenth of a second so that the stream stays smooth.
+func NewThrottleReadCloser(rc io.ReadCloser, kbps int) io.ReadCloser {
+	rate := float64(kbps) * 1000 / 8
+	chunk := int(rate / 10)
+	if chunk < 128 {
+		chunk = 128
+	}
+	return &throttleReadCloser{
+		rc:    rc,
+		rate:  rate,
+		chunk: chunk,
+	}
+}
+
+func (r *throttleReadCloser) Read(p []byte) (int, error) {
+	if r.start.IsZero() {
+		r.start = time.Now()
+	}
+	if len(p) > r.chunk {
+		p = p[:r.chunk]
+	}
+
+	n, err := r.rc.Read(p)
+	r.n += int64(n)
+
+	due := time.Duration(float64(r.n) / r.rate * float64(time.Second))
+	if d := due - time.Since(r.start); d > 0 {
+		time.Sleep(d)
+	}
+
+	return n, err
+}
+
+func (r *throttleReadCloser) Close() error {
+	return r.rc.Close()
+}
@@ -0,0 +1,108 @@
+package throttle
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"../../filters"
+)
+
+func TestThrottleReadCloser(t *testing.T) {
+	data := make([]byte, 10*1000)
+
+	start := time.Now()
+	// 400kbps is 50KB/s, so 10KB take 200ms
+	b, err := ioutil.ReadAll(NewThrottleReadCloser(ioutil.NopCloser(bytes.NewReader(data)), 400))
+	d := time.Since(start)
+
+	if err != nil || len(b) != len(data) {
+		t.Fatalf("ioutil.ReadAll() = %d bytes, %v", len(b), err)
+	}
+	if d < 190*time.Millisecond || d > 400*time.Millisecond {
+		t.Errorf("reading %d bytes at 400kbps took %s, want about 200ms", len(data), d)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	f, err := NewFilter(&Config{
+		Rules: []Rule{
+			{Hosts: []string{"dev.example.com"}, Paths: []string{"/api/"}, Latency: 100, DownKbps: 800},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewFilter error: %v", err)
+	}
+
+	for _, c := range []struct {
+		url       string
+		throttled bool
+	}{
+		{"http://dev.example.com/api/users", true},
+		{"http://dev.example.com/static/a.js", false},
+		{"http://www.example.com/api/users", false},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, c.url, nil)
+		ctx, req, _ := f.(*Filter).Request(context.Background(), req)
+
+		start := time.Now()
+		resp := filters.NewResponse(req, http.StatusOK, nil, bytes.NewReader(make([]byte, 10*1000)))
+		_, resp, err := f.(*Filter).Response(ctx, resp)
+		if err != nil {
+			t.Fatalf("%T.Response(%#v) error: %v", f, c.url, err)
+		}
+		latency := time.Since(start)
+		ioutil.ReadAll(resp.Body)
+		total := time.Since(start)
+
+		// 100ms latency, then 10KB at 100KB/s
+		switch {
+		case c.throttled && (latency < 100*time.Millisecond || total < 190*time.Millisecond):
+			t.Errorf("%#v throttled with latency %s and total %s, want 100ms and 200ms", c.url, latency, total)
+		case !c.throttled && total > 50*time.Millisecond:
+			t.Errorf("%#v throttled, took %s", c.url, total)
+		}
+	}
+
+	if _, err := NewFilter(&Config{Rules: []Rule{{Profile: "dialup"}}}); err == nil {
+		t.Errorf("NewFilter() with an unknown Profile returns no error")
+	}
+}
+
+type closeRecorder struct {
+	*bytes.Reader
+	closed bool
+}
+
+func (r *closeRecorder) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestFilterResponseCanceled(t *testing.T) {
+	f, err := NewFilter(&Config{
+		Rules: []Rule{
+			{Hosts: []string{"dev.example.com"}, Latency: 1000},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewFilter error: %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://dev.example.com/", nil)
+	ctx, req, _ := f.(*Filter).Request(context.Background(), req)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+
+	body := &closeRecorder{Reader: bytes.NewReader([]byte("body"))}
+	resp := &http.Response{StatusCode: http.StatusOK, Request: req, Body: body}
+	if _, _, err := f.(*Filter).Response(ctx, resp); err != context.DeadlineExceeded {
+		t.Errorf("%T.Response() canceled error = %v, want %v", f, err, context.DeadlineExceeded)
+	}
+	if !body.closed {
+		t.Errorf("%T.Response() canceled leaves the response body open", f)
+	}
+}
@@ -0,0 +1,209 @@
+package transcode
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../helpers"
+	"../../storage"
+)
+
+const (
+	filterName string = "transcode"
+)
+
+// Encoders maps a Content-Encoding to a compressor writing it, "gzip" is
+// built in. Builds with a brotli package add "br".
+var Encoders = map[string]func(w io.Writer, level int) (io.WriteCloser, error){
+	"gzip": func(w io.Writer, level int) (io.WriteCloser, error) {
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	},
+}
+
+type Config struct {
+	// Hosts opts sites in, transcoding costs cpu for every response
+	Hosts []string
+	// ContentTypes are the media type prefixes worth compressing
+	ContentTypes []string
+	// MinSize skips responses with a smaller Content-Length
+	MinSize int64
+	// Encodings lists the encodings to send, the most preferred first
+	Encodings []string
+	Level     int
+}
+
+type Filter struct {
+	Config
+	hosts *helpers.HostMatcher
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.LookupStoreByConfig(filterName).UnmarshallJson(filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	err = filters.Register(filterName, &filters.RegisteredFilter{
+		New: func() (filters.Filter, error) {
+			return NewFilter(config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	f := &Filter{
+		Config: *config,
+		hosts:  helpers.NewHostMatcher(config.Hosts),
+	}
+
+	for _, name := range config.Encodings {
+		if _, ok := Encoders[name]; !ok {
+			glog.V(2).Infof("%s: encoding %#v is not built in, skips it", filterName, name)
+		}
+	}
+
+	return f, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
+
+func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Context, *http.Response, error) {
+	req := resp.Request
+	if req == nil || req.Method != http.MethodGet || resp.StatusCode != http.StatusOK {
+		return ctx, resp, nil
+	}
+	if len(f.Hosts) == 0 || !f.hosts.Match(helpers.GetHostName(req)) {
+		return ctx, resp, nil
+	}
+	if resp.Header.Get("Content-Range") != "" || strings.Contains(strings.ToLower(resp.Header.Get("Cache-Control")), "no-transform") {
+		return ctx, resp, nil
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < f.MinSize {
+		return ctx, resp, nil
+	}
+	if !f.compressible(resp.Header.Get("Content-Type")) {
+		return ctx, resp, nil
+	}
+
+	// other encodings than gzip may well be better already
+	from := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if from != "" && from != "identity" && from != "gzip" {
+		return ctx, resp, nil
+	}
+
+	to := f.encoding(req.Header.Get("Accept-Encoding"))
+	if to == "" || to == from {
+		return ctx, resp, nil
+	}
+
+	glog.V(2).Infof("%s \"TRANSCODE %s %s %s\" %#v -> %#v", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, from, to)
+
+	resp.Body = transcode(resp.Body, from == "gzip", Encoders[to], f.Level)
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Content-MD5")
+	resp.Header.Set("Content-Encoding", to)
+	resp.Header.Add("Vary", "Accept-Encoding")
+	if etag := resp.Header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("Etag", "W/"+etag)
+	}
+
+	return ctx, resp, nil
+}
+
+func (f *Filter) compressible(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, prefix := range f.ContentTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// encoding returns the first of Encodings built in and accepted by
+// acceptEncoding, "" if there is none.
+func (f *Filter) encoding(acceptEncoding string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		name, q := part, 1.0
+		if i := strings.IndexByte(part, ';'); i >= 0 {
+			name = strings.TrimSpace(part[:i])
+			if params := strings.TrimSpace(part[i+1:]); strings.HasPrefix(params, "q=") {
+				if v, err := strconv.ParseFloat(params[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		accepted[strings.ToLower(name)] = q > 0
+	}
+
+	for _, name := range f.Encodings {
+		if _, ok := Encoders[name]; ok && accepted[name] {
+			return name
+		}
+	}
+	return ""
+}
+
+// transcode streams rc decompressed if gzipped, and compressed with encoder.
+func transcode(rc io.ReadCloser, gzipped bool, encoder func(io.Writer, int) (io.WriteCloser, error), level int) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		var r io.Reader = rc
+		if gzipped {
+			gr, err := gzip.NewReader(rc)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			r = gr
+		}
+
+		w, err := encoder(pw, level)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(w.Close())
+	}()
+
+	return &transcodeReadCloser{pr, rc}
+}
+
+type transcodeReadCloser struct {
+	*io.PipeReader
+	rc io.ReadCloser
+}
+
+// Close stops the transcoding, and the upstream body with it.
+func (r *transcodeReadCloser) Close() error {
+	r.PipeReader.Close()
+	return r.rc.Close()
+}
@@ -0,0 +1,116 @@
+package transcode
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"../../filters"
+)
+
+var testBody = strings.Repeat("hello world, ", 200)
+
+func gzipped(s string) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	io.WriteString(w, s)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestResponse(t *testing.T) {
+	// stands in for brotli, which is not built in
+	Encoders["x-flate"] = func(w io.Writer, level int) (io.WriteCloser, error) {
+		return flate.NewWriter(w, flate.BestCompression)
+	}
+	defer delete(Encoders, "x-flate")
+
+	f1, err := NewFilter(&Config{
+		Hosts:        []string{"*.example.com"},
+		ContentTypes: []string{"text/"},
+		MinSize:      1024,
+		Encodings:    []string{"x-flate", "gzip"},
+	})
+	if err != nil {
+		t.Fatalf("NewFilter error: %v", err)
+	}
+	f := f1.(*Filter)
+
+	cases := []struct {
+		url            string
+		acceptEncoding string
+		contentType    string
+		from           string
+		length         int
+		to             string
+	}{
+		{"http://www.example.com/", "gzip, x-flate", "text/html", "gzip", -1, "x-flate"},
+		{"http://www.example.com/", "gzip", "text/html", "", -1, "gzip"},
+		{"http://www.example.com/", "gzip, x-flate;q=0", "text/plain", "", len(testBody), "gzip"},
+		// already gzip, or better than anything built in
+		{"http://www.example.com/", "gzip", "text/html", "gzip", -1, "gzip"},
+		{"http://www.example.com/", "br, gzip, x-flate", "text/html", "br", -1, "br"},
+		{"http://www.example.com/", "", "text/html", "", -1, ""},
+		{"http://www.example.com/", "gzip", "image/png", "", -1, ""},
+		{"http://www.example.com/", "gzip", "text/html", "", 100, ""},
+		{"http://www.example.org/", "gzip", "text/html", "", -1, ""},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(http.MethodGet, c.url, nil)
+		if c.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", c.acceptEncoding)
+		}
+
+		body := []byte(testBody)
+		if c.from == "gzip" {
+			body = gzipped(testBody)
+		}
+		header := http.Header{"Content-Type": {c.contentType}, "Etag": {`"v1"`}}
+		if c.from != "" {
+			header.Set("Content-Encoding", c.from)
+		}
+		resp := filters.NewResponse(req, http.StatusOK, header, bytes.NewReader(body))
+		resp.ContentLength = int64(c.length)
+
+		_, resp, err := f.Response(context.Background(), resp)
+		if err != nil {
+			t.Fatalf("%T.Response() error: %v", f, err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%T.Response(%#v) body error: %v", f, c, err)
+		}
+
+		to := resp.Header.Get("Content-Encoding")
+		if to != c.to {
+			t.Errorf("%T.Response(%#v) sends Content-Encoding %#v, want %#v", f, c, to, c.to)
+			continue
+		}
+
+		var r io.Reader = bytes.NewReader(b)
+		switch to {
+		case "gzip":
+			r, _ = gzip.NewReader(r)
+		case "x-flate":
+			r = flate.NewReader(r)
+		case "br":
+			// passed through as is
+			continue
+		}
+		if b, err := ioutil.ReadAll(r); err != nil || string(b) != testBody {
+			t.Errorf("%T.Response(%#v) body decodes to %d bytes, %v", f, c, len(b), err)
+		}
+
+		if to != c.from && (resp.ContentLength != -1 || resp.Header.Get("Vary") != "Accept-Encoding" || resp.Header.Get("Etag") != `W/"v1"`) {
+			t.Errorf("%T.Response(%#v) transcodes with length %d, header %v", f, c, resp.ContentLength, resp.Header)
+		}
+	}
+}
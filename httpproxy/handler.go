@@ -1,6 +1,7 @@
 package httpproxy
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"io"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"runtime"
 	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/phuslu/glog"
@@ -22,6 +24,10 @@ type Handler struct {
 	RequestFilters   []filters.RequestFilter
 	RoundTripFilters []filters.RoundTripFilter
 	ResponseFilters  []filters.ResponseFilter
+	Queue            *helpers.FairQueue
+	ClientConns      *filters.ClientConns
+	ErrorDelay       *filters.ErrorDelay
+	AmbiguousFraming string
 }
 
 func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
@@ -29,10 +35,44 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 
 	remoteAddr := req.RemoteAddr
 
+	var slot *queueSlot
+	if h.Queue != nil {
+		slot = &queueSlot{queue: h.Queue, key: remoteAddr}
+		if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+			slot.key = host
+		}
+		// a hijacked conn, e.g. a CONNECT tunnel, gives its slot back
+		if hijacker, ok := rw.(http.Hijacker); ok {
+			rw = &hijackWriter{rw, hijacker, slot}
+		}
+	}
+
 	// Prepare filter.Context
 	ctx := filters.NewContext(req.Context(), h, h.Listener, rw)
+	if req.TLS != nil {
+		ctx = filters.WithTLSState(ctx, req.TLS)
+	}
+	// unix socket clients all have the same address
+	if h.ClientConns != nil && remoteAddr != helpers.UnixRemoteAddr {
+		ctx = filters.WithClientConn(ctx, h.ClientConns.Get(remoteAddr))
+	}
+	if h.ErrorDelay != nil {
+		ctx = filters.WithErrorDelay(ctx, h.ErrorDelay)
+		// runs after the queue slot is released, the rejection of an abuser
+		// does not hold it
+		defer filters.DelayRejection(ctx)
+	}
 	req = req.WithContext(ctx)
 
+	// Wait for an inflight slot, shared fairly between client ips
+	if slot != nil {
+		if err := h.Queue.Acquire(ctx, slot.key); err != nil {
+			http.Error(rw, fmtError(ctx, err), http.StatusServiceUnavailable)
+			return
+		}
+		defer slot.release()
+	}
+
 	// Enable transport http proxy
 	if req.Method != "CONNECT" && !req.URL.IsAbs() {
 		if req.URL.Scheme == "" {
@@ -61,6 +101,13 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	// Proxy-Connection is for this hop only
+	helpers.ProxyConnection(rw, req)
+
+	if !helpers.AmbiguousFraming(rw, req, h.AmbiguousFraming) {
+		return
+	}
+
 	// Filter Request
 	for _, f := range h.RequestFilters {
 		ctx, req, err = f.Request(ctx, req)
@@ -112,7 +159,7 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		}
 		ctx, resp, err = f.Response(ctx, resp)
 		if err != nil {
-			glog.Errorln("%s Filter %T Response error: %+v", remoteAddr, f, err)
+			glog.Errorf("%s Filter %T Response error: %+v", remoteAddr, f, err)
 			http.Error(rw, fmtError(ctx, err), http.StatusBadGateway)
 			return
 		}
@@ -121,7 +168,7 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	if resp == nil {
-		glog.Errorln("%s Handler %#v Response empty response", remoteAddr, h)
+		glog.Errorf("%s Handler %#v Response empty response", remoteAddr, h)
 		http.Error(rw, fmtError(ctx, fmt.Errorf("empty response")), http.StatusBadGateway)
 		return
 	}
@@ -131,20 +178,95 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 			rw.Header().Add(key, value)
 		}
 	}
+	// announce trailers, e.g. grpc-status, their values are known after the body
+	for key := range resp.Trailer {
+		rw.Header().Add("Trailer", key)
+	}
 	rw.WriteHeader(resp.StatusCode)
 	if resp.Body != nil {
 		defer resp.Body.Close()
-		n, err := helpers.IoCopy(rw, resp.Body)
+		var w io.Writer = rw
+		if isStreaming(resp) {
+			if flusher, ok := rw.(http.Flusher); ok {
+				w = &flushWriter{rw, flusher}
+			}
+		}
+		n, err := helpers.IoCopy(w, resp.Body)
 		if err != nil {
 			if isClosedConnError(err) {
 				glog.Infof("IoCopy %#v return %#v %T(%v)", resp.Body, n, err, err)
 			} else {
 				glog.Warningf("IoCopy %#v return %#v %T(%v)", resp.Body, n, err, err)
 			}
+			if err == helpers.ErrDigestMismatch || err == helpers.ErrBodyTooLarge {
+				// drop the connection, so the client does not take the body as complete
+				if hijacker, ok := rw.(http.Hijacker); ok {
+					if conn, _, err := hijacker.Hijack(); err == nil {
+						conn.Close()
+					}
+				}
+			}
+		}
+		for key, values := range resp.Trailer {
+			rw.Header()[key] = values
 		}
 	}
 }
 
+// isStreaming reports whether every chunk of resp must reach the client at
+// once, as gRPC messages and server-sent events do.
+func isStreaming(resp *http.Response) bool {
+	if resp.ContentLength >= 0 {
+		return false
+	}
+	ct := resp.Header.Get("Content-Type")
+	return strings.HasPrefix(ct, "application/grpc") || strings.HasPrefix(ct, "text/event-stream")
+}
+
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (fw *flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	fw.f.Flush()
+	return n, err
+}
+
+// queueSlot is the FairQueue slot of a request, released once.
+type queueSlot struct {
+	queue *helpers.FairQueue
+	key   string
+	once  sync.Once
+}
+
+func (s *queueSlot) release() {
+	s.once.Do(func() { s.queue.Release(s.key) })
+}
+
+// hijackWriter releases the queue slot of a request once its conn is
+// hijacked, the tunnel on it may outlive any request.
+type hijackWriter struct {
+	http.ResponseWriter
+	hijacker http.Hijacker
+	slot     *queueSlot
+}
+
+func (w *hijackWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := w.hijacker.Hijack()
+	if err == nil {
+		w.slot.release()
+	}
+	return conn, brw, err
+}
+
 func fmtError(ctx context.Context, err error) string {
 	return fmt.Sprintf(`{
     "type": "localproxy",
@@ -0,0 +1,254 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"./filters"
+	"./helpers"
+)
+
+type requestFilter func(context.Context, *http.Request) (context.Context, *http.Request, error)
+
+func (f requestFilter) FilterName() string { return "request" }
+
+func (f requestFilter) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
+	return f(ctx, req)
+}
+
+type roundTripFilter func(context.Context, *http.Request) (context.Context, *http.Response, error)
+
+func (f roundTripFilter) FilterName() string { return "roundtrip" }
+
+func (f roundTripFilter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	return f(ctx, req)
+}
+
+func okFilter(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	return ctx, filters.NewResponse(req, http.StatusOK, nil, strings.NewReader("ok")), nil
+}
+
+func TestHandlerQueueReleasesHijacked(t *testing.T) {
+	tunnel := make(chan struct{})
+	defer close(tunnel)
+
+	h := Handler{
+		Queue: helpers.NewFairQueue(1, 1, nil),
+		RoundTripFilters: []filters.RoundTripFilter{roundTripFilter(func(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+			if req.Method != http.MethodConnect {
+				return okFilter(ctx, req)
+			}
+			conn, _, err := filters.GetResponseWriter(ctx).(http.Hijacker).Hijack()
+			if err != nil {
+				return ctx, nil, err
+			}
+			defer conn.Close()
+			io.WriteString(conn, "HTTP/1.1 200 OK\r\n\r\n")
+			<-tunnel
+			return ctx, filters.DummyResponse, nil
+		})},
+	}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(%#v) error: %v", ts.Listener.Addr().String(), err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "CONNECT example.org:443 HTTP/1.1\r\nHost: example.org:443\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT through %T = %v, %v", h, resp, err)
+	}
+
+	// the tunnel is still open, the only slot is free for the next client
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err = client.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatalf("GET beside a CONNECT tunnel error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET beside a CONNECT tunnel = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestHandlerErrorDelay(t *testing.T) {
+	const delay = 200 * time.Millisecond
+
+	h := Handler{
+		Queue:      helpers.NewFairQueue(1, 1, nil),
+		ErrorDelay: &filters.ErrorDelay{Delay: delay},
+		RequestFilters: []filters.RequestFilter{requestFilter(func(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
+			if req.URL.Path != "/forbidden" {
+				return ctx, req, nil
+			}
+			filters.MarkRejection(ctx, http.StatusForbidden)
+			http.Error(filters.GetResponseWriter(ctx), "forbidden", http.StatusForbidden)
+			return ctx, filters.DummyRequest, nil
+		})},
+		RoundTripFilters: []filters.RoundTripFilter{roundTripFilter(okFilter)},
+	}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	rejected := make(chan time.Duration, 1)
+	go func() {
+		start := time.Now()
+		resp, err := http.Get(ts.URL + "/forbidden")
+		if err != nil {
+			t.Errorf("GET /forbidden error: %v", err)
+		} else {
+			resp.Body.Close()
+		}
+		rejected <- time.Since(start)
+	}()
+
+	// the rejection waits out its delay without the slot
+	time.Sleep(delay / 4)
+	start := time.Now()
+	resp, err := http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatalf("GET / error: %v", err)
+	}
+	resp.Body.Close()
+	if d := time.Since(start); d >= delay/2 {
+		t.Errorf("GET / beside a delayed rejection took %v, want it served at once", d)
+	}
+
+	if d := <-rejected; d < delay {
+		t.Errorf("GET /forbidden took %v, want at least the %v ErrorDelay", d, delay)
+	}
+}
+
+func TestHandlerProxyConnection(t *testing.T) {
+	var forwarded http.Header
+	h := Handler{
+		RoundTripFilters: []filters.RoundTripFilter{roundTripFilter(func(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+			forwarded = req.Header
+			return okFilter(ctx, req)
+		})},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.org/", nil)
+	req.Header.Set("Proxy-Connection", "close")
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if v := forwarded.Get("Proxy-Connection"); v != "" {
+		t.Errorf("%T.ServeHTTP forwards Proxy-Connection: %#v", h, v)
+	}
+	if v := rw.Header().Get("Connection"); v != "close" {
+		t.Errorf("%T.ServeHTTP answers Connection %#v to Proxy-Connection: close, want \"close\"", h, v)
+	}
+}
+
+func TestHandlerAmbiguousFraming(t *testing.T) {
+	for _, c := range []struct {
+		Mode   string
+		Status int
+	}{
+		{helpers.AmbiguousFramingReject, http.StatusBadRequest},
+		{helpers.AmbiguousFramingStrip, http.StatusOK},
+	} {
+		var length int64
+		h := Handler{
+			AmbiguousFraming: c.Mode,
+			RoundTripFilters: []filters.RoundTripFilter{roundTripFilter(func(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+				length = req.ContentLength
+				return okFilter(ctx, req)
+			})},
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "http://example.org/", strings.NewReader("body"))
+		req.Header.Set("Content-Length", "4")
+		req.Header.Set("Transfer-Encoding", "chunked")
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+
+		if rw.Code != c.Status {
+			t.Errorf("%T.ServeHTTP(%#v) of an ambiguous request = %d, want %d", h, c.Mode, rw.Code, c.Status)
+		}
+		if c.Status == http.StatusOK && length != -1 {
+			t.Errorf("%T.ServeHTTP(%#v) forwards ContentLength %d, want -1", h, c.Mode, length)
+		}
+	}
+}
+
+// trailerBody sets the trailers of its response at EOF, as the body of an
+// upstream response does.
+type trailerBody struct {
+	io.ReadCloser
+	trailer http.Header
+}
+
+func (b *trailerBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.trailer.Set("Grpc-Status", "0")
+	}
+	return n, err
+}
+
+func TestHandlerStreamingTrailers(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	h := Handler{
+		RoundTripFilters: []filters.RoundTripFilter{roundTripFilter(func(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+			trailer := http.Header{"Grpc-Status": nil}
+			resp := &http.Response{
+				StatusCode:    http.StatusOK,
+				Header:        http.Header{"Content-Type": {"application/grpc"}},
+				Trailer:       trailer,
+				Request:       req,
+				ContentLength: -1,
+				Body:          &trailerBody{pr, trailer},
+			}
+			return ctx, resp, nil
+		})},
+	}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	// the first message arrives before the body ends
+	go io.WriteString(pw, "message")
+	got, trailer := make(chan string, 1), make(chan string, 1)
+	go func() {
+		resp, err := http.Get(ts.URL + "/")
+		if err != nil {
+			t.Errorf("GET / error: %v", err)
+			close(got)
+			close(trailer)
+			return
+		}
+		b := make([]byte, len("message"))
+		io.ReadFull(resp.Body, b)
+		got <- string(b)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		trailer <- resp.Trailer.Get("Grpc-Status")
+	}()
+	select {
+	case s := <-got:
+		if s != "message" {
+			t.Errorf("%T.ServeHTTP streams %#v, want \"message\"", h, s)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%T.ServeHTTP holds back the messages of a streaming body", h)
+	}
+
+	pw.Close()
+	if v := <-trailer; v != "0" {
+		t.Errorf("%T.ServeHTTP sends the Grpc-Status trailer %#v, want \"0\"", h, v)
+	}
+}
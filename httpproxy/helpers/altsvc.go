@@ -0,0 +1,265 @@
+package helpers
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+const (
+	DefaultAltSvcMaxAge    time.Duration = 24 * time.Hour
+	DefaultAltSvcCacheSize uint          = 1024
+)
+
+// AltSvc is the process wide cache of alternative services learned from
+// upstream responses, listed by the admin filter.
+var AltSvc = NewAltSvcCache(DefaultAltSvcCacheSize)
+
+// AltService is one alternative of an Alt-Svc header, e.g. h2=":8443".
+type AltService struct {
+	Protocol string
+	Host     string
+	Port     string
+	MaxAge   time.Duration
+	Persist  bool
+}
+
+// Addr returns the address to dial for origin "host:port", Host is empty
+// when the alternative is on the origin host.
+func (a AltService) Addr(origin string) string {
+	host := a.Host
+	if host == "" {
+		host, _, _ = net.SplitHostPort(origin)
+	}
+	return net.JoinHostPort(host, a.Port)
+}
+
+// altSvcSplit splits a header value on sep outside of quoted strings.
+func altSvcSplit(s string, sep byte) []string {
+	var parts []string
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case escaped:
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func altSvcUnquote(s string) (string, error) {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 1; i < len(s)-1; i++ {
+		if s[i] == '\\' {
+			i++
+			if i == len(s)-1 {
+				return "", fmt.Errorf("bad quoted-string %s", s)
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String(), nil
+}
+
+// ParseAltSvc parses an Alt-Svc header value of RFC 7838, clear is true for
+// "Alt-Svc: clear".
+func ParseAltSvc(v string) (alts []AltService, clear bool, err error) {
+	v = strings.TrimSpace(v)
+	if v == "clear" {
+		return nil, true, nil
+	}
+
+	for _, value := range altSvcSplit(v, ',') {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+
+		params := altSvcSplit(value, ';')
+
+		kv := strings.SplitN(strings.TrimSpace(params[0]), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, false, fmt.Errorf("bad alternative %#v", params[0])
+		}
+
+		var a AltService
+		if a.Protocol, err = url.PathUnescape(kv[0]); err != nil {
+			return nil, false, fmt.Errorf("bad protocol-id %#v: %v", kv[0], err)
+		}
+
+		authority, err := altSvcUnquote(kv[1])
+		if err != nil {
+			return nil, false, err
+		}
+		if a.Host, a.Port, err = net.SplitHostPort(authority); err != nil {
+			return nil, false, fmt.Errorf("bad alt-authority %#v: %v", authority, err)
+		}
+		if n, err := strconv.Atoi(a.Port); err != nil || n <= 0 || n > 65535 {
+			return nil, false, fmt.Errorf("bad alt-authority port %#v", a.Port)
+		}
+
+		a.MaxAge = DefaultAltSvcMaxAge
+		for _, p := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			value, err := altSvcUnquote(kv[1])
+			if err != nil {
+				return nil, false, err
+			}
+			switch strings.ToLower(kv[0]) {
+			case "ma":
+				n, err := strconv.ParseUint(value, 10, 32)
+				if err != nil {
+					return nil, false, fmt.Errorf("bad ma %#v", value)
+				}
+				a.MaxAge = time.Duration(n) * time.Second
+			case "persist":
+				a.Persist = value == "1"
+			}
+		}
+
+		alts = append(alts, a)
+	}
+
+	return alts, false, nil
+}
+
+type AltSvcEntry struct {
+	AltService
+	Expires time.Time
+}
+
+// AltSvcCache keeps the alternatives each origin "host:port" advertised.
+type AltSvcCache struct {
+	mu      sync.Mutex
+	cache   lrucache.Cache
+	size    uint
+	origins map[string]struct{}
+}
+
+func NewAltSvcCache(size uint) *AltSvcCache {
+	return &AltSvcCache{
+		cache:   lrucache.NewLRUCache(size),
+		size:    size,
+		origins: make(map[string]struct{}),
+	}
+}
+
+// Observe updates the alternatives of origin from an Alt-Svc header value.
+func (c *AltSvcCache) Observe(origin, header string) error {
+	if header == "" {
+		return nil
+	}
+
+	alts, clear, err := ParseAltSvc(header)
+	if err != nil {
+		return err
+	}
+	if clear {
+		c.Forget(origin)
+		return nil
+	}
+
+	now := time.Now()
+	entries := make([]AltSvcEntry, 0, len(alts))
+	var expires time.Time
+	for _, a := range alts {
+		if a.MaxAge <= 0 {
+			continue
+		}
+		e := AltSvcEntry{a, now.Add(a.MaxAge)}
+		if e.Expires.After(expires) {
+			expires = e.Expires
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) == 0 {
+		c.Forget(origin)
+		return nil
+	}
+
+	c.mu.Lock()
+	c.cache.Set(origin, entries, expires)
+	c.origins[origin] = struct{}{}
+	if uint(len(c.origins)) > 2*c.size {
+		for o := range c.origins {
+			if _, ok := c.cache.GetQuiet(o); !ok {
+				delete(c.origins, o)
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	return nil
+}
+
+// Lookup returns the first unexpired alternative of origin speaking one of
+// protocols.
+func (c *AltSvcCache) Lookup(origin string, protocols ...string) (AltSvcEntry, bool) {
+	v, ok := c.cache.Get(origin)
+	if !ok {
+		return AltSvcEntry{}, false
+	}
+
+	now := time.Now()
+	for _, e := range v.([]AltSvcEntry) {
+		if e.Expires.Before(now) {
+			continue
+		}
+		for _, p := range protocols {
+			if e.Protocol == p {
+				return e, true
+			}
+		}
+	}
+	return AltSvcEntry{}, false
+}
+
+func (c *AltSvcCache) Forget(origin string) {
+	c.mu.Lock()
+	c.cache.Del(origin)
+	delete(c.origins, origin)
+	c.mu.Unlock()
+}
+
+// Stats returns the unexpired alternatives by origin.
+func (c *AltSvcCache) Stats() map[string][]AltSvcEntry {
+	c.mu.Lock()
+	origins := make([]string, 0, len(c.origins))
+	for o := range c.origins {
+		origins = append(origins, o)
+	}
+	c.mu.Unlock()
+
+	now := time.Now()
+	stats := make(map[string][]AltSvcEntry)
+	for _, o := range origins {
+		v, ok := c.cache.GetQuiet(o)
+		if !ok {
+			continue
+		}
+		for _, e := range v.([]AltSvcEntry) {
+			if e.Expires.After(now) {
+				stats[o] = append(stats[o], e)
+			}
+		}
+	}
+	return stats
+}
@@ -0,0 +1,66 @@
+package helpers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseAltSvc(t *testing.T) {
+	var cases = []struct {
+		value string
+		alts  []AltService
+		clear bool
+		err   bool
+	}{
+		{`h3=":443"; ma=3600`, []AltService{{"h3", "", "443", time.Hour, false}}, false, false},
+		{`h3-29=":443", h2="alt.example.org:8443"; persist=1`, []AltService{
+			{"h3-29", "", "443", DefaultAltSvcMaxAge, false},
+			{"h2", "alt.example.org", "8443", DefaultAltSvcMaxAge, true},
+		}, false, false},
+		{`http%2F1.1="[2001:db8::1]:8080"; ma="60"`, []AltService{{"http/1.1", "2001:db8::1", "8080", time.Minute, false}}, false, false},
+		{`h2=":443"; ma=0`, []AltService{{"h2", "", "443", 0, false}}, false, false},
+		{` clear `, nil, true, false},
+		{`h2=":1,2"`, nil, false, true},
+		{`h2`, nil, false, true},
+		{`h2="example.org"`, nil, false, true},
+		{`h2=":443"; ma=forever`, nil, false, true},
+	}
+
+	for _, c := range cases {
+		alts, clear, err := ParseAltSvc(c.value)
+		if (err != nil) != c.err {
+			t.Errorf("ParseAltSvc(%#v) error = %v, want error %v", c.value, err, c.err)
+			continue
+		}
+		if !reflect.DeepEqual(alts, c.alts) || clear != c.clear {
+			t.Errorf("ParseAltSvc(%#v) = %v, %v, want %v, %v", c.value, alts, clear, c.alts, c.clear)
+		}
+	}
+}
+
+func TestAltSvcCache(t *testing.T) {
+	c := NewAltSvcCache(16)
+
+	c.Observe("example.org:443", `h3=":443"; ma=60, h2="alt.example.org:8443"`)
+	if e, ok := c.Lookup("example.org:443", "h2"); !ok || e.Addr("example.org:443") != "alt.example.org:8443" {
+		t.Errorf("AltSvcCache.Lookup(h2) = %v, %v, want alt.example.org:8443", e, ok)
+	}
+	if e, ok := c.Lookup("example.org:443", "h3"); !ok || e.Addr("example.org:443") != "example.org:443" {
+		t.Errorf("AltSvcCache.Lookup(h3) = %v, %v, want example.org:443", e, ok)
+	}
+	if _, ok := c.Lookup("example.org:443", "http/1.1"); ok {
+		t.Errorf("AltSvcCache.Lookup(http/1.1) found an alternative never advertised")
+	}
+	if stats := c.Stats(); len(stats["example.org:443"]) != 2 {
+		t.Errorf("AltSvcCache.Stats() = %v, want 2 alternatives of example.org:443", stats)
+	}
+
+	c.Observe("example.org:443", "clear")
+	if _, ok := c.Lookup("example.org:443", "h2", "h3"); ok {
+		t.Errorf("AltSvcCache.Lookup() after clear found an alternative")
+	}
+	if stats := c.Stats(); len(stats) != 0 {
+		t.Errorf("AltSvcCache.Stats() after clear = %v, want none", stats)
+	}
+}
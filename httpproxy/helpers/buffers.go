@@ -0,0 +1,98 @@
+package helpers
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Buffers is the process wide budget of body buffering features, like the
+// abtest tee, cache and deadletter captures. Unlimited until SetMax.
+var Buffers = &BufferBudget{
+	inuse:  Metrics.Gauge("buffer_memory_bytes", "Bytes held by body buffers."),
+	denied: Metrics.Counter("buffer_memory_denied_total", "Body buffers degraded by MaxBufferMemory."),
+}
+
+// BufferBudget caps the bytes held by body buffers at once, a buffer which
+// cannot grow within it should degrade, e.g. stream through without a copy.
+type BufferBudget struct {
+	max    int64
+	used   int64
+	inuse  *Gauge
+	denied *Counter
+}
+
+func NewBufferBudget(max int64) *BufferBudget {
+	return &BufferBudget{
+		max:    max,
+		inuse:  new(Gauge),
+		denied: new(Counter),
+	}
+}
+
+// SetMax sets the budget, 0 for unlimited.
+func (b *BufferBudget) SetMax(max int64) {
+	atomic.StoreInt64(&b.max, max)
+}
+
+func (b *BufferBudget) InUse() int64 {
+	return atomic.LoadInt64(&b.used)
+}
+
+// Acquire takes n bytes of the budget, it reports false and takes nothing if
+// that would exceed it.
+func (b *BufferBudget) Acquire(n int64) bool {
+	for {
+		used := atomic.LoadInt64(&b.used)
+		if max := atomic.LoadInt64(&b.max); max > 0 && used+n > max {
+			b.denied.Add(1)
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.used, used, used+n) {
+			b.inuse.Add(n)
+			return true
+		}
+	}
+}
+
+func (b *BufferBudget) Release(n int64) {
+	atomic.AddInt64(&b.used, -n)
+	b.inuse.Add(-n)
+}
+
+// Reserve returns an empty reservation of one buffer.
+func (b *BufferBudget) Reserve() *BufferReservation {
+	return &BufferReservation{budget: b}
+}
+
+// BufferReservation is what one buffer holds of a BufferBudget.
+type BufferReservation struct {
+	mu     sync.Mutex
+	budget *BufferBudget
+	n      int64
+	done   bool
+}
+
+// Grow takes n more bytes, false if the budget is exhausted or the
+// reservation was released.
+func (r *BufferReservation) Grow(n int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.done || !r.budget.Acquire(n) {
+		return false
+	}
+	r.n += n
+	return true
+}
+
+// Release gives everything back, it may be called more than once.
+func (r *BufferReservation) Release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.done {
+		r.done = true
+		r.budget.Release(r.n)
+		r.n = 0
+	}
+}
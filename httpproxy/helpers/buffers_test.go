@@ -0,0 +1,40 @@
+package helpers
+
+import (
+	"testing"
+)
+
+func TestBufferBudget(t *testing.T) {
+	b := NewBufferBudget(100)
+
+	r1 := b.Reserve()
+	if !r1.Grow(60) {
+		t.Fatalf("BufferReservation.Grow(60) of 100 return false")
+	}
+
+	r2 := b.Reserve()
+	if r2.Grow(50) {
+		t.Errorf("BufferReservation.Grow(50) beyond the budget return true")
+	}
+	if !r2.Grow(40) {
+		t.Errorf("BufferReservation.Grow(40) within the budget return false")
+	}
+	if v := b.InUse(); v != 100 {
+		t.Errorf("BufferBudget.InUse() = %d, want 100", v)
+	}
+
+	r1.Release()
+	r1.Release()
+	if v := b.InUse(); v != 40 {
+		t.Errorf("BufferBudget.InUse() after Release = %d, want 40", v)
+	}
+	if r1.Grow(1) {
+		t.Errorf("BufferReservation.Grow() after Release return true")
+	}
+
+	r2.Release()
+	b.SetMax(0)
+	if !b.Reserve().Grow(1 << 40) {
+		t.Errorf("BufferReservation.Grow() of an unlimited budget return false")
+	}
+}
@@ -0,0 +1,128 @@
+package helpers
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrDigestMismatch = errors.New("body does not match Content-MD5/Digest header")
+)
+
+type digestHash struct {
+	hash.Hash
+	want []byte
+}
+
+type digestReader struct {
+	rc     io.ReadCloser
+	hashes []digestHash
+	buf    []byte
+	held   []byte
+	eof    bool
+	err    error
+}
+
+// NewDigestReadCloser verifies rc against the Content-MD5 and Digest (RFC 3230)
+// headers in header. The last byte read is held back until EOF, so on mismatch
+// the body ends with ErrDigestMismatch instead of being delivered complete.
+// If header has no known digest, rc is returned as is.
+func NewDigestReadCloser(rc io.ReadCloser, header http.Header) io.ReadCloser {
+	hashes := make([]digestHash, 0)
+
+	if v := header.Get("Content-MD5"); v != "" {
+		if want, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v)); err == nil {
+			hashes = append(hashes, digestHash{md5.New(), want})
+		}
+	}
+
+	for _, v := range header["Digest"] {
+		for _, part := range strings.Split(v, ",") {
+			parts := strings.SplitN(strings.TrimSpace(part), "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			var h hash.Hash
+			switch strings.ToUpper(parts[0]) {
+			case "MD5":
+				h = md5.New()
+			case "SHA":
+				h = sha1.New()
+			case "SHA-256":
+				h = sha256.New()
+			case "SHA-512":
+				h = sha512.New()
+			default:
+				continue
+			}
+			if want, err := base64.StdEncoding.DecodeString(parts[1]); err == nil {
+				hashes = append(hashes, digestHash{h, want})
+			}
+		}
+	}
+
+	if len(hashes) == 0 {
+		return rc
+	}
+
+	return &digestReader{
+		rc:     rc,
+		hashes: hashes,
+		buf:    make([]byte, BUFSZ),
+	}
+}
+
+func (r *digestReader) Read(p []byte) (int, error) {
+	for !r.eof && r.err == nil && len(r.held) <= 1 {
+		m, err := r.rc.Read(r.buf)
+		for _, h := range r.hashes {
+			h.Write(r.buf[:m])
+		}
+		r.held = append(r.held, r.buf[:m]...)
+
+		switch err {
+		case nil:
+			if m == 0 {
+				return 0, nil
+			}
+		case io.EOF:
+			for _, h := range r.hashes {
+				if !bytes.Equal(h.Sum(nil), h.want) {
+					r.err = ErrDigestMismatch
+				}
+			}
+			r.eof = r.err == nil
+		default:
+			r.err = err
+		}
+	}
+
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	n := len(r.held)
+	if !r.eof {
+		n--
+	}
+	n = copy(p, r.held[:n])
+	r.held = append(r.held[:0], r.held[n:]...)
+
+	if r.eof && len(r.held) == 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *digestReader) Close() error {
+	return r.rc.Close()
+}
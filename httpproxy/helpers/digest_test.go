@@ -0,0 +1,47 @@
+package helpers
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestDigestReadCloser(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 8192)
+	tampered := append([]byte{}, data...)
+	tampered[len(tampered)/2] ^= 0xff
+
+	md5sum := md5.Sum(data)
+	sha256sum := sha256.Sum256(data)
+
+	var cases = []struct {
+		Header http.Header
+		Body   []byte
+		Err    error
+	}{
+		{http.Header{"Content-Md5": []string{base64.StdEncoding.EncodeToString(md5sum[:])}}, data, nil},
+		{http.Header{"Content-Md5": []string{base64.StdEncoding.EncodeToString(md5sum[:])}}, tampered, ErrDigestMismatch},
+		{http.Header{"Digest": []string{"unixsum=30637, SHA-256=" + base64.StdEncoding.EncodeToString(sha256sum[:])}}, data, nil},
+		{http.Header{"Digest": []string{"SHA-256=" + base64.StdEncoding.EncodeToString(sha256sum[:])}}, tampered, ErrDigestMismatch},
+		{http.Header{}, tampered, nil},
+	}
+
+	for _, c := range cases {
+		r := NewDigestReadCloser(ioutil.NopCloser(bytes.NewReader(c.Body)), c.Header)
+		b, err := ioutil.ReadAll(r)
+		if err != c.Err {
+			t.Errorf("NewDigestReadCloser(%v) return error %v, want %v", c.Header, err, c.Err)
+			continue
+		}
+		if err == nil && !bytes.Equal(b, c.Body) {
+			t.Errorf("NewDigestReadCloser(%v) return corrupted data", c.Header)
+		}
+		if err != nil && len(b) >= len(c.Body) {
+			t.Errorf("NewDigestReadCloser(%v) return %d bytes on mismatch, want a truncated body", c.Header, len(b))
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package helpers
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+)
+
+type fairWaiter struct {
+	key       string
+	start     float64
+	seq       uint64
+	ch        chan struct{}
+	cancelled bool
+}
+
+type fairWaiters []*fairWaiter
+
+func (r fairWaiters) Len() int      { return len(r) }
+func (r fairWaiters) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r fairWaiters) Less(i, j int) bool {
+	if r[i].start == r[j].start {
+		return r[i].seq < r[j].seq
+	}
+	return r[i].start < r[j].start
+}
+func (r *fairWaiters) Push(x interface{}) { *r = append(*r, x.(*fairWaiter)) }
+func (r *fairWaiters) Pop() interface{} {
+	old := *r
+	w := old[len(old)-1]
+	*r = old[:len(old)-1]
+	return w
+}
+
+// FairQueue limits inflight requests to Capacity and, once it is full, hands
+// out freed slots by start-time fair queuing keyed by client, so a burst from
+// one client does not starve the others. A client with weight 2 is served
+// twice as often as a client with weight 1.
+type FairQueue struct {
+	Capacity      int
+	DefaultWeight int
+	Weights       map[string]int
+
+	mu       sync.Mutex
+	inflight int
+	vtime    float64
+	seq      uint64
+	clients  map[string]*fairClient
+	waiters  fairWaiters
+}
+
+// fairClient is the finish time of the last request of a client, kept while
+// it has requests inflight or waiting.
+type fairClient struct {
+	finish float64
+	active int
+}
+
+func NewFairQueue(capacity int, defaultWeight int, weights map[string]int) *FairQueue {
+	if defaultWeight <= 0 {
+		defaultWeight = 1
+	}
+	return &FairQueue{
+		Capacity:      capacity,
+		DefaultWeight: defaultWeight,
+		Weights:       weights,
+		clients:       make(map[string]*fairClient),
+	}
+}
+
+func (q *FairQueue) weight(key string) float64 {
+	if w, ok := q.Weights[key]; ok && w > 0 {
+		return float64(w)
+	}
+	return float64(q.DefaultWeight)
+}
+
+// Acquire blocks until key gets an inflight slot or ctx is done.
+func (q *FairQueue) Acquire(ctx context.Context, key string) error {
+	q.mu.Lock()
+
+	c, ok := q.clients[key]
+	if !ok {
+		c = &fairClient{}
+		q.clients[key] = c
+	}
+	start := c.finish
+	if start < q.vtime {
+		start = q.vtime
+	}
+	c.finish = start + 1/q.weight(key)
+	c.active++
+
+	if q.inflight < q.Capacity && len(q.waiters) == 0 {
+		q.inflight++
+		q.mu.Unlock()
+		return nil
+	}
+
+	q.seq++
+	w := &fairWaiter{key: key, start: start, seq: q.seq, ch: make(chan struct{})}
+	heap.Push(&q.waiters, w)
+	q.mu.Unlock()
+
+	select {
+	case <-w.ch:
+		return nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		select {
+		case <-w.ch:
+			// granted meanwhile, give the slot back
+			q.mu.Unlock()
+			q.Release(key)
+		default:
+			w.cancelled = true
+			q.done(key)
+			q.mu.Unlock()
+		}
+		return ctx.Err()
+	}
+}
+
+// done ends a request of key, a client with none left inflight or waiting
+// is forgotten.
+func (q *FairQueue) done(key string) {
+	if c, ok := q.clients[key]; ok {
+		if c.active--; c.active <= 0 {
+			delete(q.clients, key)
+		}
+	}
+}
+
+// Release frees a slot taken by Acquire for key.
+func (q *FairQueue) Release(key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.inflight--
+	q.done(key)
+
+	for len(q.waiters) > 0 {
+		w := heap.Pop(&q.waiters).(*fairWaiter)
+		if w.cancelled {
+			continue
+		}
+		q.vtime = w.start
+		q.inflight++
+		close(w.ch)
+		return
+	}
+
+	if q.inflight == 0 {
+		// idle, restart the virtual time
+		q.vtime = 0
+	}
+}
+
+// Waiting returns the number of requests blocked in Acquire.
+func (q *FairQueue) Waiting() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := 0
+	for _, w := range q.waiters {
+		if !w.cancelled {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,121 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func fairQueueOrder(t *testing.T, q *FairQueue, keys []string) []string {
+	ctx := context.Background()
+	if err := q.Acquire(ctx, "holder"); err != nil {
+		t.Fatalf("FairQueue.Acquire error: %v", err)
+	}
+
+	granted := make(chan string, len(keys))
+	for i, key := range keys {
+		go func(key string) {
+			if err := q.Acquire(ctx, key); err != nil {
+				t.Errorf("FairQueue.Acquire(%#v) error: %v", key, err)
+			}
+			granted <- key
+		}(key)
+		for q.Waiting() != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	order := make([]string, 0, len(keys))
+	holder := "holder"
+	for range keys {
+		q.Release(holder)
+		holder = <-granted
+		order = append(order, holder)
+	}
+	q.Release(holder)
+
+	return order
+}
+
+func TestFairQueueBurst(t *testing.T) {
+	q := NewFairQueue(1, 1, nil)
+
+	keys := make([]string, 0)
+	for i := 0; i < 10; i++ {
+		keys = append(keys, "burst")
+	}
+	keys = append(keys, "steady", "steady")
+
+	order := fairQueueOrder(t, q, keys)
+
+	for i, key := range order {
+		if key == "steady" && i > 3 {
+			t.Errorf("FairQueue starves steady client: %v", order)
+			break
+		}
+	}
+}
+
+func TestFairQueueWeights(t *testing.T) {
+	q := NewFairQueue(1, 1, map[string]int{"heavy": 2})
+
+	keys := make([]string, 0)
+	for i := 0; i < 6; i++ {
+		keys = append(keys, "light")
+	}
+	for i := 0; i < 6; i++ {
+		keys = append(keys, "heavy")
+	}
+
+	order := fairQueueOrder(t, q, keys)
+
+	heavy := 0
+	for _, key := range order[:6] {
+		if key == "heavy" {
+			heavy++
+		}
+	}
+	if heavy < 3 {
+		t.Errorf("FairQueue ignores weights, first 6 grants: %v", order[:6])
+	}
+}
+
+func TestFairQueueCancel(t *testing.T) {
+	q := NewFairQueue(1, 1, nil)
+	q.Acquire(context.Background(), "a")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.Acquire(ctx, "b"); err != context.DeadlineExceeded {
+		t.Errorf("FairQueue.Acquire return %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	q.Release("a")
+	if err := q.Acquire(context.Background(), "c"); err != nil {
+		t.Errorf("FairQueue.Acquire after cancel error: %v", err)
+	}
+}
+
+func TestFairQueueForgetsIdleClients(t *testing.T) {
+	q := NewFairQueue(2, 1, nil)
+	ctx := context.Background()
+
+	// a long request keeps the queue from idling
+	q.Acquire(ctx, "tunnel")
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("10.0.0.%d", i)
+		if err := q.Acquire(ctx, key); err != nil {
+			t.Fatalf("FairQueue.Acquire(%#v) error: %v", key, err)
+		}
+		q.Release(key)
+	}
+
+	q.mu.Lock()
+	n := len(q.clients)
+	q.mu.Unlock()
+	if n != 1 {
+		t.Errorf("FairQueue keeps %d clients after 100 came and went, want 1", n)
+	}
+	q.Release("tunnel")
+}
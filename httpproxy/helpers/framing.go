@@ -0,0 +1,241 @@
+package helpers
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/phuslu/glog"
+)
+
+// maxFramingHeadBytes is the longest request head framingConn holds back,
+// longer ones pass through unchecked for http.Server to answer 431.
+const maxFramingHeadBytes = 1<<20 + 4096
+
+// framingRejectedHead replaces the head of a rejected request, http.Server
+// cannot parse it and answers 400 with Connection: close on every Go version.
+var framingRejectedHead = []byte("AMBIGUOUS-FRAMING\r\n\r\n")
+
+const (
+	framingHead = iota
+	framingBody
+	framingChunkSize
+	framingChunkData
+	framingChunkCRLF
+	framingTrailer
+	framingPassthrough
+	framingRejected
+)
+
+// framingConn checks the raw heads of the HTTP/1 requests read off an
+// accepted conn for a Content-Length beside a chunked Transfer-Encoding,
+// before http.Server parses them and drops the Content-Length, the handlers
+// never see it then. It follows the framing of the bodies to find the next
+// head, and passes everything through once a request switches protocols.
+type framingConn struct {
+	net.Conn
+	mode string
+
+	state int
+	// head is the head being read, buf what parsed and is not read yet
+	head []byte
+	buf  []byte
+	// n is the count of body bytes left, line the chunk size or trailer line
+	// being read
+	n    int64
+	line []byte
+}
+
+func (c *framingConn) Read(b []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.state == framingRejected {
+			return 0, io.EOF
+		}
+
+		p := make([]byte, len(b))
+		n, err := c.Conn.Read(p)
+		if n > 0 {
+			c.feed(p[:n])
+		}
+		if err != nil {
+			if len(c.buf) == 0 {
+				// a partial head is for http.Server to fail on
+				c.buf, c.head = c.head, nil
+			}
+			if len(c.buf) == 0 {
+				return 0, err
+			}
+			break
+		}
+	}
+
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// feed runs p through the framing state machine, appending what may be read
+// to c.buf.
+func (c *framingConn) feed(p []byte) {
+	for len(p) > 0 {
+		switch c.state {
+		case framingPassthrough:
+			c.buf = append(c.buf, p...)
+			return
+		case framingRejected:
+			return
+		case framingHead:
+			c.head = append(c.head, p...)
+			p = nil
+			end := bytes.Index(c.head, []byte("\r\n\r\n"))
+			if end < 0 {
+				if len(c.head) > maxFramingHeadBytes {
+					c.state = framingPassthrough
+					c.buf, c.head = append(c.buf, c.head...), nil
+				}
+				continue
+			}
+			head, rest := c.head[:end+4], c.head[end+4:]
+			c.head = nil
+			c.buf = append(c.buf, c.checkHead(head)...)
+			p = rest
+		case framingBody:
+			n := int64(len(p))
+			if n > c.n {
+				n = c.n
+			}
+			c.buf = append(c.buf, p[:n]...)
+			p = p[n:]
+			if c.n -= n; c.n == 0 {
+				c.state = framingHead
+			}
+		case framingChunkData:
+			n := int64(len(p))
+			if n > c.n {
+				n = c.n
+			}
+			c.buf = append(c.buf, p[:n]...)
+			p = p[n:]
+			if c.n -= n; c.n == 0 {
+				c.state = framingChunkCRLF
+				c.n = 2
+			}
+		case framingChunkCRLF:
+			c.buf = append(c.buf, p[0])
+			p = p[1:]
+			if c.n--; c.n == 0 {
+				c.state = framingChunkSize
+			}
+		case framingChunkSize, framingTrailer:
+			i := bytes.IndexByte(p, '\n')
+			if i < 0 {
+				c.line = append(c.line, p...)
+				c.buf = append(c.buf, p...)
+				p = nil
+				if len(c.line) > 4096 {
+					c.state = framingPassthrough
+				}
+				continue
+			}
+			c.line = append(c.line, p[:i+1]...)
+			c.buf = append(c.buf, p[:i+1]...)
+			p = p[i+1:]
+			line := strings.TrimSpace(string(c.line))
+			c.line = c.line[:0]
+
+			if c.state == framingTrailer {
+				if line == "" {
+					c.state = framingHead
+				}
+				continue
+			}
+			if i := strings.IndexByte(line, ';'); i >= 0 {
+				line = line[:i]
+			}
+			size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+			switch {
+			case err != nil || size < 0:
+				// http.Server fails the body, nothing to frame
+				c.state = framingPassthrough
+			case size == 0:
+				c.state = framingTrailer
+			default:
+				c.state = framingChunkData
+				c.n = size
+			}
+		}
+	}
+}
+
+// checkHead returns what to pass on for head, and sets the state for the body
+// after it.
+func (c *framingConn) checkHead(head []byte) []byte {
+	lines := strings.Split(string(head[:len(head)-4]), "\r\n")
+	// http.Server skips empty lines before a request line
+	for len(lines) > 1 && lines[0] == "" {
+		lines = lines[1:]
+	}
+	requestLine := lines[0]
+
+	var contentLength []string
+	var chunked, upgrade bool
+	clLines := make(map[int]bool)
+	for i, line := range lines[1:] {
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			continue
+		}
+		name, value := strings.TrimSpace(line[:colon]), strings.TrimSpace(line[colon+1:])
+		switch {
+		case strings.EqualFold(name, "Content-Length"):
+			contentLength = append(contentLength, value)
+			clLines[i+1] = true
+		case strings.EqualFold(name, "Transfer-Encoding"):
+			chunked = chunked || strings.Contains(strings.ToLower(value), "chunked")
+		case strings.EqualFold(name, "Upgrade"):
+			upgrade = true
+		}
+	}
+
+	if len(contentLength) > 0 && chunked {
+		if c.mode != AmbiguousFramingStrip {
+			glog.Warningf("%s %#v Content-Length %v with a chunked Transfer-Encoding, rejected", c.RemoteAddr(), requestLine, contentLength)
+			c.state = framingRejected
+			return framingRejectedHead
+		}
+		glog.Warningf("%s %#v Content-Length %v with a chunked Transfer-Encoding, strips it and forwards the body chunked", c.RemoteAddr(), requestLine, contentLength)
+		kept := lines[:0:0]
+		for i, line := range lines {
+			if !clLines[i] {
+				kept = append(kept, line)
+			}
+		}
+		head = []byte(strings.Join(kept, "\r\n") + "\r\n\r\n")
+		contentLength = nil
+	}
+
+	switch {
+	case strings.HasPrefix(requestLine, "CONNECT ") || upgrade:
+		// tunnel bytes or another protocol follow
+		c.state = framingPassthrough
+	case chunked:
+		c.state = framingChunkSize
+	case len(contentLength) > 0:
+		n, err := strconv.ParseInt(contentLength[0], 10, 64)
+		switch {
+		case err != nil || n < 0:
+			c.state = framingPassthrough
+		case n == 0:
+			c.state = framingHead
+		default:
+			c.state = framingBody
+			c.n = n
+		}
+	default:
+		c.state = framingHead
+	}
+
+	return head
+}
@@ -0,0 +1,79 @@
+package helpers
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestListenAmbiguousFraming(t *testing.T) {
+	const (
+		chunked   = "POST /chunked HTTP/1.1\r\nHost: example.org\r\nTransfer-Encoding: chunked\r\n\r\n5;ext=1\r\nhello\r\n0\r\nX-Trailer: 1\r\n\r\n"
+		sized     = "POST /sized HTTP/1.1\r\nHost: example.org\r\nContent-Length: 19\r\n\r\nContent-Length: 5\r\n"
+		ambiguous = "POST /ambiguous HTTP/1.1\r\nHost: example.org\r\ncontent-length: 5\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"
+		get       = "GET /get HTTP/1.1\r\nHost: example.org\r\n\r\n"
+	)
+
+	cases := []struct {
+		Mode     string
+		Requests string
+		Statuses []int
+		Bodies   []string
+	}{
+		// bodies which look like heads are skipped, the ambiguous request
+		// after them is rejected and the conn closed
+		{AmbiguousFramingReject, chunked + sized + ambiguous + get, []int{200, 200, 400}, []string{"/chunked hello", "/sized Content-Length: 5\r\n"}},
+		{AmbiguousFramingStrip, chunked + ambiguous + get, []int{200, 200, 200}, []string{"/chunked hello", "/ambiguous hello", "/get "}},
+	}
+
+	for _, c := range cases {
+		ln, err := ListenTCP("tcp", "127.0.0.1:0", &ListenOptions{AmbiguousFraming: c.Mode})
+		if err != nil {
+			t.Fatalf("ListenTCP failed: %v", err)
+		}
+
+		s := &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			b, _ := ioutil.ReadAll(req.Body)
+			io.WriteString(rw, req.URL.Path+" "+string(b))
+		})}
+		go s.Serve(ln)
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("net.Dial failed: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, c.Requests)
+
+		br := bufio.NewReader(conn)
+		for i, status := range c.Statuses {
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatalf("AmbiguousFraming=%#v response %d error: %v", c.Mode, i, err)
+			}
+			b, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != status {
+				t.Errorf("AmbiguousFraming=%#v response %d status = %d, want %d", c.Mode, i, resp.StatusCode, status)
+			}
+			if i < len(c.Bodies) && string(b) != c.Bodies[i] {
+				t.Errorf("AmbiguousFraming=%#v response %d body = %#v, want %#v", c.Mode, i, string(b), c.Bodies[i])
+			}
+			if status == http.StatusBadRequest && !resp.Close {
+				t.Errorf("AmbiguousFraming=%#v 400 response keeps the conn open", c.Mode)
+			}
+		}
+		if c.Mode == AmbiguousFramingReject {
+			if _, err := br.ReadByte(); err != io.EOF {
+				t.Errorf("AmbiguousFraming=%#v conn after the 400 read error = %v, want io.EOF", c.Mode, err)
+			}
+		}
+
+		conn.Close()
+		s.Close()
+	}
+}
@@ -1,9 +1,12 @@
 package helpers
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"sync"
 	"time"
 
@@ -18,8 +21,15 @@ type Listener interface {
 	net.Listener
 
 	Add(net.Conn) error
+	// ActiveConns returns the number of accepted conns not closed yet,
+	// hijacked ones included.
+	ActiveConns() int
+	// CloseConns closes all accepted conns and returns how many were open.
+	CloseConns() int
 }
 
+var errListenerClosed = errors.New("httpproxy.Listener: use of closed listener")
+
 type racer struct {
 	conn net.Conn
 	err  error
@@ -29,14 +39,39 @@ type listener struct {
 	ln              net.Listener
 	lane            chan racer
 	keepAlivePeriod time.Duration
+	tlsConfig       *tls.Config
+	framing         string
 	stopped         bool
 	once            sync.Once
 	mu              sync.Mutex
+	connsMu         sync.Mutex
+	conns           map[*trackedConn]struct{}
+}
+
+// trackedConn removes itself from the conns of its listener once closed.
+type trackedConn struct {
+	net.Conn
+	l    *listener
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.l.connsMu.Lock()
+		delete(c.l.conns, c)
+		c.l.connsMu.Unlock()
+	})
+	return c.Conn.Close()
 }
 
 type ListenOptions struct {
 	TLSConfig       *tls.Config
 	KeepAlivePeriod time.Duration
+	// AmbiguousFraming checks the raw request heads of plain conns for a
+	// Content-Length beside a chunked Transfer-Encoding, AmbiguousFramingReject
+	// or AmbiguousFramingStrip. Over TLS the *tls.Conn has to stay outermost,
+	// the handler checks what http.Server leaves of them instead.
+	AmbiguousFraming string
 }
 
 func ListenTCP(network, addr string, opts *ListenOptions) (Listener, error) {
@@ -45,32 +80,85 @@ func ListenTCP(network, addr string, opts *ListenOptions) (Listener, error) {
 		return nil, err
 	}
 
-	ln0, err := net.ListenTCP(network, laddr)
+	ln, err := net.ListenTCP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return newListener(ln, opts), nil
+}
+
+// ListenUnix listens on the unix socket path, replacing a stale socket file,
+// and sets its permissions to mode, which control who may connect. Clients
+// have no ip, their RemoteAddr is UnixRemoteAddr.
+func ListenUnix(path string, mode os.FileMode, opts *ListenOptions) (Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	ln0, err := net.Listen("unix", path)
 	if err != nil {
 		return nil, err
 	}
 
-	var ln net.Listener
-	if opts != nil && opts.TLSConfig != nil {
-		ln = tls.NewListener(ln0, opts.TLSConfig)
-	} else {
-		ln = ln0
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			ln0.Close()
+			return nil, err
+		}
 	}
 
+	return newListener(unixListener{ln0}, opts), nil
+}
+
+// newListener serves TLS over the conns of ln if opts has a TLSConfig.
+func newListener(ln net.Listener, opts *ListenOptions) *listener {
 	var keepAlivePeriod time.Duration
-	if opts != nil && opts.KeepAlivePeriod > 0 {
-		keepAlivePeriod = opts.KeepAlivePeriod
+	var tlsConfig *tls.Config
+	var framing string
+	if opts != nil {
+		if opts.KeepAlivePeriod > 0 {
+			keepAlivePeriod = opts.KeepAlivePeriod
+		}
+		tlsConfig = opts.TLSConfig
+		framing = opts.AmbiguousFraming
 	}
 
-	l := &listener{
+	return &listener{
 		ln:              ln,
 		lane:            make(chan racer, backlog),
 		stopped:         false,
 		keepAlivePeriod: keepAlivePeriod,
+		tlsConfig:       tlsConfig,
+		framing:         framing,
+		conns:           make(map[*trackedConn]struct{}),
 	}
+}
+
+// UnixRemoteAddr is the RemoteAddr of unix socket clients, filters acting on
+// client ips should let the socket permissions decide for them.
+const UnixRemoteAddr = "@"
+
+type unixListener struct {
+	net.Listener
+}
 
-	return l, nil
+func (l unixListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return unixConn{c}, nil
+}
 
+// unixConn reports the same RemoteAddr on every platform, unnamed client
+// sockets are "@" on linux but "" elsewhere.
+type unixConn struct {
+	net.Conn
+}
+
+func (c unixConn) RemoteAddr() net.Addr {
+	return &net.UnixAddr{Name: UnixRemoteAddr, Net: "unix"}
 }
 
 func (l *listener) Accept() (c net.Conn, err error) {
@@ -79,7 +167,19 @@ func (l *listener) Accept() (c net.Conn, err error) {
 			var tempDelay time.Duration
 			for {
 				conn, err := l.ln.Accept()
+				if err == nil {
+					conn = l.track(conn)
+				}
+				l.mu.Lock()
+				if l.stopped {
+					l.mu.Unlock()
+					if conn != nil {
+						conn.Close()
+					}
+					return
+				}
 				l.lane <- racer{conn, err}
+				l.mu.Unlock()
 				if err != nil {
 					if ne, ok := err.(net.Error); ok && ne.Temporary() {
 						if tempDelay == 0 {
@@ -100,19 +200,40 @@ func (l *listener) Accept() (c net.Conn, err error) {
 		}()
 	})
 
-	r := <-l.lane
+	r, ok := <-l.lane
+	if !ok {
+		return nil, errListenerClosed
+	}
 	if r.err != nil {
 		return r.conn, r.err
 	}
 
+	return r.conn, nil
+}
+
+// track sets up an accepted conn, conns passed to Add are not tracked again
+// as they wrap an accepted one. The *tls.Conn stays outermost, net/http only
+// fills in req.TLS and negotiates h2 for those.
+func (l *listener) track(conn net.Conn) net.Conn {
 	if l.keepAlivePeriod > 0 {
-		if tc, ok := r.conn.(*net.TCPConn); ok {
+		if tc, ok := conn.(*net.TCPConn); ok {
 			tc.SetKeepAlive(true)
 			tc.SetKeepAlivePeriod(l.keepAlivePeriod)
 		}
 	}
 
-	return r.conn, nil
+	c := &trackedConn{Conn: conn, l: l}
+	l.connsMu.Lock()
+	l.conns[c] = struct{}{}
+	l.connsMu.Unlock()
+
+	if l.tlsConfig != nil {
+		return tls.Server(c, l.tlsConfig)
+	}
+	if l.framing != "" {
+		return &framingConn{Conn: c, mode: l.framing}
+	}
+	return c
 }
 
 func (l *listener) Close() error {
@@ -142,3 +263,87 @@ func (l *listener) Add(conn net.Conn) error {
 
 	return nil
 }
+
+func (l *listener) ActiveConns() int {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+	return len(l.conns)
+}
+
+func (l *listener) CloseConns() int {
+	l.connsMu.Lock()
+	conns := make([]*trackedConn, 0, len(l.conns))
+	for c := range l.conns {
+		conns = append(conns, c)
+	}
+	l.connsMu.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+	return len(conns)
+}
+
+// DrainInterval is how often Drain checks the conns left.
+var DrainInterval = time.Second
+
+// Drain waits for the conns of closed listeners to finish in two phases: until
+// ctx is done, then for grace more while logging progress. The conns still
+// open after grace are force closed, and an error reports how many.
+func Drain(ctx context.Context, grace time.Duration, lns ...Listener) error {
+	active := func() int {
+		n := 0
+		for _, ln := range lns {
+			n += ln.ActiveConns()
+		}
+		return n
+	}
+
+	ticker := time.NewTicker(DrainInterval)
+	defer ticker.Stop()
+
+	for done := false; !done; {
+		if active() == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			done = true
+		case <-ticker.C:
+		}
+	}
+
+	last := active()
+	if last == 0 {
+		return nil
+	}
+	glog.Warningf("httpproxy.Listener: drain deadline reached with %d conns, force close them in %s", last, grace)
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			n := 0
+			for _, ln := range lns {
+				n += ln.CloseConns()
+			}
+			if n == 0 {
+				return nil
+			}
+			glog.Warningf("httpproxy.Listener: force closed %d conns after %s grace", n, grace)
+			return fmt.Errorf("httpproxy.Listener: force closed %d conns", n)
+		case <-ticker.C:
+			n := active()
+			if n == 0 {
+				glog.Infof("httpproxy.Listener: all conns finished during grace")
+				return nil
+			}
+			if n != last {
+				glog.Infof("httpproxy.Listener: %d conns left in grace", n)
+				last = n
+			}
+		}
+	}
+}
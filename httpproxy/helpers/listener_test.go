@@ -0,0 +1,276 @@
+package helpers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListenerDrain(t *testing.T) {
+	DrainInterval = 10 * time.Millisecond
+	defer func() { DrainInterval = time.Second }()
+
+	ln, err := ListenTCP("tcp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatalf("ListenTCP failed: %v", err)
+	}
+
+	// a short tunnel finishing in the drain phase, a long one in the grace
+	// phase, and a stuck one force closed
+	lifetimes := []time.Duration{20 * time.Millisecond, 150 * time.Millisecond, time.Hour}
+	clients := make([]net.Conn, len(lifetimes))
+	for i, lifetime := range lifetimes {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("net.Dial failed: %v", err)
+		}
+		defer c.Close()
+		clients[i] = c
+
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("%T.Accept failed: %v", ln, err)
+		}
+		time.AfterFunc(lifetime, func() { conn.Close() })
+	}
+
+	if n := ln.ActiveConns(); n != 3 {
+		t.Fatalf("%T.ActiveConns() = %d, want 3", ln, n)
+	}
+	ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err = Drain(ctx, 300*time.Millisecond, ln)
+	if err == nil {
+		t.Errorf("Drain() returns no error with a stuck conn")
+	}
+	if d := time.Since(start); d < 350*time.Millisecond || d > time.Second {
+		t.Errorf("Drain() returns after %s, want drain and grace, 350ms", d)
+	}
+	if n := ln.ActiveConns(); n != 0 {
+		t.Errorf("%T.ActiveConns() = %d after Drain, want 0", ln, n)
+	}
+
+	clients[2].SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := clients[2].Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("stuck conn Read() error = %v, want io.EOF after force close", err)
+	}
+}
+
+func TestListenerDrainInTime(t *testing.T) {
+	DrainInterval = 10 * time.Millisecond
+	defer func() { DrainInterval = time.Second }()
+
+	ln, err := ListenTCP("tcp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatalf("ListenTCP failed: %v", err)
+	}
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("%T.Accept failed: %v", ln, err)
+	}
+	time.AfterFunc(100*time.Millisecond, func() { conn.Close() })
+	ln.Close()
+
+	if _, err := ln.Accept(); err == nil {
+		t.Errorf("%T.Accept() after Close returns no error", ln)
+	}
+
+	// the conn finishes in the grace phase
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := Drain(ctx, time.Second, ln); err != nil {
+		t.Errorf("Drain() error: %v", err)
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listener")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "goproxy.sock")
+
+	// a socket file left by an unclean exit is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("net.Listen(%#v) error: %v", path, err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := ListenUnix(path, 0600, nil)
+	if err != nil {
+		t.Fatalf("ListenUnix(%#v) error: %v", path, err)
+	}
+	defer ln.Close()
+
+	if fi, err := os.Stat(path); err != nil {
+		t.Errorf("os.Stat(%#v) error: %v", path, err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("ListenUnix(%#v) socket mode %v, want %v", path, fi.Mode().Perm(), os.FileMode(0600))
+	}
+
+	go http.Serve(ln, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, req.RemoteAddr)
+	}))
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		},
+	}
+
+	resp, err := client.Get("http://goproxy/")
+	if err != nil {
+		t.Fatalf("Get over %#v error: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	b, _ := ioutil.ReadAll(resp.Body)
+	if string(b) != UnixRemoteAddr {
+		t.Errorf("request over %#v has RemoteAddr %#v, want %#v", path, string(b), UnixRemoteAddr)
+	}
+}
+
+func TestListenerIdleTimeout(t *testing.T) {
+	ln, err := ListenTCP("tcp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatalf("ListenTCP failed: %v", err)
+	}
+	s := &http.Server{
+		Handler:     http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) { io.WriteString(rw, "ok") }),
+		IdleTimeout: 100 * time.Millisecond,
+	}
+	go s.Serve(ln)
+	defer s.Close()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: example.org\r\n\r\n")
+	b := make([]byte, 4096)
+	if _, err := c.Read(b); err != nil {
+		t.Fatalf("%T.Read failed: %v", c, err)
+	}
+	if n := ln.ActiveConns(); n != 1 {
+		t.Fatalf("ActiveConns after a keep-alive request = %d, want 1", n)
+	}
+
+	// the idle conn is closed by the server, and no longer tracked
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(b); err != io.EOF {
+		t.Fatalf("%T.Read of an idle conn = %v, want io.EOF", c, err)
+	}
+	for i := 0; ln.ActiveConns() != 0; i++ {
+		if i > 100 {
+			t.Fatalf("ActiveConns after the idle timeout = %d, want 0", ln.ActiveConns())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newListenerTestCert(t *testing.T, cn string, usage x509.ExtKeyUsage) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey error: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate error: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate error: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, cert
+}
+
+func TestListenTCPClientCert(t *testing.T) {
+	serverCert, serverLeaf := newListenerTestCert(t, "127.0.0.1", x509.ExtKeyUsageServerAuth)
+	clientCert, clientLeaf := newListenerTestCert(t, "team-a", x509.ExtKeyUsageClientAuth)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientLeaf)
+	ln, err := ListenTCP("tcp", "127.0.0.1:0", &ListenOptions{TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		NextProtos:   []string{"http/1.1"},
+	}})
+	if err != nil {
+		t.Fatalf("ListenTCP failed: %v", err)
+	}
+
+	peers := make(chan string, 1)
+	s := &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.TLS == nil:
+			peers <- "no TLS"
+		case len(req.TLS.PeerCertificates) == 0:
+			peers <- "no client cert"
+		default:
+			peers <- req.TLS.PeerCertificates[0].Subject.CommonName + " " + req.TLS.NegotiatedProtocol
+		}
+	})}
+	go s.Serve(ln)
+	defer s.Close()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(serverLeaf)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      rootCAs,
+		Certificates: []tls.Certificate{clientCert},
+		NextProtos:   []string{"http/1.1"},
+	}}}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatalf("GET over %T with a client cert error: %v", ln, err)
+	}
+	resp.Body.Close()
+
+	if peer := <-peers; peer != "team-a http/1.1" {
+		t.Errorf("request over %T with a client cert has TLS %#v, want %#v", ln, peer, "team-a http/1.1")
+	}
+	if n := ln.ActiveConns(); n != 1 {
+		t.Errorf("ActiveConns over TLS = %d, want 1", n)
+	}
+}
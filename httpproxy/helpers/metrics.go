@@ -0,0 +1,206 @@
+package helpers
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics is the process wide registry, written out in the Prometheus text
+// format by the admin filter.
+var Metrics = NewMetricsRegistry()
+
+type Counter struct {
+	v int64
+}
+
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.v, n)
+}
+
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.v)
+}
+
+type Gauge struct {
+	Counter
+}
+
+func (g *Gauge) Set(n int64) {
+	atomic.StoreInt64(&g.v, n)
+}
+
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+
+	h.mu.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+	h.mu.Unlock()
+}
+
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+func (h *Histogram) Sum() float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sum
+}
+
+// ExponentialBuckets returns n upper bounds, start, start*factor, ...
+func ExponentialBuckets(start, factor float64, n int) []float64 {
+	buckets := make([]float64, n)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+type metric struct {
+	name  string
+	help  string
+	kind  string
+	value interface{}
+}
+
+type MetricsRegistry struct {
+	mu      sync.Mutex
+	metrics map[string]*metric
+}
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{
+		metrics: make(map[string]*metric),
+	}
+}
+
+func (r *MetricsRegistry) lookup(name, help, kind string, value func() interface{}) interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if m, ok := r.metrics[name]; ok {
+		if m.kind != kind {
+			panic(fmt.Sprintf("metric %#v registered as %s, not %s", name, m.kind, kind))
+		}
+		return m.value
+	}
+
+	m := &metric{name, help, kind, value()}
+	r.metrics[name] = m
+	return m.value
+}
+
+// Counter returns the counter of name, creating it if needed. name may carry
+// labels, e.g. `direct_requests_total{code="200"}`.
+func (r *MetricsRegistry) Counter(name, help string) *Counter {
+	return r.lookup(name, help, "counter", func() interface{} { return new(Counter) }).(*Counter)
+}
+
+func (r *MetricsRegistry) Gauge(name, help string) *Gauge {
+	return r.lookup(name, help, "gauge", func() interface{} { return new(Gauge) }).(*Gauge)
+}
+
+func (r *MetricsRegistry) Histogram(name, help string, buckets []float64) *Histogram {
+	return r.lookup(name, help, "histogram", func() interface{} {
+		return &Histogram{
+			buckets: buckets,
+			counts:  make([]uint64, len(buckets)),
+		}
+	}).(*Histogram)
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+func (r *MetricsRegistry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := make([]*metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		metrics = append(metrics, m)
+	}
+	r.mu.Unlock()
+
+	family := func(name string) string {
+		if i := strings.IndexByte(name, '{'); i >= 0 {
+			return name[:i]
+		}
+		return name
+	}
+
+	sort.Slice(metrics, func(i, j int) bool {
+		fi, fj := family(metrics[i].name), family(metrics[j].name)
+		if fi != fj {
+			return fi < fj
+		}
+		return metrics[i].name < metrics[j].name
+	})
+
+	b := new(bytes.Buffer)
+	last := ""
+	for _, m := range metrics {
+		name, labels := family(m.name), ""
+		if len(name) < len(m.name) {
+			labels = m.name[len(name)+1 : len(m.name)-1]
+		}
+
+		if name != last {
+			last = name
+			if m.help != "" {
+				fmt.Fprintf(b, "# HELP %s %s\n", name, m.help)
+			}
+			fmt.Fprintf(b, "# TYPE %s %s\n", name, m.kind)
+		}
+
+		switch v := m.value.(type) {
+		case *Counter:
+			fmt.Fprintf(b, "%s %d\n", m.name, v.Value())
+		case *Gauge:
+			fmt.Fprintf(b, "%s %d\n", m.name, v.Value())
+		case *Histogram:
+			withLabels := func(extra string) string {
+				switch {
+				case labels == "" && extra == "":
+					return ""
+				case labels == "":
+					return "{" + extra + "}"
+				case extra == "":
+					return "{" + labels + "}"
+				default:
+					return "{" + labels + "," + extra + "}"
+				}
+			}
+
+			v.mu.Lock()
+			var cumulative uint64
+			for i, le := range v.buckets {
+				cumulative += v.counts[i]
+				fmt.Fprintf(b, "%s_bucket%s %d\n", name, withLabels("le=\""+strconv.FormatFloat(le, 'f', -1, 64)+"\""), cumulative)
+			}
+			fmt.Fprintf(b, "%s_bucket%s %d\n", name, withLabels("le=\"+Inf\""), v.count)
+			fmt.Fprintf(b, "%s_sum%s %g\n", name, withLabels(""), v.sum)
+			fmt.Fprintf(b, "%s_count%s %d\n", name, withLabels(""), v.count)
+			v.mu.Unlock()
+		}
+	}
+
+	return b.WriteTo(w)
+}
@@ -0,0 +1,59 @@
+package helpers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestMetricsRegistry(t *testing.T) {
+	r := NewMetricsRegistry()
+
+	r.Counter(`test_requests_total{code="200"}`, "Requests.").Add(3)
+	r.Counter(`test_requests_total{code="502"}`, "Requests.").Add(1)
+	r.Counter(`test_requests_total{code="200"}`, "Requests.").Add(1)
+	r.Gauge("test_inflight", "").Set(7)
+
+	h := r.Histogram("test_size_bytes", "Sizes.", []float64{10, 100})
+	for _, v := range []float64{1, 50, 500} {
+		h.Observe(v)
+	}
+
+	b := new(bytes.Buffer)
+	r.WriteTo(b)
+	s := b.String()
+
+	for _, line := range []string{
+		"# TYPE test_requests_total counter\n",
+		`test_requests_total{code="200"} 4` + "\n",
+		`test_requests_total{code="502"} 1` + "\n",
+		"test_inflight 7\n",
+		`test_size_bytes_bucket{le="10"} 1` + "\n",
+		`test_size_bytes_bucket{le="100"} 2` + "\n",
+		`test_size_bytes_bucket{le="+Inf"} 3` + "\n",
+		"test_size_bytes_sum 551\n",
+	} {
+		if !strings.Contains(s, line) {
+			t.Errorf("MetricsRegistry.WriteTo() missing %#v in:\n%s", line, s)
+		}
+	}
+
+	if n := strings.Count(s, "# TYPE test_requests_total"); n != 1 {
+		t.Errorf("MetricsRegistry.WriteTo() writes %d TYPE lines for test_requests_total", n)
+	}
+}
+
+func TestCountReadCloser(t *testing.T) {
+	var counted int64 = -1
+	rc := NewCountReadCloser(ioutil.NopCloser(strings.NewReader("hello world")), func(n int64) {
+		counted = n
+	})
+
+	ioutil.ReadAll(rc)
+	rc.Close()
+
+	if counted != 11 {
+		t.Errorf("NewCountReadCloser counted %d bytes, want %d", counted, 11)
+	}
+}
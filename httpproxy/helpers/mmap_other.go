@@ -0,0 +1,20 @@
+// +build !linux,!darwin,!freebsd
+
+package helpers
+
+import (
+	"io"
+	"os"
+)
+
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	b := make([]byte, size)
+	if _, err := io.ReadFull(f, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func munmapFile(b []byte) error {
+	return nil
+}
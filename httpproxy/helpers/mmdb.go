@@ -0,0 +1,411 @@
+package helpers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// MMDB reads a MaxMind DB file, e.g. GeoLite2-ASN.mmdb. A file opened with
+// OpenMMDB is memory-mapped and can be swapped in place by Reload.
+type MMDB struct {
+	mu       sync.RWMutex
+	filename string
+	modTime  time.Time
+	mapped   bool
+	db       *mmdbData
+}
+
+type mmdbData struct {
+	buf        []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	dbType     string
+	ipv4Start  uint
+}
+
+// NewMMDB returns a MMDB over data held in memory.
+func NewMMDB(buf []byte) (*MMDB, error) {
+	db, err := parseMMDB(buf)
+	if err != nil {
+		return nil, err
+	}
+	return &MMDB{db: db}, nil
+}
+
+// OpenMMDB memory-maps filename.
+func OpenMMDB(filename string) (*MMDB, error) {
+	m := &MMDB{filename: filename, mapped: true}
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Reload maps the file again, so an updated database takes effect without a
+// restart. It is a no-op for a MMDB from NewMMDB.
+func (m *MMDB) Reload() error {
+	if !m.mapped {
+		return nil
+	}
+
+	f, err := os.Open(m.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	buf, err := mmapFile(f, int(fi.Size()))
+	if err != nil {
+		return err
+	}
+
+	db, err := parseMMDB(buf)
+	if err != nil {
+		munmapFile(buf)
+		return fmt.Errorf("%s: %v", m.filename, err)
+	}
+
+	m.mu.Lock()
+	old := m.db
+	m.db = db
+	m.modTime = fi.ModTime()
+	m.mu.Unlock()
+
+	if old != nil {
+		munmapFile(old.buf)
+	}
+	return nil
+}
+
+// ReloadIfModified calls Reload when the file changed since it was mapped.
+func (m *MMDB) ReloadIfModified() error {
+	if !m.mapped {
+		return nil
+	}
+
+	fi, err := os.Stat(m.filename)
+	if err != nil {
+		return err
+	}
+
+	m.mu.RLock()
+	modTime := m.modTime
+	m.mu.RUnlock()
+
+	if fi.ModTime().Equal(modTime) {
+		return nil
+	}
+	return m.Reload()
+}
+
+func (m *MMDB) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.db == nil {
+		return nil
+	}
+	var err error
+	if m.mapped {
+		err = munmapFile(m.db.buf)
+	}
+	m.db = nil
+	return err
+}
+
+// DatabaseType returns the database_type of the metadata, e.g. "GeoLite2-ASN".
+func (m *MMDB) DatabaseType() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.db == nil {
+		return ""
+	}
+	return m.db.dbType
+}
+
+// Lookup returns the record of ip, nil if the database has none.
+func (m *MMDB) Lookup(ip net.IP) (interface{}, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.db == nil {
+		return nil, errors.New("mmdb: database closed")
+	}
+	return m.db.lookup(ip)
+}
+
+// LookupASN returns the autonomous system number and organization of ip, 0
+// if ip is not in the database.
+func (m *MMDB) LookupASN(ip net.IP) (uint, string, error) {
+	v, err := m.Lookup(ip)
+	if err != nil || v == nil {
+		return 0, "", err
+	}
+
+	r, ok := v.(map[string]interface{})
+	if !ok {
+		return 0, "", fmt.Errorf("mmdb: record of %s is %T, not a map", ip, v)
+	}
+
+	asn, _ := r["autonomous_system_number"].(uint64)
+	org, _ := r["autonomous_system_organization"].(string)
+
+	return uint(asn), org, nil
+}
+
+func parseMMDB(buf []byte) (*mmdbData, error) {
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("mmdb: metadata not found")
+	}
+
+	d := &mmdbData{buf: buf}
+
+	v, _, err := mmdbDecode(buf[i+len(mmdbMetadataMarker):], 0)
+	if err != nil {
+		return nil, fmt.Errorf("mmdb: bad metadata: %v", err)
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("mmdb: metadata is %T, not a map", v)
+	}
+
+	number := func(key string) uint {
+		n, _ := meta[key].(uint64)
+		return uint(n)
+	}
+
+	d.nodeCount = number("node_count")
+	d.recordSize = number("record_size")
+	d.ipVersion = number("ip_version")
+	d.dbType, _ = meta["database_type"].(string)
+
+	switch d.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("mmdb: unsupported record_size %d", d.recordSize)
+	}
+
+	treeSize := d.recordSize * 2 / 8 * d.nodeCount
+	if treeSize+16 > uint(i) {
+		return nil, errors.New("mmdb: search tree exceeds file size")
+	}
+	d.data = buf[treeSize+16 : i]
+
+	if d.ipVersion == 6 {
+		node := uint(0)
+		for j := 0; j < 96 && node < d.nodeCount; j++ {
+			node = d.record(node, 0)
+		}
+		d.ipv4Start = node
+	}
+
+	return d, nil
+}
+
+func (d *mmdbData) record(node, bit uint) uint {
+	b := d.buf[node*d.recordSize/4:]
+	switch d.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+func (d *mmdbData) lookup(ip net.IP) (interface{}, error) {
+	node, bits := uint(0), 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+		if d.ipVersion == 6 {
+			node = d.ipv4Start
+		}
+	} else if d.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < bits && node < d.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = d.record(node, bit)
+	}
+
+	if node <= d.nodeCount {
+		return nil, nil
+	}
+
+	offset := node - d.nodeCount - 16
+	if offset >= uint(len(d.data)) {
+		return nil, fmt.Errorf("mmdb: invalid data offset %d", offset)
+	}
+
+	v, _, err := mmdbDecode(d.data, offset)
+	return v, err
+}
+
+// mmdbDecode decodes the data section field at offset and returns it with the
+// offset of the next field.
+func mmdbDecode(data []byte, offset uint) (interface{}, uint, error) {
+	if offset >= uint(len(data)) {
+		return nil, 0, errors.New("unexpected end of data")
+	}
+
+	ctrl := data[offset]
+	offset++
+
+	kind := uint(ctrl >> 5)
+	if kind == 1 {
+		// pointer, the size bits are part of the pointer itself
+		n := uint(ctrl>>3)&0x3 + 1
+		if offset+n > uint(len(data)) {
+			return nil, 0, errors.New("unexpected end of data")
+		}
+		b := data[offset : offset+n]
+		var p uint
+		switch n {
+		case 1:
+			p = uint(ctrl&0x7)<<8 | uint(b[0])
+		case 2:
+			p = (uint(ctrl&0x7)<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+		case 3:
+			p = (uint(ctrl&0x7)<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+		case 4:
+			p = uint(binary.BigEndian.Uint32(b))
+		}
+		v, _, err := mmdbDecode(data, p)
+		return v, offset + n, err
+	}
+
+	if kind == 0 {
+		if offset >= uint(len(data)) {
+			return nil, 0, errors.New("unexpected end of data")
+		}
+		kind = 7 + uint(data[offset])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(data)) {
+			return nil, 0, errors.New("unexpected end of data")
+		}
+		var x uint
+		for _, c := range data[offset : offset+n] {
+			x = x<<8 | uint(c)
+		}
+		offset += n
+		switch size {
+		case 29:
+			size = 29 + x
+		case 30:
+			size = 285 + x
+		case 31:
+			size = 65821 + x
+		}
+	}
+
+	switch kind {
+	case 7:
+		// map
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := mmdbDecode(data, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key is %T, not a string", k)
+			}
+			v, next, err := mmdbDecode(data, next)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case 11:
+		// array
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := mmdbDecode(data, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case 14:
+		// boolean, the value is the size
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(data)) {
+		return nil, 0, errors.New("unexpected end of data")
+	}
+	b := data[offset : offset+size]
+	offset += size
+
+	switch kind {
+	case 2:
+		return string(b), offset, nil
+	case 3:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 4:
+		// copy out, the mapping may go away on Reload
+		return append([]byte(nil), b...), offset, nil
+	case 5, 6, 9:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("invalid unsigned size %d", size)
+		}
+		var x uint64
+		for _, c := range b {
+			x = x<<8 | uint64(c)
+		}
+		return x, offset, nil
+	case 8:
+		var x int32
+		for _, c := range b {
+			x = x<<8 | int32(c)
+		}
+		return x, offset, nil
+	case 10:
+		// uint128 does not fit a machine word, hand out the raw bytes
+		return append([]byte(nil), b...), offset, nil
+	case 15:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size %d", size)
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), offset, nil
+	}
+
+	return nil, 0, fmt.Errorf("unsupported data type %d", kind)
+}
@@ -0,0 +1,197 @@
+package helpers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func mmdbEncode(b *bytes.Buffer, v interface{}) {
+	header := func(kind int, size int) {
+		ctrl := byte(0)
+		if kind <= 7 {
+			ctrl = byte(kind) << 5
+		}
+		if size < 29 {
+			b.WriteByte(ctrl | byte(size))
+		} else {
+			b.WriteByte(ctrl | 29)
+		}
+		if kind > 7 {
+			b.WriteByte(byte(kind - 7))
+		}
+		if size >= 29 {
+			b.WriteByte(byte(size - 29))
+		}
+	}
+
+	switch v := v.(type) {
+	case string:
+		header(2, len(v))
+		b.WriteString(v)
+	case uint32:
+		header(6, 4)
+		b.Write([]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		header(7, len(v))
+		for _, k := range keys {
+			mmdbEncode(b, k)
+			mmdbEncode(b, v[k])
+		}
+	}
+}
+
+// buildMMDB writes an IPv4 database of record_size 24 mapping each prefix to
+// its record.
+func buildMMDB(prefixes map[string]map[string]interface{}) []byte {
+	type node struct{ children [2]int }
+	const empty, leaf = -1, -2
+
+	nodes := []node{{[2]int{empty, empty}}}
+	leaves := map[[2]int]int{}
+	data := new(bytes.Buffer)
+
+	for prefix, record := range prefixes {
+		_, ipnet, _ := net.ParseCIDR(prefix)
+		ones, _ := ipnet.Mask.Size()
+		ip := ipnet.IP.To4()
+
+		n := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+			if i == ones-1 {
+				leaves[[2]int{n, bit}] = data.Len()
+				nodes[n].children[bit] = leaf
+				mmdbEncode(data, record)
+				break
+			}
+			if nodes[n].children[bit] == empty {
+				nodes = append(nodes, node{[2]int{empty, empty}})
+				nodes[n].children[bit] = len(nodes) - 1
+			}
+			n = nodes[n].children[bit]
+		}
+	}
+
+	b := new(bytes.Buffer)
+	for n, nd := range nodes {
+		for bit, c := range nd.children {
+			r := c
+			switch c {
+			case empty:
+				r = len(nodes)
+			case leaf:
+				r = len(nodes) + 16 + leaves[[2]int{n, bit}]
+			}
+			b.Write([]byte{byte(r >> 16), byte(r >> 8), byte(r)})
+		}
+	}
+	b.Write(make([]byte, 16))
+	b.Write(data.Bytes())
+	b.Write(mmdbMetadataMarker)
+	mmdbEncode(b, map[string]interface{}{
+		"node_count":    uint32(len(nodes)),
+		"record_size":   uint32(24),
+		"ip_version":    uint32(4),
+		"database_type": "GeoLite2-ASN",
+	})
+
+	return b.Bytes()
+}
+
+func TestMMDBLookupASN(t *testing.T) {
+	buf := buildMMDB(map[string]map[string]interface{}{
+		"8.8.8.0/24": {
+			"autonomous_system_number":       uint32(15169),
+			"autonomous_system_organization": "GOOGLE",
+		},
+		"1.1.1.0/24": {
+			"autonomous_system_number":       uint32(13335),
+			"autonomous_system_organization": "CLOUDFLARENET",
+		},
+	})
+
+	db, err := NewMMDB(buf)
+	if err != nil {
+		t.Fatalf("NewMMDB error: %v", err)
+	}
+
+	if v := db.DatabaseType(); v != "GeoLite2-ASN" {
+		t.Errorf("DatabaseType() = %#v, want %#v", v, "GeoLite2-ASN")
+	}
+
+	cases := []struct {
+		ip  string
+		asn uint
+		org string
+	}{
+		{"8.8.8.8", 15169, "GOOGLE"},
+		{"8.8.8.255", 15169, "GOOGLE"},
+		{"1.1.1.1", 13335, "CLOUDFLARENET"},
+		{"8.8.4.4", 0, ""},
+		{"2001:db8::1", 0, ""},
+	}
+
+	for _, c := range cases {
+		asn, org, err := db.LookupASN(net.ParseIP(c.ip))
+		if err != nil {
+			t.Errorf("LookupASN(%s) error: %v", c.ip, err)
+			continue
+		}
+		if asn != c.asn || org != c.org {
+			t.Errorf("LookupASN(%s) = %d, %#v, want %d, %#v", c.ip, asn, org, c.asn, c.org)
+		}
+	}
+}
+
+func TestMMDBReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mmdb")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "GeoLite2-ASN.mmdb")
+	record := func(asn uint32) []byte {
+		return buildMMDB(map[string]map[string]interface{}{
+			"8.8.8.0/24": {"autonomous_system_number": asn},
+		})
+	}
+
+	if err := ioutil.WriteFile(filename, record(15169), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile error: %v", err)
+	}
+
+	db, err := OpenMMDB(filename)
+	if err != nil {
+		t.Fatalf("OpenMMDB(%#v) error: %v", filename, err)
+	}
+	defer db.Close()
+
+	if asn, _, _ := db.LookupASN(net.ParseIP("8.8.8.8")); asn != 15169 {
+		t.Errorf("LookupASN(8.8.8.8) = %d, want %d", asn, 15169)
+	}
+
+	if err := ioutil.WriteFile(filename+".tmp", record(36040), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile error: %v", err)
+	}
+	if err := os.Rename(filename+".tmp", filename); err != nil {
+		t.Fatalf("os.Rename error: %v", err)
+	}
+	if err := db.Reload(); err != nil {
+		t.Fatalf("Reload error: %v", err)
+	}
+
+	if asn, _, _ := db.LookupASN(net.ParseIP("8.8.8.8")); asn != 36040 {
+		t.Errorf("LookupASN(8.8.8.8) after Reload = %d, want %d", asn, 36040)
+	}
+}
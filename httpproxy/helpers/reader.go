@@ -1,7 +1,13 @@
 package helpers
 
 import (
+	"errors"
 	"io"
+	"sync"
+)
+
+var (
+	ErrBodyTooLarge = errors.New("body exceeds the size limit")
 )
 
 type multiReadCloser struct {
@@ -57,3 +63,69 @@ func (x *xorReadCloser) Read(p []byte) (n int, err error) {
 func (x *xorReadCloser) Close() error {
 	return x.rc.Close()
 }
+
+type countReadCloser struct {
+	rc   io.ReadCloser
+	n    int64
+	once sync.Once
+	done func(n int64)
+}
+
+// NewCountReadCloser counts the bytes read from rc, and calls done with the
+// count once, at EOF, on a read error or on Close, whichever comes first.
+func NewCountReadCloser(rc io.ReadCloser, done func(n int64)) io.ReadCloser {
+	return &countReadCloser{
+		rc:   rc,
+		done: done,
+	}
+}
+
+func (r *countReadCloser) Read(p []byte) (n int, err error) {
+	n, err = r.rc.Read(p)
+	r.n += int64(n)
+	if err != nil {
+		r.once.Do(func() { r.done(r.n) })
+	}
+	return n, err
+}
+
+func (r *countReadCloser) Close() error {
+	r.once.Do(func() { r.done(r.n) })
+	return r.rc.Close()
+}
+
+type limitedReadCloser struct {
+	rc io.ReadCloser
+	n  int64
+}
+
+// NewLimitedReadCloser passes up to max bytes of rc through, a longer body
+// ends with ErrBodyTooLarge instead of io.EOF so it is not taken as complete.
+func NewLimitedReadCloser(rc io.ReadCloser, max int64) io.ReadCloser {
+	return &limitedReadCloser{
+		rc: rc,
+		n:  max,
+	}
+}
+
+func (r *limitedReadCloser) Read(p []byte) (n int, err error) {
+	if r.n <= 0 {
+		var b [1]byte
+		n, err = r.rc.Read(b[:])
+		if n > 0 {
+			return 0, ErrBodyTooLarge
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	n, err = r.rc.Read(p)
+	r.n -= int64(n)
+	return n, err
+}
+
+func (r *limitedReadCloser) Close() error {
+	return r.rc.Close()
+}
@@ -0,0 +1,24 @@
+// +build windows plan9
+
+package helpers
+
+import (
+	"errors"
+	"io"
+)
+
+type SyslogWriter struct {
+	Fallback io.Writer
+}
+
+func NewSyslogWriter(network, raddr, facility, tag string) (*SyslogWriter, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
+
+func (w *SyslogWriter) Write(b []byte) (int, error) {
+	return w.Fallback.Write(b)
+}
+
+func (w *SyslogWriter) Close() error {
+	return nil
+}
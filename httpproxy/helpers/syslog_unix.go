@@ -0,0 +1,190 @@
+// +build !windows,!plan9
+
+package helpers
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// SyslogBufferTime is how long lines are kept while the syslog server is
+	// unreachable, before they go to the fallback writer.
+	SyslogBufferTime = 5 * time.Second
+	// SyslogRetryInterval spaces reconnects to an unreachable syslog server.
+	SyslogRetryInterval = time.Second
+
+	syslogMaxPending = 1024
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// SyslogWriter writes each line at info level to a syslog server. While the
+// server is unreachable lines are buffered for SyslogBufferTime, then written
+// to Fallback, os.Stderr by default. Reconnects dial in the background, so
+// writers never wait on them.
+type SyslogWriter struct {
+	Fallback io.Writer
+
+	network  string
+	raddr    string
+	priority syslog.Priority
+	tag      string
+
+	mu        sync.Mutex
+	w         *syslog.Writer
+	dialing   bool
+	closed    bool
+	retryAt   time.Time
+	pending   [][]byte
+	pendingAt time.Time
+}
+
+// NewSyslogWriter returns a SyslogWriter to raddr over network, both empty for
+// the local syslog daemon. facility is a name like "daemon" or "local0".
+func NewSyslogWriter(network, raddr, facility, tag string) (*SyslogWriter, error) {
+	if facility == "" {
+		facility = "daemon"
+	}
+	priority, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %#v", facility)
+	}
+
+	w := &SyslogWriter{
+		Fallback: os.Stderr,
+		network:  network,
+		raddr:    raddr,
+		priority: priority | syslog.LOG_INFO,
+		tag:      tag,
+	}
+
+	// nothing writes yet, the first dial may block
+	w.dialing = true
+	w.redial()
+
+	return w, nil
+}
+
+// dial starts a reconnect once SyslogRetryInterval has passed, w.mu held.
+func (w *SyslogWriter) dial() {
+	if w.w != nil || w.dialing || w.closed || time.Now().Before(w.retryAt) {
+		return
+	}
+	w.dialing = true
+	go w.redial()
+}
+
+// redial dials the syslog server without w.mu, then swaps the writer in and
+// sends the lines buffered meanwhile.
+func (w *SyslogWriter) redial() {
+	sw, err := syslog.Dial(w.network, w.raddr, w.priority, w.tag)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.dialing = false
+	switch {
+	case err != nil:
+		w.retryAt = time.Now().Add(SyslogRetryInterval)
+	case w.closed:
+		sw.Close()
+	default:
+		w.w = sw
+		w.flush()
+	}
+}
+
+// flush sends the pending lines, w.mu held.
+func (w *SyslogWriter) flush() {
+	for w.w != nil && len(w.pending) > 0 {
+		if _, err := w.w.Write(w.pending[0]); err != nil {
+			w.broken()
+			break
+		}
+		w.pending = w.pending[1:]
+	}
+}
+
+func (w *SyslogWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.dial()
+	w.flush()
+
+	if w.w != nil && len(w.pending) == 0 {
+		if _, err := w.w.Write(b); err == nil {
+			return len(b), nil
+		}
+		w.broken()
+	}
+
+	if len(w.pending) == 0 {
+		w.pendingAt = time.Now()
+	}
+	w.pending = append(w.pending, append([]byte(nil), b...))
+
+	if time.Since(w.pendingAt) >= SyslogBufferTime || len(w.pending) > syslogMaxPending {
+		for _, p := range w.pending {
+			w.Fallback.Write(p)
+			if len(p) > 0 && p[len(p)-1] != '\n' {
+				w.Fallback.Write([]byte{'\n'})
+			}
+		}
+		w.pending = nil
+	}
+
+	return len(b), nil
+}
+
+func (w *SyslogWriter) broken() {
+	w.w.Close()
+	w.w = nil
+	w.retryAt = time.Now().Add(SyslogRetryInterval)
+}
+
+func (w *SyslogWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+
+	for _, p := range w.pending {
+		w.Fallback.Write(p)
+	}
+	w.pending = nil
+
+	if w.w == nil {
+		return nil
+	}
+	err := w.w.Close()
+	w.w = nil
+	return err
+}
@@ -0,0 +1,128 @@
+// +build !windows,!plan9
+
+package helpers
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogWriter(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket error: %v", err)
+	}
+	defer conn.Close()
+
+	w, err := NewSyslogWriter("udp", conn.LocalAddr().String(), "local0", "goproxy")
+	if err != nil {
+		t.Fatalf("NewSyslogWriter error: %v", err)
+	}
+	defer w.Close()
+
+	if _, err := w.Write([]byte("127.0.0.1:1234 \"DIRECT GET http://example.org/ HTTP/1.1\" 200 0\n")); err != nil {
+		t.Fatalf("SyslogWriter.Write error: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b := make([]byte, 2048)
+	n, _, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("syslog listener ReadFrom error: %v", err)
+	}
+
+	record := string(b[:n])
+	// local0.info is 16*8+6
+	if !strings.HasPrefix(record, "<134>") || !strings.Contains(record, "goproxy") || !strings.Contains(record, "\"DIRECT GET http://example.org/ HTTP/1.1\" 200 0") {
+		t.Errorf("syslog record = %#v", record)
+	}
+}
+
+func TestSyslogWriterFallback(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	bufferTime := SyslogBufferTime
+	SyslogBufferTime = 50 * time.Millisecond
+	defer func() { SyslogBufferTime = bufferTime }()
+
+	w, err := NewSyslogWriter("tcp", addr, "daemon", "goproxy")
+	if err != nil {
+		t.Fatalf("NewSyslogWriter error: %v", err)
+	}
+	fallback := new(bytes.Buffer)
+	w.Fallback = fallback
+
+	w.Write([]byte("first\n"))
+	if fallback.Len() != 0 {
+		t.Errorf("SyslogWriter wrote %#v to Fallback before SyslogBufferTime", fallback.String())
+	}
+
+	time.Sleep(SyslogBufferTime)
+	w.Write([]byte("second\n"))
+	if v := fallback.String(); v != "first\nsecond\n" {
+		t.Errorf("SyslogWriter Fallback = %#v, want both buffered lines", v)
+	}
+}
+
+func TestSyslogWriterFacility(t *testing.T) {
+	if _, err := NewSyslogWriter("udp", "127.0.0.1:514", "nosuch", ""); err == nil {
+		t.Errorf("NewSyslogWriter(facility=nosuch) return no error")
+	}
+}
+
+func TestSyslogWriterReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	retryInterval := SyslogRetryInterval
+	SyslogRetryInterval = 10 * time.Millisecond
+	defer func() { SyslogRetryInterval = retryInterval }()
+
+	w, err := NewSyslogWriter("tcp", addr, "daemon", "goproxy")
+	if err != nil {
+		t.Fatalf("NewSyslogWriter error: %v", err)
+	}
+	defer w.Close()
+	w.Fallback = new(bytes.Buffer)
+
+	w.Write([]byte("buffered\n"))
+
+	if ln, err = net.Listen("tcp", addr); err != nil {
+		t.Skipf("net.Listen(%#v) again error: %v", addr, err)
+	}
+	defer ln.Close()
+
+	// a write after the retry interval starts the dial, which sends the
+	// buffered line once it is through
+	time.Sleep(2 * SyslogRetryInterval)
+	w.Write([]byte("next\n"))
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("syslog listener Accept error: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var got []byte
+	b := make([]byte, 2048)
+	for !bytes.Contains(got, []byte("buffered")) {
+		n, err := conn.Read(b)
+		if err != nil {
+			t.Fatalf("syslog conn Read error: %v, read %#v", err, string(got))
+		}
+		got = append(got, b[:n]...)
+	}
+}
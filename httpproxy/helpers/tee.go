@@ -0,0 +1,95 @@
+package helpers
+
+import (
+	"io"
+	"sync"
+)
+
+type teeBranch struct {
+	ch   chan []byte
+	done chan struct{}
+	once sync.Once
+	buf  []byte
+	err  error
+}
+
+func (b *teeBranch) Read(p []byte) (int, error) {
+	if len(b.buf) == 0 {
+		chunk, ok := <-b.ch
+		if !ok {
+			return 0, b.err
+		}
+		b.buf = chunk
+	}
+
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+func (b *teeBranch) Close() error {
+	b.once.Do(func() { close(b.done) })
+	return nil
+}
+
+// NewTeeReadClosers returns n readers which all read the content of rc, for
+// sending one request body to several upstreams concurrently. A branch may run
+// at most bufsize bytes ahead of the slowest open branch; closing a branch
+// stops feeding it. rc is closed once it is drained or all branches are closed.
+func NewTeeReadClosers(rc io.ReadCloser, n int, bufsize int) []io.ReadCloser {
+	chunks := bufsize / BUFSZ
+	if chunks < 1 {
+		chunks = 1
+	}
+
+	branches := make([]*teeBranch, n)
+	rcs := make([]io.ReadCloser, n)
+	for i := range branches {
+		branches[i] = &teeBranch{
+			ch:   make(chan []byte, chunks),
+			done: make(chan struct{}),
+		}
+		rcs[i] = branches[i]
+	}
+
+	go func() {
+		defer rc.Close()
+
+		for {
+			buf := make([]byte, BUFSZ)
+			nr, err := rc.Read(buf)
+
+			open := 0
+			if nr > 0 {
+				for _, b := range branches {
+					select {
+					case b.ch <- buf[:nr]:
+						open++
+					case <-b.done:
+					}
+				}
+			} else {
+				for _, b := range branches {
+					select {
+					case <-b.done:
+					default:
+						open++
+					}
+				}
+			}
+
+			if err != nil || open == 0 {
+				if err == nil {
+					err = io.ErrClosedPipe
+				}
+				for _, b := range branches {
+					b.err = err
+					close(b.ch)
+				}
+				return
+			}
+		}
+	}()
+
+	return rcs
+}
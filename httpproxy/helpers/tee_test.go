@@ -0,0 +1,36 @@
+package helpers
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestTeeReadClosers(t *testing.T) {
+	data := make([]byte, 1024*1024)
+	rand.Read(data)
+
+	rcs := NewTeeReadClosers(ioutil.NopCloser(bytes.NewReader(data)), 3, 64*1024)
+
+	// the last branch gives up early, it must not block the others
+	rcs[2].Close()
+
+	var wg sync.WaitGroup
+	for _, rc := range rcs[:2] {
+		wg.Add(1)
+		go func(rc io.ReadCloser) {
+			defer wg.Done()
+			b, err := ioutil.ReadAll(rc)
+			if err != nil {
+				t.Errorf("ioutil.ReadAll(%T) error: %v", rc, err)
+			}
+			if !bytes.Equal(b, data) {
+				t.Errorf("tee branch returns %d corrupted bytes", len(b))
+			}
+		}(rc)
+	}
+	wg.Wait()
+}
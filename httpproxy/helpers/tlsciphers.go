@@ -8,6 +8,11 @@ const (
 	TLS_RSA_WITH_AES_128_CBC_SHA256       uint16 = 0x003c
 	TLS_RSA_WITH_AES_256_CBC_SHA256       uint16 = 0x003d
 	TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256 uint16 = 0xc027
+	TLS_AES_128_GCM_SHA256                uint16 = 0x1301
+	TLS_AES_256_GCM_SHA384                uint16 = 0x1302
+	TLS_CHACHA20_POLY1305_SHA256          uint16 = 0x1303
+
+	VersionTLS13 uint16 = 0x0304
 )
 
 func Cipher(name string) uint16 {
@@ -52,6 +57,16 @@ func Cipher(name string) uint16 {
 		return tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
 	case "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":
 		return tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384
+	case "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":
+		return tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305
+	case "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":
+		return tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305
+	case "TLS_AES_128_GCM_SHA256":
+		return TLS_AES_128_GCM_SHA256
+	case "TLS_AES_256_GCM_SHA384":
+		return TLS_AES_256_GCM_SHA384
+	case "TLS_CHACHA20_POLY1305_SHA256":
+		return TLS_CHACHA20_POLY1305_SHA256
 	}
 	return 0
 }
@@ -98,6 +113,32 @@ func CipherName(value uint16) string {
 		return "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"
 	case tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384:
 		return "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"
+	case tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305:
+		return "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305"
+	case tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:
+		return "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305"
+	case TLS_AES_128_GCM_SHA256:
+		return "TLS_AES_128_GCM_SHA256"
+	case TLS_AES_256_GCM_SHA384:
+		return "TLS_AES_256_GCM_SHA384"
+	case TLS_CHACHA20_POLY1305_SHA256:
+		return "TLS_CHACHA20_POLY1305_SHA256"
+	}
+	return ""
+}
+
+func TLSVersionName(version uint16) string {
+	switch version {
+	case tls.VersionSSL30:
+		return "SSL3.0"
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case VersionTLS13:
+		return "TLS1.3"
 	}
 	return ""
 }
@@ -0,0 +1,79 @@
+package helpers
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// RequestTiming records the phases of a client request through httptrace.
+type RequestTiming struct {
+	mu           sync.Mutex
+	Start        time.Time
+	DNSStart     time.Time
+	DNSDone      time.Time
+	ConnectStart time.Time
+	ConnectDone  time.Time
+	TLSStart     time.Time
+	TLSDone      time.Time
+	FirstByte    time.Time
+	RemoteAddr   string
+	Reused       bool
+}
+
+func NewRequestTiming() (*RequestTiming, *httptrace.ClientTrace) {
+	t := &RequestTiming{Start: time.Now()}
+
+	set := func(p *time.Time) {
+		t.mu.Lock()
+		if p.IsZero() {
+			*p = time.Now()
+		}
+		t.mu.Unlock()
+	}
+
+	trace := &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { set(&t.DNSStart) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { set(&t.DNSDone) },
+		ConnectStart:      func(string, string) { set(&t.ConnectStart) },
+		ConnectDone:       func(string, string, error) { set(&t.ConnectDone) },
+		TLSHandshakeStart: func() { set(&t.TLSStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { set(&t.TLSDone) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.Reused = info.Reused
+			if info.Conn != nil {
+				t.RemoteAddr = info.Conn.RemoteAddr().String()
+			}
+			t.mu.Unlock()
+		},
+		GotFirstResponseByte: func() { set(&t.FirstByte) },
+	}
+
+	return t, trace
+}
+
+func since(start, end time.Time) time.Duration {
+	if start.IsZero() || end.IsZero() {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+// String returns the phase breakdown up to now, e.g.
+// "remote=1.2.3.4:443 dns=12ms connect=30ms tls=61ms ttfb=180ms total=250ms".
+func (t *RequestTiming) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return fmt.Sprintf("remote=%s reused=%v dns=%s connect=%s tls=%s ttfb=%s total=%s",
+		t.RemoteAddr,
+		t.Reused,
+		since(t.DNSStart, t.DNSDone),
+		since(t.ConnectStart, t.ConnectDone),
+		since(t.TLSStart, t.TLSDone),
+		since(t.Start, t.FirstByte),
+		time.Since(t.Start))
+}
@@ -3,6 +3,9 @@ package helpers
 import (
 	"net"
 	"net/http"
+	"strings"
+
+	"github.com/phuslu/glog"
 )
 
 var (
@@ -58,6 +61,9 @@ func TryCloseConnectionByRemoteAddr(tr http.RoundTripper, addr string) bool {
 	return false
 }
 
+// FixRequestURL fills in the host of the url of req from its Host or SNI,
+// and lowercases it, so that a transport pools the conns of "Example.com" and
+// "example.com" together. The Host header keeps its case.
 func FixRequestURL(req *http.Request) {
 	if req.URL.Host == "" {
 		switch {
@@ -67,6 +73,67 @@ func FixRequestURL(req *http.Request) {
 			req.URL.Host = req.TLS.ServerName
 		}
 	}
+	// ipv6 zones are case sensitive
+	if !strings.Contains(req.URL.Host, "%") {
+		req.URL.Host = strings.ToLower(req.URL.Host)
+	}
+}
+
+// ProxyConnection honors the Proxy-Connection header legacy clients send for
+// their conn to the proxy, apart from the end to end Connection one, and
+// removes it, it is hop-by-hop. "close" closes the conn after the response,
+// "keep-alive" is what HTTP/1.1 conns do anyway; http.Server reads HTTP/1.0
+// keep-alive off the Connection header alone, before handlers run.
+func ProxyConnection(rw http.ResponseWriter, req *http.Request) {
+	v := req.Header.Get("Proxy-Connection")
+	if v == "" {
+		return
+	}
+	req.Header.Del("Proxy-Connection")
+
+	if req.ProtoMajor == 1 && strings.EqualFold(strings.TrimSpace(v), "close") {
+		rw.Header().Set("Connection", "close")
+	}
+}
+
+const (
+	AmbiguousFramingReject = "reject"
+	AmbiguousFramingStrip  = "strip"
+)
+
+// AmbiguousFraming handles a request with a Content-Length beside a chunked
+// Transfer-Encoding, which an upstream reading the body by the other one
+// splits into two requests, a smuggling vector. AmbiguousFramingStrip drops the
+// Content-Length and forwards it chunked, as RFC 7230 3.3.3 reads it, any
+// other mode answers 400 and closes the conn. It returns false if it answered.
+// Newer net/http servers drop such a Content-Length before handlers run, the
+// listeners check the raw heads with ListenOptions.AmbiguousFraming for that,
+// this catches the ones left over TLS on older Go and constructed requests.
+func AmbiguousFraming(rw http.ResponseWriter, req *http.Request, mode string) bool {
+	cl, ok := req.Header["Content-Length"]
+	if !ok {
+		return true
+	}
+	chunked := len(req.TransferEncoding) > 0 && req.TransferEncoding[0] == "chunked"
+	for _, v := range req.Header["Transfer-Encoding"] {
+		chunked = chunked || strings.Contains(strings.ToLower(v), "chunked")
+	}
+	if !chunked {
+		return true
+	}
+
+	if mode == AmbiguousFramingStrip {
+		glog.Warningf("%s \"%s %s %s\" Content-Length %v with a chunked Transfer-Encoding, strips it and forwards the body chunked", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, cl)
+		req.Header.Del("Content-Length")
+		req.ContentLength = -1
+		return true
+	}
+
+	glog.Warningf("%s \"%s %s %s\" Content-Length %v with a chunked Transfer-Encoding, rejected", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, cl)
+	// the rest of the conn is framed two ways too
+	rw.Header().Set("Connection", "close")
+	http.Error(rw, "Content-Length with a chunked Transfer-Encoding", http.StatusBadRequest)
+	return false
 }
 
 // CloneRequest returns a clone of the provided *http.Request.
@@ -90,3 +157,25 @@ func GetHostName(req *http.Request) string {
 		return req.Host
 	}
 }
+
+func headerSize(h http.Header) int {
+	n := 2 // blank line
+	for key, values := range h {
+		for _, value := range values {
+			n += len(key) + len(": ") + len(value) + len("\r\n")
+		}
+	}
+	return n
+}
+
+// RequestHeaderSize returns the size of the request line and headers of req
+// in HTTP/1.1 wire format.
+func RequestHeaderSize(req *http.Request) int {
+	return len(req.Method) + len(" ") + len(req.URL.RequestURI()) + len(" HTTP/1.1\r\n") + len("Host: \r\n") + len(req.Host) + headerSize(req.Header)
+}
+
+// ResponseHeaderSize returns the size of the status line and headers of resp
+// in HTTP/1.1 wire format.
+func ResponseHeaderSize(resp *http.Response) int {
+	return len("HTTP/1.1 000 ") + len(http.StatusText(resp.StatusCode)) + len("\r\n") + headerSize(resp.Header)
+}
@@ -1,9 +1,17 @@
 package helpers
 
 import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestTryCloseConnections(t *testing.T) {
@@ -11,3 +19,108 @@ func TestTryCloseConnections(t *testing.T) {
 		t.Errorf("go %+v net/http does not support CloseConnections()", runtime.Version())
 	}
 }
+
+func TestHeaderSize(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "http://example.org/index.html?a=1", nil)
+	req.Header.Set("Accept", "*/*")
+
+	b := new(bytes.Buffer)
+	req.Header.Write(b)
+	want := len("GET /index.html?a=1 HTTP/1.1\r\nHost: example.org\r\n") + b.Len() + len("\r\n")
+	if n := RequestHeaderSize(req); n != want {
+		t.Errorf("RequestHeaderSize(%#v) = %d, want %d", req.URL.String(), n, want)
+	}
+
+	resp := &http.Response{StatusCode: http.StatusOK, Header: req.Header}
+	want = len("HTTP/1.1 200 OK\r\n") + b.Len() + len("\r\n")
+	if n := ResponseHeaderSize(resp); n != want {
+		t.Errorf("ResponseHeaderSize() = %d, want %d", n, want)
+	}
+}
+
+func TestProxyConnection(t *testing.T) {
+	leaked := make(chan string, 4)
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ProxyConnection(rw, req)
+		leaked <- req.Header.Get("Proxy-Connection")
+		io.WriteString(rw, "ok")
+	}))
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial failed: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(c)
+
+	get := func(proxyConnection string) *http.Response {
+		io.WriteString(c, "GET http://example.org/ HTTP/1.1\r\nHost: example.org\r\nProxy-Connection: "+proxyConnection+"\r\n\r\n")
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("http.ReadResponse with Proxy-Connection %#v failed: %v", proxyConnection, err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if v := <-leaked; v != "" {
+			t.Errorf("Proxy-Connection %#v left in the request: %#v", proxyConnection, v)
+		}
+		return resp
+	}
+
+	// keep-alive twice on the same conn
+	for i := 0; i < 2; i++ {
+		if resp := get("keep-alive"); resp.Close {
+			t.Fatalf("Proxy-Connection keep-alive response %d closes the conn", i)
+		}
+	}
+
+	if resp := get("close"); !resp.Close {
+		t.Errorf("Proxy-Connection close response has no Connection: close")
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("conn after Proxy-Connection close read error = %v, want io.EOF", err)
+	}
+}
+
+func TestAmbiguousFraming(t *testing.T) {
+	cases := []struct {
+		Header    http.Header
+		Chunked   bool
+		Mode      string
+		OK        bool
+		Length    string
+		Forwarded int64
+	}{
+		{http.Header{"Content-Length": {"5"}}, false, AmbiguousFramingReject, true, "5", 5},
+		{http.Header{}, true, AmbiguousFramingReject, true, "", -1},
+		{http.Header{"Content-Length": {"5"}}, true, AmbiguousFramingReject, false, "", 0},
+		{http.Header{"Content-Length": {"5"}, "Transfer-Encoding": {"gzip, chunked"}}, false, "", false, "", 0},
+		{http.Header{"Content-Length": {"5"}}, true, AmbiguousFramingStrip, true, "", -1},
+		{http.Header{"Content-Length": {"5"}, "Transfer-Encoding": {"chunked"}}, false, AmbiguousFramingStrip, true, "", -1},
+	}
+
+	for i, c := range cases {
+		req, _ := http.NewRequest(http.MethodPost, "http://example.org/", strings.NewReader("0\r\n\r\n"))
+		req.Header = c.Header
+		if c.Chunked {
+			req.TransferEncoding = []string{"chunked"}
+			req.ContentLength = -1
+		}
+
+		rw := httptest.NewRecorder()
+		if ok := AmbiguousFraming(rw, req, c.Mode); ok != c.OK {
+			t.Errorf("#%d AmbiguousFraming(%v, chunked=%v, %#v) = %v, want %v", i, c.Header, c.Chunked, c.Mode, ok, c.OK)
+		}
+		if !c.OK && (rw.Code != http.StatusBadRequest || rw.Header().Get("Connection") != "close") {
+			t.Errorf("#%d AmbiguousFraming(%v, %#v) answers %d Connection %#v, want 400 close", i, c.Header, c.Mode, rw.Code, rw.Header().Get("Connection"))
+		}
+		if v := req.Header.Get("Content-Length"); c.OK && v != c.Length {
+			t.Errorf("#%d AmbiguousFraming(%v, %#v) leaves Content-Length %#v, want %#v", i, c.Header, c.Mode, v, c.Length)
+		}
+		if c.OK && req.ContentLength != c.Forwarded {
+			t.Errorf("#%d AmbiguousFraming(%v, %#v) leaves ContentLength %d, want %d", i, c.Header, c.Mode, req.ContentLength, c.Forwarded)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package helpers
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Upstreams are the upstream proxies filters dial through by name, drained by
+// the admin filter.
+var Upstreams = NewUpstreamRegistry()
+
+// An Upstream is the state of an upstream proxy. A draining one gets no new
+// sessions, tunnels or requests, and is safe to remove once the ones it has
+// are over.
+type Upstream struct {
+	draining int32
+	active   int64
+}
+
+func (u *Upstream) Draining() bool {
+	return atomic.LoadInt32(&u.draining) != 0
+}
+
+func (u *Upstream) SetDraining(draining bool) {
+	var v int32
+	if draining {
+		v = 1
+	}
+	atomic.StoreInt32(&u.draining, v)
+}
+
+// Begin counts a session through u, which calls End when it is over.
+func (u *Upstream) Begin() {
+	atomic.AddInt64(&u.active, 1)
+}
+
+func (u *Upstream) End() {
+	atomic.AddInt64(&u.active, -1)
+}
+
+// Active returns the number of sessions through u.
+func (u *Upstream) Active() int64 {
+	return atomic.LoadInt64(&u.active)
+}
+
+type UpstreamStats struct {
+	Draining bool
+	Active   int64
+	// Drained is set for draining upstreams without sessions left
+	Drained bool
+}
+
+type UpstreamRegistry struct {
+	mu        sync.Mutex
+	upstreams map[string]*Upstream
+}
+
+func NewUpstreamRegistry() *UpstreamRegistry {
+	return &UpstreamRegistry{upstreams: make(map[string]*Upstream)}
+}
+
+// Get returns the Upstream of name, a new one the first time.
+func (r *UpstreamRegistry) Get(name string) *Upstream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.upstreams[name]
+	if !ok {
+		u = &Upstream{}
+		r.upstreams[name] = u
+	}
+	return u
+}
+
+// Lookup returns the Upstream of name if a filter dials through it.
+func (r *UpstreamRegistry) Lookup(name string) (*Upstream, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	u, ok := r.upstreams[name]
+	return u, ok
+}
+
+func (r *UpstreamRegistry) Stats() map[string]UpstreamStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m := make(map[string]UpstreamStats, len(r.upstreams))
+	for name, u := range r.upstreams {
+		s := UpstreamStats{Draining: u.Draining(), Active: u.Active()}
+		s.Drained = s.Draining && s.Active == 0
+		m[name] = s
+	}
+	return m
+}
@@ -1,43 +1,100 @@
 package httpproxy
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/phuslu/glog"
+	"github.com/phuslu/net/http2"
 
+	"./dialer"
 	"./filters"
 	"./helpers"
 	"./storage"
 
+	_ "./filters/abtest"
+	_ "./filters/admin"
 	_ "./filters/auth"
 	_ "./filters/autoproxy"
 	_ "./filters/autorange"
+	_ "./filters/cache"
+	_ "./filters/contenttypeacl"
+	_ "./filters/deadletter"
 	_ "./filters/direct"
 	_ "./filters/gae"
+	_ "./filters/hostratelimit"
+	_ "./filters/httpsredirect"
+	_ "./filters/maintenance"
+	_ "./filters/methodacl"
 	_ "./filters/php"
+	_ "./filters/querynorm"
 	_ "./filters/ratelimit"
+	_ "./filters/requestid"
 	_ "./filters/rewrite"
+	_ "./filters/secheaders"
+	_ "./filters/signing"
 	_ "./filters/ssh2"
+	_ "./filters/statusrewrite"
 	_ "./filters/stripssl"
+	_ "./filters/throttle"
+	_ "./filters/transcode"
 	_ "./filters/vps"
 )
 
 type configType map[string]struct {
-	Enabled          bool
-	Address          string
+	Enabled  bool
+	Address  string
+	Listener struct {
+		UnixSocket     string
+		UnixSocketMode string
+		TLS            struct {
+			CertFile     string
+			KeyFile      string
+			ClientCAFile string
+			// RequireClientCert refuses clients without a cert ClientCAFile
+			// verifies, otherwise a cert is only verified if given
+			RequireClientCert bool
+		}
+		// IdleTimeout in seconds closes keep-alive conns of clients idle
+		// between requests, 0 for ReadTimeout
+		IdleTimeout int
+		// AmbiguousFraming is what requests with a Content-Length beside a
+		// chunked Transfer-Encoding get, "reject" or "strip"
+		AmbiguousFraming string
+	}
 	KeepAlivePeriod  int
 	ReadTimeout      int
 	WriteTimeout     int
+	HTTP2            bool
 	RequestFilters   []string
 	RoundTripFilters []string
 	ResponseFilters  []string
+	FairQueue        struct {
+		MaxInflight   int
+		DefaultWeight int
+		Weights       map[string]int
+	}
+	// ErrorResponseDelay, plus up to ErrorResponseJitter, in seconds holds
+	// back the 403, 407 and 429 rejections of the proxy itself
+	ErrorResponseDelay  float32
+	ErrorResponseJitter float32
 }
 
 var (
 	Config configType
+
+	servers   = make(map[string]*http.Server)
+	listeners = make(map[string]helpers.Listener)
+	serversMu sync.Mutex
 )
 
 func init() {
@@ -57,11 +114,46 @@ func ServeProfile(profile string) error {
 		return fmt.Errorf("profile(%#v) not exists", profile)
 	}
 
+	var err error
 	listenOpts := &helpers.ListenOptions{TLSConfig: nil}
 
-	ln, err := helpers.ListenTCP("tcp", config.Address, listenOpts)
-	if err != nil {
-		glog.Fatalf("ListenTCP(%s, %#v) error: %s", config.Address, listenOpts, err)
+	framing := config.Listener.AmbiguousFraming
+	switch framing {
+	case "":
+		framing = helpers.AmbiguousFramingReject
+	case helpers.AmbiguousFramingReject, helpers.AmbiguousFramingStrip:
+	default:
+		glog.Fatalf("profile(%#v) invalid Listener.AmbiguousFraming %#v, want %#v or %#v", profile, framing, helpers.AmbiguousFramingReject, helpers.AmbiguousFramingStrip)
+	}
+	listenOpts.AmbiguousFraming = framing
+	if c := config.Listener.TLS; c.CertFile != "" {
+		listenOpts.TLSConfig, err = listenerTLSConfig(c.CertFile, c.KeyFile, c.ClientCAFile, c.RequireClientCert)
+		if err != nil {
+			glog.Fatalf("profile(%#v) invalid Listener.TLS: %s", profile, err)
+		}
+		if config.HTTP2 {
+			listenOpts.TLSConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+	}
+
+	var ln helpers.Listener
+	if config.Listener.UnixSocket != "" {
+		mode := uint64(0660)
+		if config.Listener.UnixSocketMode != "" {
+			mode, err = strconv.ParseUint(config.Listener.UnixSocketMode, 8, 32)
+			if err != nil {
+				glog.Fatalf("profile(%#v) invalid Listener.UnixSocketMode %#v: %s", profile, config.Listener.UnixSocketMode, err)
+			}
+		}
+		ln, err = helpers.ListenUnix(config.Listener.UnixSocket, os.FileMode(mode), listenOpts)
+		if err != nil {
+			glog.Fatalf("ListenUnix(%s, %#v) error: %s", config.Listener.UnixSocket, listenOpts, err)
+		}
+	} else {
+		ln, err = helpers.ListenTCP("tcp", config.Address, listenOpts)
+		if err != nil {
+			glog.Fatalf("ListenTCP(%s, %#v) error: %s", config.Address, listenOpts, err)
+		}
 	}
 
 	requestFilters, roundtripFilters, responseFilters := getFilters(profile)
@@ -71,17 +163,100 @@ func ServeProfile(profile string) error {
 		RequestFilters:   requestFilters,
 		RoundTripFilters: roundtripFilters,
 		ResponseFilters:  responseFilters,
+		ClientConns:      filters.NewClientConns(),
+		AmbiguousFraming: framing,
+	}
+
+	if config.FairQueue.MaxInflight > 0 {
+		h.Queue = helpers.NewFairQueue(config.FairQueue.MaxInflight, config.FairQueue.DefaultWeight, config.FairQueue.Weights)
+	}
+
+	if config.ErrorResponseDelay > 0 || config.ErrorResponseJitter > 0 {
+		h.ErrorDelay = &filters.ErrorDelay{
+			Delay:  time.Duration(config.ErrorResponseDelay*1000) * time.Millisecond,
+			Jitter: time.Duration(config.ErrorResponseJitter*1000) * time.Millisecond,
+		}
 	}
 
 	s := &http.Server{
 		Handler:        h,
 		ReadTimeout:    time.Duration(config.ReadTimeout) * time.Second,
 		WriteTimeout:   time.Duration(config.WriteTimeout) * time.Second,
+		IdleTimeout:    time.Duration(config.Listener.IdleTimeout) * time.Second,
 		MaxHeaderBytes: 1 << 20,
+		ConnState:      h.ClientConns.ConnState,
 	}
 
+	// serves h2 on conns which negotiated it, e.g. stripssl ones with HTTP2
+	if config.HTTP2 {
+		if err := http2.ConfigureServer(s, &http2.Server{}); err != nil {
+			glog.Fatalf("http2.ConfigureServer(%#v) error: %v", profile, err)
+		}
+	}
+
+	serversMu.Lock()
+	servers[profile] = s
+	listeners[profile] = ln
+	serversMu.Unlock()
+
 	glog.Infof("ListenAndServe(%#v) on %s\n", profile, h.Listener.Addr().String())
-	return s.Serve(h.Listener)
+	err = s.Serve(h.Listener)
+	if err == http.ErrServerClosed {
+		err = nil
+	}
+	return err
+}
+
+// listenerTLSConfig terminates client TLS with the cert of certFile, asking
+// clients for certs clientCAFile signed if it is set.
+func listenerTLSConfig(certFile, keyFile, clientCAFile string, requireClientCert bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if clientCAFile != "" {
+		data, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate found in %#v", clientCAFile)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if requireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return config, nil
+}
+
+// Shutdown stops all profiles from accepting, then drains their requests and
+// tunnels until ctx is done. Conns left then get grace more to finish before
+// they are force closed. The DNS caches are written to their DNSExportFile
+// last.
+func Shutdown(ctx context.Context, grace time.Duration) error {
+	serversMu.Lock()
+	lns := make([]helpers.Listener, 0, len(listeners))
+	for profile, s := range servers {
+		s.SetKeepAlivesEnabled(false)
+		// closes the listener and idle conns, hijacked ones are left to Drain
+		go s.Shutdown(ctx)
+		lns = append(lns, listeners[profile])
+	}
+	serversMu.Unlock()
+
+	err := helpers.Drain(ctx, grace, lns...)
+	if err1 := dialer.ExportDNSFiles(); err1 != nil {
+		glog.Warningf("dialer.ExportDNSFiles() error: %v", err1)
+	}
+	return err
 }
 
 func getFilters(profile string) ([]filters.RequestFilter, []filters.RoundTripFilter, []filters.ResponseFilter) {
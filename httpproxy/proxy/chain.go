@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+)
+
+// FromURLs returns a Dialer tunneling through each proxy of urls in order,
+// every proxy is dialed through the ones before it and the last one dials the
+// target. The schemes may be mixed, e.g. socks5 hops behind a http one. Each
+// URL carries its own auth, only the last hop uses resolver, the addresses of
+// the inner proxies are resolved by the hop reaching them. A failed dial
+// returns a *ChainError naming the hop which failed.
+func FromURLs(urls []*url.URL, forward Dialer, resolver Resolver) (Dialer, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("proxy: empty proxy chain")
+	}
+
+	d := forward
+	for i, u := range urls {
+		var r Resolver
+		if i == len(urls)-1 {
+			r = resolver
+		}
+
+		hop, err := FromURL(u, d, r)
+		if err != nil {
+			return nil, &ChainError{Hop: i + 1, URL: redactURL(u), Err: err}
+		}
+		d = &chainHop{Dialer: hop, hop: i + 1, url: redactURL(u)}
+	}
+
+	return d, nil
+}
+
+// A ChainError is the error of hop Hop, counted from 1, of a FromURLs chain.
+// The URL is without the password.
+type ChainError struct {
+	Hop int
+	URL string
+	Err error
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("proxy: chain hop %d %s: %v", e.Hop, e.URL, e.Err)
+}
+
+// chainHop is a hop of a FromURLs chain, it tells its errors from the ones of
+// the hops before it, which are already ChainErrors.
+type chainHop struct {
+	Dialer
+	hop int
+	url string
+}
+
+func (h *chainHop) Dial(network, addr string) (net.Conn, error) {
+	conn, err := h.Dialer.Dial(network, addr)
+	if err != nil {
+		if _, ok := err.(*ChainError); !ok {
+			err = &ChainError{Hop: h.hop, URL: h.url, Err: err}
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+func redactURL(u *url.URL) string {
+	if _, ok := u.User.Password(); !ok {
+		return u.String()
+	}
+	u1 := *u
+	u1.User = url.UserPassword(u.User.Username(), "xxxxx")
+	return u1.String()
+}
@@ -0,0 +1,307 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+// connectProxy is a CONNECT proxy requiring user:password, it records the
+// tunnels it opened.
+func connectProxy(t *testing.T, user, password string, tunnels chan<- string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+
+				br := bufio.NewReader(c)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != auth {
+					io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+
+				rc, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer rc.Close()
+
+				tunnels <- ln.Addr().String() + " " + req.Host
+				io.WriteString(c, "HTTP/1.1 200 OK\r\n\r\n")
+
+				go io.Copy(rc, br)
+				io.Copy(c, rc)
+			}(c)
+		}
+	}()
+
+	return ln
+}
+
+// socks5Proxy is a SOCKS5 proxy requiring user:password, it records the
+// tunnels it opened.
+func socks5Proxy(t *testing.T, user, password string, tunnels chan<- string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+
+				buf := make([]byte, 256)
+				if _, err := io.ReadFull(c, buf[:2]); err != nil || buf[0] != socks5Version {
+					return
+				}
+				if _, err := io.ReadFull(c, buf[:buf[1]]); err != nil {
+					return
+				}
+				c.Write([]byte{socks5Version, socks5AuthPassword})
+
+				// version, user, password
+				if _, err := io.ReadFull(c, buf[:2]); err != nil {
+					return
+				}
+				u := make([]byte, buf[1])
+				if _, err := io.ReadFull(c, u); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(c, buf[:1]); err != nil {
+					return
+				}
+				p := make([]byte, buf[0])
+				if _, err := io.ReadFull(c, p); err != nil {
+					return
+				}
+				if string(u) != user || string(p) != password {
+					c.Write([]byte{1, 1})
+					return
+				}
+				c.Write([]byte{1, 0})
+
+				// version, command, reserved, address type
+				if _, err := io.ReadFull(c, buf[:4]); err != nil {
+					return
+				}
+				var host string
+				switch buf[3] {
+				case socks5IP4:
+					if _, err := io.ReadFull(c, buf[:net.IPv4len]); err != nil {
+						return
+					}
+					host = net.IP(buf[:net.IPv4len]).String()
+				case socks5Domain:
+					if _, err := io.ReadFull(c, buf[:1]); err != nil {
+						return
+					}
+					n := int(buf[0])
+					if _, err := io.ReadFull(c, buf[:n]); err != nil {
+						return
+					}
+					host = string(buf[:n])
+				default:
+					return
+				}
+				if _, err := io.ReadFull(c, buf[:2]); err != nil {
+					return
+				}
+				addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buf))))
+
+				rc, err := net.Dial("tcp", addr)
+				if err != nil {
+					// connection refused
+					c.Write([]byte{socks5Version, 5, 0, socks5IP4, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer rc.Close()
+
+				tunnels <- ln.Addr().String() + " " + addr
+				c.Write([]byte{socks5Version, 0, 0, socks5IP4, 0, 0, 0, 0, 0, 0})
+
+				go io.Copy(rc, c)
+				io.Copy(c, rc)
+			}(c)
+		}
+	}()
+
+	return ln
+}
+
+// echoOrigin echoes the first 5 bytes of each conn.
+func echoOrigin(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				io.Copy(c, io.LimitReader(c, 5))
+			}(c)
+		}
+	}()
+
+	return ln
+}
+
+func TestFromURLsChain(t *testing.T) {
+	origin, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	defer origin.Close()
+
+	go func() {
+		c, err := origin.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, io.LimitReader(c, 5))
+	}()
+
+	tunnels := make(chan string, 2)
+	a := connectProxy(t, "alice", "a", tunnels)
+	defer a.Close()
+	b := connectProxy(t, "bob", "b", tunnels)
+	defer b.Close()
+
+	urls := []*url.URL{
+		{Scheme: "http", User: url.UserPassword("alice", "a"), Host: a.Addr().String()},
+		{Scheme: "http", User: url.UserPassword("bob", "b"), Host: b.Addr().String()},
+	}
+	d, err := FromURLs(urls, Direct, nil)
+	if err != nil {
+		t.Fatalf("FromURLs() error: %v", err)
+	}
+
+	c, err := d.Dial("tcp", origin.Addr().String())
+	if err != nil {
+		t.Fatalf("chain Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	io.WriteString(c, "hello")
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("chain echo = %#v, %v, want %#v", string(buf), err, "hello")
+	}
+
+	for _, want := range []string{a.Addr().String() + " " + b.Addr().String(), b.Addr().String() + " " + origin.Addr().String()} {
+		if got := <-tunnels; got != want {
+			t.Errorf("chain tunnel = %#v, want %#v", got, want)
+		}
+	}
+
+	// a bad password of the second hop fails the dial
+	urls[1].User = url.UserPassword("bob", "wrong")
+	d, _ = FromURLs(urls, Direct, nil)
+	if c, err := d.Dial("tcp", origin.Addr().String()); err == nil {
+		c.Close()
+		t.Errorf("chain Dial with a bad second hop password return no error")
+	}
+
+	if _, err := FromURLs(nil, Direct, nil); err == nil {
+		t.Errorf("FromURLs(nil) return no error")
+	}
+}
+
+func TestFromURLsSOCKS5Chain(t *testing.T) {
+	origin := echoOrigin(t)
+	defer origin.Close()
+
+	tunnels := make(chan string, 2)
+	a := socks5Proxy(t, "alice", "a", tunnels)
+	defer a.Close()
+	b := socks5Proxy(t, "bob", "b", tunnels)
+	defer b.Close()
+
+	urls := []*url.URL{
+		{Scheme: "socks5", User: url.UserPassword("alice", "a"), Host: a.Addr().String()},
+		{Scheme: "socks5", User: url.UserPassword("bob", "b"), Host: b.Addr().String()},
+	}
+	d, err := FromURLs(urls, Direct, nil)
+	if err != nil {
+		t.Fatalf("FromURLs() error: %v", err)
+	}
+
+	c, err := d.Dial("tcp", origin.Addr().String())
+	if err != nil {
+		t.Fatalf("chain Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	io.WriteString(c, "hello")
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("chain echo = %#v, %v, want %#v", string(buf), err, "hello")
+	}
+
+	for _, want := range []string{a.Addr().String() + " " + b.Addr().String(), b.Addr().String() + " " + origin.Addr().String()} {
+		if got := <-tunnels; got != want {
+			t.Errorf("chain tunnel = %#v, want %#v", got, want)
+		}
+	}
+
+	// the errors name the hop which failed, without its password
+	for _, c := range []struct {
+		user string
+		url  *url.URL
+		hop  int
+	}{
+		{"alice", urls[0], 1},
+		{"bob", urls[1], 2},
+	} {
+		c.url.User = url.UserPassword(c.user, "wrong")
+		d, _ := FromURLs(urls, Direct, nil)
+		conn, err := d.Dial("tcp", origin.Addr().String())
+		c.url.User = url.UserPassword(c.user, c.user[:1])
+		if err == nil {
+			conn.Close()
+			t.Errorf("chain Dial with a bad hop %d password return no error", c.hop)
+			continue
+		}
+		e, ok := err.(*ChainError)
+		if !ok || e.Hop != c.hop {
+			t.Errorf("chain Dial with a bad hop %d password error: %#v, want a hop %d *ChainError", c.hop, err, c.hop)
+			continue
+		}
+		if want := "socks5://" + c.user + ":xxxxx@" + c.url.Host; e.URL != want {
+			t.Errorf("chain Dial error URL = %#v, want %#v", e.URL, want)
+		}
+	}
+}
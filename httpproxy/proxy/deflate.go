@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"compress/flate"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	// TunnelCompressionHeader is sent on CONNECT requests and echoed back by a
+	// compatible upstream proxy to agree on a compressed tunnel.
+	TunnelCompressionHeader  = "X-Tunnel-Compression"
+	TunnelCompressionDeflate = "deflate"
+)
+
+type deflateConn struct {
+	net.Conn
+	r  io.ReadCloser
+	w  *flate.Writer
+	mu sync.Mutex
+}
+
+// NewDeflateConn returns a net.Conn which deflates everything written to conn
+// and inflates everything read from it. Both ends of conn must be wrapped.
+func NewDeflateConn(conn net.Conn) net.Conn {
+	w, _ := flate.NewWriter(conn, flate.DefaultCompression)
+	return &deflateConn{
+		Conn: conn,
+		r:    flate.NewReader(conn),
+		w:    w,
+	}
+}
+
+func (c *deflateConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *deflateConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n, err := c.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+
+	// flush every write, tunneled protocols are usually interactive
+	return n, c.w.Flush()
+}
+
+func (c *deflateConn) Close() error {
+	c.mu.Lock()
+	c.w.Close()
+	c.mu.Unlock()
+	c.r.Close()
+	return c.Conn.Close()
+}
+
+// WithTunnelCompression makes an HTTP1 dialer returned by FromURL, or a
+// FromURLs chain ending in one, negotiate deflate compression with the
+// upstream proxy. It reports false if d cannot negotiate it.
+func WithTunnelCompression(d Dialer) bool {
+	if c, ok := d.(*chainHop); ok {
+		d = c.Dialer
+	}
+	h, ok := d.(*http1)
+	if ok {
+		h.compression = TunnelCompressionDeflate
+	}
+	return ok
+}
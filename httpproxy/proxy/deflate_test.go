@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func tcpPipe(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial failed: %v", err)
+	}
+	c2, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("net.Listener.Accept failed: %v", err)
+	}
+	return c1, c2
+}
+
+func TestDeflateConn(t *testing.T) {
+	c1, c2 := tcpPipe(t)
+	lconn := NewDeflateConn(c1)
+	rconn := NewDeflateConn(c2)
+	defer lconn.Close()
+	defer rconn.Close()
+
+	data := make([]byte, 256*1024)
+	rand.Read(data[:len(data)/2])
+
+	go func() {
+		for i := 0; i < len(data); i += 1000 {
+			end := i + 1000
+			if end > len(data) {
+				end = len(data)
+			}
+			if _, err := lconn.Write(data[i:end]); err != nil {
+				t.Errorf("deflateConn.Write error: %v", err)
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(rconn, buf); err != nil {
+		t.Fatalf("io.ReadFull(%T) error: %v", rconn, err)
+	}
+
+	if !bytes.Equal(buf, data) {
+		t.Errorf("deflateConn returns corrupted data")
+	}
+}
+
+func TestHTTP1TunnelCompression(t *testing.T) {
+	gateway, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	defer gateway.Close()
+
+	go func() {
+		c, err := gateway.Accept()
+		if err != nil {
+			t.Errorf("net.Listener.Accept failed: %v", err)
+			return
+		}
+		defer c.Close()
+
+		req, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil {
+			t.Errorf("http.ReadRequest failed: %v", err)
+			return
+		}
+		if v := req.Header.Get(TunnelCompressionHeader); v != TunnelCompressionDeflate {
+			t.Errorf("CONNECT %s header = %#v, want %#v", TunnelCompressionHeader, v, TunnelCompressionDeflate)
+			return
+		}
+		io.WriteString(c, "HTTP/1.1 200 OK\r\n"+TunnelCompressionHeader+": "+TunnelCompressionDeflate+"\r\n\r\n")
+
+		// echo server behind a compressed tunnel
+		dc := NewDeflateConn(c)
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(dc, b); err != nil {
+			t.Errorf("io.ReadFull failed: %v", err)
+			return
+		}
+		dc.Write(b)
+	}()
+
+	d, _ := HTTP1("tcp", gateway.Addr().String(), nil, Direct, nil)
+	if !WithTunnelCompression(d) {
+		t.Fatalf("WithTunnelCompression(%T) return false", d)
+	}
+
+	c, err := d.Dial("tcp", "example.org:443")
+	if err != nil {
+		t.Fatalf("HTTP1.Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	io.WriteString(c, "hello")
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatalf("io.ReadFull failed: %v", err)
+	}
+	if string(b) != "hello" {
+		t.Errorf("compressed tunnel echo = %#v, want %#v", string(b), "hello")
+	}
+}
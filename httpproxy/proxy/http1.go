@@ -7,6 +7,7 @@ package proxy
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -36,6 +37,7 @@ type http1 struct {
 	network, addr  string
 	forward        Dialer
 	resolver       Resolver
+	compression    string
 }
 
 type preReaderConn struct {
@@ -59,16 +61,28 @@ func (r *preReaderConn) Read(b []byte) (int, error) {
 
 // Dial connects to the address addr on the network net via the HTTP1 proxy.
 func (h *http1) Dial(network, addr string) (net.Conn, error) {
+	return h.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is Dial, giving up once ctx is done.
+func (h *http1) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	switch network {
 	case "tcp", "tcp6", "tcp4":
 	default:
 		return nil, errors.New("proxy: no support for HTTP proxy connections of type " + network)
 	}
 
-	conn, err := h.forward.Dial(h.network, h.addr)
+	conn, err := DialContext(ctx, h.forward, h.network, h.addr)
 	if err != nil {
 		return nil, err
 	}
+	return handshakeContext(ctx, conn, func(conn net.Conn) (net.Conn, error) {
+		return h.handshake(conn, addr)
+	})
+}
+
+// handshake asks the HTTP1 proxy on conn to connect to addr.
+func (h *http1) handshake(conn net.Conn, addr string) (net.Conn, error) {
 	closeConn := &conn
 	defer func() {
 		if closeConn != nil {
@@ -102,6 +116,9 @@ func (h *http1) Dial(network, addr string) (net.Conn, error) {
 	if h.user != "" {
 		fmt.Fprintf(b, "Proxy-Authorization: Basic %s\r\n", base64.StdEncoding.EncodeToString([]byte(h.user+":"+h.password)))
 	}
+	if h.compression != "" {
+		fmt.Fprintf(b, "%s: %s\r\n", TunnelCompressionHeader, h.compression)
+	}
 	io.WriteString(b, "\r\n")
 
 	if _, err := conn.Write(b.Bytes()); err != nil {
@@ -136,6 +153,10 @@ func (h *http1) Dial(network, addr string) (net.Conn, error) {
 		return nil, errors.New("proxy: failed to read greeting from HTTP proxy at " + h.addr + ": " + resp.Status)
 	}
 
+	if h.compression != "" && resp.Header.Get(TunnelCompressionHeader) == h.compression {
+		conn = NewDeflateConn(conn)
+	}
+
 	closeConn = nil
 	return conn, nil
 }
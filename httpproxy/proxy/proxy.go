@@ -7,10 +7,12 @@
 package proxy
 
 import (
+	"context"
 	"errors"
 	"net"
 	"net/url"
 	"os"
+	"time"
 )
 
 // A Dialer is a means to establish a connection.
@@ -19,6 +21,41 @@ type Dialer interface {
 	Dial(network, addr string) (c net.Conn, err error)
 }
 
+// DialContext connects to addr via d, giving up once ctx is done. Dialers
+// with no DialContext of their own dial on, the conn they make then is closed.
+func DialContext(ctx context.Context, d Dialer, network, addr string) (net.Conn, error) {
+	if d, ok := d.(interface {
+		DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+	}); ok {
+		return d.DialContext(ctx, network, addr)
+	}
+	if ctx.Done() == nil {
+		return d.Dial(network, addr)
+	}
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan dialResult, 1)
+	go func() {
+		conn, err := d.Dial(network, addr)
+		ch <- dialResult{conn, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
 // A Resolver is a means to transform hostname.
 type Resolver interface {
 	LookupHost(host string) (addrs []string, err error)
@@ -105,3 +142,31 @@ func FromURL(u *url.URL, forward Dialer, resolver Resolver) (Dialer, error) {
 
 	return nil, errors.New("proxy: unknown scheme: " + u.Scheme)
 }
+
+// handshakeContext runs handshake on conn, which closes it on errors, and
+// aborts its I/O once ctx is done.
+func handshakeContext(ctx context.Context, conn net.Conn, handshake func(conn net.Conn) (net.Conn, error)) (net.Conn, error) {
+	if ctx.Done() == nil {
+		return handshake(conn)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	c, err := handshake(conn)
+	close(done)
+	<-stopped
+
+	if err == nil && ctx.Err() != nil {
+		c.Close()
+		return nil, ctx.Err()
+	}
+	return c, err
+}
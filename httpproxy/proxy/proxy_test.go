@@ -5,12 +5,15 @@
 package proxy
 
 import (
+	"context"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/url"
 	"strconv"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestFromURL(t *testing.T) {
@@ -33,7 +36,7 @@ func TestFromURL(t *testing.T) {
 	if err != nil {
 		t.Fatalf("url.Parse failed: %v", err)
 	}
-	proxy, err := FromURL(url, Direct)
+	proxy, err := FromURL(url, Direct, nil)
 	if err != nil {
 		t.Fatalf("FromURL failed: %v", err)
 	}
@@ -66,7 +69,7 @@ func TestSOCKS5(t *testing.T) {
 	wg.Add(1)
 	go socks5Gateway(t, gateway, endSystem, socks5IP4, &wg)
 
-	proxy, err := SOCKS5("tcp", gateway.Addr().String(), nil, Direct)
+	proxy, err := SOCKS5("tcp", gateway.Addr().String(), nil, Direct, nil)
 	if err != nil {
 		t.Fatalf("SOCKS5 failed: %v", err)
 	}
@@ -79,6 +82,71 @@ func TestSOCKS5(t *testing.T) {
 	wg.Wait()
 }
 
+type blockingDialer chan net.Conn
+
+func (d blockingDialer) Dial(network, addr string) (net.Conn, error) {
+	return <-d, nil
+}
+
+func TestDialContext(t *testing.T) {
+	d := make(blockingDialer)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if c, err := DialContext(ctx, d, "tcp", "example.org:80"); err != context.Canceled {
+		t.Fatalf("DialContext() with a done ctx = %v, %v, want context.Canceled", c, err)
+	}
+
+	// the dial given up on closes its conn
+	c1, c2 := net.Pipe()
+	d <- c1
+	c2.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c2.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("the conn of a dial given up is not closed: %v", err)
+	}
+}
+
+// ctxDialer dials pipes to a proxy which never answers, keeping the ctx of
+// the last dial.
+type ctxDialer struct {
+	ctx context.Context
+}
+
+func (d *ctxDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *ctxDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.ctx = ctx
+	c1, c2 := net.Pipe()
+	go io.Copy(ioutil.Discard, c2)
+	return c1, nil
+}
+
+func TestDialContextHandshake(t *testing.T) {
+	type key struct{}
+	for _, s := range []string{"http://127.0.0.1:8080", "socks5://127.0.0.1:1080", "socks4://127.0.0.1:1080"} {
+		u, _ := url.Parse(s)
+		forward := &ctxDialer{}
+		d, err := FromURL(u, forward, nil)
+		if err != nil {
+			t.Fatalf("FromURL(%#v) error: %v", s, err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), key{}, s), 100*time.Millisecond)
+		start := time.Now()
+		if c, err := DialContext(ctx, d, "tcp", "127.0.0.1:443"); err == nil {
+			t.Errorf("DialContext(%#v) via a silent proxy = %v, want an error", s, c)
+		}
+		cancel()
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("DialContext(%#v) via a silent proxy returns after %v of a 100ms ctx", s, d)
+		}
+		if forward.ctx == nil || forward.ctx.Value(key{}) != s {
+			t.Errorf("DialContext(%#v) does not hand its ctx to the forward dialer", s)
+		}
+	}
+}
+
 func socks5Gateway(t *testing.T, gateway, endSystem net.Listener, typ byte, wg *sync.WaitGroup) {
 	defer wg.Done()
 
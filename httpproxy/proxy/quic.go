@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// A StreamSession is a multiplexed connection to a peer proxy, e.g. a QUIC
+// connection, whose streams carry one tunnel each.
+type StreamSession interface {
+	OpenStream() (net.Conn, error)
+	Close() error
+}
+
+const (
+	streamTunnelVersion byte = 1
+
+	streamTunnelOK        byte = 0
+	streamTunnelDialError byte = 1
+)
+
+// QUIC returns a Dialer which tunnels through the peer proxy at addr over
+// streams of the sessions dial connects. No QUIC stack is built in, one
+// registers its quic:// scheme with RegisterDialerType and this.
+func QUIC(addr string, dial func() (StreamSession, error), resolver Resolver) Dialer {
+	return &streamTunnel{
+		addr:     addr,
+		resolver: resolver,
+		dial:     dial,
+	}
+}
+
+// streamTunnel opens a stream of one session per tunnel, and only dials a
+// new session once the current one fails.
+type streamTunnel struct {
+	addr     string
+	resolver Resolver
+	dial     func() (StreamSession, error)
+
+	mu      sync.Mutex
+	session StreamSession
+}
+
+func (s *streamTunnel) Dial(network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp6", "tcp4":
+	default:
+		return nil, errors.New("proxy: no support for quic proxy connections of type " + network)
+	}
+
+	if s.resolver != nil {
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			if addrs, err := s.resolver.LookupHost(host); err == nil && len(addrs) > 0 {
+				addr = net.JoinHostPort(addrs[0], port)
+			}
+		}
+	}
+
+	stream, err := s.openStream()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := WriteStreamTarget(stream, addr); err != nil {
+		stream.Close()
+		return nil, errors.New("proxy: failed to write tunnel target to quic proxy at " + s.addr + ": " + err.Error())
+	}
+
+	var status [1]byte
+	if _, err := io.ReadFull(stream, status[:]); err != nil {
+		stream.Close()
+		return nil, errors.New("proxy: failed to read tunnel status from quic proxy at " + s.addr + ": " + err.Error())
+	}
+	if status[0] != streamTunnelOK {
+		stream.Close()
+		return nil, fmt.Errorf("proxy: quic proxy at %s failed to connect to %s", s.addr, addr)
+	}
+
+	return stream, nil
+}
+
+func (s *streamTunnel) openStream() (net.Conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.session != nil {
+		stream, err := s.session.OpenStream()
+		if err == nil {
+			return stream, nil
+		}
+		s.session.Close()
+		s.session = nil
+	}
+
+	session, err := s.dial()
+	if err != nil {
+		return nil, errors.New("proxy: failed to connect to quic proxy at " + s.addr + ": " + err.Error())
+	}
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		session.Close()
+		return nil, errors.New("proxy: failed to open a stream to quic proxy at " + s.addr + ": " + err.Error())
+	}
+	s.session = session
+
+	return stream, nil
+}
+
+// WriteStreamTarget starts a tunnel stream with its frame, a version byte and
+// the big endian uint16 length of the "host:port" target which follows.
+func WriteStreamTarget(w io.Writer, addr string) error {
+	if len(addr) > 0xffff {
+		return errors.New("proxy: tunnel target too long")
+	}
+
+	b := make([]byte, 3+len(addr))
+	b[0] = streamTunnelVersion
+	binary.BigEndian.PutUint16(b[1:3], uint16(len(addr)))
+	copy(b[3:], addr)
+
+	_, err := w.Write(b)
+	return err
+}
+
+// ReadStreamTarget reads the target frame written by WriteStreamTarget.
+func ReadStreamTarget(r io.Reader) (string, error) {
+	var header [3]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", err
+	}
+	if header[0] != streamTunnelVersion {
+		return "", fmt.Errorf("proxy: unsupported tunnel stream version %d", header[0])
+	}
+
+	addr := make([]byte, binary.BigEndian.Uint16(header[1:3]))
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return "", err
+	}
+
+	return string(addr), nil
+}
+
+// ServeStreamTunnel is the peer proxy side of a tunnel stream, it dials the
+// target with forward and splices the stream to it until either side closes.
+func ServeStreamTunnel(stream net.Conn, forward Dialer) error {
+	defer stream.Close()
+
+	addr, err := ReadStreamTarget(stream)
+	if err != nil {
+		return err
+	}
+
+	conn, err := forward.Dial("tcp", addr)
+	if err != nil {
+		stream.Write([]byte{streamTunnelDialError})
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := stream.Write([]byte{streamTunnelOK}); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(conn, stream)
+		conn.Close()
+		close(done)
+	}()
+	io.Copy(stream, conn)
+	stream.Close()
+	<-done
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// pipeSession serves each stream with ServeStreamTunnel, as the peer proxy
+// does for the streams of a QUIC connection.
+type pipeSession struct {
+	closed int32
+}
+
+func (s *pipeSession) OpenStream() (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	go ServeStreamTunnel(c2, Direct)
+	return c1, nil
+}
+
+func (s *pipeSession) Close() error {
+	atomic.StoreInt32(&s.closed, 1)
+	return nil
+}
+
+func TestQUICTunnel(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	var sessions int32
+	RegisterDialerType("quic", func(u *url.URL, forward Dialer) (Dialer, error) {
+		return QUIC(u.Host, func() (StreamSession, error) {
+			atomic.AddInt32(&sessions, 1)
+			return &pipeSession{}, nil
+		}, nil), nil
+	})
+	defer delete(proxySchemes, "quic")
+
+	u, _ := url.Parse("quic://peer:4433")
+	d, err := FromURL(u, Direct, nil)
+	if err != nil {
+		t.Fatalf("FromURL(%#v) error: %v", u.String(), err)
+	}
+
+	for i := 0; i < 2; i++ {
+		conn, err := d.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("%T.Dial(%#v) error: %v", d, ln.Addr().String(), err)
+		}
+		io.WriteString(conn, "ping")
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+			t.Errorf("quic tunnel echo = %#v, %v, want %#v", string(b), err, "ping")
+		}
+		conn.Close()
+	}
+	if n := atomic.LoadInt32(&sessions); n != 1 {
+		t.Errorf("quic tunnels dialed %d sessions, want 1 reused", n)
+	}
+
+	// the peer fails to reach the target
+	refused := ln.Addr().String()
+	ln.Close()
+	if _, err := d.Dial("tcp", refused); err == nil || !strings.Contains(err.Error(), "failed to connect to "+refused) {
+		t.Errorf("%T.Dial(%#v) to a closed port error: %v", d, refused, err)
+	}
+}
+
+func TestQUICWithoutStack(t *testing.T) {
+	u, _ := url.Parse("quic://peer:4433")
+	if _, err := FromURL(u, Direct, nil); err == nil {
+		t.Errorf("FromURL(%#v) without a registered QUIC stack succeeds", u.String())
+	}
+}
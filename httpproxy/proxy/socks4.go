@@ -5,6 +5,7 @@
 package proxy
 
 import (
+	"context"
 	"errors"
 	"io"
 	"net"
@@ -49,16 +50,28 @@ var socks4Errors = []string{
 
 // Dial connects to the address addr on the network net via the SOCKS4 proxy.
 func (s *socks4) Dial(network, addr string) (net.Conn, error) {
+	return s.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is Dial, giving up once ctx is done.
+func (s *socks4) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	switch network {
 	case "tcp", "tcp4":
 	default:
 		return nil, errors.New("proxy: no support for SOCKS4 proxy connections of type " + network)
 	}
 
-	conn, err := s.forward.Dial(s.network, s.addr)
+	conn, err := DialContext(ctx, s.forward, s.network, s.addr)
 	if err != nil {
 		return nil, err
 	}
+	return handshakeContext(ctx, conn, func(conn net.Conn) (net.Conn, error) {
+		return s.handshake(conn, addr)
+	})
+}
+
+// handshake asks the SOCKS4 proxy on conn to connect to addr.
+func (s *socks4) handshake(conn net.Conn, addr string) (net.Conn, error) {
 	closeConn := &conn
 	defer func() {
 		if closeConn != nil {
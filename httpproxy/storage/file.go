@@ -160,3 +160,7 @@ func (s *FileStore) Delete(object string) (*http.Response, error) {
 func (s *FileStore) UnmarshallJson(name string, config interface{}) error {
 	return readJsonConfig(s, name, config)
 }
+
+func (s *FileStore) UnmarshallJsonStrict(name string, config interface{}) error {
+	return readJsonConfigStrict(s, name, config)
+}
@@ -11,6 +11,16 @@ import (
 )
 
 func readJsonConfig(store Store, filename string, config interface{}) error {
+	return decodeJsonConfig(store, filename, config, false)
+}
+
+func readJsonConfigStrict(store Store, filename string, config interface{}) error {
+	return decodeJsonConfig(store, filename, config, true)
+}
+
+// decodeJsonConfig merges filename and its .user override into config, strict
+// rejects keys of either that config has no field for.
+func decodeJsonConfig(store Store, filename string, config interface{}, strict bool) error {
 	fileext := path.Ext(filename)
 	filename1 := strings.TrimSuffix(filename, fileext) + ".user" + fileext
 
@@ -55,6 +65,9 @@ func readJsonConfig(store Store, filename string, config interface{}) error {
 
 	d := json.NewDecoder(bytes.NewReader(data))
 	d.UseNumber()
+	if strict {
+		d.DisallowUnknownFields()
+	}
 
 	return d.Decode(config)
 }
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnmarshallJsonStrict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	type Config struct {
+		Transport struct {
+			TLSClientConfig struct {
+				InsecureSkipVerify bool
+			}
+		}
+	}
+
+	cases := []struct {
+		json  string
+		user  string
+		error string
+	}{
+		{`{"Transport": {"TLSClientConfig": {"InsecureSkipVerify": true}}}`, "", ""},
+		{`{"Transport": {"TLSClientConfig": {"InsecureSkipVerfy": true}}}`, "", "InsecureSkipVerfy"},
+		{`{"Transprot": {}}`, "", "Transprot"},
+		{`{"Transport": {}}`, `{"Transport": {"Timeout": 4}}`, "Timeout"},
+	}
+
+	s := &FileStore{dir}
+	for _, c := range cases {
+		ioutil.WriteFile(filepath.Join(dir, "direct.json"), []byte(c.json), 0644)
+		os.Remove(filepath.Join(dir, "direct.user.json"))
+		if c.user != "" {
+			ioutil.WriteFile(filepath.Join(dir, "direct.user.json"), []byte(c.user), 0644)
+		}
+
+		var config Config
+		if err := s.UnmarshallJson("direct.json", &config); err != nil {
+			t.Errorf("%T.UnmarshallJson(%s) error: %v", s, c.json, err)
+		}
+
+		err := s.UnmarshallJsonStrict("direct.json", &config)
+		switch {
+		case c.error == "" && err != nil:
+			t.Errorf("%T.UnmarshallJsonStrict(%s) error: %v", s, c.json, err)
+		case c.error != "" && (err == nil || !strings.Contains(err.Error(), c.error)):
+			t.Errorf("%T.UnmarshallJsonStrict(%s %s) error = %v, want unknown field %s", s, c.json, c.user, err, c.error)
+		}
+	}
+}
+
+func TestStrictConfig(t *testing.T) {
+	defer os.Setenv("GOPROXY_STRICT_CONFIG", os.Getenv("GOPROXY_STRICT_CONFIG"))
+
+	os.Setenv("GOPROXY_STRICT_CONFIG", "gae, direct")
+	if !StrictConfig("direct") || StrictConfig("php") {
+		t.Errorf("StrictConfig() does not follow GOPROXY_STRICT_CONFIG=%#v", os.Getenv("GOPROXY_STRICT_CONFIG"))
+	}
+
+	// "*" matches every name, alone or among others
+	for _, v := range []string{"*", "gae, *"} {
+		os.Setenv("GOPROXY_STRICT_CONFIG", v)
+		if !StrictConfig("php") {
+			t.Errorf("StrictConfig() does not follow GOPROXY_STRICT_CONFIG=%#v", v)
+		}
+	}
+
+	os.Setenv("GOPROXY_STRICT_CONFIG", "dir*")
+	if StrictConfig("direct") {
+		t.Errorf("StrictConfig() matches %#v as a pattern, want names only", os.Getenv("GOPROXY_STRICT_CONFIG"))
+	}
+}
@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+)
+
+// KV is a key value store holding one filter config per key. Get returns an
+// error satisfying os.IsNotExist for a missing key.
+type KV interface {
+	Get(key string) (value []byte, index uint64, err error)
+}
+
+type kvValue struct {
+	value []byte
+	index uint64
+}
+
+// KVStore reads "direct.json" from the key Prefix+"/direct" of KV.
+type KVStore struct {
+	KV     KV
+	Prefix string
+}
+
+var _ Store = &KVStore{}
+
+func NewKVStore(kv KV, prefix string) *KVStore {
+	return &KVStore{
+		KV:     kv,
+		Prefix: prefix,
+	}
+}
+
+func (s *KVStore) key(name string) string {
+	return path.Join("/", s.Prefix, strings.TrimSuffix(name, path.Ext(name)))
+}
+
+func (s *KVStore) get(name string) (kvValue, error) {
+	value, index, err := s.KV.Get(s.key(name))
+	if err != nil {
+		return kvValue{}, err
+	}
+	return kvValue{value, index}, nil
+}
+
+func (s *KVStore) response(method, name string, v kvValue) *http.Response {
+	req, _ := http.NewRequest(method, "/"+strings.TrimLeft(name, "/"), nil)
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{},
+		Request:       req,
+		Close:         true,
+		ContentLength: int64(len(v.value)),
+	}
+	resp.Header.Set("Content-Type", "application/json")
+	resp.Header.Set("X-Kv-Index", strconv.FormatUint(v.index, 10))
+	return resp
+}
+
+func (s *KVStore) Get(name string, start, end int64) (*http.Response, error) {
+	if start > 0 || end > 0 {
+		return nil, fmt.Errorf("%T.GetObject do not support start end parameters", s)
+	}
+
+	v, err := s.get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := s.response(http.MethodGet, name, v)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(v.value))
+	return resp, nil
+}
+
+func (s *KVStore) Head(name string) (*http.Response, error) {
+	v, err := s.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.response(http.MethodHead, name, v), nil
+}
+
+func (s *KVStore) List(name string) ([]string, error) {
+	return nil, ErrNotImplemented
+}
+
+func (s *KVStore) Put(name string, header http.Header, data io.ReadCloser) (*http.Response, error) {
+	data.Close()
+	return nil, ErrNotImplemented
+}
+
+func (s *KVStore) Copy(dest string, src string) (*http.Response, error) {
+	return nil, ErrNotImplemented
+}
+
+func (s *KVStore) Delete(name string) (*http.Response, error) {
+	return nil, ErrNotImplemented
+}
+
+func (s *KVStore) UnmarshallJson(name string, config interface{}) error {
+	return readJsonConfig(s, name, config)
+}
+
+func (s *KVStore) UnmarshallJsonStrict(name string, config interface{}) error {
+	return readJsonConfigStrict(s, name, config)
+}
+
+// ConsulKV reads keys from the Consul KV HTTP API at Address, e.g.
+// "http://127.0.0.1:8500".
+type ConsulKV struct {
+	Address string
+	Client  *http.Client
+}
+
+func (kv *ConsulKV) Get(key string) ([]byte, uint64, error) {
+	resp, err := kv.Client.Get(kv.Address + "/v1/kv/" + strings.TrimLeft(key, "/") + "?raw")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, 0, &os.PathError{Op: "get", Path: key, Err: os.ErrNotExist}
+	default:
+		return nil, 0, fmt.Errorf("consul GET %#v: %s", key, resp.Status)
+	}
+
+	value, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	return value, index, nil
+}
+
+// EtcdKV reads keys from the etcd v3 JSON gateway at Address, e.g.
+// "http://127.0.0.1:2379".
+type EtcdKV struct {
+	Address string
+	Client  *http.Client
+}
+
+func (kv *EtcdKV) Get(key string) ([]byte, uint64, error) {
+	body, _ := json.Marshal(map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(key))})
+
+	resp, err := kv.Client.Post(kv.Address+"/v3/kv/range", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("etcd range %#v: %s", key, resp.Status)
+	}
+
+	var result struct {
+		Kvs []struct {
+			Value       []byte
+			ModRevision string `json:"mod_revision"`
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, 0, err
+	}
+	if len(result.Kvs) == 0 {
+		return nil, 0, &os.PathError{Op: "range", Path: key, Err: os.ErrNotExist}
+	}
+
+	index, _ := strconv.ParseUint(result.Kvs[0].ModRevision, 10, 64)
+	return result.Kvs[0].Value, index, nil
+}
+
+var (
+	kvStore     *KVStore
+	kvStoreOnce sync.Once
+)
+
+// lookupKVStore returns the store of the GOPROXY_STORE environment variable,
+// "consul://127.0.0.1:8500/goproxy" or "etcd://127.0.0.1:2379/goproxy", or
+// nil if it is unset.
+func lookupKVStore() *KVStore {
+	kvStoreOnce.Do(func() {
+		s := os.Getenv("GOPROXY_STORE")
+		if s == "" {
+			return
+		}
+
+		u, err := url.Parse(s)
+		if err != nil {
+			glog.Fatalf("url.Parse(GOPROXY_STORE=%#v) error: %v", s, err)
+		}
+
+		client := &http.Client{Timeout: 5 * time.Second}
+		address := "http://" + u.Host
+
+		var kv KV
+		switch u.Scheme {
+		case "consul":
+			kv = &ConsulKV{Address: address, Client: client}
+		case "etcd":
+			kv = &EtcdKV{Address: address, Client: client}
+		default:
+			glog.Fatalf("GOPROXY_STORE=%#v: unsupported scheme %#v", s, u.Scheme)
+		}
+
+		prefix := u.Path
+		if prefix == "" || prefix == "/" {
+			prefix = "/goproxy"
+		}
+		kvStore = NewKVStore(kv, prefix)
+	})
+
+	return kvStore
+}
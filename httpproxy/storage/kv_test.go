@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type mockKV struct {
+	values map[string]string
+	index  uint64
+}
+
+func (kv *mockKV) Get(key string) ([]byte, uint64, error) {
+	value, ok := kv.values[key]
+	if !ok {
+		return nil, 0, &os.PathError{Op: "get", Path: key, Err: os.ErrNotExist}
+	}
+	return []byte(value), kv.index, nil
+}
+
+func TestKVStoreUnmarshallJson(t *testing.T) {
+	kv := &mockKV{values: map[string]string{
+		"/goproxy/direct":      "{\n\t// comment\n\t\"Timeout\": 4,\n\t\"Level\": 1,\n}",
+		"/goproxy/direct.user": `{"Level": 2}`,
+	}}
+	s := NewKVStore(kv, "/goproxy")
+
+	var config struct {
+		Timeout int
+		Level   int
+	}
+	if err := s.UnmarshallJson("direct.json", &config); err != nil {
+		t.Fatalf("%T.UnmarshallJson() error: %v", s, err)
+	}
+	if config.Timeout != 4 || config.Level != 2 {
+		t.Errorf("%T.UnmarshallJson() = %+v, want the .user value merged", s, config)
+	}
+
+	if err := s.UnmarshallJson("php.json", &config); !os.IsNotExist(err) {
+		t.Errorf("%T.UnmarshallJson() of a missing key error = %v, want os.ErrNotExist", s, err)
+	}
+}
+
+func TestFallbackStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir() error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "php.json"), []byte(`{"Timeout": 2}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "direct.json"), []byte(`{"Timeout": 1}`), 0644)
+
+	kv := &mockKV{values: map[string]string{"/goproxy/direct": `{"Timeout": 4}`}}
+	s := &fallbackStore{Store: NewKVStore(kv, "/goproxy"), fallback: &FileStore{dir}}
+
+	for _, c := range []struct {
+		name    string
+		timeout int
+	}{
+		{"direct.json", 4},
+		// no key of it
+		{"php.json", 2},
+	} {
+		var config struct {
+			Timeout int
+		}
+		if err := s.UnmarshallJson(c.name, &config); err != nil {
+			t.Fatalf("%T.UnmarshallJson(%#v) error: %v", s, c.name, err)
+		}
+		if config.Timeout != c.timeout {
+			t.Errorf("%T.UnmarshallJson(%#v) = %+v, want Timeout %d", s, c.name, config, c.timeout)
+		}
+	}
+
+	if err := s.UnmarshallJson("gae.json", new(struct{})); !os.IsNotExist(err) {
+		t.Errorf("%T.UnmarshallJson() of a config in neither error = %v, want os.ErrNotExist", s, err)
+	}
+}
+
+func TestConsulKV(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/kv/goproxy/direct" || req.URL.RawQuery != "raw" {
+			http.NotFound(rw, req)
+			return
+		}
+		rw.Header().Set("X-Consul-Index", "42")
+		rw.Write([]byte(`{"Timeout": 4}`))
+	}))
+	defer ts.Close()
+
+	kv := &ConsulKV{Address: ts.URL, Client: http.DefaultClient}
+
+	value, index, err := kv.Get("/goproxy/direct")
+	if err != nil || string(value) != `{"Timeout": 4}` || index != 42 {
+		t.Errorf("%T.Get() = %#v, %d, %v", kv, string(value), index, err)
+	}
+	if _, _, err := kv.Get("/goproxy/php"); !os.IsNotExist(err) {
+		t.Errorf("%T.Get() of a missing key error = %v, want os.ErrNotExist", kv, err)
+	}
+}
+
+func TestEtcdKV(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var body struct{ Key []byte }
+		json.NewDecoder(req.Body).Decode(&body)
+		if req.URL.Path != "/v3/kv/range" || string(body.Key) != "/goproxy/direct" {
+			rw.Write([]byte(`{"header": {}}`))
+			return
+		}
+		rw.Write([]byte(`{"kvs": [{"key": "` + base64.StdEncoding.EncodeToString(body.Key) + `", "value": "` + base64.StdEncoding.EncodeToString([]byte(`{"Timeout": 4}`)) + `", "mod_revision": "7"}]}`))
+	}))
+	defer ts.Close()
+
+	kv := &EtcdKV{Address: ts.URL, Client: http.DefaultClient}
+
+	value, index, err := kv.Get("/goproxy/direct")
+	if err != nil || string(value) != `{"Timeout": 4}` || index != 7 {
+		t.Errorf("%T.Get() = %#v, %d, %v", kv, string(value), index, err)
+	}
+	if _, _, err := kv.Get("/goproxy/php"); !os.IsNotExist(err) {
+		t.Errorf("%T.Get() of a missing key error = %v, want os.ErrNotExist", kv, err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 const (
@@ -24,12 +25,29 @@ type Store interface {
 	Head(name string) (*http.Response, error)
 	Delete(name string) (*http.Response, error)
 	UnmarshallJson(name string, config interface{}) error
+	// UnmarshallJsonStrict is UnmarshallJson failing on keys config has no
+	// field for, e.g. a misspelt option
+	UnmarshallJsonStrict(name string, config interface{}) error
 }
 
-// Lookup config uri by filename
+// StrictConfig reports whether the config of filter name is decoded with
+// UnmarshallJsonStrict. GOPROXY_STRICT_CONFIG is a comma separated list of
+// filter names, in which an entry "*" matches every name. Only the filters
+// asking StrictConfig, direct for now, decode strictly.
+func StrictConfig(name string) bool {
+	for _, s := range strings.Split(os.Getenv("GOPROXY_STRICT_CONFIG"), ",") {
+		if s = strings.TrimSpace(s); s == "*" || s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup config uri by filename, or the KV store set by GOPROXY_STORE, which
+// falls back to the file for configs it has no key of
 func LookupStoreByConfig(name string) Store {
 	var store Store
-	for _, dirname := range []string{filepath.Dir(os.Args[0]), ".", "httpproxy", "httpproxy/filters/" + name} {
+	for _, dirname := range []string{filepath.Dir(os.Args[0]), ".", "httpproxy", "httpproxy/filters/" + name, "filters/" + name} {
 		filename := dirname + "/" + name + ".json"
 		if _, err := os.Stat(filename); err == nil {
 			store = &FileStore{dirname}
@@ -39,9 +57,52 @@ func LookupStoreByConfig(name string) Store {
 	if store == nil {
 		store = &FileStore{"."}
 	}
+
+	if s := lookupKVStore(); s != nil {
+		return &fallbackStore{Store: s, fallback: store}
+	}
 	return store
 }
 
+// fallbackStore reads the names Store has none of from fallback, and writes
+// to Store.
+type fallbackStore struct {
+	Store
+	fallback Store
+}
+
+func (s *fallbackStore) Get(name string, start, end int64) (*http.Response, error) {
+	resp, err := s.Store.Get(name, start, end)
+	if os.IsNotExist(err) {
+		return s.fallback.Get(name, start, end)
+	}
+	return resp, err
+}
+
+func (s *fallbackStore) Head(name string) (*http.Response, error) {
+	resp, err := s.Store.Head(name)
+	if os.IsNotExist(err) {
+		return s.fallback.Head(name)
+	}
+	return resp, err
+}
+
+// UnmarshallJson takes name and its .user override both from Store, or both
+// from fallback if Store has no name.
+func (s *fallbackStore) UnmarshallJson(name string, config interface{}) error {
+	if IsNotExist(s.Store, name) {
+		return s.fallback.UnmarshallJson(name, config)
+	}
+	return s.Store.UnmarshallJson(name, config)
+}
+
+func (s *fallbackStore) UnmarshallJsonStrict(name string, config interface{}) error {
+	if IsNotExist(s.Store, name) {
+		return s.fallback.UnmarshallJsonStrict(name, config)
+	}
+	return s.Store.UnmarshallJsonStrict(name, config)
+}
+
 func IsNotExist(store Store, name string) bool {
 	resp, err := store.Head(name)
 	return os.IsNotExist(err) || (resp != nil && resp.StatusCode == http.StatusNotFound)
@@ -153,3 +153,7 @@ func (s *ZipStore) Delete(name string) (*http.Response, error) {
 func (s *ZipStore) UnmarshallJson(name string, config interface{}) error {
 	return readJsonConfig(s, name, config)
 }
+
+func (s *ZipStore) UnmarshallJsonStrict(name string, config interface{}) error {
+	return readJsonConfigStrict(s, name, config)
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
+	"time"
 
 	"./httpproxy"
 	"./httpproxy/helpers"
@@ -15,6 +19,9 @@ import (
 var (
 	version  = "r9999"
 	http2rev = "?????"
+
+	shutdownDrain = flag.Duration("shutdown-drain", 0, "wait this long for requests and tunnels to finish on SIGINT/SIGTERM")
+	shutdownGrace = flag.Duration("shutdown-grace", 0, "then wait this long more before force closing the ones left")
 )
 
 func main() {
@@ -73,5 +80,20 @@ Pac Server         : http://%s/proxy.pac`, addr)
 	}
 	fmt.Fprintf(os.Stderr, "\n------------------------------------------------------\n")
 
-	select {}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	<-c
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownDrain)
+	defer cancel()
+
+	go func() {
+		<-c
+		os.Exit(1)
+	}()
+
+	start := time.Now()
+	if err := httpproxy.Shutdown(ctx, *shutdownGrace); err != nil {
+		fmt.Fprintf(os.Stderr, "Shutdown error after %s: %v\n", time.Since(start), err)
+	}
 }